@@ -0,0 +1,429 @@
+// Package asm implements a small assembler for AVR machine code, intended for
+// writing test programs and short inline programs as text rather than as
+// hand-encoded words. Instructions are encoded using the definitions in
+// avr.InstDefs.
+//
+// The syntax is a subset of that accepted by avr-as. Each line holds an
+// optional label ("name:"), followed by an instruction or directive, and
+// comments begin with a semicolon:
+//
+//	.equ LED, 5
+//	start:  sbi DDRB, LED       ; make the LED pin an output
+//	loop:   sbi PINB, LED       ; toggle it
+//	        rjmp loop
+//
+// The directives supported are .org (set the byte address of the next
+// statement), .equ or .set (define a symbol), and .byte and .word (emit data;
+// .byte also accepts string literals).
+//
+// Operands are expressions built from numbers, character constants, symbols
+// and the operators of C, and may use the functions lo8, hi8, hh8, pm, pm_lo8
+// and pm_hi8 as in avr-as. Labels are byte addresses, so pm(label) gives the
+// word address needed to load Z for IJMP or ICALL. The names of the MCU's I/O
+// registers may be used as symbols: in the I/O address operands of IN, OUT,
+// SBI, CBI, SBIC and SBIS they give the I/O address of the register, and
+// elsewhere its data address. The targets of branches, jumps and calls may also
+// be written as an offset from the next instruction, as avr-objdump prints
+// them (".+4", ".-2").
+package asm
+
+import (
+    "fmt"
+    "github.com/kierdavis/avr/spec"
+    "strconv"
+    "strings"
+)
+
+// An Error is an error in a line of the source.
+type Error struct {
+    Line int // line number, starting at 1
+    Err  error
+}
+
+func (e *Error) Error() string {
+    return fmt.Sprintf("asm: line %d: %s", e.Line, e.Err)
+}
+
+// An ErrorList is a list of errors, in order of line number.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+    msgs := make([]string, len(l))
+    for i, e := range l {
+        msgs[i] = e.Error()
+    }
+    return strings.Join(msgs, "\n")
+}
+
+// A Program is the result of assembling a source file.
+type Program struct {
+    // The program memory image, starting at address 0. Words not written by
+    // the program are 0xFFFF, as in erased flash.
+    Words []uint16
+    // The values of labels (byte addresses) and symbols defined with .equ.
+    Symbols map[string]int64
+}
+
+// A statement is a single line of source.
+type statement struct {
+    line     int
+    labels   []string
+    op       string // mnemonic or directive, in lower case
+    operands []string
+    addr     uint32 // byte address
+}
+
+// State of an assembly in progress.
+type assembler struct {
+    spec        *spec.MCUSpec
+    reducedCore bool
+    symbols     map[string]int64
+    ioAddrs     map[string]int64 // I/O addresses of registers in I/O bank 0
+    dataAddrs   map[string]int64 // data addresses of all I/O registers
+    mem         []byte
+    errs        ErrorList
+}
+
+// Assemble assembles the source text src into a program for the given MCU. If
+// there are errors, an ErrorList is returned.
+func Assemble(mcuSpec *spec.MCUSpec, src string) (prog *Program, err error) {
+    a := &assembler{
+        spec:        mcuSpec,
+        reducedCore: mcuSpec.Family == spec.ReducedCore,
+        symbols:     make(map[string]int64),
+        ioAddrs:     make(map[string]int64),
+        dataAddrs:   make(map[string]int64),
+    }
+    a.definePorts()
+
+    stmts := a.parse(src)
+    if len(a.errs) == 0 {
+        a.layout(stmts)
+    }
+    if len(a.errs) == 0 {
+        a.emit(stmts)
+    }
+    if len(a.errs) > 0 {
+        return nil, a.errs
+    }
+
+    prog = &Program{
+        Words:   make([]uint16, (len(a.mem)+1)/2),
+        Symbols: a.symbols,
+    }
+    for i := range prog.Words {
+        prog.Words[i] = 0xFFFF
+    }
+    for i, b := range a.mem {
+        shift := 8 * uint(i%2)
+        prog.Words[i/2] = prog.Words[i/2]&^(0xFF<<shift) | uint16(b)<<shift
+    }
+    return prog, nil
+}
+
+// MustAssemble is like Assemble but panics if the source cannot be assembled,
+// and returns only the program words. It simplifies writing tests.
+func MustAssemble(mcuSpec *spec.MCUSpec, src string) []uint16 {
+    prog, err := Assemble(mcuSpec, src)
+    if err != nil {
+        panic(err)
+    }
+    return prog.Words
+}
+
+// Records the addresses of the MCU's I/O registers.
+func (a *assembler) definePorts() {
+    for name, pref := range a.spec.Ports {
+        if pref.BankNum == 0 {
+            a.ioAddrs[name] = int64(pref.Index)
+        }
+        for _, r := range a.spec.Regions {
+            if r, ok := r.(spec.IORegionSpec); ok && r.BankNum() == pref.BankNum {
+                a.dataAddrs[name] = int64(r.Start()) + int64(pref.Index)
+            }
+        }
+    }
+}
+
+// Records an error on a line.
+func (a *assembler) errorf(line int, format string, args ...interface{}) {
+    a.errs = append(a.errs, &Error{line, fmt.Errorf(format, args...)})
+}
+
+// Splits the source into statements.
+func (a *assembler) parse(src string) (stmts []*statement) {
+    for i, text := range strings.Split(src, "\n") {
+        st := &statement{line: i + 1}
+        text = strings.TrimSpace(stripComment(text))
+
+        // labels
+        for {
+            n := 0
+            for n < len(text) && isIdentChar(text[n]) {
+                n++
+            }
+            if n == 0 || n >= len(text) || text[n] != ':' || !isIdentStart(text[0]) {
+                break
+            }
+            st.labels = append(st.labels, text[:n])
+            text = strings.TrimSpace(text[n+1:])
+        }
+
+        if text != "" {
+            n := strings.IndexAny(text, " \t")
+            if n < 0 {
+                n = len(text)
+            }
+            st.op = strings.ToLower(text[:n])
+            var err error
+            if st.operands, err = splitOperands(text[n:]); err != nil {
+                a.errorf(st.line, "%s", err)
+            }
+        }
+
+        if st.op != "" || len(st.labels) > 0 {
+            stmts = append(stmts, st)
+        }
+    }
+    return stmts
+}
+
+// Removes a comment from a line.
+func stripComment(text string) string {
+    quote := byte(0)
+    for i := 0; i < len(text); i++ {
+        c := text[i]
+        switch {
+        case quote != 0 && c == '\\':
+            i++
+        case quote != 0 && c == quote:
+            quote = 0
+        case quote == 0 && (c == '"' || c == '\''):
+            quote = c
+        case quote == 0 && c == ';':
+            return text[:i]
+        }
+    }
+    return text
+}
+
+// Splits a list of operands separated by commas, which may appear inside
+// parentheses, strings and character constants.
+func splitOperands(text string) (operands []string, err error) {
+    text = strings.TrimSpace(text)
+    if text == "" {
+        return nil, nil
+    }
+
+    depth, quote, start := 0, byte(0), 0
+    for i := 0; i < len(text); i++ {
+        c := text[i]
+        switch {
+        case quote != 0 && c == '\\':
+            i++
+        case quote != 0 && c == quote:
+            quote = 0
+        case quote != 0:
+        case c == '"' || c == '\'':
+            quote = c
+        case c == '(':
+            depth++
+        case c == ')':
+            depth--
+        case c == ',' && depth == 0:
+            operands = append(operands, strings.TrimSpace(text[start:i]))
+            start = i + 1
+        }
+    }
+    if quote != 0 {
+        return nil, fmt.Errorf("unterminated string")
+    }
+    operands = append(operands, strings.TrimSpace(text[start:]))
+    for _, op := range operands {
+        if op == "" {
+            return nil, fmt.Errorf("missing operand")
+        }
+    }
+    return operands, nil
+}
+
+// First pass: assigns addresses to statements and defines labels and symbols.
+func (a *assembler) layout(stmts []*statement) {
+    pc := uint32(0)
+    for _, st := range stmts {
+        for _, label := range st.labels {
+            a.define(st.line, label, int64(pc))
+        }
+        st.addr = pc
+
+        switch st.op {
+        case "":
+
+        case ".org":
+            if len(st.operands) != 1 {
+                a.errorf(st.line, ".org takes 1 operand")
+                continue
+            }
+            v, err := a.eval(st.operands[0], false)
+            switch {
+            case err != nil:
+                a.errorf(st.line, "%s", err)
+            case v < int64(pc):
+                a.errorf(st.line, ".org cannot move backwards from 0x%X to 0x%X", pc, v)
+            default:
+                pc = uint32(v)
+            }
+
+        case ".equ", ".set":
+            if len(st.operands) != 2 {
+                a.errorf(st.line, "%s takes 2 operands", st.op)
+                continue
+            }
+            v, err := a.eval(st.operands[1], false)
+            if err != nil {
+                a.errorf(st.line, "%s", err)
+                continue
+            }
+            a.define(st.line, st.operands[0], v)
+
+        case ".byte":
+            for _, op := range st.operands {
+                if s, ok := stringLiteral(op); ok {
+                    pc += uint32(len(s))
+                } else {
+                    pc++
+                }
+            }
+
+        case ".word":
+            pc += 2 * uint32(len(st.operands))
+
+        default:
+            size, err := a.instSize(st.op)
+            if err != nil {
+                a.errorf(st.line, "%s", err)
+                continue
+            }
+            if pc%2 != 0 {
+                a.errorf(st.line, "instruction at odd address 0x%X", pc)
+            }
+            pc += 2 * size
+        }
+
+        if limit := uint32(a.spec.ProgMemSize()); pc > limit {
+            a.errorf(st.line, "program exceeds %s's %d bytes of program memory", a.spec.Label, limit)
+            return
+        }
+    }
+}
+
+// Defines a label or symbol.
+func (a *assembler) define(line int, name string, v int64) {
+    if name == "" || !isIdentStart(name[0]) || strings.IndexFunc(name, func(r rune) bool { return r > 0x7F || !isIdentChar(byte(r)) }) >= 0 {
+        a.errorf(line, "invalid symbol name %q", name)
+        return
+    }
+    if _, ok := a.symbols[name]; ok {
+        a.errorf(line, "symbol %s redefined", name)
+        return
+    }
+    a.symbols[name] = v
+}
+
+// Second pass: encodes instructions and data.
+func (a *assembler) emit(stmts []*statement) {
+    for _, st := range stmts {
+        var data []byte
+        var err error
+
+        switch st.op {
+        case "", ".org", ".equ", ".set":
+            continue
+
+        case ".byte":
+            for _, op := range st.operands {
+                if s, ok := stringLiteral(op); ok {
+                    data = append(data, s...)
+                    continue
+                }
+                var v int64
+                if v, err = a.evalRange(op, -128, 255); err != nil {
+                    break
+                }
+                data = append(data, uint8(v))
+            }
+
+        case ".word":
+            for _, op := range st.operands {
+                var v int64
+                if v, err = a.evalRange(op, -32768, 65535); err != nil {
+                    break
+                }
+                data = append(data, uint8(v), uint8(v>>8))
+            }
+
+        default:
+            var words []uint16
+            words, err = a.encode(st)
+            for _, w := range words {
+                data = append(data, uint8(w), uint8(w>>8))
+            }
+        }
+
+        if err != nil {
+            a.errorf(st.line, "%s", err)
+            continue
+        }
+        for uint32(len(a.mem)) < st.addr+uint32(len(data)) {
+            a.mem = append(a.mem, 0xFF)
+        }
+        copy(a.mem[st.addr:], data)
+    }
+}
+
+// Returns the contents of a string literal operand.
+func stringLiteral(op string) (s string, ok bool) {
+    if len(op) < 2 || op[0] != '"' {
+        return "", false
+    }
+    s, err := strconv.Unquote(op)
+    return s, err == nil
+}
+
+// Evaluates an expression. If io is true, the names of I/O registers give
+// their I/O addresses rather than their data addresses.
+func (a *assembler) eval(expr string, io bool) (v int64, err error) {
+    var ioErr error
+    v, err = evalExpr(expr, func(name string) (v int64, ok bool) {
+        if v, ok = a.symbols[name]; ok {
+            return v, true
+        }
+        if io {
+            if v, ok = a.ioAddrs[name]; ok {
+                return v, true
+            }
+            if _, ok = a.dataAddrs[name]; ok {
+                ioErr = fmt.Errorf("%s is not in the I/O space", name)
+            }
+            return 0, false
+        }
+        v, ok = a.dataAddrs[name]
+        return v, ok
+    })
+    if ioErr != nil {
+        return 0, ioErr
+    }
+    return v, err
+}
+
+// Evaluates an expression and checks that its value is in the range [min,
+// max].
+func (a *assembler) evalRange(expr string, min, max int64) (v int64, err error) {
+    if v, err = a.eval(expr, false); err != nil {
+        return 0, err
+    }
+    if v < min || v > max {
+        return 0, fmt.Errorf("value %d (%s) out of range %d to %d", v, expr, min, max)
+    }
+    return v, nil
+}
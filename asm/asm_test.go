@@ -0,0 +1,158 @@
+package asm
+
+import (
+    "bufio"
+    "fmt"
+    "github.com/kierdavis/avr/spec"
+    "os"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// Assembles each instruction of an avr-objdump listing and compares the result
+// with the bytes in the listing.
+func TestBlinkListing(t *testing.T) {
+    f, err := os.Open("../programs/blink/blink-atmega168.txt")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    n := 0
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        // "  c2:	11 24       	eor	r1, r1"
+        fields := strings.Split(scanner.Text(), "\t")
+        if len(fields) < 3 || !strings.HasSuffix(fields[0], ":") || strings.HasPrefix(fields[2], ".") {
+            continue
+        }
+        addr, err := strconv.ParseUint(strings.TrimSpace(strings.TrimSuffix(fields[0], ":")), 16, 32)
+        if err != nil {
+            continue
+        }
+        var expected []uint16
+        hex := strings.Fields(fields[1])
+        for i := 0; i+1 < len(hex); i += 2 {
+            lo, _ := strconv.ParseUint(hex[i], 16, 8)
+            hi, _ := strconv.ParseUint(hex[i+1], 16, 8)
+            expected = append(expected, uint16(hi<<8|lo))
+        }
+        text := fields[2]
+        if len(fields) >= 4 {
+            text += "\t" + fields[3]
+        }
+
+        prog, err := Assemble(spec.ATmega168, fmt.Sprintf(".org 0x%x\n%s", addr, text))
+        if err != nil {
+            t.Errorf("0x%04x: %s: %s", addr, text, err)
+            continue
+        }
+        got := prog.Words[addr/2:]
+        if fmt.Sprint(got) != fmt.Sprint(expected) {
+            t.Errorf("0x%04x: %s: expected %04x, got %04x", addr, text, expected, got)
+        }
+        n++
+    }
+    if n < 300 {
+        t.Errorf("only assembled %d instructions from listing", n)
+    }
+}
+
+func TestProgram(t *testing.T) {
+    src := `
+        .equ    LED, 5
+        .org    0x04
+start:  ldi     r16, lo8(table)     ; comment, with a comma
+        ldi     r17, hi8(table)
+        sbi     DDRB, LED
+        sts     PORTB, r16
+loop:   sbic    PINB, LED
+        rjmp    loop
+        clr     r1
+        ldi     r30, pm_lo8(start)
+        call    start
+        breq    .-2
+        ld      r0, Y
+        std     Z+3, r24
+        sbrc    r0, 7
+        out     SREG, r1
+        cbr     r16, 0x0F
+table:  .byte   1, 'a', "bc"
+        .word   0x1234, pm(loop)
+`
+    prog, err := Assemble(spec.ATmega168, src)
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := []uint16{
+        0xFFFF, 0xFFFF,
+        0xE206,         // ldi r16, 0x26
+        0xE010,         // ldi r17, 0x00
+        0x9A25,         // sbi 0x04, 5
+        0x9300, 0x0025, // sts 0x0025, r16
+        0x991D,         // sbic 0x03, 5
+        0xCFFE,         // rjmp loop
+        0x2411,         // eor r1, r1
+        0xE0E2,         // ldi r30, 0x02
+        0x940E, 0x0002, // call 0x4
+        0xF3F9,         // breq .-2
+        0x8008,         // ldd r0, Y+0
+        0x8383,         // std Z+3, r24
+        0xFC07,         // sbrc r0, 7
+        0xBE1F,         // out 0x3f, r1
+        0x7F00,         // andi r16, 0xF0
+        0x6101, 0x6362, // .byte
+        0x1234, 0x0007, // .word
+    }
+    if fmt.Sprintf("%04X", prog.Words) != fmt.Sprintf("%04X", expected) {
+        t.Errorf("expected:\n%04X\ngot:\n%04X", expected, prog.Words)
+    }
+    if prog.Symbols["loop"] != 0x0E || prog.Symbols["LED"] != 5 {
+        t.Errorf("unexpected symbols %v", prog.Symbols)
+    }
+}
+
+func TestReducedCore(t *testing.T) {
+    words := MustAssemble(spec.ATtiny10, "lds r16, 0x45\nld r17, Z\nsts 0xBF, r31")
+    expected := []uint16{0xA105, 0x8110, 0xAEFF}
+    if fmt.Sprintf("%04X", words) != fmt.Sprintf("%04X", expected) {
+        t.Errorf("expected %04X, got %04X", expected, words)
+    }
+}
+
+var errorTests = []struct {
+    src  string
+    line int
+    msg  string
+}{
+    {"nop\nfoo r1", 2, "unknown instruction foo"},
+    {"ldi r1, 5", 1, "r1 not allowed with ldi (expected r16 to r31)"},
+    {"\n\nldi r16, 256", 3, "value 256 (256) out of range -128 to 255"},
+    {"rjmp nowhere", 1, "undefined symbol nowhere"},
+    {"x: nop\nx: nop", 2, "symbol x redefined"},
+    {"in r0, UDR0", 1, "UDR0 is not in the I/O space"},
+    {".org 0x100\nbrne 0", 2, "branch target 0x0 out of range"},
+    {"add r1", 1, "add takes 2 operand(s), got 1"},
+    {".byte 1\nnop", 2, "instruction at odd address 0x1"},
+}
+
+func TestErrors(t *testing.T) {
+    for _, test := range errorTests {
+        _, err := Assemble(spec.ATmega168, test.src)
+        list, ok := err.(ErrorList)
+        if !ok || len(list) == 0 {
+            t.Errorf("%q: expected an ErrorList, got %v", test.src, err)
+            continue
+        }
+        if list[0].Line != test.line || list[0].Err.Error() != test.msg {
+            t.Errorf("%q: expected error %q on line %d, got %q on line %d",
+                test.src, test.msg, test.line, list[0].Err, list[0].Line)
+        }
+    }
+
+    // CALL is not available on the ATmega48
+    if _, err := Assemble(spec.ATmega48, "call 0"); err == nil {
+        t.Errorf("expected call to be rejected on ATmega48")
+    }
+}
@@ -0,0 +1,566 @@
+package asm
+
+import (
+    "fmt"
+    "github.com/kierdavis/avr"
+    "strconv"
+    "strings"
+)
+
+// Instructions whose mnemonic is the lower-case name of the instruction.
+var instNames = make(map[string]avr.Instruction)
+
+func init() {
+    for inst := avr.Instruction(0); int(inst) < avr.NumInstructions; inst++ {
+        if name := inst.String(); !strings.Contains(name, "_") {
+            instNames[strings.ToLower(name)] = inst
+        }
+    }
+}
+
+// Mnemonics that are resolved to an instruction according to their operands
+// or the MCU, rather than by name.
+var operandMnemonics = map[string]bool{
+    "ld": true, "ldd": true, "st": true, "std": true,
+    "lpm": true, "elpm": true, "spm": true, "lds": true, "sts": true,
+}
+
+// Aliases of BSET, BCLR, BRBS and BRBC, giving the instruction and the status
+// bit operand.
+type flagAlias struct {
+    inst avr.Instruction
+    bit  uint16
+}
+
+var flagAliases = make(map[string]flagAlias)
+
+func init() {
+    names := map[avr.Instruction][8]string{
+        avr.BSET: {"sec", "sez", "sen", "sev", "ses", "seh", "set", "sei"},
+        avr.BCLR: {"clc", "clz", "cln", "clv", "cls", "clh", "clt", "cli"},
+        avr.BRBS: {"brcs", "breq", "brmi", "brvs", "brlt", "brhs", "brts", "brie"},
+        avr.BRBC: {"brcc", "brne", "brpl", "brvc", "brge", "brhc", "brtc", "brid"},
+    }
+    for inst, list := range names {
+        for bit, name := range list {
+            flagAliases[name] = flagAlias{inst, uint16(bit)}
+        }
+    }
+    flagAliases["brlo"] = flagAliases["brcs"]
+    flagAliases["brsh"] = flagAliases["brcc"]
+}
+
+// Mnemonics that are shorthand for another instruction with a repeated register
+// operand.
+var doubledAliases = map[string]string{
+    "clr": "eor", "tst": "and", "lsl": "add", "rol": "adc",
+}
+
+// Pointer register operands of LD and ST.
+var ldPointers = map[string]avr.Instruction{
+    "X": avr.LD_X, "X+": avr.LD_X_INC, "-X": avr.LD_X_DEC,
+    "Y": avr.LD_Y, "Y+": avr.LD_Y_INC, "-Y": avr.LD_Y_DEC,
+    "Z": avr.LD_Z, "Z+": avr.LD_Z_INC, "-Z": avr.LD_Z_DEC,
+}
+var stPointers = map[string]avr.Instruction{
+    "X": avr.ST_X, "X+": avr.ST_X_INC, "-X": avr.ST_X_DEC,
+    "Y": avr.ST_Y, "Y+": avr.ST_Y_INC, "-Y": avr.ST_Y_DEC,
+    "Z": avr.ST_Z, "Z+": avr.ST_Z_INC, "-Z": avr.ST_Z_DEC,
+}
+
+// Names of the upper registers as halves of the pointer registers.
+var pointerHalves = map[string]uint16{
+    "xl": 26, "xh": 27, "yl": 28, "yh": 29, "zl": 30, "zh": 31,
+}
+
+// Returns the size in words of an instruction with the given mnemonic.
+func (a *assembler) instSize(op string) (size uint32, err error) {
+    _, isInst := instNames[op]
+    _, isFlag := flagAliases[op]
+    _, isDoubled := doubledAliases[op]
+    if !isInst && !isFlag && !isDoubled && !operandMnemonics[op] && op != "ser" && op != "sbr" && op != "cbr" {
+        return 0, fmt.Errorf("unknown instruction %s", op)
+    }
+    switch {
+    case op == "jmp" || op == "call":
+        return 2, nil
+    case (op == "lds" || op == "sts") && !a.reducedCore:
+        return 2, nil
+    }
+    return 1, nil
+}
+
+// State of the encoding of a single instruction. The first error encountered
+// is recorded in err; subsequent operations do nothing.
+type encoder struct {
+    a   *assembler
+    st  *statement
+    op  string
+    ops []string
+    err error
+}
+
+// Encodes an instruction statement.
+func (a *assembler) encode(st *statement) (words []uint16, err error) {
+    e := &encoder{a: a, st: st, op: st.op, ops: st.operands}
+    e.expandAlias()
+    inst := e.resolve()
+    if e.err != nil {
+        return nil, e.err
+    }
+
+    if !a.spec.Available[inst] {
+        return nil, fmt.Errorf("%s is not available on %s", e.op, a.spec.Label)
+    }
+    def, ok := a.instDef(inst)
+    if !ok {
+        return nil, fmt.Errorf("%s is not available on %s", e.op, a.spec.Label)
+    }
+
+    w := def.Match
+    words = []uint16{0}
+    if inst.IsTwoWord() {
+        words = append(words, 0)
+    }
+
+    switch inst {
+    case avr.ADC, avr.ADD, avr.AND, avr.CP, avr.CPC, avr.CPSE, avr.EOR, avr.MOV, avr.MUL, avr.OR, avr.SBC, avr.SUB:
+        e.want(2)
+        r := e.reg(1, 0, 31)
+        w |= e.reg(0, 0, 31)<<4 | r&0x0F | (r&0x10)<<5
+
+    case avr.ANDI, avr.CPI, avr.LDI, avr.ORI, avr.SBCI, avr.SUBI:
+        e.want(2)
+        k := uint16(e.value(1, -128, 255)) & 0xFF
+        w |= (e.reg(0, 16, 31)-16)<<4 | (k&0xF0)<<4 | k&0x0F
+
+    case avr.ADIW, avr.SBIW:
+        e.want(2)
+        d := e.evenReg(0, 24, 30)
+        k := uint16(e.value(1, 0, 63))
+        w |= (d-24)/2<<4 | (k&0x30)<<2 | k&0x0F
+
+    case avr.ASR, avr.COM, avr.DEC, avr.INC, avr.LSR, avr.NEG, avr.POP, avr.PUSH, avr.ROR, avr.SWAP:
+        e.want(1)
+        w |= e.reg(0, 0, 31) << 4
+
+    case avr.BSET, avr.BCLR:
+        if alias, ok := flagAliases[e.op]; ok {
+            e.want(0)
+            w |= alias.bit << 4
+        } else {
+            e.want(1)
+            w |= uint16(e.value(0, 0, 7)) << 4
+        }
+
+    case avr.BRBS, avr.BRBC:
+        var bit uint16
+        if alias, ok := flagAliases[e.op]; ok {
+            e.want(1)
+            bit = alias.bit
+        } else {
+            e.want(2)
+            bit = uint16(e.value(0, 0, 7))
+            e.ops = e.ops[1:]
+        }
+        w |= uint16(e.relative(0, 1, 7))&0x7F<<3 | bit
+
+    case avr.RJMP, avr.RCALL:
+        e.want(1)
+        w |= uint16(e.relative(0, 1, 12)) & 0x0FFF
+
+    case avr.JMP, avr.CALL:
+        e.want(1)
+        k := uint32(e.target(0, 2)) / 2
+        if k >= 1<<22 {
+            e.fail("target 0x%X out of range", 2*k)
+        }
+        w |= uint16(k>>16)&0x3E<<3 | uint16(k>>16)&0x01
+        words[1] = uint16(k)
+
+    case avr.BLD, avr.BST, avr.SBRC, avr.SBRS:
+        e.want(2)
+        w |= e.reg(0, 0, 31)<<4 | uint16(e.value(1, 0, 7))
+
+    case avr.CBI, avr.SBI, avr.SBIC, avr.SBIS:
+        e.want(2)
+        w |= uint16(e.ioValue(0, 31))<<3 | uint16(e.value(1, 0, 7))
+
+    case avr.IN:
+        e.want(2)
+        addr := uint16(e.ioValue(1, 63))
+        w |= e.reg(0, 0, 31)<<4 | (addr&0x30)<<5 | addr&0x0F
+    case avr.OUT:
+        e.want(2)
+        addr := uint16(e.ioValue(0, 63))
+        w |= e.reg(1, 0, 31)<<4 | (addr&0x30)<<5 | addr&0x0F
+
+    case avr.DES:
+        e.want(1)
+        w |= uint16(e.value(0, 0, 15)) << 4
+
+    case avr.FMUL, avr.FMULS, avr.FMULSU, avr.MULSU:
+        e.want(2)
+        w |= (e.reg(0, 16, 23)-16)<<4 | (e.reg(1, 16, 23) - 16)
+    case avr.MULS:
+        e.want(2)
+        w |= (e.reg(0, 16, 31)-16)<<4 | (e.reg(1, 16, 31) - 16)
+    case avr.MOVW:
+        e.want(2)
+        w |= e.evenReg(0, 0, 30)/2<<4 | e.evenReg(1, 0, 30)/2
+
+    case avr.LAC, avr.LAS, avr.LAT, avr.XCH:
+        e.want(2)
+        if p := e.pointer(0); e.err == nil && p != "Z" {
+            e.fail("expected Z, got %s", e.ops[0])
+        }
+        w |= e.reg(1, 0, 31) << 4
+
+    case avr.LD_X, avr.LD_X_INC, avr.LD_X_DEC, avr.LD_Y, avr.LD_Y_INC, avr.LD_Y_DEC,
+        avr.LD_Z, avr.LD_Z_INC, avr.LD_Z_DEC, avr.ELPM, avr.ELPM_INC, avr.LPM, avr.LPM_INC:
+        w |= e.reg(0, 0, 31) << 4
+    case avr.ST_X, avr.ST_X_INC, avr.ST_X_DEC, avr.ST_Y, avr.ST_Y_INC, avr.ST_Y_DEC,
+        avr.ST_Z, avr.ST_Z_INC, avr.ST_Z_DEC:
+        w |= e.reg(1, 0, 31) << 4
+    case avr.SPM_2:
+        // the operand was checked by resolve
+
+    case avr.LDD_Y, avr.LDD_Z, avr.STD_Y, avr.STD_Z:
+        ptr, reg := 1, 0
+        if inst == avr.STD_Y || inst == avr.STD_Z {
+            ptr, reg = 0, 1
+        }
+        q := uint16(e.displacement(ptr))
+        w |= e.reg(reg, 0, 31)<<4 | (q&0x20)<<8 | (q&0x18)<<7 | q&0x07
+
+    case avr.LDS:
+        e.want(2)
+        w |= e.reg(0, 0, 31) << 4
+        words[1] = uint16(e.value(1, 0, 0xFFFF))
+    case avr.STS:
+        e.want(2)
+        w |= e.reg(1, 0, 31) << 4
+        words[1] = uint16(e.value(0, 0, 0xFFFF))
+
+    case avr.LDS_SHORT, avr.STS_SHORT:
+        e.want(2)
+        reg, addr := 0, 1
+        if inst == avr.STS_SHORT {
+            reg, addr = 1, 0
+        }
+        // ADDR[7:0] = ~w[8], w[8], w[10], w[9], w[3], w[2], w[1], w[0]
+        k := uint16(e.value(addr, 0x40, 0xBF))
+        w |= (e.reg(reg, 16, 31)-16)<<4 | (k&0x40)<<2 | (k&0x30)<<5 | k&0x0F
+
+    default:
+        // instructions without operands
+        e.want(0)
+    }
+
+    if e.err != nil {
+        return nil, e.err
+    }
+    words[0] = w
+    return words, nil
+}
+
+// Returns the definition of an instruction that applies to the MCU.
+func (a *assembler) instDef(inst avr.Instruction) (def avr.InstDef, ok bool) {
+    for _, def = range avr.InstDefs {
+        if def.Inst == inst && (def.RCMode == avr.Either || (def.RCMode == avr.RC) == a.reducedCore) {
+            return def, true
+        }
+    }
+    return avr.InstDef{}, false
+}
+
+// Rewrites shorthand mnemonics as the instructions they stand for.
+func (e *encoder) expandAlias() {
+    switch {
+    case doubledAliases[e.op] != "":
+        e.want(1)
+        if e.err == nil {
+            e.op, e.ops = doubledAliases[e.op], []string{e.ops[0], e.ops[0]}
+        }
+    case e.op == "ser":
+        e.want(1)
+        if e.err == nil {
+            e.op, e.ops = "ldi", []string{e.ops[0], "0xFF"}
+        }
+    case e.op == "sbr":
+        e.op = "ori"
+    case e.op == "cbr":
+        e.want(2)
+        if e.err == nil {
+            e.op, e.ops = "andi", []string{e.ops[0], "0xFF & ~(" + e.ops[1] + ")"}
+        }
+    }
+}
+
+// Returns the instruction that a mnemonic and its operands encode.
+func (e *encoder) resolve() (inst avr.Instruction) {
+    if e.err != nil {
+        return -1
+    }
+    if alias, ok := flagAliases[e.op]; ok {
+        return alias.inst
+    }
+
+    a := e.a
+    switch e.op {
+    case "ld", "st":
+        ptr, table := 1, ldPointers
+        if e.op == "st" {
+            ptr, table = 0, stPointers
+        }
+        e.want(2)
+        p := e.pointer(ptr)
+        if e.err != nil {
+            return -1
+        }
+        inst, ok := table[p]
+        if !ok {
+            e.fail("invalid pointer operand %s", e.ops[ptr])
+            return -1
+        }
+        // on most devices, LD and ST through Y or Z are LDD and STD with a
+        // displacement of 0
+        if !a.spec.Available[inst] {
+            switch inst {
+            case avr.LD_Y:
+                inst = avr.LDD_Y
+            case avr.LD_Z:
+                inst = avr.LDD_Z
+            case avr.ST_Y:
+                inst = avr.STD_Y
+            case avr.ST_Z:
+                inst = avr.STD_Z
+            }
+        }
+        return inst
+
+    case "ldd", "std":
+        e.want(2)
+        if e.err != nil {
+            return -1
+        }
+        ptr := 1
+        if e.op == "std" {
+            ptr = 0
+        }
+        switch strings.ToUpper(strings.TrimSpace(e.ops[ptr]))[:1] {
+        case "Y":
+            if e.op == "ldd" {
+                return avr.LDD_Y
+            }
+            return avr.STD_Y
+        case "Z":
+            if e.op == "ldd" {
+                return avr.LDD_Z
+            }
+            return avr.STD_Z
+        }
+        e.fail("expected Y+q or Z+q, got %s", e.ops[ptr])
+        return -1
+
+    case "lpm", "elpm":
+        insts := [3]avr.Instruction{avr.LPM_R0, avr.LPM, avr.LPM_INC}
+        if e.op == "elpm" {
+            insts = [3]avr.Instruction{avr.ELPM_R0, avr.ELPM, avr.ELPM_INC}
+        }
+        if len(e.ops) == 0 {
+            return insts[0]
+        }
+        e.want(2)
+        switch e.pointer(1) {
+        case "Z":
+            return insts[1]
+        case "Z+":
+            return insts[2]
+        }
+        e.fail("expected Z or Z+, got %s", e.ops[1])
+        return -1
+
+    case "spm":
+        if len(e.ops) == 0 {
+            return avr.SPM
+        }
+        e.want(1)
+        if e.pointer(0) != "Z+" {
+            e.fail("expected Z+, got %s", e.ops[0])
+        }
+        return avr.SPM_2
+
+    case "lds", "sts":
+        if a.reducedCore {
+            if e.op == "lds" {
+                return avr.LDS_SHORT
+            }
+            return avr.STS_SHORT
+        }
+        if e.op == "lds" {
+            return avr.LDS
+        }
+        return avr.STS
+    }
+
+    inst, ok := instNames[e.op]
+    if !ok {
+        e.fail("unknown instruction %s", e.op)
+        return -1
+    }
+    return inst
+}
+
+// Records an error, unless one has already been recorded.
+func (e *encoder) fail(format string, args ...interface{}) {
+    if e.err == nil {
+        e.err = fmt.Errorf(format, args...)
+    }
+}
+
+// Checks the number of operands.
+func (e *encoder) want(n int) {
+    if len(e.ops) != n {
+        e.fail("%s takes %d operand(s), got %d", e.op, n, len(e.ops))
+    }
+}
+
+// Parses operand i as a register in the range rlo to rhi.
+func (e *encoder) reg(i int, lo, hi uint16) (n uint16) {
+    if e.err != nil {
+        return lo
+    }
+    s := strings.ToLower(e.ops[i])
+    if n, ok := pointerHalves[s]; ok {
+        return e.checkReg(n, lo, hi)
+    }
+    if len(s) >= 2 && s[0] == 'r' {
+        v, err := strconv.ParseUint(s[1:], 10, 8)
+        if err == nil && v < 32 {
+            return e.checkReg(uint16(v), lo, hi)
+        }
+    }
+    e.fail("expected register, got %s", e.ops[i])
+    return lo
+}
+
+func (e *encoder) checkReg(n, lo, hi uint16) uint16 {
+    if n < lo || n > hi {
+        e.fail("r%d not allowed with %s (expected r%d to r%d)", n, e.op, lo, hi)
+        return lo
+    }
+    return n
+}
+
+// Parses operand i as an even-numbered register in the range rlo to rhi.
+func (e *encoder) evenReg(i int, lo, hi uint16) (n uint16) {
+    n = e.reg(i, lo, hi)
+    if n%2 != 0 {
+        e.fail("expected even-numbered register, got r%d", n)
+        return lo
+    }
+    return n
+}
+
+// Evaluates operand i and checks that it is in the range lo to hi.
+func (e *encoder) value(i int, lo, hi int64) (v int64) {
+    if e.err != nil {
+        return 0
+    }
+    v, err := e.a.evalRange(e.ops[i], lo, hi)
+    if err != nil {
+        e.fail("%s", err)
+    }
+    return v
+}
+
+// Evaluates operand i as an I/O address in the range 0 to hi.
+func (e *encoder) ioValue(i int, hi int64) (v int64) {
+    if e.err != nil {
+        return 0
+    }
+    v, err := e.a.eval(e.ops[i], true)
+    if err == nil && (v < 0 || v > hi) {
+        err = fmt.Errorf("I/O address 0x%X (%s) out of range 0 to 0x%X", v, e.ops[i], hi)
+    }
+    if err != nil {
+        e.fail("%s", err)
+    }
+    return v
+}
+
+// Evaluates operand i as the byte address of the target of a branch, jump or
+// call, size words long. The target may be given as an offset from the next
+// instruction (".+4").
+func (e *encoder) target(i int, size uint32) (addr int64) {
+    if e.err != nil {
+        return 0
+    }
+    s := strings.TrimSpace(e.ops[i])
+    next := int64(e.st.addr + 2*size)
+    if s == "." {
+        return next
+    }
+    if len(s) > 1 && s[0] == '.' && (s[1] == '+' || s[1] == '-') {
+        offset, err := e.a.eval(s[1:], false)
+        if err != nil {
+            e.fail("%s", err)
+        }
+        return next + offset
+    }
+    addr, err := e.a.eval(s, false)
+    if err != nil {
+        e.fail("%s", err)
+    }
+    if addr%2 != 0 {
+        e.fail("target 0x%X is not word-aligned", addr)
+    }
+    return addr
+}
+
+// Evaluates operand i as the target of a one-word relative branch, returning
+// the offset in words from the next instruction, which must fit in a signed
+// field of the given width.
+func (e *encoder) relative(i int, size uint32, bits uint) (offset int64) {
+    target := e.target(i, size)
+    if e.err != nil {
+        return 0
+    }
+    offset = (target - int64(e.st.addr+2*size)) / 2
+    if limit := int64(1) << (bits - 1); offset < -limit || offset >= limit {
+        e.fail("branch target 0x%X out of range", target)
+        return 0
+    }
+    return offset
+}
+
+// Parses operand i as a pointer register operand such as "X+", returning it in
+// upper case without spaces.
+func (e *encoder) pointer(i int) string {
+    if e.err != nil {
+        return ""
+    }
+    return strings.ToUpper(strings.Replace(e.ops[i], " ", "", -1))
+}
+
+// Parses operand i as a displaced pointer ("Y+q" or "Z+q"), returning the
+// displacement.
+func (e *encoder) displacement(i int) (q int64) {
+    if e.err != nil {
+        return 0
+    }
+    s := strings.TrimSpace(e.ops[i])
+    if len(s) == 1 {
+        return 0
+    }
+    if s[1] != '+' {
+        e.fail("expected Y+q or Z+q, got %s", s)
+        return 0
+    }
+    q, err := e.a.evalRange(s[2:], 0, 63)
+    if err != nil {
+        e.fail("%s", err)
+    }
+    return q
+}
@@ -0,0 +1,278 @@
+package asm
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// The kinds of token in an expression.
+type tokenKind int
+
+const (
+    tokEOF tokenKind = iota
+    tokNumber
+    tokIdent
+    tokOp
+)
+
+type token struct {
+    kind  tokenKind
+    text  string
+    value int64
+}
+
+// Splits an expression into tokens.
+func tokenize(s string) (toks []token, err error) {
+    for i := 0; i < len(s); {
+        c := s[i]
+        switch {
+        case c == ' ' || c == '\t':
+            i++
+
+        case isDigit(c):
+            j := i
+            for j < len(s) && isIdentChar(s[j]) {
+                j++
+            }
+            text := s[i:j]
+            v, err := parseNumber(text)
+            if err != nil {
+                return nil, err
+            }
+            toks = append(toks, token{tokNumber, text, v})
+            i = j
+
+        case c == '\'':
+            // character constant, such as 'a' or '\n'
+            j := i + 1
+            for j < len(s) && s[j] != '\'' {
+                if s[j] == '\\' {
+                    j++
+                }
+                j++
+            }
+            if j >= len(s) {
+                return nil, fmt.Errorf("unterminated character constant")
+            }
+            ch, _, tail, err := strconv.UnquoteChar(s[i+1:j], '\'')
+            if err != nil || tail != "" {
+                return nil, fmt.Errorf("invalid character constant %s", s[i:j+1])
+            }
+            toks = append(toks, token{tokNumber, s[i : j+1], int64(ch)})
+            i = j + 1
+
+        case isIdentStart(c):
+            j := i
+            for j < len(s) && isIdentChar(s[j]) {
+                j++
+            }
+            toks = append(toks, token{kind: tokIdent, text: s[i:j]})
+            i = j
+
+        default:
+            op := s[i : i+1]
+            if i+1 < len(s) && (s[i:i+2] == "<<" || s[i:i+2] == ">>") {
+                op = s[i : i+2]
+            }
+            if !strings.Contains("+-*/%&|^~()", op) && op != "<<" && op != ">>" {
+                return nil, fmt.Errorf("unexpected character %q in expression", c)
+            }
+            toks = append(toks, token{kind: tokOp, text: op})
+            i += len(op)
+        }
+    }
+    return append(toks, token{kind: tokEOF}), nil
+}
+
+// Parses an integer constant: decimal, hexadecimal (0x), binary (0b) or octal
+// (leading 0).
+func parseNumber(s string) (v int64, err error) {
+    u, err := strconv.ParseUint(s, 0, 32)
+    if err != nil {
+        return 0, fmt.Errorf("invalid number %q", s)
+    }
+    return int64(u), nil
+}
+
+func isDigit(c byte) bool {
+    return '0' <= c && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+    return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c == '_' || c == '.'
+}
+
+func isIdentChar(c byte) bool {
+    return isIdentStart(c) || isDigit(c) || c == '$'
+}
+
+// Functions that may be applied to an expression, such as lo8(label).
+var exprFuncs = map[string]func(int64) int64{
+    "lo8":    func(x int64) int64 { return x & 0xFF },
+    "hi8":    func(x int64) int64 { return (x >> 8) & 0xFF },
+    "hh8":    func(x int64) int64 { return (x >> 16) & 0xFF },
+    "hlo8":   func(x int64) int64 { return (x >> 16) & 0xFF },
+    "hhi8":   func(x int64) int64 { return (x >> 24) & 0xFF },
+    "pm":     func(x int64) int64 { return x >> 1 },
+    "pm_lo8": func(x int64) int64 { return (x >> 1) & 0xFF },
+    "pm_hi8": func(x int64) int64 { return (x >> 9) & 0xFF },
+    "pm_hh8": func(x int64) int64 { return (x >> 17) & 0xFF },
+}
+
+// A parser evaluates an expression. Symbols are resolved by lookup, which
+// returns false if the symbol is not defined.
+type exprParser struct {
+    toks   []token
+    lookup func(name string) (v int64, ok bool)
+}
+
+// Evaluates the expression s. Operators have the same precedence as in C.
+func evalExpr(s string, lookup func(string) (int64, bool)) (v int64, err error) {
+    toks, err := tokenize(s)
+    if err != nil {
+        return 0, err
+    }
+    if toks[0].kind == tokEOF {
+        return 0, fmt.Errorf("missing expression")
+    }
+    p := &exprParser{toks, lookup}
+    v, err = p.binary(0)
+    if err == nil && p.toks[0].kind != tokEOF {
+        err = fmt.Errorf("unexpected %q in expression", p.toks[0].text)
+    }
+    return v, err
+}
+
+// Binary operators, in increasing order of precedence.
+var precedence = [][]string{
+    {"|"},
+    {"^"},
+    {"&"},
+    {"<<", ">>"},
+    {"+", "-"},
+    {"*", "/", "%"},
+}
+
+// Parses a sequence of operands separated by operators of the given level of
+// precedence or higher.
+func (p *exprParser) binary(level int) (v int64, err error) {
+    if level == len(precedence) {
+        return p.unary()
+    }
+    if v, err = p.binary(level + 1); err != nil {
+        return 0, err
+    }
+    for {
+        op, ok := p.peekOp(precedence[level]...)
+        if !ok {
+            return v, nil
+        }
+        p.toks = p.toks[1:]
+        w, err := p.binary(level + 1)
+        if err != nil {
+            return 0, err
+        }
+        switch op {
+        case "|":
+            v |= w
+        case "^":
+            v ^= w
+        case "&":
+            v &= w
+        case "<<":
+            v <<= uint(w)
+        case ">>":
+            v >>= uint(w)
+        case "+":
+            v += w
+        case "-":
+            v -= w
+        case "*":
+            v *= w
+        case "/", "%":
+            if w == 0 {
+                return 0, fmt.Errorf("division by zero")
+            }
+            if op == "/" {
+                v /= w
+            } else {
+                v %= w
+            }
+        }
+    }
+}
+
+// Parses a unary expression.
+func (p *exprParser) unary() (v int64, err error) {
+    if op, ok := p.peekOp("-", "+", "~"); ok {
+        p.toks = p.toks[1:]
+        if v, err = p.unary(); err != nil {
+            return 0, err
+        }
+        switch op {
+        case "-":
+            return -v, nil
+        case "~":
+            return ^v, nil
+        }
+        return v, nil
+    }
+    return p.primary()
+}
+
+// Parses a number, symbol, function application or parenthesised expression.
+func (p *exprParser) primary() (v int64, err error) {
+    tok := p.toks[0]
+    switch tok.kind {
+    case tokNumber:
+        p.toks = p.toks[1:]
+        return tok.value, nil
+
+    case tokIdent:
+        p.toks = p.toks[1:]
+        if _, ok := p.peekOp("("); ok {
+            f, ok := exprFuncs[tok.text]
+            if !ok {
+                return 0, fmt.Errorf("unknown function %s", tok.text)
+            }
+            if v, err = p.primary(); err != nil {
+                return 0, err
+            }
+            return f(v), nil
+        }
+        v, ok := p.lookup(tok.text)
+        if !ok {
+            return 0, fmt.Errorf("undefined symbol %s", tok.text)
+        }
+        return v, nil
+
+    case tokOp:
+        if tok.text == "(" {
+            p.toks = p.toks[1:]
+            if v, err = p.binary(0); err != nil {
+                return 0, err
+            }
+            if _, ok := p.peekOp(")"); !ok {
+                return 0, fmt.Errorf("missing )")
+            }
+            p.toks = p.toks[1:]
+            return v, nil
+        }
+        return 0, fmt.Errorf("unexpected %q in expression", tok.text)
+    }
+    return 0, fmt.Errorf("unexpected end of expression")
+}
+
+// Returns the next token if it is one of the given operators.
+func (p *exprParser) peekOp(ops ...string) (op string, ok bool) {
+    if p.toks[0].kind != tokOp {
+        return "", false
+    }
+    for _, op = range ops {
+        if p.toks[0].text == op {
+            return op, true
+        }
+    }
+    return "", false
+}
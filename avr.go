@@ -1,5 +1,9 @@
 package avr
 
+import (
+    "fmt"
+)
+
 //go:generate stringer -type=Flag
 
 // A CPU status flag.
@@ -30,3 +34,33 @@ type PortRef struct {
     BankNum uint
     Index   uint16
 }
+
+// A StopReason is the reason that an emulator stopped running before executing
+// all of the ticks it was given, if it did.
+type StopReason int
+
+const (
+    // All of the ticks were executed.
+    StopTicks StopReason = iota
+    // The program counter reached a breakpoint. The instruction at the
+    // breakpoint has not been executed.
+    StopBreakpoint
+    // An instruction made an access matching a watchpoint. The instruction has
+    // completed.
+    StopWatchpoint
+    // A BREAK instruction was executed while a debugger was attached. The
+    // program counter is left at the instruction after the BREAK.
+    StopBreak
+    // An instruction caused a warning that was configured to stop the
+    // emulator. The instruction has completed.
+    StopWarning
+)
+
+var stopReasonNames = []string{"ticks", "breakpoint", "watchpoint", "break", "warning"}
+
+func (r StopReason) String() string {
+    if r < 0 || int(r) >= len(stopReasonNames) {
+        return fmt.Sprintf("StopReason(%d)", int(r))
+    }
+    return stopReasonNames[r]
+}
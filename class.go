@@ -0,0 +1,55 @@
+package avr
+
+import (
+    "fmt"
+)
+
+// An InstClass is one of the groups into which the instruction set summary of
+// the AVR datasheets divides the instructions.
+type InstClass int
+
+const (
+    ArithmeticClass InstClass = iota // arithmetic and logic instructions
+    BranchClass                      // jumps, calls, returns, branches, skips and compares
+    TransferClass                    // data transfer instructions
+    BitClass                         // bit and bit-test instructions, including shifts
+    ControlClass                     // MCU control instructions
+)
+
+var instClassNames = []string{"arithmetic", "branch", "transfer", "bit", "control"}
+
+func (c InstClass) String() string {
+    if c < 0 || int(c) >= len(instClassNames) {
+        return fmt.Sprintf("InstClass(%d)", int(c))
+    }
+    return instClassNames[c]
+}
+
+// Returns the class with the given name (as returned by String), such as
+// "branch".
+func ParseInstClass(name string) (c InstClass, ok bool) {
+    for i, n := range instClassNames {
+        if n == name {
+            return InstClass(i), true
+        }
+    }
+    return 0, false
+}
+
+// Returns the class of the instruction.
+func (inst Instruction) Class() InstClass {
+    switch inst {
+    case ADC, ADD, ADIW, AND, ANDI, COM, DEC, DES, EOR, FMUL, FMULS, FMULSU, INC,
+        MUL, MULS, MULSU, NEG, OR, ORI, SBC, SBCI, SBIW, SUB, SUBI:
+        return ArithmeticClass
+    case BRBC, BRBS, CALL, CP, CPC, CPI, CPSE, EICALL, EIJMP, ICALL, IJMP, JMP,
+        RCALL, RET, RETI, RJMP, SBIC, SBIS, SBRC, SBRS:
+        return BranchClass
+    case ASR, BCLR, BLD, BSET, BST, CBI, LSR, ROR, SBI, SWAP:
+        return BitClass
+    case BREAK, NOP, SLEEP, WDR:
+        return ControlClass
+    default:
+        return TransferClass
+    }
+}
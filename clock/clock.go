@@ -1,6 +1,9 @@
 package clock
 
 import (
+    "encoding/binary"
+    "fmt"
+    "github.com/kierdavis/avr"
     "log"
     "time"
 )
@@ -9,12 +12,22 @@ type Process interface {
     Run(ticks uint)
 }
 
+// A CPU is a process that can stop before it has run for all of the ticks it is
+// given, such as an emulator reaching a breakpoint. An emulator.Emulator is a
+// CPU; attach it with SetCPU rather than Add.
+type CPU interface {
+    Run(ticks uint) (reason avr.StopReason, executed uint)
+}
+
 type Clock struct {
+    cpu                 CPU
     procs               []Process
+    ticks               uint64
     lastFreqCheck       time.Time
     lastThrottle        time.Time
     ticksSinceFreqCheck uint
     ticksSinceThrottle  uint
+    step                uint
 }
 
 func New() (c *Clock) {
@@ -25,12 +38,81 @@ func (c *Clock) Add(p Process) {
     c.procs = append(c.procs, p)
 }
 
-func (c *Clock) Run(ticks uint) {
+// Sets the CPU driven by the clock. It is run before the other processes, which
+// are then run for only as many ticks as the CPU executed.
+func (c *Clock) SetCPU(cpu CPU) {
+    c.cpu = cpu
+}
+
+// Limits the number of ticks that the CPU and the processes are run for at a
+// time to step, so that each process sees the state of the others (and of the
+// CPU) at most step ticks out of date. Smaller steps are slower. A step of 0,
+// the default, runs everything for the whole of each call to Run.
+func (c *Clock) SetStep(step uint) {
+    c.step = step
+}
+
+// Runs the CPU and the processes for the given number of ticks, or until the
+// CPU stops. Returns the CPU's reason for stopping and the number of ticks run.
+func (c *Clock) Run(ticks uint) (reason avr.StopReason, executed uint) {
+    if c.step == 0 || ticks <= c.step {
+        return c.runStep(ticks)
+    }
+    for executed < ticks && reason == avr.StopTicks {
+        n := ticks - executed
+        if n > c.step {
+            n = c.step
+        }
+        var stepExecuted uint
+        reason, stepExecuted = c.runStep(n)
+        executed += stepExecuted
+    }
+    return reason, executed
+}
+
+func (c *Clock) runStep(ticks uint) (reason avr.StopReason, executed uint) {
+    if c.cpu != nil {
+        reason, ticks = c.cpu.Run(ticks)
+    }
     for _, proc := range c.procs {
         proc.Run(ticks)
     }
+    c.ticks += uint64(ticks)
     c.ticksSinceFreqCheck += ticks
     c.ticksSinceThrottle += ticks
+    return reason, ticks
+}
+
+// Returns the total number of ticks run since the clock was created.
+func (c *Clock) Ticks() uint64 {
+    return c.ticks
+}
+
+// Clock implements emulator.Snapshotter, so that the simulated time is saved
+// with the emulator's state. Add the clock to an emulator with
+// em.AddSnapshotter(clk).
+func (c *Clock) SnapshotName() string {
+    return "clock"
+}
+
+func (c *Clock) SnapshotState() []byte {
+    data := make([]byte, 8)
+    binary.LittleEndian.PutUint64(data, c.ticks)
+    return data
+}
+
+func (c *Clock) RestoreState(data []byte) error {
+    if len(data) != 8 {
+        return fmt.Errorf("clock state is %d bytes, expected 8", len(data))
+    }
+    c.ticks = binary.LittleEndian.Uint64(data)
+
+    // restart frequency monitoring and throttling from the current time
+    c.lastFreqCheck = time.Time{}
+    c.lastThrottle = time.Time{}
+    c.ticksSinceFreqCheck = 0
+    c.ticksSinceThrottle = 0
+    return nil
 }
 
 func (c *Clock) MonitorFrequency() (freq float64) {
@@ -0,0 +1,38 @@
+package clock
+
+import (
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+// A process that counts the ticks it is run for.
+type countingProcess struct {
+    ticks uint
+}
+
+func (p *countingProcess) Run(ticks uint) {
+    p.ticks += ticks
+}
+
+func TestClockStopsWithCPU(t *testing.T) {
+    em := emulator.NewEmulator(spec.ATmega168)
+    em.WriteProg(0, []uint16{0x0000, 0x0000, 0x0000, 0xCFFC}) // nop; nop; nop; rjmp .-8
+    em.SetBreakpoint(3)
+
+    clk := New()
+    var cpu CPU = em
+    clk.SetCPU(cpu)
+    p := &countingProcess{}
+    clk.Add(p)
+    clk.SetStep(2)
+
+    reason, executed := clk.Run(100)
+    if reason != avr.StopBreakpoint || executed != 3 || em.PC() != 3 {
+        t.Errorf("expected to stop at the breakpoint after 3 ticks, got %s after %d ticks at 0x%04X", reason, executed, em.PC())
+    }
+    if p.ticks != 3 || clk.Ticks() != 3 {
+        t.Errorf("expected the process and the clock to run for 3 ticks, got %d and %d", p.ticks, clk.Ticks())
+    }
+}
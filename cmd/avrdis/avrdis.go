@@ -0,0 +1,207 @@
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "github.com/kierdavis/avr/disasm"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader"
+    _ "github.com/kierdavis/avr/loader/binloader"
+    "github.com/kierdavis/avr/loader/elfloader"
+    _ "github.com/kierdavis/avr/loader/ihexloader"
+    _ "github.com/kierdavis/avr/loader/srecloader"
+    "github.com/kierdavis/avr/spec"
+    "io"
+    "log"
+    "os"
+    "sort"
+    "strings"
+)
+
+var mcu = flag.String("mcu", "mega168", "select specific MCU to use (use avrem -mcus to list available MCU names)")
+var all = flag.Bool("all", false, "disassemble every word as code instead of following control flow from the interrupt vectors")
+
+// The number of words printed on each line of data.
+const dataWordsPerLine = 4
+
+func main() {
+    flag.Parse()
+
+    if flag.NArg() < 1 {
+        fmt.Fprintf(os.Stderr, "usage: %s [options] <program.elf|program.hex|program.srec|program.bin>\n", os.Args[0])
+        os.Exit(2)
+    }
+
+    elfFile := openELF()
+    spec := selectSpec(elfFile)
+    log.Printf("[avr/cmd/avrdis] using MCU spec: %s", spec.Label)
+
+    em := emulator.NewEmulator(spec)
+    ranges := loadProgram(em, elfFile)
+
+    prog := make([]uint16, spec.ProgMemSize()/2)
+    em.ReadProg(0, prog)
+
+    d := disasm.New(spec)
+    d.Symbolizer = elfFile.Symbolizer(spec)
+
+    var code []bool
+    if !*all {
+        code = d.FindCode(prog, entryPoints(spec, elfFile, ranges))
+    }
+
+    w := bufio.NewWriter(os.Stdout)
+    printListing(w, d, prog, ranges, code, labels(spec, elfFile))
+    w.Flush()
+}
+
+// Opens the program as an ELF file if it is one, else returns nil.
+func openELF() *elfloader.File {
+    elfFile, err := elfloader.OpenIfELF(flag.Arg(0))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+        os.Exit(1)
+    }
+    return elfFile
+}
+
+// Selects the MCU spec named by -mcu or, if the flag was not given and the
+// program is an ELF file that records its MCU, the one it was built for.
+func selectSpec(elfFile *elfloader.File) *spec.MCUSpec {
+    flag.Visit(func(f *flag.Flag) {
+        if f.Name == "mcu" {
+            elfFile = nil
+        }
+    })
+
+    s, err := elfFile.SelectSpec(*mcu)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "error: invalid value for -mcu (try avrem -mcus for a list)\n")
+        os.Exit(2)
+    }
+    return s
+}
+
+// Loads the program into em and returns the ranges of program memory that it
+// occupies.
+func loadProgram(em *emulator.Emulator, elfFile *elfloader.File) (ranges []loader.Range) {
+    if elfFile != nil {
+        err := elfFile.Load(em)
+        elfFile.Close()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+            os.Exit(1)
+        }
+        log.Printf("[avr/cmd/avrdis] loaded ELF file with %d symbols", len(elfFile.Symbols))
+        return elfFile.Ranges(elfloader.Flash)
+    }
+
+    format, ranges, err := loader.LoadFile(em, flag.Arg(0), loader.Target{Memory: loader.Flash})
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+        os.Exit(1)
+    }
+    log.Printf("[avr/cmd/avrdis] loaded %s file", format)
+
+    // records need not appear in address order
+    sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+    return ranges
+}
+
+// Returns the word addresses from which control flow is followed: the
+// interrupt vectors lying within the program, and the program's functions if
+// it has a symbol table.
+func entryPoints(s *spec.MCUSpec, elfFile *elfloader.File, ranges []loader.Range) (entries []uint32) {
+    for n := uint(0); n < s.NumInterrupts; n++ {
+        addr := 2 * uint32(n*s.InterruptVectorSize)
+        if inRanges(ranges, addr) {
+            entries = append(entries, addr/2)
+        }
+    }
+
+    if elfFile != nil {
+        entries = append(entries, elfFile.Entry/2)
+        for _, sym := range elfFile.Symbols {
+            if sym.Space == elfloader.Flash && sym.Kind == elfloader.Func {
+                entries = append(entries, sym.Address/2)
+            }
+        }
+    }
+    return entries
+}
+
+func inRanges(ranges []loader.Range, addr uint32) bool {
+    for _, r := range ranges {
+        if r.Start <= addr && addr < r.End {
+            return true
+        }
+    }
+    return false
+}
+
+// Returns the labels to print in the listing, indexed by byte address: the
+// names of the interrupt vectors, followed by the program's symbols.
+func labels(s *spec.MCUSpec, elfFile *elfloader.File) (labels map[uint32][]string) {
+    labels = make(map[uint32][]string)
+    for n := uint(0); n < s.NumInterrupts; n++ {
+        addr := 2 * uint32(n*s.InterruptVectorSize)
+        labels[addr] = append(labels[addr], disasm.VectorName(s, n))
+    }
+
+    if elfFile != nil {
+        for _, sym := range elfFile.Symbols {
+            if sym.Space == elfloader.Flash && sym.Name != "" {
+                labels[sym.Address] = append(labels[sym.Address], sym.Name)
+            }
+        }
+    }
+    return labels
+}
+
+// Prints a listing of the given ranges of prog. Words marked in code are
+// disassembled and the remainder are printed as data; if code is nil, every
+// word is disassembled.
+func printListing(w io.Writer, d *disasm.Disassembler, prog []uint16, ranges []loader.Range, code []bool, labels map[uint32][]string) {
+    for i, r := range ranges {
+        if i > 0 {
+            fmt.Fprintf(w, "\t...\n")
+        }
+
+        end := (r.End + 1) / 2
+        for pc := r.Start / 2; pc < end; {
+            for _, label := range labels[2*pc] {
+                fmt.Fprintf(w, "\n%08x <%s>:\n", 2*pc, label)
+            }
+
+            if code == nil || code[pc] {
+                inst := d.Decode(prog, pc)
+                fmt.Fprintf(w, "%8x:\t%-9s\t%s\n", 2*pc, rawWords(inst.Words), inst)
+                pc += uint32(len(inst.Words))
+                continue
+            }
+
+            // a line of data, ending at the next instruction or label
+            n := uint32(1)
+            for n < dataWordsPerLine && pc+n < end && !code[pc+n] && labels[2*(pc+n)] == nil {
+                n++
+            }
+            words := prog[pc : pc+n]
+            operands := make([]string, len(words))
+            for j, word := range words {
+                operands[j] = fmt.Sprintf("0x%04x", word)
+            }
+            fmt.Fprintf(w, "%8x:\t%-9s\t.word\t%s\n", 2*pc, rawWords(words), strings.Join(operands, ", "))
+            pc += n
+        }
+    }
+}
+
+// Formats the raw words of an instruction or line of data.
+func rawWords(words []uint16) string {
+    parts := make([]string, len(words))
+    for i, word := range words {
+        parts[i] = fmt.Sprintf("%04x", word)
+    }
+    return strings.Join(parts, " ")
+}
@@ -3,47 +3,103 @@ package main
 import (
     "flag"
     "fmt"
+    "github.com/kierdavis/avr"
     "github.com/kierdavis/avr/clock"
     "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/gdbstub"
     "github.com/kierdavis/avr/hardware/gpio"
     "github.com/kierdavis/avr/hardware/timer"
-    "github.com/kierdavis/avr/loader/ihexloader"
+    "github.com/kierdavis/avr/loader"
+    _ "github.com/kierdavis/avr/loader/binloader"
+    "github.com/kierdavis/avr/loader/elfloader"
+    _ "github.com/kierdavis/avr/loader/ihexloader"
+    _ "github.com/kierdavis/avr/loader/srecloader"
     "github.com/kierdavis/avr/spec"
     "log"
     "os"
+    "os/signal"
+    "path/filepath"
     "runtime/pprof"
+    "strconv"
+    "strings"
+    "text/tabwriter"
 )
 
 var cpuProfile = flag.String("cpuprofile", "", "filename to write profiling data to")
 var throttleFreq = flag.Float64("freq", 0, "clock frequency to throttle emulation to (in MHz, 0 to run unthrottled)")
 var mcu = flag.String("mcu", "mega168", "select specific MCU to use (use -mcus to list available MCU names)")
 var mcus = flag.Bool("mcus", false, "list MCU names")
+var dumpFlash = flag.String("dump-flash", "", "filename to write the contents of program memory to on exit (IHEX if it ends in .hex, else raw binary)")
+var dumpEEPROM = flag.String("dump-eeprom", "", "filename to write the contents of EEPROM to on exit (IHEX if it ends in .hex, else raw binary)")
+var gdbAddr = flag.String("gdb", "", "wait for avr-gdb to connect on the given TCP address (such as :1234) and run the program under its control")
+var monitorMode = flag.Bool("monitor", false, "run the program under an interactive monitor (type help for a list of commands)")
+var preloads preloadList
 
-var mcuMap = map[string]*spec.MCUSpec{
-    "tiny4":   spec.ATtiny4,
-    "tiny5":   spec.ATtiny5,
-    "tiny9":   spec.ATtiny9,
-    "tiny10":  spec.ATtiny10,
-    "mega48":  spec.ATmega48,
-    "mega88":  spec.ATmega88,
-    "mega168": spec.ATmega168,
+func init() {
+    flag.Var(&preloads, "preload", "load `MEM[@OFFSET]=FILE` into flash, eeprom or data memory before running (may be repeated)")
+}
+
+// A file to be loaded into memory in addition to the program.
+type preload struct {
+    target loader.Target
+    name   string
+}
+
+// A flag.Value accumulating -preload arguments.
+type preloadList []preload
+
+func (l *preloadList) String() string {
+    parts := make([]string, len(*l))
+    for i, p := range *l {
+        parts[i] = p.target.String() + "=" + p.name
+    }
+    return strings.Join(parts, ",")
+}
+
+func (l *preloadList) Set(value string) (err error) {
+    eq := strings.IndexByte(value, '=')
+    if eq < 0 {
+        return fmt.Errorf("expected MEM[@OFFSET]=FILE")
+    }
+    memName, name := value[:eq], value[eq+1:]
+
+    var offset uint64
+    if at := strings.IndexByte(memName, '@'); at >= 0 {
+        offset, err = strconv.ParseUint(memName[at+1:], 0, 32)
+        if err != nil {
+            return fmt.Errorf("invalid offset %q", memName[at+1:])
+        }
+        memName = memName[:at]
+    }
+
+    mem, ok := loader.ParseMemory(memName)
+    if !ok {
+        return fmt.Errorf("unknown memory %q (expected flash, eeprom or data)", memName)
+    }
+    *l = append(*l, preload{loader.Target{mem, uint32(offset)}, name})
+    return nil
 }
 
 func main() {
     flag.Parse()
 
+    if *mcus {
+        listMCUs()
+        return
+    }
+
     if flag.NArg() < 1 {
-        fmt.Fprintf(os.Stderr, "usage: %s <program.hex>\n", os.Args[0])
+        fmt.Fprintf(os.Stderr, "usage: %s [options] <program.elf|program.hex|program.srec|program.bin>\n", os.Args[0])
         os.Exit(2)
     }
 
-    if *mcus {
-        fmt.Printf("MCUs available for use with -mcu:\n")
-        for name := range mcuMap {
-            fmt.Printf("  %s\n", name)
+    // exit with an error status once the CPU profile has been written
+    ok := true
+    defer func() {
+        if !ok {
+            os.Exit(1)
         }
-        return
-    }
+    }()
 
     if *cpuProfile != "" {
         f, err := os.Create(*cpuProfile)
@@ -58,33 +114,83 @@ func main() {
         }()
     }
 
-    runEmulator()
+    ok = runEmulator()
 }
 
-func runEmulator() {
-    spec, ok := mcuMap[*mcu]
-    if !ok {
-        fmt.Fprintf(os.Stderr, "error: invalid value for -mcu (try -mcus for a list)\n")
-        os.Exit(2)
+// Runs the program. Returns false if it was stopped by a warning treated as an
+// error.
+func runEmulator() (ok bool) {
+    elfFile := openELF()
+    if elfFile != nil {
+        defer elfFile.Close()
     }
+    spec := selectSpec(elfFile)
     log.Printf("[avr/cmd/avrem] using MCU spec: %s", spec.Label)
 
     clk := clock.New()
 
     em := emulator.NewEmulator(spec)
     em.SetLogging(true)
-    clk.Add(em)
+    clk.SetCPU(em)
+    em.AddSnapshotter(clk)
+    stopWarnings := setupWarnings(em)
+    defer stopWarnings()
 
-    loadProgram(em)
-    setupIO(em, clk)
+    stopCoverage := setupCoverage(em, elfFile)
+    defer stopCoverage()
+    stopSanitizer := setupSanitizer(em)
+    defer stopSanitizer()
+    loadProgram(em, elfFile)
+    loadPreloads(em)
+    gpios, timers := setupIO(em, clk)
+    stopTrace := setupTrace(em, elfFile)
+    defer stopTrace()
+    stopVCD := setupVCD(em, clk, gpios, timers)
+    defer stopVCD()
+    stopProfile := setupProfile(em, elfFile)
+    defer stopProfile()
+    stopStack := setupStack(em, elfFile)
+    defer stopStack()
 
     throttleFreq_ := *throttleFreq
 
+    if *gdbAddr != "" || *monitorMode {
+        if *gdbAddr != "" {
+            debugWithGDB(em, clk, resetIO(gpios, timers))
+        } else {
+            m := newMonitor(em, throttledRun(clk), elfFile, gpios, os.Stdout)
+            m.reset = resetIO(gpios, timers)
+            m.serve(os.Stdin)
+        }
+        dumpMemory(em, loader.Flash, *dumpFlash)
+        dumpMemory(em, loader.EEPROM, *dumpEEPROM)
+        return true
+    }
+
+    // stop cleanly on interrupt, so that the trace and memory dumps are
+    // complete
+    interrupt := make(chan os.Signal, 1)
+    signal.Notify(interrupt, os.Interrupt)
+    defer signal.Stop(interrupt)
+
+run:
     for i := 0; i < 100; i++ {
+        select {
+        case <-interrupt:
+            log.Printf("[avr/cmd/avrem] interrupted")
+            break run
+        default:
+        }
+
         clk.LogFrequency()
 
         for i := 0; i < 1e5; i++ {
-            clk.Run(20)
+            if reason, _ := clk.Run(20); reason == avr.StopWarning {
+                log.Printf("[avr/cmd/avrem] stopped by warning: %s", em.StopWarning())
+                dumpMemory(em, loader.Flash, *dumpFlash)
+                dumpMemory(em, loader.EEPROM, *dumpEEPROM)
+                return false
+            }
         }
 
         if throttleFreq_ != 0 {
@@ -92,25 +198,145 @@ func runEmulator() {
         }
     }
 
+    dumpMemory(em, loader.Flash, *dumpFlash)
+    dumpMemory(em, loader.EEPROM, *dumpEEPROM)
+
     fmt.Println("OK.")
+    return true
+}
+
+// Returns a function that runs the clock, throttled to the frequency given by
+// -freq, for use by debuggers.
+func throttledRun(clk *clock.Clock) func(ticks uint) (reason avr.StopReason, executed uint) {
+    ticksSinceThrottle := uint(0)
+    return func(ticks uint) (reason avr.StopReason, executed uint) {
+        reason, executed = clk.Run(ticks)
+        if *throttleFreq != 0 {
+            ticksSinceThrottle += executed
+            if ticksSinceThrottle >= 1e5 {
+                clk.Throttle(*throttleFreq * 1e6)
+                ticksSinceThrottle = 0
+            }
+        }
+        return reason, executed
+    }
+}
+
+// Runs the program under the control of avr-gdb until it detaches.
+func debugWithGDB(em *emulator.Emulator, clk *clock.Clock, reset func()) {
+    srv := gdbstub.New(em)
+    srv.SetLogging(true)
+    srv.Run = throttledRun(clk)
+    srv.Reset = reset
+
+    if err := srv.ListenAndServe(*gdbAddr); err != nil {
+        fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+        os.Exit(1)
+    }
 }
 
-func loadProgram(em *emulator.Emulator) {
-    f, err := os.Open(flag.Arg(0))
+// Writes the contents of a memory to the named file, if one was given.
+func dumpMemory(em *emulator.Emulator, m loader.Memory, name string) {
+    if name == "" {
+        return
+    }
+
+    format := loader.RawFormat
+    switch strings.ToLower(filepath.Ext(name)) {
+    case ".hex", ".ihex", ".ihx":
+        format = "ihex"
+    }
+
+    if err := loader.SaveFile(em, name, m, format); err != nil {
+        fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+        os.Exit(1)
+    }
+    log.Printf("[avr/cmd/avrem] wrote %s to %s", m, name)
+}
+
+func listMCUs() {
+    fmt.Printf("MCUs available for use with -mcu:\n")
+    w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+    for _, e := range spec.Entries() {
+        s := e.Spec
+        names := strings.Join(append([]string{e.Name}, e.Aliases...), ", ")
+        fmt.Fprintf(w, "  %s\t%s\t%s flash\t%s RAM\t%s EEPROM\n", names, s.Family,
+            formatSize(s.ProgMemSize()), formatSize(s.RAMSize()), formatSize(s.EEPROMSize()))
+    }
+    w.Flush()
+}
+
+func formatSize(n uint) string {
+    if n >= 1024 && n%1024 == 0 {
+        return fmt.Sprintf("%d KiB", n/1024)
+    }
+    return fmt.Sprintf("%d B", n)
+}
+
+// Opens the program as an ELF file if it is one, else returns nil.
+func openELF() *elfloader.File {
+    elfFile, err := elfloader.OpenIfELF(flag.Arg(0))
     if err != nil {
         fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
         os.Exit(1)
     }
+    return elfFile
+}
 
-    err = ihexloader.Load(em, f)
-    f.Close()
+// Selects the MCU spec named by -mcu or, if the flag was not given and the
+// program is an ELF file that records its MCU, the one it was built for.
+func selectSpec(elfFile *elfloader.File) *spec.MCUSpec {
+    flag.Visit(func(f *flag.Flag) {
+        if f.Name == "mcu" {
+            elfFile = nil
+        }
+    })
+
+    s, err := elfFile.SelectSpec(*mcu)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "error: invalid value for -mcu (try -mcus for a list)\n")
+        os.Exit(2)
+    }
+    return s
+}
+
+func loadProgram(em *emulator.Emulator, elfFile *elfloader.File) {
+    if elfFile != nil {
+        if err := elfFile.Load(em); err != nil {
+            fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+            os.Exit(1)
+        }
+        log.Printf("[avr/cmd/avrem] loaded ELF file with %d symbols", len(elfFile.Symbols))
+        return
+    }
+
+    format, ranges, err := loader.LoadFile(em, flag.Arg(0), loader.Target{Memory: loader.Flash})
     if err != nil {
         fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
         os.Exit(1)
     }
+    for _, r := range ranges {
+        log.Printf("[avr/cmd/avrem] loaded program memory %s (%s)", r, format)
+    }
+}
+
+// Loads the files given with -preload.
+func loadPreloads(em *emulator.Emulator) {
+    for _, p := range preloads {
+        format, ranges, err := loader.LoadFile(em, p.name, p.target)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "error: %s: %s\n", p.name, err.Error())
+            os.Exit(1)
+        }
+        for _, r := range ranges {
+            log.Printf("[avr/cmd/avrem] preloaded %s %s from %s (%s)", p.target.Memory, r, p.name, format)
+        }
+    }
 }
 
-func setupIO(em *emulator.Emulator, clk *clock.Clock) {
+// Attaches the peripherals to the emulator. Returns the GPIO ports, keyed by
+// letter, and the timers, keyed by number.
+func setupIO(em *emulator.Emulator, clk *clock.Clock) (gpios map[byte]*gpio.GPIO, timers map[uint]*timer.Timer) {
     gpioB := gpio.New('B', 8)
     gpioB.SetOutputAdapter(5, &PrintingOutputPinAdapter{Label: "LED"})
     gpioB.AddTo(em)
@@ -119,6 +345,21 @@ func setupIO(em *emulator.Emulator, clk *clock.Clock) {
     t0.SetLogging(true)
     t0.AddTo(em)
     clk.Add(t0)
+
+    return map[byte]*gpio.GPIO{'B': gpioB}, map[uint]*timer.Timer{0: t0}
+}
+
+// Returns a function that resets the peripherals created by setupIO, for use
+// after the CPU is reset.
+func resetIO(gpios map[byte]*gpio.GPIO, timers map[uint]*timer.Timer) func() {
+    return func() {
+        for _, g := range gpios {
+            g.Reset()
+        }
+        for _, t := range timers {
+            t.Reset()
+        }
+    }
 }
 
 type PrintingOutputPinAdapter struct {
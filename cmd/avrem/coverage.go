@@ -0,0 +1,122 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "github.com/kierdavis/avr/debuginfo"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader/elfloader"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+var coverageFile = flag.String("coverage", "", "write the code coverage of the emulated program to the named file, in lcov format if the program has debugging information or else as a summary per function")
+
+// Starts recording coverage if -coverage was given. Returns a function that
+// writes the coverage. It must be called before the program is loaded, while
+// the ELF file's debugging information can still be read.
+func setupCoverage(em *emulator.Emulator, elfFile *elfloader.File) (stop func()) {
+    if *coverageFile == "" {
+        return func() {}
+    }
+
+    f, err := os.Create(*coverageFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+        os.Exit(1)
+    }
+
+    var info *debuginfo.Info
+    if elfFile != nil {
+        if info, err = debuginfo.New(elfFile.ELF()); err != nil {
+            log.Printf("[avr/cmd/avrem] no debugging information (%s); coverage will be summarised by function", err)
+        }
+    }
+
+    cov := emulator.NewCoverage(em)
+
+    return func() {
+        cov.Stop()
+        fns := coverageFunctions(em, elfFile)
+        if info != nil {
+            name := strings.TrimSuffix(filepath.Base(flag.Arg(0)), filepath.Ext(flag.Arg(0)))
+            err = info.WriteLCOV(f, cov, name)
+        } else {
+            err = writeCoverageSummary(f, cov, fns)
+        }
+        if cerr := f.Close(); err == nil {
+            err = cerr
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "error: writing coverage: %s\n", err.Error())
+            os.Exit(1)
+        }
+
+        total := summarizeCoverage(cov, fns)
+        log.Printf("[avr/cmd/avrem] coverage: %s of instructions, %s of branches; written to %s",
+            percent(total.Executed, total.Instructions), percent(total.BranchesCovered, total.Branches), *coverageFile)
+    }
+}
+
+// Returns the ranges of the program's functions, or if it has no function
+// symbols, a single range covering the whole program.
+func coverageFunctions(em *emulator.Emulator, elfFile *elfloader.File) (fns []emulator.FunctionCoverage) {
+    if elfFile != nil {
+        for _, sym := range elfFile.Symbols {
+            if sym.Space == elfloader.Flash && sym.Kind == elfloader.Func && sym.Size != 0 {
+                fns = append(fns, emulator.FunctionCoverage{
+                    Name:    sym.Name,
+                    PCRange: emulator.PCRange{sym.Address / 2, (sym.Address + sym.Size + 1) / 2},
+                })
+            }
+        }
+    }
+    if len(fns) == 0 {
+        // up to the last programmed word, ignoring erased (or never loaded)
+        // memory
+        end := uint32(1) << em.Spec.LogProgMemSize
+        for end > 0 && (em.ProgWord(end-1) == 0xFFFF || em.ProgWord(end-1) == 0) {
+            end--
+        }
+        fns = append(fns, emulator.FunctionCoverage{Name: "program", PCRange: emulator.PCRange{0, end}})
+    }
+    return fns
+}
+
+// Returns the total coverage of the given functions.
+func summarizeCoverage(cov *emulator.Coverage, fns []emulator.FunctionCoverage) (total emulator.FunctionCoverage) {
+    for _, fn := range fns {
+        fc := cov.Summarize(fn.Name, fn.PCRange)
+        total.Instructions += fc.Instructions
+        total.Executed += fc.Executed
+        total.Branches += fc.Branches
+        total.BranchesCovered += fc.BranchesCovered
+    }
+    return total
+}
+
+// Writes a table of the coverage of each function.
+func writeCoverageSummary(w io.Writer, cov *emulator.Coverage, fns []emulator.FunctionCoverage) error {
+    fmt.Fprintf(w, "%-32s %-8s %18s %18s\n", "function", "address", "instructions", "branches")
+    for _, fn := range fns {
+        fc := cov.Summarize(fn.Name, fn.PCRange)
+        fmt.Fprintf(w, "%-32s 0x%04x   %9s %8s %9s %8s\n", fc.Name, fc.Start*2,
+            fmt.Sprintf("%d/%d", fc.Executed, fc.Instructions), percent(fc.Executed, fc.Instructions),
+            fmt.Sprintf("%d/%d", fc.BranchesCovered, fc.Branches), percent(fc.BranchesCovered, fc.Branches))
+    }
+    total := summarizeCoverage(cov, fns)
+    _, err := fmt.Fprintf(w, "%-32s %-8s %9s %8s %9s %8s\n", "total", "",
+        fmt.Sprintf("%d/%d", total.Executed, total.Instructions), percent(total.Executed, total.Instructions),
+        fmt.Sprintf("%d/%d", total.BranchesCovered, total.Branches), percent(total.BranchesCovered, total.Branches))
+    return err
+}
+
+func percent(n, total int) string {
+    if total == 0 {
+        return "-"
+    }
+    return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
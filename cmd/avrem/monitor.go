@@ -0,0 +1,783 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/disasm"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/hardware/gpio"
+    "github.com/kierdavis/avr/loader/elfloader"
+    "github.com/kierdavis/avr/spec"
+    "io"
+    "os"
+    "os/signal"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// The number of ticks run between checks for Ctrl-C while continuing.
+const monitorChunk = 10000
+
+// An interactive monitor for examining and controlling the emulated program,
+// started by -monitor.
+type monitor struct {
+    em        *emulator.Emulator
+    run       func(ticks uint) (reason avr.StopReason, executed uint)
+    reset     func() // if not nil, called by the reset command to reset peripherals
+    dis       *disasm.Disassembler
+    elfFile   *elfloader.File
+    pins      map[string]*MonitorInputPinAdapter // keyed by port letter and pin number, such as "B3"
+    out       io.Writer
+    history   []string
+    interrupt chan os.Signal
+    quit      bool
+}
+
+// A monitor command.
+type monitorCommand struct {
+    names []string
+    args  string
+    help  string
+    fn    func(m *monitor, args []string) error
+}
+
+var monitorCommands []monitorCommand
+
+func init() {
+    monitorCommands = []monitorCommand{
+        {[]string{"step", "s"}, "[N]", "execute N instructions (default 1)", (*monitor).cmdStep},
+        {[]string{"continue", "c"}, "", "run until a breakpoint, watchpoint or BREAK, or Ctrl-C", (*monitor).cmdContinue},
+        {[]string{"run"}, "N", "run for N clock cycles, stopping early at a breakpoint", (*monitor).cmdRun},
+        {[]string{"regs", "r"}, "", "show the registers, SREG, SP and PC", (*monitor).cmdRegs},
+        {[]string{"x"}, "[data|flash|eeprom] ADDR [LEN]", "hexdump memory (default data memory, 64 bytes)", (*monitor).cmdExamine},
+        {[]string{"disas", "d"}, "[ADDR] [N]", "disassemble N instructions (default around the PC)", (*monitor).cmdDisas},
+        {[]string{"break", "b"}, "ADDR", "set a breakpoint at a program byte address or symbol", (*monitor).cmdBreak},
+        {[]string{"delete"}, "ADDR", "remove a breakpoint", (*monitor).cmdDelete},
+        {[]string{"watch", "w"}, "LOC [read|write|access] [VALUE]", "stop when a data address, variable or I/O register is accessed (default write), optionally only with VALUE", (*monitor).cmdWatch},
+        {[]string{"unwatch"}, "N", "remove watchpoint N (as numbered by info)", (*monitor).cmdUnwatch},
+        {[]string{"info"}, "", "list breakpoints and watchpoints", (*monitor).cmdInfo},
+        {[]string{"io"}, "[NAME]", "show the named I/O registers, or one of them", (*monitor).cmdIO},
+        {[]string{"set"}, "LOC VALUE", "set rN, pc, sp, sreg, an I/O register (through its port) or a data address", (*monitor).cmdSet},
+        {[]string{"pin"}, "PIN [high|low|toggle|float]", "show or drive an input pin, such as B3", (*monitor).cmdPin},
+        {[]string{"bt"}, "", "show the call stack, found by scanning the stack for return addresses", (*monitor).cmdBacktrace},
+        {[]string{"reset"}, "", "reset the MCU", (*monitor).cmdReset},
+        {[]string{"history"}, "", "list previous commands; !N repeats command N, !! the last, and an empty line repeats the last", (*monitor).cmdHistory},
+        {[]string{"help", "h", "?"}, "", "show this help", (*monitor).cmdHelp},
+        {[]string{"quit", "q"}, "", "leave the monitor", (*monitor).cmdQuit},
+    }
+}
+
+// An input pin driven by the monitor's pin command. While it is not driven, it
+// reads high if its pull-up is enabled.
+type MonitorInputPinAdapter struct {
+    Driven bool
+    State  bool
+    Pullup bool
+}
+
+func (a *MonitorInputPinAdapter) GetState() bool {
+    if a.Driven {
+        return a.State
+    }
+    return a.Pullup
+}
+
+func (a *MonitorInputPinAdapter) SetPullupEnabled(enabled bool) {
+    a.Pullup = enabled
+}
+
+func newMonitor(em *emulator.Emulator, run func(ticks uint) (avr.StopReason, uint), elfFile *elfloader.File, gpios map[byte]*gpio.GPIO, out io.Writer) (m *monitor) {
+    m = &monitor{
+        em:      em,
+        run:     run,
+        dis:     disasm.New(em.Spec),
+        elfFile: elfFile,
+        pins:    make(map[string]*MonitorInputPinAdapter),
+        out:     out,
+    }
+    m.dis.Symbolizer = elfFile.Symbolizer(em.Spec)
+    for letter, g := range gpios {
+        for n := uint(0); n < 8; n++ {
+            a := &MonitorInputPinAdapter{}
+            g.SetInputAdapter(n, a)
+            m.pins[fmt.Sprintf("%c%d", letter, n)] = a
+        }
+    }
+    return m
+}
+
+// Reads and executes commands from r until the quit command or the end of the
+// input.
+func (m *monitor) serve(r io.Reader) {
+    m.interrupt = make(chan os.Signal, 1)
+    signal.Notify(m.interrupt, os.Interrupt)
+    defer signal.Stop(m.interrupt)
+    m.em.SetDebuggerAttached(true)
+    defer m.em.SetDebuggerAttached(false)
+
+    m.showNext()
+    scanner := bufio.NewScanner(r)
+    for !m.quit {
+        fmt.Fprint(m.out, "(avrem) ")
+        if !scanner.Scan() {
+            fmt.Fprintln(m.out)
+            return
+        }
+        m.execute(scanner.Text())
+    }
+}
+
+// Executes a line of input, expanding history references.
+func (m *monitor) execute(line string) {
+    line = strings.TrimSpace(line)
+    switch {
+    case line == "" || line == "!!":
+        if len(m.history) == 0 {
+            return
+        }
+        line = m.history[len(m.history)-1]
+    case strings.HasPrefix(line, "!"):
+        n, err := strconv.Atoi(line[1:])
+        if err != nil || n < 1 || n > len(m.history) {
+            fmt.Fprintf(m.out, "error: no command %s in history\n", line)
+            return
+        }
+        line = m.history[n-1]
+        fmt.Fprintln(m.out, line)
+    }
+    m.history = append(m.history, line)
+
+    fields := strings.Fields(line)
+    for _, cmd := range monitorCommands {
+        for _, name := range cmd.names {
+            if name == fields[0] {
+                if err := cmd.fn(m, fields[1:]); err != nil {
+                    fmt.Fprintf(m.out, "error: %s\n", err)
+                }
+                return
+            }
+        }
+    }
+    fmt.Fprintf(m.out, "error: unknown command %q (try help)\n", fields[0])
+}
+
+// Returns the symbolic form of a program byte address, such as
+// "0x00d2 <main+4>".
+func (m *monitor) formatProgAddr(addr uint32) string {
+    if name, offset, ok := m.dis.Symbolizer(addr); ok {
+        if offset == 0 {
+            return fmt.Sprintf("0x%04x <%s>", addr, name)
+        }
+        return fmt.Sprintf("0x%04x <%s+%d>", addr, name, offset)
+    }
+    return fmt.Sprintf("0x%04x", addr)
+}
+
+// Prints the instruction at the PC.
+func (m *monitor) showNext() {
+    pc := m.em.PC()
+    inst := m.dis.Decode(m.progWords(), pc)
+    fmt.Fprintf(m.out, "=> %s:\t%s\n", m.formatProgAddr(2*pc), inst)
+}
+
+// Returns the contents of program memory.
+func (m *monitor) progWords() []uint16 {
+    words := make([]uint16, m.em.Spec.ProgMemSize()/2)
+    for i := range words {
+        words[i] = m.em.ProgWord(uint32(i))
+    }
+    return words
+}
+
+// Reports why the program stopped and shows the next instruction.
+func (m *monitor) report(reason avr.StopReason, interrupted bool) {
+    switch {
+    case reason == avr.StopBreakpoint:
+        fmt.Fprintf(m.out, "breakpoint at %s\n", m.formatProgAddr(2*m.em.PC()))
+    case reason == avr.StopWatchpoint:
+        _, a := m.em.StopAccess()
+        loc := fmt.Sprintf("0x%04x", a.Addr)
+        if name := m.dis.DataName(a.Addr); name != "" {
+            loc += " (" + name + ")"
+        }
+        switch a.Kind {
+        case emulator.DataWrite:
+            fmt.Fprintf(m.out, "watchpoint: wrote 0x%02x to %s (was 0x%02x)\n", a.Value, loc, a.Old)
+        case emulator.PortWrite:
+            fmt.Fprintf(m.out, "watchpoint: wrote 0x%02x to %s\n", a.Value, loc)
+        default:
+            fmt.Fprintf(m.out, "watchpoint: read 0x%02x from %s\n", a.Value, loc)
+        }
+    case reason == avr.StopBreak:
+        fmt.Fprintf(m.out, "BREAK instruction\n")
+    case reason == avr.StopWarning:
+        fmt.Fprintf(m.out, "warning: %s\n", m.em.StopWarning())
+    case interrupted:
+        fmt.Fprintf(m.out, "interrupted\n")
+    }
+    m.showNext()
+}
+
+// Returns true if Ctrl-C has been pressed since the last call.
+func (m *monitor) interrupted() bool {
+    select {
+    case <-m.interrupt:
+        return true
+    default:
+        return false
+    }
+}
+
+func (m *monitor) cmdStep(args []string) error {
+    n := uint64(1)
+    if len(args) > 0 {
+        var err error
+        if n, err = strconv.ParseUint(args[0], 0, 64); err != nil {
+            return fmt.Errorf("invalid count %q", args[0])
+        }
+    }
+
+    target := m.em.InstructionCount() + n
+    reason := avr.StopTicks
+    for m.em.InstructionCount() < target && reason == avr.StopTicks {
+        // one tick at a time, so that no more than n instructions are executed
+        reason, _ = m.run(1)
+    }
+    m.report(reason, false)
+    return nil
+}
+
+func (m *monitor) cmdContinue(args []string) error {
+    for {
+        reason, _ := m.run(monitorChunk)
+        if reason != avr.StopTicks {
+            m.report(reason, false)
+            return nil
+        }
+        if m.interrupted() {
+            m.report(reason, true)
+            return nil
+        }
+    }
+}
+
+func (m *monitor) cmdRun(args []string) error {
+    if len(args) != 1 {
+        return fmt.Errorf("usage: run N")
+    }
+    n, err := strconv.ParseUint(args[0], 0, 64)
+    if err != nil {
+        return fmt.Errorf("invalid cycle count %q", args[0])
+    }
+
+    for n > 0 {
+        ticks := uint(monitorChunk)
+        if n < monitorChunk {
+            ticks = uint(n)
+        }
+        reason, executed := m.run(ticks)
+        n -= uint64(executed)
+        if reason != avr.StopTicks || m.interrupted() {
+            m.report(reason, reason == avr.StopTicks)
+            return nil
+        }
+    }
+    m.showNext()
+    return nil
+}
+
+func (m *monitor) cmdRegs(args []string) error {
+    for n := uint(0); n < m.em.Spec.NumRegs; n++ {
+        sep := " "
+        if n%8 == 7 || n == m.em.Spec.NumRegs-1 {
+            sep = "\n"
+        }
+        fmt.Fprintf(m.out, "r%-2d %02x%s", n, m.em.Reg(n), sep)
+    }
+
+    flags := []byte("ITHSVNZC")
+    sreg := m.em.SREG()
+    for i := range flags {
+        if sreg&(0x80>>uint(i)) == 0 {
+            flags[i] += 'a' - 'A'
+        }
+    }
+    fmt.Fprintf(m.out, "SREG %02x [%s]  SP %04x  PC %s\n", sreg, flags, m.em.SP(), m.formatProgAddr(2*m.em.PC()))
+    return nil
+}
+
+func (m *monitor) cmdExamine(args []string) error {
+    space := "data"
+    if len(args) > 0 && (args[0] == "data" || args[0] == "flash" || args[0] == "eeprom") {
+        space, args = args[0], args[1:]
+    }
+    if len(args) < 1 || len(args) > 2 {
+        return fmt.Errorf("usage: x [data|flash|eeprom] ADDR [LEN]")
+    }
+
+    var start, size uint32
+    var read func(addr uint32) uint8
+    switch space {
+    case "data":
+        addr, err := m.parseDataAddr(args[0])
+        if err != nil {
+            return err
+        }
+        start, size = uint32(addr), 1<<m.em.Spec.LogDataSpaceSize
+        read = func(addr uint32) uint8 { return m.em.PeekData(uint16(addr)) }
+    case "flash":
+        addr, err := m.parseProgAddr(args[0])
+        if err != nil {
+            return err
+        }
+        start, size = addr, uint32(m.em.Spec.ProgMemSize())
+        read = m.em.ProgByte
+    case "eeprom":
+        addr, err := parseNumber(args[0])
+        if err != nil {
+            return err
+        }
+        start, size = uint32(addr), uint32(m.em.Spec.EEPROMSize())
+        read = func(addr uint32) uint8 { return m.em.EEPROMByte(uint16(addr)) }
+    }
+
+    length := uint32(64)
+    if len(args) == 2 {
+        n, err := parseNumber(args[1])
+        if err != nil {
+            return err
+        }
+        length = uint32(n)
+    }
+    if start >= size {
+        return fmt.Errorf("address 0x%x is outside %s memory", start, space)
+    }
+    if length > size-start {
+        length = size - start
+    }
+
+    for line := start; line < start+length; line += 16 {
+        var hex, text strings.Builder
+        for addr := line; addr < line+16; addr++ {
+            if addr >= start+length {
+                hex.WriteString("   ")
+                continue
+            }
+            b := read(addr)
+            fmt.Fprintf(&hex, " %02x", b)
+            if b >= 0x20 && b < 0x7F {
+                text.WriteByte(b)
+            } else {
+                text.WriteByte('.')
+            }
+        }
+        fmt.Fprintf(m.out, "%04x:%s  |%s|\n", line, hex.String(), text.String())
+    }
+    return nil
+}
+
+func (m *monitor) cmdDisas(args []string) error {
+    prog := m.progWords()
+    pc := m.em.PC()
+    var start uint32
+    n := 10
+
+    if len(args) > 0 {
+        addr, err := m.parseProgAddr(args[0])
+        if err != nil {
+            return err
+        }
+        start = addr / 2
+    } else {
+        // start a few instructions before the PC, at an address from which
+        // decoding lands on the PC
+        start = pc
+        for back := uint32(8); back > 0; back-- {
+            if back > pc {
+                continue
+            }
+            a := pc - back
+            for a < pc {
+                a += uint32(len(m.dis.Decode(prog, a).Words))
+            }
+            if a == pc {
+                start = pc - back
+                break
+            }
+        }
+    }
+    if len(args) > 1 {
+        count, err := parseNumber(args[1])
+        if err != nil {
+            return err
+        }
+        n = int(count)
+    }
+
+    addr := start
+    for i := 0; i < n && addr < uint32(len(prog)); i++ {
+        inst := m.dis.Decode(prog, addr)
+        marker := "  "
+        if addr == pc {
+            marker = "=>"
+        }
+        fmt.Fprintf(m.out, "%s %s:\t%s\n", marker, m.formatProgAddr(2*addr), inst)
+        addr += uint32(len(inst.Words))
+    }
+    return nil
+}
+
+func (m *monitor) cmdBreak(args []string) error {
+    if len(args) != 1 {
+        return fmt.Errorf("usage: break ADDR")
+    }
+    addr, err := m.parseProgAddr(args[0])
+    if err != nil {
+        return err
+    }
+    m.em.SetBreakpoint(addr / 2)
+    fmt.Fprintf(m.out, "breakpoint at %s\n", m.formatProgAddr(addr&^1))
+    return nil
+}
+
+func (m *monitor) cmdDelete(args []string) error {
+    if len(args) != 1 {
+        return fmt.Errorf("usage: delete ADDR")
+    }
+    addr, err := m.parseProgAddr(args[0])
+    if err != nil {
+        return err
+    }
+    m.em.ClearBreakpoint(addr / 2)
+    return nil
+}
+
+var watchKindNames = map[string]emulator.WatchKind{
+    "read":   emulator.WatchRead,
+    "write":  emulator.WatchWrite,
+    "access": emulator.WatchAccess,
+}
+
+func (m *monitor) cmdWatch(args []string) error {
+    if len(args) < 1 || len(args) > 3 {
+        return fmt.Errorf("usage: watch LOC [read|write|access] [VALUE]")
+    }
+    w := emulator.Watchpoint{Kind: emulator.WatchWrite, Size: 1}
+    var err error
+    if w.Addr, err = m.parseDataAddr(args[0]); err != nil {
+        return err
+    }
+    if m.elfFile != nil {
+        if sym, ok := m.elfFile.Lookup(args[0]); ok && sym.Space == elfloader.Data && sym.Size > 1 {
+            w.Size = uint16(sym.Size)
+        }
+    }
+
+    for _, arg := range args[1:] {
+        if kind, ok := watchKindNames[arg]; ok {
+            w.Kind = kind
+            continue
+        }
+        v, err := parseNumber(arg)
+        if err != nil || v > 0xFF {
+            return fmt.Errorf("invalid watch kind or value %q", arg)
+        }
+        w.Conditional, w.Value = true, uint8(v)
+    }
+
+    m.em.AddWatchpoint(w)
+    fmt.Fprintf(m.out, "watchpoint %d: %s\n", len(m.em.Watchpoints()), m.formatWatchpoint(w))
+    return nil
+}
+
+func (m *monitor) cmdUnwatch(args []string) error {
+    if len(args) != 1 {
+        return fmt.Errorf("usage: unwatch N")
+    }
+    ws := m.em.Watchpoints()
+    n, err := strconv.Atoi(args[0])
+    if err != nil || n < 1 || n > len(ws) {
+        return fmt.Errorf("no watchpoint %s", args[0])
+    }
+    m.em.RemoveWatchpoint(ws[n-1])
+    return nil
+}
+
+func (m *monitor) formatWatchpoint(w emulator.Watchpoint) string {
+    var kind string
+    for name, k := range watchKindNames {
+        if k == w.Kind {
+            kind = name
+        }
+    }
+    s := fmt.Sprintf("%s of 0x%04x", kind, w.Addr)
+    if w.Size > 1 {
+        s += fmt.Sprintf("-0x%04x", w.Addr+w.Size-1)
+    }
+    if name := m.dis.DataName(w.Addr); name != "" {
+        s += " (" + name + ")"
+    }
+    if w.Conditional {
+        s += fmt.Sprintf(" with value 0x%02x", w.Value)
+    }
+    return s
+}
+
+func (m *monitor) cmdInfo(args []string) error {
+    for _, pc := range m.em.Breakpoints() {
+        fmt.Fprintf(m.out, "breakpoint at %s\n", m.formatProgAddr(2*pc))
+    }
+    for i, w := range m.em.Watchpoints() {
+        fmt.Fprintf(m.out, "watchpoint %d: %s\n", i+1, m.formatWatchpoint(w))
+    }
+    return nil
+}
+
+func (m *monitor) cmdIO(args []string) error {
+    var names []string
+    if len(args) > 0 {
+        for _, arg := range args {
+            if _, ok := m.em.Spec.Ports[arg]; !ok {
+                return fmt.Errorf("unknown I/O register %s", arg)
+            }
+        }
+        names = args
+    } else {
+        for name := range m.em.Spec.Ports {
+            names = append(names, name)
+        }
+        sort.Slice(names, func(i, j int) bool {
+            return m.em.PortAddress(m.em.Spec.Ports[names[i]]) < m.em.PortAddress(m.em.Spec.Ports[names[j]])
+        })
+    }
+
+    for _, name := range names {
+        addr := m.em.PortAddress(m.em.Spec.Ports[name])
+        fmt.Fprintf(m.out, "%-8s 0x%04x  %02x\n", name, addr, m.em.PeekData(addr))
+    }
+    return nil
+}
+
+func (m *monitor) cmdSet(args []string) error {
+    if len(args) != 2 {
+        return fmt.Errorf("usage: set LOC VALUE")
+    }
+    loc := strings.ToLower(args[0])
+    if loc == "pc" {
+        addr, err := m.parseProgAddr(args[1])
+        if err != nil {
+            return err
+        }
+        m.em.SetPC(addr / 2)
+        m.showNext()
+        return nil
+    }
+    v, err := parseNumber(args[1])
+    if err != nil {
+        return err
+    }
+
+    switch {
+    case loc == "sp":
+        m.em.SetSP(uint16(v))
+        return nil
+    case loc == "sreg":
+        m.em.SetSREG(uint8(v))
+        return nil
+    case strings.HasPrefix(loc, "r"):
+        if n, err := strconv.ParseUint(loc[1:], 10, 8); err == nil && uint(n) < m.em.Spec.NumRegs {
+            m.em.SetReg(uint(n), uint8(v))
+            return nil
+        }
+    }
+
+    addr, err := m.parseDataAddr(args[0])
+    if err != nil {
+        return err
+    }
+    if v > 0xFF {
+        return fmt.Errorf("value %s does not fit in a byte", args[1])
+    }
+    if !m.em.PokeData(addr, uint8(v)) {
+        // an I/O register that cannot be poked: write it through its port, as
+        // a store would, but without triggering watchpoints
+        ws := m.em.Watchpoints()
+        for _, w := range ws {
+            m.em.RemoveWatchpoint(w)
+        }
+        m.em.StoreData(addr, uint8(v))
+        for _, w := range ws {
+            m.em.AddWatchpoint(w)
+        }
+    }
+    return nil
+}
+
+func (m *monitor) cmdPin(args []string) error {
+    if len(args) < 1 || len(args) > 2 {
+        return fmt.Errorf("usage: pin PIN [high|low|toggle|float]")
+    }
+    name := strings.TrimPrefix(strings.ToUpper(args[0]), "P")
+    a, ok := m.pins[name]
+    if !ok {
+        return fmt.Errorf("no input pin %s", args[0])
+    }
+
+    if len(args) == 2 {
+        switch args[1] {
+        case "high", "1":
+            a.Driven, a.State = true, true
+        case "low", "0":
+            a.Driven, a.State = true, false
+        case "toggle":
+            a.Driven, a.State = true, !a.GetState()
+        case "float":
+            a.Driven = false
+        default:
+            return fmt.Errorf("invalid pin state %q", args[1])
+        }
+    }
+
+    state := "low"
+    if a.GetState() {
+        state = "high"
+    }
+    how := "driven"
+    if !a.Driven {
+        how = "floating"
+        if a.Pullup {
+            how = "pulled up"
+        }
+    }
+    fmt.Fprintf(m.out, "P%s: %s (%s)\n", name, state, how)
+    return nil
+}
+
+func (m *monitor) cmdBacktrace(args []string) error {
+    fmt.Fprintf(m.out, "#0  %s\n", m.formatProgAddr(2*m.em.PC()))
+
+    pcBytes := uint16(2)
+    if m.em.Spec.LogProgMemSize > 16 {
+        pcBytes = 3
+    }
+    prog := m.progWords()
+    ramEnd := uint16(0)
+    for _, r := range m.em.Spec.Regions {
+        if r, ok := r.(spec.RAMRegionSpec); ok {
+            ramEnd = r.Start() + r.Size() - 1
+        }
+    }
+
+    frame := 1
+    for addr := m.em.SP() + 1; addr != 0 && addr+pcBytes-1 <= ramEnd; {
+        // return addresses are stored big-endian
+        ret := uint32(0)
+        for i := uint16(0); i < pcBytes; i++ {
+            ret = ret<<8 | uint32(m.em.PeekData(addr+i))
+        }
+        if m.isReturnAddress(prog, ret) {
+            fmt.Fprintf(m.out, "#%-2d %s (return address at 0x%04x)\n", frame, m.formatProgAddr(2*ret), addr)
+            frame++
+            addr += pcBytes
+        } else {
+            addr++
+        }
+    }
+    return nil
+}
+
+// Returns true if the word address follows a call instruction.
+func (m *monitor) isReturnAddress(prog []uint16, ret uint32) bool {
+    if ret == 0 || ret >= uint32(len(prog)) {
+        return false
+    }
+    switch m.dis.Decode(prog, ret-1).Inst {
+    case avr.RCALL, avr.ICALL, avr.EICALL:
+        return true
+    }
+    return ret >= 2 && m.dis.Decode(prog, ret-2).Inst == avr.CALL
+}
+
+func (m *monitor) cmdReset(args []string) error {
+    m.em.Reset()
+    if m.reset != nil {
+        m.reset()
+    }
+    m.showNext()
+    return nil
+}
+
+func (m *monitor) cmdHistory(args []string) error {
+    for i, line := range m.history {
+        fmt.Fprintf(m.out, "%4d  %s\n", i+1, line)
+    }
+    return nil
+}
+
+func (m *monitor) cmdHelp(args []string) error {
+    fmt.Fprintln(m.out, "Program addresses are byte addresses, as printed by avr-objdump. Addresses")
+    fmt.Fprintln(m.out, "may be given as numbers or as symbols from the ELF file, and data addresses as")
+    fmt.Fprintln(m.out, "I/O register names.")
+    for _, cmd := range monitorCommands {
+        usage := strings.Join(cmd.names, ", ")
+        if cmd.args != "" {
+            usage += " " + cmd.args
+        }
+        fmt.Fprintf(m.out, "  %-38s %s\n", usage, cmd.help)
+    }
+    return nil
+}
+
+func (m *monitor) cmdQuit(args []string) error {
+    m.quit = true
+    return nil
+}
+
+// Parses a program byte address: a number or the name of a symbol in program
+// memory.
+func (m *monitor) parseProgAddr(s string) (addr uint32, err error) {
+    if m.elfFile != nil {
+        if sym, ok := m.elfFile.Lookup(s); ok && sym.Space == elfloader.Flash {
+            return sym.Address, nil
+        }
+    }
+    n, err := parseNumber(s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid program address or unknown symbol %q", s)
+    }
+    if n >= uint64(m.em.Spec.ProgMemSize()) {
+        return 0, fmt.Errorf("address 0x%x is outside program memory", n)
+    }
+    return uint32(n), nil
+}
+
+// Parses a data address: a number, the name of an I/O register or the name of
+// a variable.
+func (m *monitor) parseDataAddr(s string) (addr uint16, err error) {
+    if pref, ok := m.em.Spec.Ports[strings.ToUpper(s)]; ok {
+        return m.em.PortAddress(pref), nil
+    }
+    if m.elfFile != nil {
+        if sym, ok := m.elfFile.Lookup(s); ok && sym.Space == elfloader.Data {
+            return uint16(sym.Address), nil
+        }
+    }
+    n, err := parseNumber(s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid data address or unknown symbol %q", s)
+    }
+    if n >= 1<<m.em.Spec.LogDataSpaceSize {
+        return 0, fmt.Errorf("address 0x%x is outside data memory", n)
+    }
+    return uint16(n), nil
+}
+
+func parseNumber(s string) (n uint64, err error) {
+    n, err = strconv.ParseUint(s, 0, 32)
+    if err != nil {
+        return 0, fmt.Errorf("invalid number %q", s)
+    }
+    return n, nil
+}
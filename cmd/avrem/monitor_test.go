@@ -0,0 +1,98 @@
+package main
+
+import (
+    "bytes"
+    "github.com/kierdavis/avr/asm"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/hardware/gpio"
+    "github.com/kierdavis/avr/hardware/timer"
+    "github.com/kierdavis/avr/spec"
+    "strings"
+    "testing"
+)
+
+const monitorTestProgram = `
+        ldi     r16, 0x04
+        out     SPH, r16
+        ldi     r16, 0xFF
+        out     SPL, r16
+loop:   rcall   store
+        rjmp    loop
+store:  in      r17, PINB
+        sts     0x0100, r17
+        ret
+`
+
+func TestMonitor(t *testing.T) {
+    em := emulator.NewEmulator(spec.ATmega168)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, monitorTestProgram))
+    gpioB := gpio.New('B', 8)
+    gpioB.AddTo(em)
+
+    var out bytes.Buffer
+    m := newMonitor(em, em.Run, nil, map[byte]*gpio.GPIO{'B': gpioB}, &out)
+    for _, line := range []string{
+        "break 0x0c",
+        "c",
+        "bt",
+        "delete 0x0c",
+        "pin B2 high",
+        "watch 0x100 write 4",
+        "c",
+        "s",
+        "",
+        "set r20 0x5a",
+        "x 0x100 1",
+    } {
+        out.Reset()
+        m.execute(line)
+    }
+
+    if em.PC() != 4 || em.Reg(20) != 0x5A {
+        t.Errorf("unexpected state: PC 0x%04X, r20 = 0x%02X", em.PC(), em.Reg(20))
+    }
+    if got := out.String(); !strings.HasPrefix(got, "0100: 04") {
+        t.Errorf("unexpected hexdump %q", got)
+    }
+    if len(m.history) != 11 || m.history[8] != "s" {
+        t.Errorf("unexpected history %q", m.history)
+    }
+}
+
+func TestMonitorBacktrace(t *testing.T) {
+    em := emulator.NewEmulator(spec.ATmega168)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, monitorTestProgram))
+    em.SetBreakpoint(6)
+    em.Run(100)
+
+    var out bytes.Buffer
+    m := newMonitor(em, em.Run, nil, nil, &out)
+    m.execute("bt")
+    expected := "#0  0x000c <PCINT0>\n#1  0x000a <INT1+2> (return address at 0x04fe)\n"
+    if out.String() != expected {
+        t.Errorf("expected backtrace:\n%sgot:\n%s", expected, out.String())
+    }
+}
+
+func TestMonitorResetsPeripherals(t *testing.T) {
+    em := emulator.NewEmulator(spec.ATmega168)
+    gpioB := gpio.New('B', 8)
+    gpioB.AddTo(em)
+    t0 := timer.New(0)
+    t0.AddTo(em)
+
+    var out bytes.Buffer
+    m := newMonitor(em, em.Run, nil, map[byte]*gpio.GPIO{'B': gpioB}, &out)
+    m.reset = resetIO(map[byte]*gpio.GPIO{'B': gpioB}, map[uint]*timer.Timer{0: t0})
+    m.execute("set DDRB 0xff")
+    m.execute("set TCCR0B 0x05")
+    if em.PeekData(0x24) != 0xFF || em.PeekData(0x45) != 0x05 {
+        t.Fatalf("set failed: %s", out.String())
+    }
+    em.SetPC(0x10)
+    m.execute("reset")
+
+    if em.PC() != 0 || em.PeekData(0x24) != 0 || em.PeekData(0x45) != 0 {
+        t.Errorf("after reset: PC 0x%04X, DDRB 0x%02X, TCCR0B 0x%02X", em.PC(), em.PeekData(0x24), em.PeekData(0x45))
+    }
+}
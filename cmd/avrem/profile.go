@@ -0,0 +1,50 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader/elfloader"
+    "log"
+    "os"
+)
+
+var profileFile = flag.String("profile", "", "write a profile of the cycles spent by the emulated program, by function and call stack, to the named file in pprof format (view it with go tool pprof)")
+
+// Starts profiling if -profile was given. Returns a function that writes the
+// profile.
+func setupProfile(em *emulator.Emulator, elfFile *elfloader.File) (stop func()) {
+    if *profileFile == "" {
+        return func() {}
+    }
+
+    f, err := os.Create(*profileFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+        os.Exit(1)
+    }
+
+    p := emulator.NewProfiler(em)
+    p.Symbolizer = elfFile.Symbolizer(em.Spec)
+
+    return func() {
+        p.Stop()
+        err := p.WriteProfile(f)
+        if cerr := f.Close(); err == nil {
+            err = cerr
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "error: writing profile: %s\n", err.Error())
+            os.Exit(1)
+        }
+
+        fns := p.Functions()
+        if len(fns) > 5 {
+            fns = fns[:5]
+        }
+        for _, fn := range fns {
+            log.Printf("[avr/cmd/avrem] profile: %-20s %12d cycles (%d in the function itself), %d calls", fn.Name, fn.CumCycles, fn.FlatCycles, fn.Calls)
+        }
+        log.Printf("[avr/cmd/avrem] wrote profile to %s", *profileFile)
+    }
+}
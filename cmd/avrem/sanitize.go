@@ -0,0 +1,30 @@
+package main
+
+import (
+    "flag"
+    "github.com/kierdavis/avr/emulator"
+    "log"
+    "math/rand"
+)
+
+var sanitize = flag.Bool("sanitize", false, "track which registers and bytes of RAM hold defined values, warning when an undefined value decides a branch, is used as an address or is written to an I/O register")
+var randomRAM = flag.Int64("random-ram", 0, "fill the registers and RAM with random values generated from `SEED` before loading the program, as at power-up (0 to leave them zeroed)")
+
+// Randomises RAM if -random-ram was given and starts the sanitizer if
+// -sanitize was given. Returns a function that reports the number of errors
+// found. It must be called before the program is loaded, so that initial data
+// loaded into RAM counts as defined.
+func setupSanitizer(em *emulator.Emulator) (stop func()) {
+    if *randomRAM != 0 {
+        em.RandomizeRAM(rand.New(rand.NewSource(*randomRAM)))
+    }
+    if !*sanitize {
+        return func() {}
+    }
+
+    s := emulator.NewSanitizer(em)
+    return func() {
+        s.Stop()
+        log.Printf("[avr/cmd/avrem] sanitizer: %d uses of undefined values", s.Errors())
+    }
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "github.com/kierdavis/avr/disasm"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader/elfloader"
+    "log"
+    "os"
+    "strconv"
+)
+
+var stackMonitor = flag.Bool("stack", false, "monitor the stack, warning when it overflows, and report its maximum depth and the stack used by each interrupt handler on exit")
+var stackLimit = flag.String("stack-limit", "", "with -stack, the lowest `ADDRESS` (or data symbol) that the stack may grow down to (defaults to the _end symbol of an ELF file)")
+
+// Starts monitoring the stack if -stack was given. Returns a function that
+// reports the stack usage.
+func setupStack(em *emulator.Emulator, elfFile *elfloader.File) (stop func()) {
+    if !*stackMonitor {
+        return func() {}
+    }
+
+    m := emulator.NewStackMonitor(em)
+    if sym, ok := lookupDataSymbol(elfFile, "__stack"); ok {
+        m.Top = uint16(sym.Address)
+        log.Printf("[avr/cmd/avrem] stack top is 0x%04x (__stack)", m.Top)
+    }
+    limit := *stackLimit
+    if limit == "" && elfFile != nil {
+        if _, ok := elfFile.Lookup("_end"); ok {
+            limit = "_end"
+        }
+    }
+    if limit != "" {
+        if sym, ok := lookupDataSymbol(elfFile, limit); ok {
+            m.Limit = uint16(sym.Address)
+        } else if addr, err := strconv.ParseUint(limit, 0, 16); err == nil {
+            m.Limit = uint16(addr)
+        } else {
+            fmt.Fprintf(os.Stderr, "error: invalid value for -stack-limit (expected an address or data symbol)\n")
+            os.Exit(2)
+        }
+        log.Printf("[avr/cmd/avrem] stack limit is 0x%04x (%s)", m.Limit, limit)
+    }
+
+    sym := elfFile.Symbolizer(em.Spec)
+    return func() {
+        m.Stop()
+        if !m.Started() {
+            log.Printf("[avr/cmd/avrem] stack: not monitored, as SP was never set to 0x%04x", m.Top)
+            return
+        }
+        depth, pc := m.MaxDepth()
+        where := fmt.Sprintf("0x%04x", pc*2)
+        if name, offset, ok := sym(pc * 2); ok {
+            where += fmt.Sprintf(" <%s+%d>", name, offset)
+        }
+        log.Printf("[avr/cmd/avrem] stack: maximum depth %d bytes below 0x%04x, reached at %s", depth, m.Top, where)
+        for _, v := range m.Vectors() {
+            log.Printf("[avr/cmd/avrem] stack: %-20s used at most %d bytes (%d calls)", disasm.VectorName(em.Spec, v.Num), v.MaxUsage, v.Calls)
+        }
+        if overflows, collisions := m.Errors(); overflows != 0 || collisions != 0 {
+            log.Printf("[avr/cmd/avrem] stack: overflowed the limit %d times, and grew out of RAM %d times", overflows, collisions)
+        }
+    }
+}
+
+// Looks up a symbol in data memory.
+func lookupDataSymbol(elfFile *elfloader.File, name string) (sym elfloader.Symbol, ok bool) {
+    if elfFile == nil {
+        return sym, false
+    }
+    sym, ok = elfFile.Lookup(name)
+    return sym, ok && sym.Space == elfloader.Data
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader/elfloader"
+    "io"
+    "log"
+    "os"
+    "strconv"
+    "strings"
+)
+
+var traceFile = flag.String("trace", "", "write a trace of the instructions executed to the named file (- for standard output)")
+var traceFormat = flag.String("trace-format", "text", "format of the trace: text, json (one object per line) or binary")
+var traceRanges = flag.String("trace-range", "", "only trace instructions in the given comma-separated `START-END` ranges of program byte addresses")
+var traceFuncs = flag.String("trace-func", "", "only trace instructions in the given comma-separated functions (requires an ELF file)")
+var traceClasses = flag.String("trace-class", "", "only trace instructions of the given comma-separated classes: arithmetic, branch, transfer, bit, control")
+
+// Starts tracing if -trace was given. Returns a function that stops tracing.
+func setupTrace(em *emulator.Emulator, elfFile *elfloader.File) (stop func()) {
+    if *traceFile == "" {
+        return func() {}
+    }
+
+    format, ok := emulator.ParseTraceFormat(*traceFormat)
+    if !ok {
+        fmt.Fprintf(os.Stderr, "error: invalid value for -trace-format (expected text, json or binary)\n")
+        os.Exit(2)
+    }
+    filter, err := traceFilter(elfFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+        os.Exit(2)
+    }
+
+    var w io.WriteCloser = os.Stdout
+    if *traceFile != "-" {
+        if w, err = os.Create(*traceFile); err != nil {
+            fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+            os.Exit(1)
+        }
+    }
+
+    tracer := emulator.NewTracer(em, w, format)
+    tracer.Disassembler.Symbolizer = elfFile.Symbolizer(em.Spec)
+    tracer.SetFilter(filter)
+    log.Printf("[avr/cmd/avrem] tracing to %s (%s)", *traceFile, format)
+
+    return func() {
+        err := tracer.Stop()
+        if w != os.Stdout {
+            if cerr := w.Close(); err == nil {
+                err = cerr
+            }
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "error: writing trace: %s\n", err.Error())
+            os.Exit(1)
+        }
+    }
+}
+
+// Builds the trace filter from the -trace-range, -trace-func and -trace-class
+// flags.
+func traceFilter(elfFile *elfloader.File) (filter emulator.TraceFilter, err error) {
+    for _, r := range splitList(*traceRanges) {
+        parts := strings.SplitN(r, "-", 2)
+        if len(parts) != 2 {
+            return filter, fmt.Errorf("invalid -trace-range %q (expected START-END)", r)
+        }
+        start, err1 := strconv.ParseUint(parts[0], 0, 32)
+        end, err2 := strconv.ParseUint(parts[1], 0, 32)
+        if err1 != nil || err2 != nil || end <= start {
+            return filter, fmt.Errorf("invalid -trace-range %q (expected START-END)", r)
+        }
+        filter.Ranges = append(filter.Ranges, emulator.PCRange{uint32(start) / 2, uint32(end+1) / 2})
+    }
+
+    for _, name := range splitList(*traceFuncs) {
+        if elfFile == nil {
+            return filter, fmt.Errorf("-trace-func requires an ELF file")
+        }
+        sym, ok := elfFile.Lookup(name)
+        if !ok || sym.Space != elfloader.Flash {
+            return filter, fmt.Errorf("no function %s in the program", name)
+        }
+        size := sym.Size
+        if size == 0 {
+            size = 2
+        }
+        filter.Ranges = append(filter.Ranges, emulator.PCRange{sym.Address / 2, (sym.Address + size + 1) / 2})
+    }
+
+    for _, name := range splitList(*traceClasses) {
+        c, ok := avr.ParseInstClass(name)
+        if !ok {
+            return filter, fmt.Errorf("unknown instruction class %q", name)
+        }
+        filter.Classes = append(filter.Classes, c)
+    }
+    return filter, nil
+}
+
+// Splits a comma-separated list, ignoring empty items.
+func splitList(s string) (items []string) {
+    for _, item := range strings.Split(s, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "github.com/kierdavis/avr/clock"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/hardware/gpio"
+    "github.com/kierdavis/avr/hardware/timer"
+    "github.com/kierdavis/avr/vcd"
+    "log"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+)
+
+var vcdFile = flag.String("vcd", "", "write a Value Change Dump of the signals given by -vcd-signals to the named file")
+var vcdSignals = flag.String("vcd-signals", "", "comma-separated signals to dump: GPIO pins (PORTB5), timer outputs (OC0A), I/O registers (TCNT0), interrupts (TIMER0_OVF, high while in service) and ISR (the vector in service); defaults to all pins and timer outputs, and ISR")
+
+var pinSignalRegexp = regexp.MustCompile(`^P(?:ORT)?([A-Z])([0-7])$`)
+var ocSignalRegexp = regexp.MustCompile(`^OC([0-9])([AB])$`)
+
+// Starts writing a VCD if -vcd was given. Returns a function that finishes it.
+func setupVCD(em *emulator.Emulator, clk *clock.Clock, gpios map[byte]*gpio.GPIO, timers map[uint]*timer.Timer) (stop func()) {
+    if *vcdFile == "" {
+        return func() {}
+    }
+
+    f, err := os.Create(*vcdFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+        os.Exit(1)
+    }
+
+    // VCD times are absolute, so assume a typical clock if none was given
+    freq := *throttleFreq * 1e6
+    if freq == 0 {
+        freq = 16e6
+    }
+    v := vcd.New(f, clk, freq)
+
+    names := splitList(*vcdSignals)
+    if len(names) == 0 {
+        names = defaultVCDSignals(gpios, timers)
+    }
+    for _, name := range names {
+        if err := addVCDSignal(v, em, gpios, timers, name); err != nil {
+            fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+            os.Exit(2)
+        }
+    }
+
+    // record changes at the tick they happen
+    clk.SetStep(1)
+    v.Start()
+    log.Printf("[avr/cmd/avrem] writing VCD to %s (%d signals, %.1f MHz)", *vcdFile, len(names), freq/1e6)
+
+    return func() {
+        err := v.Close()
+        if cerr := f.Close(); err == nil {
+            err = cerr
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "error: writing VCD: %s\n", err.Error())
+            os.Exit(1)
+        }
+    }
+}
+
+// Adds the named signal to the VCD.
+func addVCDSignal(v *vcd.Writer, em *emulator.Emulator, gpios map[byte]*gpio.GPIO, timers map[uint]*timer.Timer, name string) error {
+    if m := pinSignalRegexp.FindStringSubmatch(name); m != nil {
+        g, ok := gpios[m[1][0]]
+        if !ok {
+            return fmt.Errorf("no GPIO port %s is emulated", m[1])
+        }
+        pin, _ := strconv.Atoi(m[2])
+        v.AddPin(name, g, uint(pin))
+        return nil
+    }
+
+    if m := ocSignalRegexp.FindStringSubmatch(name); m != nil {
+        digit, _ := strconv.Atoi(m[1])
+        t, ok := timers[uint(digit)]
+        if !ok {
+            return fmt.Errorf("no timer %d is emulated", digit)
+        }
+        v.AddOCPin(name, t, uint(m[2][0]-'A'))
+        return nil
+    }
+
+    if name == "ISR" {
+        v.AddInterruptInService(em, name)
+        return nil
+    }
+    if v.AddRegister(em, name) || v.AddInterrupt(em, name) {
+        return nil
+    }
+    return fmt.Errorf("unknown VCD signal %s (expected a pin, timer output, I/O register or interrupt)", name)
+}
+
+// Returns the names of every emulated GPIO pin and timer output, and ISR.
+func defaultVCDSignals(gpios map[byte]*gpio.GPIO, timers map[uint]*timer.Timer) (names []string) {
+    var letters []int
+    for letter := range gpios {
+        letters = append(letters, int(letter))
+    }
+    sort.Ints(letters)
+    for _, letter := range letters {
+        for pin := 0; pin < 8; pin++ {
+            names = append(names, fmt.Sprintf("PORT%c%d", letter, pin))
+        }
+    }
+
+    var digits []int
+    for digit := range timers {
+        digits = append(digits, int(digit))
+    }
+    sort.Ints(digits)
+    for _, digit := range digits {
+        names = append(names, fmt.Sprintf("OC%dA", digit), fmt.Sprintf("OC%dB", digit))
+    }
+
+    return append(names, "ISR")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "github.com/kierdavis/avr/emulator"
+    "log"
+    "strings"
+)
+
+var werror = flag.Bool("werror", false, "treat all warnings as errors that stop the program with exit status 1")
+var werrorKinds warningKinds
+var wignore warningKinds
+var wonce = flag.Bool("wonce", false, "report warnings of each kind only once for each instruction address")
+
+func init() {
+    flag.Var(&werrorKinds, "werror-kinds", "treat warnings of the given `KINDS` (a comma-separated list, or all) as errors that stop the program with exit status 1")
+    flag.Var(&wignore, "wignore", "ignore warnings of the given `KINDS` (a comma-separated list, or all)")
+}
+
+// A flag.Value selecting kinds of warning by name.
+type warningKinds struct {
+    kinds []emulator.WarningKind
+}
+
+func (l *warningKinds) String() string {
+    names := make([]string, len(l.kinds))
+    for i, k := range l.kinds {
+        names[i] = k.String()
+    }
+    return strings.Join(names, ",")
+}
+
+func (l *warningKinds) Set(value string) error {
+    if value == "all" {
+        l.kinds = allWarningKinds()
+        return nil
+    }
+
+    for _, name := range splitList(value) {
+        k, ok := emulator.WarningKindByName(name)
+        if !ok {
+            var names []string
+            for _, k := range allWarningKinds() {
+                names = append(names, k.String())
+            }
+            return fmt.Errorf("unknown kind of warning %q (expected all or one of %s)", name, strings.Join(names, ", "))
+        }
+        l.kinds = append(l.kinds, k)
+    }
+    return nil
+}
+
+// Returns every kind of warning.
+func allWarningKinds() (kinds []emulator.WarningKind) {
+    for k := emulator.WarningKind(0); k < emulator.NumWarningKinds; k++ {
+        kinds = append(kinds, k)
+    }
+    return kinds
+}
+
+// Sets the actions taken on warnings as given by -wonce, -werror, -werror-kinds
+// and -wignore. As with gcc's -Werror and -Wno-..., -wignore takes precedence,
+// so that -werror -wignore=KINDS stops on every kind of warning but those.
+// Returns a function that logs the number of warnings of each kind issued.
+func setupWarnings(em *emulator.Emulator) (stop func()) {
+    if *wonce {
+        for k := emulator.WarningKind(0); k < emulator.NumWarningKinds; k++ {
+            em.SetWarningAction(k, emulator.WarningReportOnce)
+        }
+    }
+    errorKinds := werrorKinds.kinds
+    if *werror {
+        errorKinds = allWarningKinds()
+    }
+    for _, k := range errorKinds {
+        em.SetWarningAction(k, emulator.WarningStop)
+    }
+    for _, k := range wignore.kinds {
+        em.SetWarningAction(k, emulator.WarningIgnore)
+    }
+
+    return func() {
+        var counts []string
+        for k := emulator.WarningKind(0); k < emulator.NumWarningKinds; k++ {
+            if n := em.WarningCount(k); n != 0 {
+                counts = append(counts, fmt.Sprintf("%d %s", n, k))
+            }
+        }
+        if counts != nil {
+            log.Printf("[avr/cmd/avrem] warnings: %s", strings.Join(counts, ", "))
+        }
+    }
+}
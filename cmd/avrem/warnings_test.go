@@ -0,0 +1,25 @@
+package main
+
+import (
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+func TestWarningFlagPrecedence(t *testing.T) {
+    *werror = true
+    wignore.Set("unmapped-port")
+    defer func() {
+        *werror = false
+        wignore.kinds = nil
+    }()
+
+    em := emulator.NewEmulator(spec.ATmega168)
+    setupWarnings(em)
+    if a := em.WarningAction(emulator.UnmappedPort); a != emulator.WarningIgnore {
+        t.Errorf("-werror -wignore=unmapped-port: expected unmapped-port to be ignored, got action %d", a)
+    }
+    if a := em.WarningAction(emulator.InvalidInstruction); a != emulator.WarningStop {
+        t.Errorf("-werror -wignore=unmapped-port: expected invalid-instruction to stop, got action %d", a)
+    }
+}
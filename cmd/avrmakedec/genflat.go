@@ -1,5 +1,9 @@
 package main
 
+import (
+    "github.com/kierdavis/avr"
+)
+
 func (g *Generator) GenerateFlat() {
     g.GenerateFlatFunc("DecodeNonRC", false)
     g.GenerateFlatFunc("DecodeRC", true)
@@ -8,13 +12,13 @@ func (g *Generator) GenerateFlat() {
 func (g *Generator) GenerateFlatFunc(name string, rc bool) {
     g.Printf("func %s(word uint16) avr.Instruction {\n", name)
     g.Printf("  switch {\n")
-    for _, instDef := range InstDefs {
+    for _, instDef := range avr.InstDefs {
         if rc {
-            if instDef.RCMode == NotRC {
+            if instDef.RCMode == avr.NotRC {
                 continue
             }
         } else {
-            if instDef.RCMode == RC {
+            if instDef.RCMode == avr.RC {
                 continue
             }
         }
@@ -1,5 +1,9 @@
 package main
 
+import (
+    "github.com/kierdavis/avr"
+)
+
 func (g *Generator) GenerateLutc() {
     g.GenerateLutcFunc("DecodeNonRC", "decodeLutNonRC", false)
     g.GenerateLutcFunc("DecodeRC", "decodeLutRC", true)
@@ -11,7 +15,7 @@ func (g *Generator) GenerateLutcFunc(funcName string, lutName string, rc bool) {
     g.Printf("}\n")
     g.Printf("var %s = [65536]avr.Instruction{\n", lutName)
     for i := 0; i < 65536; i++ {
-        g.Printf("  avr.%s,\n", Decode(uint16(i), rc))
+        g.Printf("  avr.%s,\n", avr.Decode(uint16(i), rc))
     }
     g.Printf("}\n")
 }
@@ -0,0 +1,524 @@
+// Package debuginfo reads the DWARF debugging information in ELF files
+// produced by avr-gcc. It maps program addresses to source lines and
+// functions, and locates global and local variables in the state of a running
+// program.
+//
+// Program addresses accepted and returned by this package are word addresses,
+// as used by the emulator's program counter. (DWARF itself uses byte
+// addresses, and places data memory and EEPROM at 0x800000 and 0x810000
+// respectively, following the avr-gcc conventions implemented by
+// elfloader.SplitAddress.)
+package debuginfo
+
+import (
+    "debug/dwarf"
+    "debug/elf"
+    "errors"
+    "fmt"
+    "io"
+    "path"
+    "sort"
+)
+
+// Info holds the debugging information from an ELF file.
+type Info struct {
+    data      *dwarf.Data
+    debugInfo []byte      // contents of .debug_info, for reading unit headers
+    lines     []lineRow   // sorted by address
+    funcs     []*Function // sorted by LowPC
+    globals   []*Variable
+    debugLoc  []byte // contents of .debug_loc (DWARF 2 to 4)
+    debugLocs []byte // contents of .debug_loclists (DWARF 5)
+}
+
+// A Line is a position in a source file.
+type Line struct {
+    File string
+    Line int
+}
+
+func (l Line) String() string {
+    return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// A row of the line number table.
+type lineRow struct {
+    addr   uint32 // byte address
+    line   Line
+    isStmt bool
+    end    bool // marks the first address after a sequence
+}
+
+// A Function is a function defined by the program.
+type Function struct {
+    Name     string
+    LowPC    uint32      // word address of the first instruction
+    HighPC   uint32      // word address after the last instruction
+    Ranges   [][2]uint32 // word address ranges occupied by the function
+    Decl     Line        // where the function is declared
+    Params   []*Variable
+    Locals   []*Variable // including those declared in nested blocks
+    External bool        // whether the function has external linkage
+
+    frameBase location
+    unit      *unit
+}
+
+// Contains returns true if the word address pc is within the function.
+func (fn *Function) Contains(pc uint32) bool {
+    for _, r := range fn.Ranges {
+        if r[0] <= pc && pc < r[1] {
+            return true
+        }
+    }
+    return false
+}
+
+// A Variable is a global variable, a local variable or a function parameter.
+type Variable struct {
+    Name string
+    Type dwarf.Type
+    Decl Line
+
+    loc  location
+    unit *unit
+}
+
+// Information about the compilation unit an entry belongs to.
+type unit struct {
+    version  int
+    addrSize int
+    lowPC    uint64 // base address for location lists
+    files    []*dwarf.LineFile
+}
+
+// New reads the debugging information from f. It returns an error if f has no
+// DWARF sections.
+func New(f *elf.File) (info *Info, err error) {
+    data, err := f.DWARF()
+    if err != nil {
+        return nil, err
+    }
+
+    info = &Info{data: data}
+    if sec := f.Section(".debug_info"); sec != nil {
+        if info.debugInfo, err = sec.Data(); err != nil {
+            return nil, err
+        }
+    }
+    if sec := f.Section(".debug_loc"); sec != nil {
+        if info.debugLoc, err = sec.Data(); err != nil {
+            return nil, err
+        }
+    }
+    if sec := f.Section(".debug_loclists"); sec != nil {
+        if info.debugLocs, err = sec.Data(); err != nil {
+            return nil, err
+        }
+    }
+
+    if err = info.readUnits(); err != nil {
+        return nil, err
+    }
+
+    sort.SliceStable(info.lines, func(i, j int) bool {
+        a, b := info.lines[i], info.lines[j]
+        if a.addr != b.addr {
+            return a.addr < b.addr
+        }
+        // a sequence may begin where another ends
+        return a.end && !b.end
+    })
+    sort.Slice(info.funcs, func(i, j int) bool {
+        return info.funcs[i].LowPC < info.funcs[j].LowPC
+    })
+    return info, nil
+}
+
+// Reads all compilation units.
+func (info *Info) readUnits() (err error) {
+    r := info.data.Reader()
+    for {
+        e, err := r.Next()
+        if err != nil {
+            return err
+        }
+        if e == nil {
+            return nil
+        }
+        if e.Tag != dwarf.TagCompileUnit {
+            r.SkipChildren()
+            continue
+        }
+
+        u := &unit{
+            version:  unitVersion(info.debugInfo, e.Offset),
+            addrSize: r.AddressSize(),
+        }
+        if lowPC, ok := e.Val(dwarf.AttrLowpc).(uint64); ok {
+            u.lowPC = lowPC
+        }
+        if err = info.readLines(e, u); err != nil {
+            return err
+        }
+        if e.Children {
+            if err = info.readChildren(r, u, nil); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// Reads the line number table of a compilation unit.
+func (info *Info) readLines(cu *dwarf.Entry, u *unit) (err error) {
+    lr, err := info.data.LineReader(cu)
+    if err != nil {
+        return err
+    }
+    if lr == nil {
+        return nil
+    }
+    u.files = lr.Files()
+
+    var le dwarf.LineEntry
+    for {
+        err = lr.Next(&le)
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return err
+        }
+
+        var file string
+        if le.File != nil {
+            file = le.File.Name
+        }
+        info.lines = append(info.lines, lineRow{
+            addr:   uint32(le.Address),
+            line:   Line{file, le.Line},
+            isStmt: le.IsStmt,
+            end:    le.EndSequence,
+        })
+    }
+}
+
+// Reads the children of an entry, up to and including the null entry that
+// terminates them. fn is the enclosing function, if any.
+func (info *Info) readChildren(r *dwarf.Reader, u *unit, fn *Function) (err error) {
+    for {
+        e, err := r.Next()
+        if err != nil {
+            return err
+        }
+        if e == nil || e.Tag == 0 {
+            return nil
+        }
+
+        switch e.Tag {
+        case dwarf.TagSubprogram:
+            child, err := info.readFunction(e, u)
+            if err != nil {
+                return err
+            }
+            if child == nil {
+                break
+            }
+            if e.Children {
+                if err = info.readChildren(r, u, child); err != nil {
+                    return err
+                }
+            }
+            info.funcs = append(info.funcs, child)
+            continue
+
+        case dwarf.TagVariable, dwarf.TagFormalParameter:
+            v, err := info.readVariable(e, u)
+            if err != nil {
+                return err
+            }
+            if v != nil {
+                switch {
+                case fn == nil:
+                    info.globals = append(info.globals, v)
+                case e.Tag == dwarf.TagFormalParameter:
+                    fn.Params = append(fn.Params, v)
+                default:
+                    fn.Locals = append(fn.Locals, v)
+                }
+            }
+
+        case dwarf.TagLexDwarfBlock:
+            // variables in nested blocks are treated as belonging to the
+            // function; their location lists describe where they are live
+            if e.Children {
+                if err = info.readChildren(r, u, fn); err != nil {
+                    return err
+                }
+            }
+            continue
+        }
+
+        if e.Children {
+            r.SkipChildren()
+        }
+    }
+}
+
+// Returns the value of an attribute of an entry, following DW_AT_abstract_origin
+// and DW_AT_specification references if the entry does not have it.
+func (info *Info) attr(e *dwarf.Entry, a dwarf.Attr) interface{} {
+    for depth := 0; e != nil && depth < 4; depth++ {
+        if v := e.Val(a); v != nil {
+            return v
+        }
+        off, ok := e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+        if !ok {
+            off, ok = e.Val(dwarf.AttrSpecification).(dwarf.Offset)
+        }
+        if !ok {
+            return nil
+        }
+        r := info.data.Reader()
+        r.Seek(off)
+        e, _ = r.Next()
+    }
+    return nil
+}
+
+// Returns the declaration position of an entry.
+func (info *Info) decl(e *dwarf.Entry, u *unit) (l Line) {
+    if i, ok := info.attr(e, dwarf.AttrDeclFile).(int64); ok && i >= 0 && int(i) < len(u.files) && u.files[i] != nil {
+        l.File = u.files[i].Name
+    }
+    if line, ok := info.attr(e, dwarf.AttrDeclLine).(int64); ok {
+        l.Line = int(line)
+    }
+    return l
+}
+
+// Reads a subprogram entry. Returns nil if the entry does not describe code
+// (such as a declaration).
+func (info *Info) readFunction(e *dwarf.Entry, u *unit) (fn *Function, err error) {
+    ranges, err := info.data.Ranges(e)
+    if err != nil {
+        return nil, err
+    }
+    if len(ranges) == 0 {
+        return nil, nil
+    }
+
+    name, _ := info.attr(e, dwarf.AttrName).(string)
+    external, _ := info.attr(e, dwarf.AttrExternal).(bool)
+    fn = &Function{
+        Name:     name,
+        LowPC:    uint32(ranges[0][0] / 2),
+        HighPC:   uint32(ranges[0][1] / 2),
+        Decl:     info.decl(e, u),
+        External: external,
+        unit:     u,
+    }
+    for _, r := range ranges {
+        fn.Ranges = append(fn.Ranges, [2]uint32{uint32(r[0] / 2), uint32(r[1] / 2)})
+        if uint32(r[0]/2) < fn.LowPC {
+            fn.LowPC = uint32(r[0] / 2)
+        }
+        if uint32(r[1]/2) > fn.HighPC {
+            fn.HighPC = uint32(r[1] / 2)
+        }
+    }
+
+    fn.frameBase = info.readLocation(e, dwarf.AttrFrameBase, u)
+    return fn, nil
+}
+
+// Reads a variable or parameter entry. Returns nil if the entry is only a
+// declaration.
+func (info *Info) readVariable(e *dwarf.Entry, u *unit) (v *Variable, err error) {
+    if decl, _ := e.Val(dwarf.AttrDeclaration).(bool); decl {
+        return nil, nil
+    }
+
+    name, _ := info.attr(e, dwarf.AttrName).(string)
+    v = &Variable{
+        Name: name,
+        Decl: info.decl(e, u),
+        unit: u,
+    }
+    if off, ok := info.attr(e, dwarf.AttrType).(dwarf.Offset); ok {
+        if v.Type, err = info.data.Type(off); err != nil {
+            return nil, err
+        }
+    }
+    v.loc = info.readLocation(e, dwarf.AttrLocation, u)
+    if v.loc.expr == nil && v.loc.list == nil {
+        if cv := e.Val(dwarf.AttrConstValue); cv != nil {
+            v.loc.constValue = cv
+        }
+    }
+    return v, nil
+}
+
+// LineAt returns the source line containing the instruction at the word
+// address pc.
+func (info *Info) LineAt(pc uint32) (l Line, ok bool) {
+    addr := pc * 2
+    i := sort.Search(len(info.lines), func(i int) bool {
+        return info.lines[i].addr > addr
+    })
+    if i == 0 || info.lines[i-1].end {
+        return Line{}, false
+    }
+    return info.lines[i-1].line, true
+}
+
+// PCsForLine returns the word addresses of the instructions at which the given
+// source line begins, suitable for setting breakpoints on. file may be a full
+// path or a base name.
+func (info *Info) PCsForLine(file string, line int) (pcs []uint32) {
+    seen := make(map[uint32]bool)
+    for i, row := range info.lines {
+        if row.end || !row.isStmt || row.line.Line != line || !sameFile(row.line.File, file) {
+            continue
+        }
+        // only the first of consecutive rows for the line
+        if i > 0 && !info.lines[i-1].end && info.lines[i-1].line == row.line {
+            continue
+        }
+        pc := row.addr / 2
+        if !seen[pc] {
+            seen[pc] = true
+            pcs = append(pcs, pc)
+        }
+    }
+    return pcs
+}
+
+// Reports whether the file name a from the line table matches the name b
+// given by a user.
+func sameFile(a, b string) bool {
+    return a == b || path.Base(a) == b || path.Clean(a) == path.Clean(b)
+}
+
+// Functions returns all functions defined by the program, sorted by address.
+func (info *Info) Functions() []*Function {
+    return info.funcs
+}
+
+// FunctionAt returns the function containing the word address pc.
+func (info *Info) FunctionAt(pc uint32) (fn *Function, ok bool) {
+    // index of the first function starting after pc
+    i := sort.Search(len(info.funcs), func(i int) bool {
+        return info.funcs[i].LowPC > pc
+    })
+    for i--; i >= 0; i-- {
+        if info.funcs[i].Contains(pc) {
+            return info.funcs[i], true
+        }
+    }
+    return nil, false
+}
+
+// LookupFunction returns the function with the given name.
+func (info *Info) LookupFunction(name string) (fn *Function, ok bool) {
+    for _, fn = range info.funcs {
+        if fn.Name == name {
+            return fn, true
+        }
+    }
+    return nil, false
+}
+
+// Globals returns the global and file-scope static variables of the program.
+func (info *Info) Globals() []*Variable {
+    return info.globals
+}
+
+// LookupGlobal returns the global variable with the given name.
+func (info *Info) LookupGlobal(name string) (v *Variable, ok bool) {
+    for _, v = range info.globals {
+        if v.Name == name {
+            return v, true
+        }
+    }
+    return nil, false
+}
+
+// Locate returns the location of a variable when the program counter is at
+// the word address pc. fn must be the function containing pc if v is a local
+// variable or parameter, and may be nil for globals.
+func (info *Info) Locate(t Target, v *Variable, fn *Function, pc uint32) (pieces []Piece, err error) {
+    if v.loc.constValue != nil {
+        return []Piece{{Kind: IsValue, Value: constBytes(v.loc.constValue)}}, nil
+    }
+
+    expr, err := info.exprAt(v.loc, v.unit, pc)
+    if err != nil {
+        return nil, err
+    }
+
+    ctx := &evalContext{target: t, addrSize: v.unit.addrSize}
+    if fn != nil {
+        ctx.frameBase = func() (uint64, error) {
+            expr, err := info.exprAt(fn.frameBase, fn.unit, pc)
+            if err != nil {
+                return 0, err
+            }
+            pieces, err := evalLocation(expr, &evalContext{target: t, addrSize: fn.unit.addrSize})
+            if err != nil {
+                return 0, err
+            }
+            // the frame base is usually given as a register holding the
+            // address of the frame, rather than as a memory location
+            switch p := pieces[0]; p.Kind {
+            case InRegister:
+                return readDwarfReg(t, uint64(p.Reg))
+            case InMemory:
+                return uint64(p.Address), nil
+            }
+            return 0, errors.New("debuginfo: unsupported frame base")
+        }
+    }
+    return evalLocation(expr, ctx)
+}
+
+// Read returns the bytes of a variable when the program counter is at the
+// word address pc. See Locate for the meaning of fn.
+func (info *Info) Read(t Target, v *Variable, fn *Function, pc uint32) (data []byte, err error) {
+    if v.Type == nil {
+        return nil, fmt.Errorf("debuginfo: variable %s has no type", v.Name)
+    }
+    pieces, err := info.Locate(t, v, fn, pc)
+    if err != nil {
+        return nil, err
+    }
+    size := v.Type.Size()
+    if size < 0 {
+        return nil, fmt.Errorf("debuginfo: variable %s has unknown size", v.Name)
+    }
+    return readPieces(t, pieces, uint(size))
+}
+
+// Format reads a variable and formats its value for display. See Locate for
+// the meaning of fn.
+func (info *Info) Format(t Target, v *Variable, fn *Function, pc uint32) (s string, err error) {
+    data, err := info.Read(t, v, fn, pc)
+    if err != nil {
+        return "", err
+    }
+    return FormatValue(v.Type, data), nil
+}
+
+// Returns the little-endian representation of a DW_AT_const_value.
+func constBytes(cv interface{}) []byte {
+    switch x := cv.(type) {
+    case int64:
+        buf := make([]byte, 8)
+        for i := range buf {
+            buf[i] = uint8(x >> (8 * uint(i)))
+        }
+        return buf
+    case []byte:
+        return x
+    }
+    return nil
+}
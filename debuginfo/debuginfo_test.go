@@ -0,0 +1,291 @@
+package debuginfo
+
+import (
+    "bytes"
+    "debug/dwarf"
+    "github.com/kierdavis/avr/asm"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader/elfloader"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+var _ Target = (*emulator.Emulator)(nil)
+
+// A Target with fixed contents.
+type testTarget struct {
+    regs   [32]uint8
+    sp     uint16
+    data   [0x900]uint8
+    prog   [0x100]uint8
+    eeprom [0x100]uint8
+}
+
+func (t *testTarget) Reg(n uint) uint8             { return t.regs[n] }
+func (t *testTarget) SP() uint16                   { return t.sp }
+func (t *testTarget) PeekData(addr uint16) uint8   { return t.data[addr] }
+func (t *testTarget) ProgByte(addr uint32) uint8   { return t.prog[addr] }
+func (t *testTarget) EEPROMByte(addr uint16) uint8 { return t.eeprom[addr] }
+
+func newTestTarget() *testTarget {
+    t := &testTarget{sp: 0x04F0}
+    t.regs[24], t.regs[25] = 0x34, 0x12
+    t.regs[28], t.regs[29] = 0xE0, 0x04 // Y = 0x04E0
+    t.data[0x0100], t.data[0x0101] = 0xCD, 0xAB
+    t.data[0x04E3], t.data[0x04E4] = 0x78, 0x56
+    t.data[0x04F3] = 0x99
+    t.prog[0x0068] = 0x42
+    t.eeprom[0x0010] = 0x17
+    return t
+}
+
+var evalTests = []struct {
+    name string
+    expr []byte
+    size uint
+    want []byte
+}{
+    {"global in RAM", []byte{opAddr, 0x00, 0x01, 0x80, 0x00}, 2, []byte{0xCD, 0xAB}},
+    {"constant in flash", []byte{opAddr, 0x68, 0x00, 0x00, 0x00}, 1, []byte{0x42}},
+    {"EEPROM variable", []byte{opAddr, 0x10, 0x00, 0x81, 0x00}, 1, []byte{0x17}},
+    {"register pair", []byte{opReg0 + 24}, 2, []byte{0x34, 0x12}},
+    {"Y-relative local", []byte{opBreg0 + 28, 3}, 2, []byte{0x78, 0x56}},
+    {"SP-relative local", []byte{opBregx, regSP, 3}, 1, []byte{0x99}},
+    {"frame base", []byte{opFbreg, 3}, 2, []byte{0x78, 0x56}},
+    {"pieces", []byte{opReg0 + 25, opPiece, 1, opAddr, 0x01, 0x01, 0x80, 0x00, opPiece, 1}, 2, []byte{0x12, 0xAB}},
+    {"stack value", []byte{opLit0 + 7, opPlusUconst, 3, opStackValue}, 2, []byte{10, 0}},
+    {"implicit value", []byte{opImplicitValue, 2, 0xEF, 0xBE}, 2, []byte{0xEF, 0xBE}},
+    {"signed constant", []byte{opConst1s, 0xFF, opLit0 + 2, opPlus, opStackValue}, 1, []byte{1}},
+}
+
+func TestEvalLocation(t *testing.T) {
+    target := newTestTarget()
+    ctx := &evalContext{
+        target:   target,
+        addrSize: 4,
+        frameBase: func() (uint64, error) {
+            return readDwarfReg(target, 28)
+        },
+    }
+
+    for _, test := range evalTests {
+        pieces, err := evalLocation(test.expr, ctx)
+        if err != nil {
+            t.Errorf("%s: %s", test.name, err)
+            continue
+        }
+        data, err := readPieces(target, pieces, test.size)
+        if err != nil {
+            t.Errorf("%s: %s", test.name, err)
+            continue
+        }
+        if string(data) != string(test.want) {
+            t.Errorf("%s: expected % x, got % x", test.name, test.want, data)
+        }
+    }
+
+    if _, err := evalLocation(nil, ctx); err != ErrOptimizedOut {
+        t.Errorf("empty expression: expected ErrOptimizedOut, got %v", err)
+    }
+}
+
+func TestEvalLocationSpace(t *testing.T) {
+    pieces, err := evalLocation([]byte{opAddr, 0x04, 0x00, 0x81, 0x00}, &evalContext{addrSize: 4})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(pieces) != 1 || pieces[0].Kind != InMemory || pieces[0].Space != elfloader.EEPROM || pieces[0].Address != 4 {
+        t.Errorf("expected EEPROM address 4, got %+v", pieces)
+    }
+}
+
+func TestReadLoc(t *testing.T) {
+    u := &unit{version: 4, addrSize: 4, lowPC: 0x100}
+    sec := []byte{
+        0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x01, 0x00, opReg0 + 24, // [0x100, 0x108): r24
+        0xff, 0xff, 0xff, 0xff, 0x00, 0x02, 0x00, 0x00, // base address 0x200
+        0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x02, 0x00, opBreg0 + 28, 1, // [0x200, 0x204): Y+1
+        0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // end of list
+    }
+    list, err := readLoc(sec, 0, u)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(list) != 2 || list[0].low != 0x100 || list[0].high != 0x108 || list[1].low != 0x200 || list[1].high != 0x204 {
+        t.Fatalf("unexpected location list %+v", list)
+    }
+
+    info := &Info{}
+    loc := location{list: list}
+    if expr, err := info.exprAt(loc, u, 0x101); err != nil || expr[0] != opBreg0+28 {
+        t.Errorf("exprAt(0x101): got % x, %v", expr, err)
+    }
+    if _, err := info.exprAt(loc, u, 0x90); err != ErrOptimizedOut {
+        t.Errorf("exprAt(0x90): expected ErrOptimizedOut, got %v", err)
+    }
+
+    // the same list in DWARF 5 form
+    sec5 := []byte{
+        lleOffsetPair, 0x00, 0x08, 0x01, opReg0 + 24,
+        lleBaseAddress, 0x00, 0x02, 0x00, 0x00,
+        lleOffsetPair, 0x00, 0x04, 0x02, opBreg0 + 28, 1,
+        lleEndOfList,
+    }
+    list5, err := readLocLists(sec5, 0, u)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(list5) != 2 || list5[0].low != 0x100 || list5[0].high != 0x108 || list5[1].low != 0x200 || list5[1].high != 0x204 {
+        t.Errorf("unexpected DWARF 5 location list %+v", list5)
+    }
+}
+
+func TestLineAt(t *testing.T) {
+    info := &Info{lines: []lineRow{
+        {addr: 0x00, line: Line{"main.c", 3}, isStmt: true},
+        {addr: 0x04, line: Line{"main.c", 4}, isStmt: true},
+        {addr: 0x08, line: Line{"main.c", 4}, isStmt: false},
+        {addr: 0x0C, end: true},
+        {addr: 0x20, line: Line{"src/util.c", 10}, isStmt: true},
+        {addr: 0x24, end: true},
+    }}
+
+    lineTests := []struct {
+        pc   uint32
+        line Line
+        ok   bool
+    }{
+        {0x00, Line{"main.c", 3}, true},
+        {0x03, Line{"main.c", 4}, true},
+        {0x05, Line{"main.c", 4}, true},
+        {0x06, Line{}, false},
+        {0x10, Line{"src/util.c", 10}, true},
+        {0x12, Line{}, false},
+    }
+    for _, test := range lineTests {
+        line, ok := info.LineAt(test.pc)
+        if line != test.line || ok != test.ok {
+            t.Errorf("LineAt(0x%04X): expected %s, %t; got %s, %t", test.pc, test.line, test.ok, line, ok)
+        }
+    }
+
+    if pcs := info.PCsForLine("main.c", 4); len(pcs) != 1 || pcs[0] != 0x02 {
+        t.Errorf("PCsForLine(main.c, 4): expected [0x02], got %v", pcs)
+    }
+    if pcs := info.PCsForLine("util.c", 10); len(pcs) != 1 || pcs[0] != 0x10 {
+        t.Errorf("PCsForLine(util.c, 10): expected [0x10], got %v", pcs)
+    }
+}
+
+func TestFormatValue(t *testing.T) {
+    u8 := &dwarf.UintType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 1, Name: "uint8_t"}}}
+    i16 := &dwarf.IntType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 2, Name: "int"}}}
+    char := &dwarf.CharType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 1, Name: "char"}}}
+    ptr := &dwarf.PtrType{CommonType: dwarf.CommonType{ByteSize: 2}, Type: u8}
+    enum := &dwarf.EnumType{CommonType: dwarf.CommonType{ByteSize: 1}, Val: []*dwarf.EnumValue{{"IDLE", 0}, {"BUSY", 1}}}
+    str := &dwarf.ArrayType{CommonType: dwarf.CommonType{ByteSize: 4}, Type: char, Count: 4}
+    arr := &dwarf.ArrayType{CommonType: dwarf.CommonType{ByteSize: 4}, Type: i16, Count: 2}
+    st := &dwarf.StructType{CommonType: dwarf.CommonType{ByteSize: 3}, Kind: "struct", Field: []*dwarf.StructField{
+        {Name: "state", Type: enum, ByteOffset: 0},
+        {Name: "count", Type: i16, ByteOffset: 1},
+    }}
+
+    formatTests := []struct {
+        typ  dwarf.Type
+        data []byte
+        want string
+    }{
+        {u8, []byte{200}, "200"},
+        {i16, []byte{0xFE, 0xFF}, "-2"},
+        {char, []byte{'A'}, "65 'A'"},
+        {ptr, []byte{0x00, 0x01}, "0x0100"},
+        {enum, []byte{1}, "BUSY"},
+        {enum, []byte{7}, "7"},
+        {str, []byte{'h', 'i', 0, 'x'}, `"hi"`},
+        {arr, []byte{1, 0, 2, 0}, "{1, 2}"},
+        {st, []byte{0, 0x10, 0x00}, "{state = IDLE, count = 16}"},
+    }
+    for _, test := range formatTests {
+        if got := FormatValue(test.typ, test.data); got != test.want {
+            t.Errorf("FormatValue(%s, % x): expected %s, got %s", test.typ, test.data, test.want, got)
+        }
+    }
+}
+
+func TestWriteLCOV(t *testing.T) {
+    em := emulator.NewEmulator(spec.ATmega168)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, `
+main:   ldi     r16, 3
+loop:   subi    r16, 1
+        brne    loop
+        rcall   f
+done:   rjmp    done
+f:      sbrc    r16, 0
+        ret
+        ret
+`))
+    em.SetSP(0x04FF)
+    cov := emulator.NewCoverage(em)
+    em.Run(30)
+
+    info := &Info{
+        lines: []lineRow{
+            {addr: 0x00, line: Line{"main.c", 3}, isStmt: true},
+            {addr: 0x02, line: Line{"main.c", 4}, isStmt: true},
+            {addr: 0x06, line: Line{"main.c", 5}, isStmt: true},
+            {addr: 0x08, line: Line{"main.c", 6}, isStmt: true},
+            {addr: 0x0A, end: true},
+            {addr: 0x0A, line: Line{"src/util.c", 10}, isStmt: true},
+            {addr: 0x0E, line: Line{"src/util.c", 11}, isStmt: true},
+            {addr: 0x10, end: true},
+        },
+        funcs: []*Function{
+            {Name: "main", LowPC: 0, HighPC: 5, Decl: Line{"main.c", 2}},
+            {Name: "f", LowPC: 5, HighPC: 8, Decl: Line{"src/util.c", 9}},
+            {Name: "g", LowPC: 8, HighPC: 10, Decl: Line{"src/util.c", 20}},
+        },
+    }
+
+    var buf bytes.Buffer
+    if err := info.WriteLCOV(&buf, cov, "test"); err != nil {
+        t.Fatal(err)
+    }
+    expected := `TN:test
+SF:main.c
+FN:2,main
+FNDA:1,main
+FNF:1
+FNH:1
+BRDA:4,0,0,2
+BRDA:4,0,1,1
+BRF:2
+BRH:2
+DA:3,1
+DA:4,3
+DA:5,1
+DA:6,6
+LF:4
+LH:4
+end_of_record
+TN:test
+SF:src/util.c
+FN:9,f
+FN:20,g
+FNDA:1,f
+FNDA:0,g
+FNF:2
+FNH:1
+BRDA:10,0,0,1
+BRDA:10,0,1,0
+BRF:2
+BRH:1
+DA:10,1
+DA:11,1
+LF:2
+LH:2
+end_of_record
+`
+    if buf.String() != expected {
+        t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+    }
+}
@@ -0,0 +1,178 @@
+package debuginfo
+
+import (
+    "debug/dwarf"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// FormatValue formats the bytes of a value of the given type in a C-like
+// notation. Integers are printed in decimal, pointers in hexadecimal, and
+// arrays and structures in braces. Values are little-endian, as on the AVR.
+func FormatValue(typ dwarf.Type, data []byte) string {
+    switch t := typ.(type) {
+    case *dwarf.TypedefType:
+        return FormatValue(t.Type, data)
+    case *dwarf.QualType:
+        return FormatValue(t.Type, data)
+
+    case *dwarf.CharType:
+        c := int64(signExtend(readUint(data), len(data)))
+        return formatChar(c)
+    case *dwarf.UcharType:
+        return formatChar(int64(readUint(data)))
+    case *dwarf.IntType:
+        if t.BitSize != 0 {
+            return strconv.FormatInt(signExtend(readBits(data, t.BitOffset, t.DataBitOffset, t.BitSize, t.ByteSize), int(t.BitSize+7)/8), 10)
+        }
+        return strconv.FormatInt(signExtend(readUint(data), len(data)), 10)
+    case *dwarf.UintType:
+        if t.BitSize != 0 {
+            return strconv.FormatUint(readBits(data, t.BitOffset, t.DataBitOffset, t.BitSize, t.ByteSize), 10)
+        }
+        return strconv.FormatUint(readUint(data), 10)
+    case *dwarf.BoolType:
+        if readUint(data) != 0 {
+            return "true"
+        }
+        return "false"
+    case *dwarf.FloatType:
+        switch len(data) {
+        case 4:
+            return strconv.FormatFloat(float64(math.Float32frombits(uint32(readUint(data)))), 'g', -1, 32)
+        case 8:
+            return strconv.FormatFloat(math.Float64frombits(readUint(data)), 'g', -1, 64)
+        }
+
+    case *dwarf.PtrType:
+        return fmt.Sprintf("0x%04x", readUint(data))
+    case *dwarf.EnumType:
+        val := signExtend(readUint(data), len(data))
+        for _, ev := range t.Val {
+            if ev.Val == val {
+                return ev.Name
+            }
+        }
+        return strconv.FormatInt(val, 10)
+
+    case *dwarf.ArrayType:
+        return formatArray(t, data)
+    case *dwarf.StructType:
+        return formatStruct(t, data)
+    }
+
+    // unknown type; show the raw bytes
+    return fmt.Sprintf("% x", data)
+}
+
+// Formats a character as its numeric value followed by the character itself.
+func formatChar(c int64) string {
+    if c >= 0x20 && c < 0x7f {
+        return fmt.Sprintf("%d '%c'", c, rune(c))
+    }
+    return strconv.FormatInt(c, 10)
+}
+
+// Formats an array. Arrays of characters are shown as strings.
+func formatArray(t *dwarf.ArrayType, data []byte) string {
+    elemSize := int(t.Type.Size())
+    if elemSize <= 0 {
+        return fmt.Sprintf("% x", data)
+    }
+    n := len(data) / elemSize
+    if t.Count >= 0 && int(t.Count) < n {
+        n = int(t.Count)
+    }
+
+    if isCharType(t.Type) {
+        s := data[:n]
+        if i := strings.IndexByte(string(s), 0); i >= 0 {
+            s = s[:i]
+        }
+        return strconv.Quote(string(s))
+    }
+
+    elems := make([]string, n)
+    for i := range elems {
+        elems[i] = FormatValue(t.Type, data[i*elemSize:(i+1)*elemSize])
+    }
+    return "{" + strings.Join(elems, ", ") + "}"
+}
+
+// Formats a structure, union or class.
+func formatStruct(t *dwarf.StructType, data []byte) string {
+    if t.Incomplete {
+        return fmt.Sprintf("%s %s {...}", t.Kind, t.StructName)
+    }
+
+    fields := make([]string, 0, len(t.Field))
+    for _, f := range t.Field {
+        size := int(f.Type.Size())
+        if f.BitSize != 0 {
+            size = int(f.ByteSize)
+            if size == 0 {
+                size = int(f.Type.Size())
+            }
+        }
+        start := int(f.ByteOffset)
+        if start < 0 || size < 0 || start+size > len(data) {
+            fields = append(fields, f.Name+" = ?")
+            continue
+        }
+
+        val := data[start : start+size]
+        var s string
+        if f.BitSize != 0 {
+            s = strconv.FormatUint(readBits(val, f.BitOffset, f.DataBitOffset-8*f.ByteOffset, f.BitSize, int64(size)), 10)
+        } else {
+            s = FormatValue(f.Type, val)
+        }
+        fields = append(fields, f.Name+" = "+s)
+    }
+    return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// Reports whether typ is a (possibly qualified) character type.
+func isCharType(typ dwarf.Type) bool {
+    for {
+        switch t := typ.(type) {
+        case *dwarf.TypedefType:
+            typ = t.Type
+        case *dwarf.QualType:
+            typ = t.Type
+        case *dwarf.CharType, *dwarf.UcharType:
+            return true
+        default:
+            return false
+        }
+    }
+}
+
+// Sign-extends an integer of the given size in bytes.
+func signExtend(x uint64, size int) int64 {
+    if size <= 0 || size >= 8 {
+        return int64(x)
+    }
+    shift := uint(64 - 8*size)
+    return int64(x<<shift) >> shift
+}
+
+// Extracts a bit field from a little-endian storage unit. bitOffset is the
+// DWARF 2/3 offset of the field's most significant bit from the most
+// significant bit of the storage unit; dataBitOffset is the DWARF 4 offset of
+// the least significant bit from the start of the storage unit. Whichever is
+// nonzero is used.
+func readBits(data []byte, bitOffset, dataBitOffset, bitSize, byteSize int64) uint64 {
+    var shift int64
+    if bitOffset != 0 {
+        shift = 8*byteSize - bitOffset - bitSize
+    } else {
+        shift = dataBitOffset
+    }
+    if shift < 0 || bitSize >= 64 {
+        return readUint(data)
+    }
+    return (readUint(data) >> uint(shift)) & (1<<uint(bitSize) - 1)
+}
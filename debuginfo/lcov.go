@@ -0,0 +1,140 @@
+package debuginfo
+
+import (
+    "bufio"
+    "fmt"
+    "github.com/kierdavis/avr/emulator"
+    "io"
+    "sort"
+)
+
+// The coverage of one source file.
+type lcovFile struct {
+    lines    map[int]uint64 // execution count of each line with code
+    branches []lcovBranch
+    funcs    []lcovFunc
+}
+
+type lcovFunc struct {
+    name string
+    line int
+    pc   uint32 // word address of the first instruction
+}
+
+type lcovBranch struct {
+    line int
+    emulator.BranchCoverage
+}
+
+// WriteLCOV writes the coverage recorded by cov in the lcov tracefile format
+// read by genhtml and most CI coverage services, naming the test testName.
+// Each source line is credited with the execution count of its most executed
+// instruction, and each function with the execution count of its first
+// instruction. Each conditional branch or skip instruction is a block of two
+// branches: branch 0 is taken and branch 1 not taken.
+func (info *Info) WriteLCOV(w io.Writer, cov *emulator.Coverage, testName string) error {
+    files := make(map[string]*lcovFile)
+    file := func(name string) *lcovFile {
+        f := files[name]
+        if f == nil {
+            f = &lcovFile{lines: make(map[int]uint64)}
+            files[name] = f
+        }
+        return f
+    }
+
+    for i, row := range info.lines {
+        if row.end || i+1 == len(info.lines) || info.lines[i+1].addr <= row.addr {
+            continue
+        }
+        r := emulator.PCRange{row.addr / 2, info.lines[i+1].addr / 2}
+        f := file(row.line.File)
+        hits := f.lines[row.line.Line]
+        for pc := r.Start; pc < r.End; pc++ {
+            if h := cov.Hits(pc); h > hits {
+                hits = h
+            }
+        }
+        f.lines[row.line.Line] = hits
+        for _, b := range cov.Conditionals(r) {
+            f.branches = append(f.branches, lcovBranch{row.line.Line, b})
+        }
+    }
+
+    for _, fn := range info.funcs {
+        decl := fn.Decl
+        if decl.File == "" {
+            decl, _ = info.LineAt(fn.LowPC)
+        }
+        if decl.File != "" {
+            f := file(decl.File)
+            f.funcs = append(f.funcs, lcovFunc{fn.Name, decl.Line, fn.LowPC})
+        }
+    }
+
+    var names []string
+    for name := range files {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    bw := bufio.NewWriter(w)
+    for _, name := range names {
+        writeLCOVFile(bw, cov, testName, name, files[name])
+    }
+    return bw.Flush()
+}
+
+func writeLCOVFile(w io.Writer, cov *emulator.Coverage, testName, name string, f *lcovFile) {
+    fmt.Fprintf(w, "TN:%s\nSF:%s\n", testName, name)
+
+    fnHit := 0
+    for _, fn := range f.funcs {
+        fmt.Fprintf(w, "FN:%d,%s\n", fn.line, fn.name)
+    }
+    for _, fn := range f.funcs {
+        hits := cov.Hits(fn.pc)
+        if hits != 0 {
+            fnHit++
+        }
+        fmt.Fprintf(w, "FNDA:%d,%s\n", hits, fn.name)
+    }
+    fmt.Fprintf(w, "FNF:%d\nFNH:%d\n", len(f.funcs), fnHit)
+
+    sort.SliceStable(f.branches, func(i, j int) bool {
+        return f.branches[i].line < f.branches[j].line
+    })
+    brHit, block, lastLine := 0, 0, -1
+    for _, b := range f.branches {
+        if b.line != lastLine {
+            block, lastLine = 0, b.line
+        }
+        if cov.Hits(b.PC) == 0 {
+            fmt.Fprintf(w, "BRDA:%d,%d,0,-\nBRDA:%d,%d,1,-\n", b.line, block, b.line, block)
+        } else {
+            fmt.Fprintf(w, "BRDA:%d,%d,0,%d\nBRDA:%d,%d,1,%d\n", b.line, block, b.Taken, b.line, block, b.NotTaken)
+            if b.Taken != 0 {
+                brHit++
+            }
+            if b.NotTaken != 0 {
+                brHit++
+            }
+        }
+        block++
+    }
+    fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", 2*len(f.branches), brHit)
+
+    var lines []int
+    for line := range f.lines {
+        lines = append(lines, line)
+    }
+    sort.Ints(lines)
+    lineHit := 0
+    for _, line := range lines {
+        if f.lines[line] != 0 {
+            lineHit++
+        }
+        fmt.Fprintf(w, "DA:%d,%d\n", line, f.lines[line])
+    }
+    fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(lines), lineHit)
+}
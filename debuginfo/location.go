@@ -0,0 +1,401 @@
+package debuginfo
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "github.com/kierdavis/avr/loader/elfloader"
+)
+
+// DWARF register numbers used by avr-gcc. Numbers 0 to 31 are the general
+// purpose registers r0 to r31.
+const (
+    regSP = 32
+)
+
+// DWARF expression opcodes understood by the evaluator.
+const (
+    opAddr          = 0x03
+    opDeref         = 0x06
+    opConst1u       = 0x08
+    opConst1s       = 0x09
+    opConst2u       = 0x0a
+    opConst2s       = 0x0b
+    opConst4u       = 0x0c
+    opConst4s       = 0x0d
+    opConstu        = 0x10
+    opConsts        = 0x11
+    opDup           = 0x12
+    opDrop          = 0x13
+    opMinus         = 0x1c
+    opPlus          = 0x22
+    opPlusUconst    = 0x23
+    opLit0          = 0x30
+    opLit31         = 0x4f
+    opReg0          = 0x50
+    opReg31         = 0x6f
+    opBreg0         = 0x70
+    opBreg31        = 0x8f
+    opRegx          = 0x90
+    opFbreg         = 0x91
+    opBregx         = 0x92
+    opPiece         = 0x93
+    opImplicitValue = 0x9e
+    opStackValue    = 0x9f
+)
+
+// ErrOptimizedOut is returned when a variable has no location at the current
+// program counter, typically because the compiler has optimised it away.
+var ErrOptimizedOut = errors.New("debuginfo: variable is optimized out")
+
+// A Target provides access to the state of a running program. It is
+// implemented by *emulator.Emulator.
+type Target interface {
+    Reg(n uint) uint8
+    SP() uint16
+    PeekData(addr uint16) uint8
+    ProgByte(addr uint32) uint8
+    EEPROMByte(addr uint16) uint8
+}
+
+// A PieceKind identifies where a piece of a variable is stored.
+type PieceKind int
+
+const (
+    // The piece is in memory, at Space and Address.
+    InMemory PieceKind = iota
+    // The piece is in consecutive registers starting at Reg.
+    InRegister
+    // The piece is not stored anywhere; its value is Value.
+    IsValue
+)
+
+// A Piece is part of the location of a variable. Most variables consist of a
+// single piece, but the compiler may split a variable between several
+// registers and memory locations.
+type Piece struct {
+    Kind    PieceKind
+    Space   elfloader.Space
+    Address uint32
+    Reg     uint
+    Value   []byte
+    Size    uint // in bytes, or 0 for the remainder of the variable
+}
+
+// Reads a register by DWARF number. avr-gcc uses register numbers in base
+// register operations to refer to 16-bit register pairs (such as 28 for the Y
+// pointer), so the value of the pair starting at the register is returned.
+func readDwarfReg(t Target, n uint64) (val uint64, err error) {
+    switch {
+    case n < 31:
+        return uint64(t.Reg(uint(n))) | uint64(t.Reg(uint(n+1)))<<8, nil
+    case n == regSP:
+        return uint64(t.SP()), nil
+    }
+    return 0, fmt.Errorf("debuginfo: unsupported DWARF register %d", n)
+}
+
+// Context in which a location expression is evaluated.
+type evalContext struct {
+    target    Target
+    addrSize  int
+    frameBase func() (uint64, error) // nil if there is no frame base
+}
+
+// Evaluates a DWARF location expression, returning the pieces of the
+// variable's location.
+func evalLocation(expr []byte, ctx *evalContext) (pieces []Piece, err error) {
+    var stack []uint64
+    var usedAddr bool // whether the address came from DW_OP_addr
+    var regLoc = -1   // register named by DW_OP_reg*, or -1
+    var isValue bool  // set by DW_OP_stack_value
+    var implicit []byte
+
+    pop := func() (x uint64, err error) {
+        if len(stack) == 0 {
+            return 0, errors.New("debuginfo: DWARF expression stack underflow")
+        }
+        x = stack[len(stack)-1]
+        stack = stack[:len(stack)-1]
+        return x, nil
+    }
+
+    // emits a piece describing the state of the evaluation so far
+    emit := func(size uint) error {
+        piece := Piece{Size: size}
+        switch {
+        case implicit != nil:
+            piece.Kind = IsValue
+            piece.Value = implicit
+        case regLoc >= 0:
+            piece.Kind = InRegister
+            piece.Reg = uint(regLoc)
+        case isValue:
+            x, err := pop()
+            if err != nil {
+                return err
+            }
+            piece.Kind = IsValue
+            piece.Value = make([]byte, 8)
+            binary.LittleEndian.PutUint64(piece.Value, x)
+        default:
+            x, err := pop()
+            if err != nil {
+                return err
+            }
+            piece.Kind = InMemory
+            if usedAddr {
+                space, addr, ok := elfloader.SplitAddress(uint32(x))
+                if !ok {
+                    return fmt.Errorf("debuginfo: address 0x%06X is not in any memory space", x)
+                }
+                piece.Space, piece.Address = space, addr
+            } else {
+                // addresses computed from registers point into data memory
+                piece.Space, piece.Address = elfloader.Data, uint32(x)
+            }
+        }
+        pieces = append(pieces, piece)
+
+        stack = stack[:0]
+        usedAddr, regLoc, isValue, implicit = false, -1, false, nil
+        return nil
+    }
+
+    for len(expr) > 0 {
+        op := expr[0]
+        expr = expr[1:]
+
+        switch {
+        case op >= opLit0 && op <= opLit31:
+            stack = append(stack, uint64(op-opLit0))
+            continue
+        case op >= opReg0 && op <= opReg31:
+            regLoc = int(op - opReg0)
+            continue
+        case op >= opBreg0 && op <= opBreg31:
+            offset, n := sleb128(expr)
+            expr = expr[n:]
+            val, err := readDwarfReg(ctx.target, uint64(op-opBreg0))
+            if err != nil {
+                return nil, err
+            }
+            stack = append(stack, uint64(int64(val)+offset))
+            continue
+        }
+
+        switch op {
+        case opAddr:
+            if len(expr) < ctx.addrSize {
+                return nil, errors.New("debuginfo: truncated DW_OP_addr")
+            }
+            stack = append(stack, readUint(expr[:ctx.addrSize]))
+            expr = expr[ctx.addrSize:]
+            usedAddr = true
+        case opConst1u, opConst1s, opConst2u, opConst2s, opConst4u, opConst4s:
+            size := 1 << ((op - opConst1u) / 2) // 1, 2 or 4 bytes
+            if len(expr) < size {
+                return nil, errors.New("debuginfo: truncated constant in DWARF expression")
+            }
+            x := readUint(expr[:size])
+            if op == opConst1s || op == opConst2s || op == opConst4s {
+                shift := uint(64 - 8*size)
+                x = uint64(int64(x<<shift) >> shift)
+            }
+            stack = append(stack, x)
+            expr = expr[size:]
+        case opConstu:
+            x, n := uleb128(expr)
+            expr = expr[n:]
+            stack = append(stack, x)
+        case opConsts:
+            x, n := sleb128(expr)
+            expr = expr[n:]
+            stack = append(stack, uint64(x))
+        case opDup:
+            x, err := pop()
+            if err != nil {
+                return nil, err
+            }
+            stack = append(stack, x, x)
+        case opDrop:
+            if _, err := pop(); err != nil {
+                return nil, err
+            }
+        case opPlus, opMinus:
+            y, err := pop()
+            if err != nil {
+                return nil, err
+            }
+            x, err := pop()
+            if err != nil {
+                return nil, err
+            }
+            if op == opPlus {
+                stack = append(stack, x+y)
+            } else {
+                stack = append(stack, x-y)
+            }
+        case opPlusUconst:
+            y, n := uleb128(expr)
+            expr = expr[n:]
+            x, err := pop()
+            if err != nil {
+                return nil, err
+            }
+            stack = append(stack, x+y)
+        case opDeref:
+            x, err := pop()
+            if err != nil {
+                return nil, err
+            }
+            // pointers to data memory are 16 bits wide
+            addr := uint16(x)
+            stack = append(stack, uint64(ctx.target.PeekData(addr))|uint64(ctx.target.PeekData(addr+1))<<8)
+            usedAddr = false
+        case opRegx:
+            reg, n := uleb128(expr)
+            expr = expr[n:]
+            regLoc = int(reg)
+        case opBregx:
+            reg, n := uleb128(expr)
+            expr = expr[n:]
+            offset, n := sleb128(expr)
+            expr = expr[n:]
+            val, err := readDwarfReg(ctx.target, reg)
+            if err != nil {
+                return nil, err
+            }
+            stack = append(stack, uint64(int64(val)+offset))
+        case opFbreg:
+            offset, n := sleb128(expr)
+            expr = expr[n:]
+            if ctx.frameBase == nil {
+                return nil, errors.New("debuginfo: DW_OP_fbreg used outside of a function")
+            }
+            base, err := ctx.frameBase()
+            if err != nil {
+                return nil, err
+            }
+            stack = append(stack, uint64(int64(base)+offset))
+        case opPiece:
+            size, n := uleb128(expr)
+            expr = expr[n:]
+            if err := emit(uint(size)); err != nil {
+                return nil, err
+            }
+        case opImplicitValue:
+            size, n := uleb128(expr)
+            expr = expr[n:]
+            if uint64(len(expr)) < size {
+                return nil, errors.New("debuginfo: truncated DW_OP_implicit_value")
+            }
+            implicit = expr[:size]
+            expr = expr[size:]
+        case opStackValue:
+            isValue = true
+        default:
+            return nil, fmt.Errorf("debuginfo: unsupported DWARF expression opcode 0x%02x", op)
+        }
+    }
+
+    // an expression without pieces describes the whole variable
+    if len(pieces) == 0 {
+        if len(stack) == 0 && regLoc < 0 && implicit == nil {
+            return nil, ErrOptimizedOut
+        }
+        if err := emit(0); err != nil {
+            return nil, err
+        }
+    }
+    return pieces, nil
+}
+
+// Reads the bytes of a variable of the given size from the pieces of its
+// location.
+func readPieces(t Target, pieces []Piece, size uint) (data []byte, err error) {
+    data = make([]byte, 0, size)
+    for _, p := range pieces {
+        n := p.Size
+        if n == 0 || n > size-uint(len(data)) {
+            n = size - uint(len(data))
+        }
+
+        for i := uint(0); i < n; i++ {
+            var b uint8
+            switch p.Kind {
+            case InMemory:
+                addr := p.Address + uint32(i)
+                switch p.Space {
+                case elfloader.Data:
+                    b = t.PeekData(uint16(addr))
+                case elfloader.Flash:
+                    b = t.ProgByte(addr)
+                case elfloader.EEPROM:
+                    b = t.EEPROMByte(uint16(addr))
+                default:
+                    return nil, fmt.Errorf("debuginfo: cannot read from %s memory", p.Space)
+                }
+            case InRegister:
+                if p.Reg+i >= 32 {
+                    return nil, fmt.Errorf("debuginfo: variable extends beyond r31")
+                }
+                b = t.Reg(p.Reg + i)
+            case IsValue:
+                if int(i) < len(p.Value) {
+                    b = p.Value[i]
+                }
+            }
+            data = append(data, b)
+        }
+    }
+
+    if uint(len(data)) < size {
+        return nil, fmt.Errorf("debuginfo: location describes only %d of %d bytes", len(data), size)
+    }
+    return data, nil
+}
+
+// Reads a little-endian unsigned integer.
+func readUint(buf []byte) (x uint64) {
+    for i := len(buf) - 1; i >= 0; i-- {
+        x = x<<8 | uint64(buf[i])
+    }
+    return x
+}
+
+// Decodes an unsigned LEB128 number, returning it and the number of bytes
+// consumed.
+func uleb128(buf []byte) (x uint64, n int) {
+    var shift uint
+    for n < len(buf) {
+        b := buf[n]
+        n++
+        x |= uint64(b&0x7f) << shift
+        shift += 7
+        if b&0x80 == 0 {
+            break
+        }
+    }
+    return x, n
+}
+
+// Decodes a signed LEB128 number, returning it and the number of bytes
+// consumed.
+func sleb128(buf []byte) (x int64, n int) {
+    var shift uint
+    var b byte
+    for n < len(buf) {
+        b = buf[n]
+        n++
+        x |= int64(b&0x7f) << shift
+        shift += 7
+        if b&0x80 == 0 {
+            break
+        }
+    }
+    if shift < 64 && b&0x40 != 0 {
+        x |= -1 << shift
+    }
+    return x, n
+}
@@ -0,0 +1,234 @@
+package debuginfo
+
+import (
+    "debug/dwarf"
+    "encoding/binary"
+    "errors"
+    "fmt"
+)
+
+// The location of a variable (or a function's frame base). At most one of
+// expr, list and constValue is set.
+type location struct {
+    expr       []byte      // a single location expression
+    list       []locEntry  // a location list
+    constValue interface{} // DW_AT_const_value, for variables with no storage
+    err        error       // set if the location could not be decoded
+}
+
+// An entry in a location list. low and high are byte addresses.
+type locEntry struct {
+    low, high uint64
+    expr      []byte
+    isDefault bool // a DW_LLE_default_location entry, used for any address
+}
+
+// Location list entry kinds in .debug_loclists (DWARF 5).
+const (
+    lleEndOfList       = 0x00
+    lleBaseAddressx    = 0x01
+    lleStartxEndx      = 0x02
+    lleStartxLength    = 0x03
+    lleOffsetPair      = 0x04
+    lleDefaultLocation = 0x05
+    lleBaseAddress     = 0x06
+    lleStartEnd        = 0x07
+    lleStartLength     = 0x08
+)
+
+// Returns the DWARF version of the unit containing the entry at off, by
+// reading the unit headers in .debug_info.
+func unitVersion(debugInfo []byte, off dwarf.Offset) int {
+    le := binary.LittleEndian
+    pos := 0
+    for pos+6 <= len(debugInfo) {
+        length, hdr := uint64(le.Uint32(debugInfo[pos:])), 4
+        if length == 0xffffffff && pos+14 <= len(debugInfo) {
+            length, hdr = le.Uint64(debugInfo[pos+4:]), 12
+        }
+        end := uint64(pos) + uint64(hdr) + length
+        if uint64(off) < end {
+            return int(le.Uint16(debugInfo[pos+hdr:]))
+        }
+        pos = int(end)
+    }
+    return 0
+}
+
+// Reads the location given by an attribute of an entry. A missing attribute
+// results in an empty location. Location lists that cannot be decoded are
+// recorded as errors in the returned location, to be reported if the variable
+// is read.
+func (info *Info) readLocation(e *dwarf.Entry, a dwarf.Attr, u *unit) (loc location) {
+    field := e.AttrField(a)
+    if field == nil {
+        return loc
+    }
+
+    switch field.Class {
+    case dwarf.ClassExprLoc, dwarf.ClassBlock:
+        loc.expr, _ = field.Val.([]byte)
+    case dwarf.ClassLocListPtr:
+        off, _ := field.Val.(int64)
+        if u.version >= 5 {
+            loc.list, loc.err = readLocLists(info.debugLocs, off, u)
+        } else {
+            loc.list, loc.err = readLoc(info.debugLoc, off, u)
+        }
+        if loc.list == nil && loc.err == nil {
+            loc.list = []locEntry{}
+        }
+    default:
+        loc.err = fmt.Errorf("debuginfo: unsupported location attribute class %s", field.Class)
+    }
+    return loc
+}
+
+// Reads an address of the unit's address size.
+func readAddr(buf []byte, u *unit) (addr uint64, ok bool) {
+    if len(buf) < u.addrSize {
+        return 0, false
+    }
+    return readUint(buf[:u.addrSize]), true
+}
+
+var errTruncatedLocList = errors.New("debuginfo: truncated location list")
+
+// Reads a location list from .debug_loc (DWARF 2 to 4).
+func readLoc(sec []byte, off int64, u *unit) (list []locEntry, err error) {
+    if off < 0 || off >= int64(len(sec)) {
+        return nil, fmt.Errorf("debuginfo: location list offset 0x%x is out of range", off)
+    }
+    buf := sec[off:]
+    base := u.lowPC
+    maxAddr := uint64(1)<<(8*uint(u.addrSize)) - 1
+
+    for {
+        if len(buf) < 2*u.addrSize {
+            return nil, errTruncatedLocList
+        }
+        begin, _ := readAddr(buf, u)
+        end, _ := readAddr(buf[u.addrSize:], u)
+        buf = buf[2*u.addrSize:]
+
+        switch {
+        case begin == 0 && end == 0:
+            return list, nil
+        case begin == maxAddr:
+            base = end
+            continue
+        }
+
+        if len(buf) < 2 {
+            return nil, errTruncatedLocList
+        }
+        n := int(binary.LittleEndian.Uint16(buf))
+        if len(buf) < 2+n {
+            return nil, errTruncatedLocList
+        }
+        list = append(list, locEntry{low: base + begin, high: base + end, expr: buf[2 : 2+n]})
+        buf = buf[2+n:]
+    }
+}
+
+// Reads a location list from .debug_loclists (DWARF 5). Entry kinds that refer
+// to .debug_addr are not supported.
+func readLocLists(sec []byte, off int64, u *unit) (list []locEntry, err error) {
+    if off < 0 || off >= int64(len(sec)) {
+        return nil, fmt.Errorf("debuginfo: location list offset 0x%x is out of range", off)
+    }
+    buf := sec[off:]
+    base := u.lowPC
+
+    // reads a counted location expression
+    readExpr := func() ([]byte, error) {
+        n, k := uleb128(buf)
+        if uint64(len(buf)-k) < n {
+            return nil, errTruncatedLocList
+        }
+        expr := buf[k : k+int(n)]
+        buf = buf[k+int(n):]
+        return expr, nil
+    }
+
+    for len(buf) > 0 {
+        kind := buf[0]
+        buf = buf[1:]
+
+        var entry locEntry
+        switch kind {
+        case lleEndOfList:
+            return list, nil
+        case lleBaseAddress:
+            addr, ok := readAddr(buf, u)
+            if !ok {
+                return nil, errTruncatedLocList
+            }
+            buf = buf[u.addrSize:]
+            base = addr
+            continue
+        case lleOffsetPair:
+            begin, n := uleb128(buf)
+            buf = buf[n:]
+            end, n := uleb128(buf)
+            buf = buf[n:]
+            entry.low, entry.high = base+begin, base+end
+        case lleDefaultLocation:
+            entry.isDefault = true
+        case lleStartEnd:
+            if len(buf) < 2*u.addrSize {
+                return nil, errTruncatedLocList
+            }
+            begin, _ := readAddr(buf, u)
+            end, _ := readAddr(buf[u.addrSize:], u)
+            buf = buf[2*u.addrSize:]
+            entry.low, entry.high = begin, end
+        case lleStartLength:
+            begin, ok := readAddr(buf, u)
+            if !ok {
+                return nil, errTruncatedLocList
+            }
+            buf = buf[u.addrSize:]
+            length, n := uleb128(buf)
+            buf = buf[n:]
+            entry.low, entry.high = begin, begin+length
+        case lleBaseAddressx, lleStartxEndx, lleStartxLength:
+            return nil, fmt.Errorf("debuginfo: location list entry kind 0x%02x (using .debug_addr) is not supported", kind)
+        default:
+            return nil, fmt.Errorf("debuginfo: unknown location list entry kind 0x%02x", kind)
+        }
+
+        if entry.expr, err = readExpr(); err != nil {
+            return nil, err
+        }
+        list = append(list, entry)
+    }
+    return nil, errTruncatedLocList
+}
+
+// Returns the location expression that applies at the word address pc.
+func (info *Info) exprAt(loc location, u *unit, pc uint32) (expr []byte, err error) {
+    if loc.err != nil {
+        return nil, loc.err
+    }
+    if loc.list == nil {
+        if loc.expr == nil {
+            return nil, ErrOptimizedOut
+        }
+        return loc.expr, nil
+    }
+
+    addr := uint64(pc) * 2
+    var def []byte
+    for _, entry := range loc.list {
+        if entry.isDefault {
+            def = entry.expr
+        } else if entry.low <= addr && addr < entry.high {
+            return entry.expr, nil
+        }
+    }
+    if def != nil {
+        return def, nil
+    }
+    return nil, ErrOptimizedOut
+}
@@ -0,0 +1,397 @@
+// Package disasm implements a disassembler for AVR machine code. Instructions
+// are decoded using the definitions in avr.InstDefs and printed in the syntax
+// used by avr-objdump (and accepted by avr-as), with I/O register names from the
+// MCU spec and the absolute addresses of branch targets given in comments.
+package disasm
+
+import (
+    "fmt"
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/spec"
+    "strings"
+)
+
+// A Symbolizer returns the name of the symbol containing the given program
+// byte address, and the offset of the address from the start of the symbol.
+type Symbolizer func(addr uint32) (name string, offset uint32, ok bool)
+
+// Returns the name of interrupt vector n, as given by the MCU spec, or else the
+// name avr-libc gives its handler, such as "__vector_3".
+func VectorName(s *spec.MCUSpec, n uint) string {
+    for name, num := range s.Interrupts {
+        if num == n {
+            return name
+        }
+    }
+    return fmt.Sprintf("__vector_%d", n)
+}
+
+// Returns a Symbolizer that names the addresses in the interrupt vector table
+// after their vectors, for programs without a symbol table.
+func VectorSymbolizer(s *spec.MCUSpec) Symbolizer {
+    vecSize := 2 * uint32(s.InterruptVectorSize)
+    return func(addr uint32) (name string, offset uint32, ok bool) {
+        n := addr / vecSize
+        if n >= uint32(s.NumInterrupts) {
+            return "", 0, false
+        }
+        return VectorName(s, uint(n)), addr - n*vecSize, true
+    }
+}
+
+// A Disassembler decodes instructions for a particular MCU.
+type Disassembler struct {
+    Spec *spec.MCUSpec
+    // If not nil, used to annotate branch targets with symbol names.
+    Symbolizer Symbolizer
+    portNames  [][]string // indexed by bank number, then index
+}
+
+// An Inst is a decoded instruction.
+type Inst struct {
+    Addr     uint32          // byte address
+    Words    []uint16        // one or two words
+    Inst     avr.Instruction // -1 if the words are not a valid instruction
+    Mnemonic string
+    Operands []string
+    Comment  string
+    // The byte address of the target of a jump, call or branch. Indirect
+    // jumps and calls have no target.
+    Target    uint32
+    HasTarget bool
+}
+
+// Returns the mnemonic and operands of the instruction, in the form
+// "mnemonic\toperands".
+func (i Inst) Text() string {
+    if len(i.Operands) == 0 {
+        return i.Mnemonic
+    }
+    return i.Mnemonic + "\t" + strings.Join(i.Operands, ", ")
+}
+
+// Returns the instruction in the form "mnemonic\toperands\t; comment".
+func (i Inst) String() string {
+    s := i.Text()
+    if i.Comment != "" {
+        s += "\t; " + i.Comment
+    }
+    return s
+}
+
+// Returns the size of the instruction in bytes.
+func (i Inst) Size() uint32 {
+    return 2 * uint32(len(i.Words))
+}
+
+// Creates a Disassembler for the given MCU.
+func New(mcuSpec *spec.MCUSpec) (d *Disassembler) {
+    d = &Disassembler{
+        Spec:      mcuSpec,
+        portNames: make([][]string, len(mcuSpec.IOBankSizes)),
+    }
+    for i, size := range mcuSpec.IOBankSizes {
+        d.portNames[i] = make([]string, size)
+    }
+    for name, pref := range mcuSpec.Ports {
+        if pref.BankNum < uint(len(d.portNames)) && uint(pref.Index) < uint(len(d.portNames[pref.BankNum])) {
+            d.portNames[pref.BankNum][pref.Index] = name
+        }
+    }
+    return d
+}
+
+// Decodes the instruction at word address pc in prog, which holds the program
+// memory (or a part of it starting at word address 0).
+func (d *Disassembler) Decode(prog []uint16, pc uint32) (inst Inst) {
+    end := pc + 2
+    if end > uint32(len(prog)) {
+        end = uint32(len(prog))
+    }
+    return d.DecodeWords(prog[pc:end], pc)
+}
+
+// Decodes the instruction whose words begin with words[0], which is at word
+// address pc. words holds one or two words; any beyond the first two are
+// ignored.
+func (d *Disassembler) DecodeWords(words []uint16, pc uint32) (inst Inst) {
+    inst = Inst{
+        Addr:  2 * pc,
+        Words: words[:1],
+        Inst:  avr.Decode(words[0], d.Spec.Family == spec.ReducedCore),
+    }
+
+    if inst.Inst < 0 {
+        return d.invalid(inst)
+    }
+    if inst.Inst.IsTwoWord() {
+        if len(words) < 2 {
+            return d.invalid(inst)
+        }
+        inst.Words = words[:2]
+    }
+
+    d.decodeOperands(&inst)
+    return inst
+}
+
+// Disassembles the program words in prog between the word addresses start and
+// end.
+func (d *Disassembler) Disassemble(prog []uint16, start, end uint32) (insts []Inst) {
+    for pc := start; pc < end && pc < uint32(len(prog)); {
+        inst := d.Decode(prog, pc)
+        insts = append(insts, inst)
+        pc += uint32(len(inst.Words))
+    }
+    return insts
+}
+
+// Returns the name of the I/O port at index in the given bank, or "" if it is
+// not defined by the MCU spec.
+func (d *Disassembler) PortName(bankNum uint, index uint16) string {
+    if bankNum < uint(len(d.portNames)) && uint(index) < uint(len(d.portNames[bankNum])) {
+        return d.portNames[bankNum][index]
+    }
+    return ""
+}
+
+// Returns the name of the I/O port at the given data address, or "" if the
+// address is not that of a named port.
+func (d *Disassembler) DataName(addr uint16) string {
+    for _, r := range d.Spec.Regions {
+        if r, ok := r.(spec.IORegionSpec); ok && addr-r.Start() < r.Size() {
+            return d.PortName(r.BankNum(), addr-r.Start())
+        }
+    }
+    return ""
+}
+
+// Fills in an Inst for a word that is not a valid instruction.
+func (d *Disassembler) invalid(inst Inst) Inst {
+    inst.Inst = -1
+    inst.Words = inst.Words[:1]
+    inst.Mnemonic = ".word"
+    inst.Operands = []string{fmt.Sprintf("0x%04x", inst.Words[0])}
+    inst.Comment = "????"
+    return inst
+}
+
+// Aliases of BSET and BCLR, indexed by status bit.
+var bsetNames = [8]string{"sec", "sez", "sen", "sev", "ses", "seh", "set", "sei"}
+var bclrNames = [8]string{"clc", "clz", "cln", "clv", "cls", "clh", "clt", "cli"}
+
+// Aliases of BRBS and BRBC, indexed by status bit.
+var brbsNames = [8]string{"brcs", "breq", "brmi", "brvs", "brlt", "brhs", "brts", "brie"}
+var brbcNames = [8]string{"brcc", "brne", "brpl", "brvc", "brge", "brhc", "brtc", "brid"}
+
+// Mnemonics of instructions that have the same form as another, where the
+// mnemonic is not just the lower-case name of the instruction.
+var mnemonics = map[avr.Instruction]string{
+    avr.ELPM_R0: "elpm", avr.ELPM_INC: "elpm",
+    avr.LPM_R0: "lpm", avr.LPM_INC: "lpm", avr.SPM_2: "spm",
+    avr.LD_X: "ld", avr.LD_X_INC: "ld", avr.LD_X_DEC: "ld",
+    avr.LD_Y: "ld", avr.LD_Y_INC: "ld", avr.LD_Y_DEC: "ld",
+    avr.LD_Z: "ld", avr.LD_Z_INC: "ld", avr.LD_Z_DEC: "ld",
+    avr.LDD_Y: "ldd", avr.LDD_Z: "ldd", avr.LDS_SHORT: "lds",
+    avr.ST_X: "st", avr.ST_X_INC: "st", avr.ST_X_DEC: "st",
+    avr.ST_Y: "st", avr.ST_Y_INC: "st", avr.ST_Y_DEC: "st",
+    avr.ST_Z: "st", avr.ST_Z_INC: "st", avr.ST_Z_DEC: "st",
+    avr.STD_Y: "std", avr.STD_Z: "std", avr.STS_SHORT: "sts",
+}
+
+// Operands of load and store instructions that use a pointer register.
+var pointerOperands = map[avr.Instruction]string{
+    avr.LD_X: "X", avr.LD_X_INC: "X+", avr.LD_X_DEC: "-X",
+    avr.LD_Y: "Y", avr.LD_Y_INC: "Y+", avr.LD_Y_DEC: "-Y",
+    avr.LD_Z: "Z", avr.LD_Z_INC: "Z+", avr.LD_Z_DEC: "-Z",
+    avr.ST_X: "X", avr.ST_X_INC: "X+", avr.ST_X_DEC: "-X",
+    avr.ST_Y: "Y", avr.ST_Y_INC: "Y+", avr.ST_Y_DEC: "-Y",
+    avr.ST_Z: "Z", avr.ST_Z_INC: "Z+", avr.ST_Z_DEC: "-Z",
+    avr.ELPM: "Z", avr.ELPM_INC: "Z+",
+    avr.LPM: "Z", avr.LPM_INC: "Z+",
+}
+
+// Decodes the operands of a valid instruction.
+func (d *Disassembler) decodeOperands(inst *Inst) {
+    w := inst.Words[0]
+    pc := inst.Addr / 2
+
+    // common operand fields
+    rd := reg((w >> 4) & 0x1F)
+    rr := reg((w & 0x0F) | ((w >> 5) & 0x10))
+    rdHigh := reg(16 + (w>>4)&0x0F) // d in 16-31
+    k8 := uint8(((w >> 4) & 0xF0) | (w & 0x0F))
+    bit := fmt.Sprint(w & 0x07)
+
+    inst.Mnemonic = mnemonics[inst.Inst]
+    if inst.Mnemonic == "" {
+        inst.Mnemonic = strings.ToLower(inst.Inst.String())
+    }
+
+    switch inst.Inst {
+    case avr.ADC, avr.ADD, avr.AND, avr.CP, avr.CPC, avr.CPSE, avr.EOR, avr.MOV, avr.MUL, avr.OR, avr.SBC, avr.SUB:
+        inst.Operands = []string{rd, rr}
+
+    case avr.ANDI, avr.CPI, avr.LDI, avr.ORI, avr.SBCI, avr.SUBI:
+        inst.Operands = []string{rdHigh, fmt.Sprintf("0x%02X", k8)}
+        inst.Comment = fmt.Sprint(k8)
+
+    case avr.ADIW, avr.SBIW:
+        k := (w>>2)&0x30 | w&0x0F
+        inst.Operands = []string{reg(24 + 2*((w>>4)&0x03)), fmt.Sprintf("0x%02X", k)}
+        inst.Comment = fmt.Sprint(k)
+
+    case avr.ASR, avr.COM, avr.DEC, avr.INC, avr.LSR, avr.NEG, avr.POP, avr.PUSH, avr.ROR, avr.SWAP:
+        inst.Operands = []string{rd}
+
+    case avr.BSET:
+        inst.Mnemonic = bsetNames[(w>>4)&0x07]
+    case avr.BCLR:
+        inst.Mnemonic = bclrNames[(w>>4)&0x07]
+
+    case avr.BRBS, avr.BRBC:
+        if inst.Inst == avr.BRBS {
+            inst.Mnemonic = brbsNames[w&0x07]
+        } else {
+            inst.Mnemonic = brbcNames[w&0x07]
+        }
+        d.relative(inst, pc, signExtend(uint32(w>>3)&0x7F, 7))
+
+    case avr.RJMP, avr.RCALL:
+        d.relative(inst, pc, signExtend(uint32(w)&0x0FFF, 12))
+
+    case avr.JMP, avr.CALL:
+        k := (uint32(w>>3)&0x3E|uint32(w)&0x01)<<16 | uint32(inst.Words[1])
+        d.absolute(inst, 2*k)
+
+    case avr.BLD, avr.BST, avr.SBRC, avr.SBRS:
+        inst.Operands = []string{rd, bit}
+
+    case avr.CBI, avr.SBI, avr.SBIC, avr.SBIS:
+        a := (w >> 3) & 0x1F
+        inst.Operands = []string{fmt.Sprintf("0x%02x", a), bit}
+        inst.Comment = d.ioComment(a)
+
+    case avr.IN:
+        a := (w>>5)&0x30 | w&0x0F
+        inst.Operands = []string{rd, fmt.Sprintf("0x%02x", a)}
+        inst.Comment = d.ioComment(a)
+    case avr.OUT:
+        a := (w>>5)&0x30 | w&0x0F
+        inst.Operands = []string{fmt.Sprintf("0x%02x", a), rd}
+        inst.Comment = d.ioComment(a)
+
+    case avr.DES:
+        inst.Operands = []string{fmt.Sprintf("0x%02X", (w>>4)&0x0F)}
+
+    case avr.FMUL, avr.FMULS, avr.FMULSU, avr.MULSU:
+        inst.Operands = []string{reg(16 + (w>>4)&0x07), reg(16 + w&0x07)}
+    case avr.MULS:
+        inst.Operands = []string{rdHigh, reg(16 + w&0x0F)}
+    case avr.MOVW:
+        inst.Operands = []string{reg(2 * ((w >> 4) & 0x0F)), reg(2 * (w & 0x0F))}
+
+    case avr.LAC, avr.LAS, avr.LAT, avr.XCH:
+        inst.Operands = []string{"Z", rd}
+
+    case avr.LD_X, avr.LD_X_INC, avr.LD_X_DEC, avr.LD_Y, avr.LD_Y_INC, avr.LD_Y_DEC,
+        avr.LD_Z, avr.LD_Z_INC, avr.LD_Z_DEC, avr.ELPM, avr.ELPM_INC, avr.LPM, avr.LPM_INC:
+        inst.Operands = []string{rd, pointerOperands[inst.Inst]}
+    case avr.ST_X, avr.ST_X_INC, avr.ST_X_DEC, avr.ST_Y, avr.ST_Y_INC, avr.ST_Y_DEC,
+        avr.ST_Z, avr.ST_Z_INC, avr.ST_Z_DEC:
+        inst.Operands = []string{pointerOperands[inst.Inst], rd}
+    case avr.SPM_2:
+        inst.Operands = []string{"Z+"}
+
+    case avr.LDD_Y, avr.LDD_Z, avr.STD_Y, avr.STD_Z:
+        ptr := "Y"
+        if inst.Inst == avr.LDD_Z || inst.Inst == avr.STD_Z {
+            ptr = "Z"
+        }
+        q := (w>>8)&0x20 | (w>>7)&0x18 | w&0x07
+        if q == 0 {
+            // displacement 0 is written as a plain LD or ST
+            inst.Mnemonic = inst.Mnemonic[:2]
+        } else {
+            ptr = fmt.Sprintf("%s+%d", ptr, q)
+        }
+        if inst.Inst == avr.LDD_Y || inst.Inst == avr.LDD_Z {
+            inst.Operands = []string{rd, ptr}
+        } else {
+            inst.Operands = []string{ptr, rd}
+        }
+
+    case avr.LDS:
+        inst.Operands = []string{rd, fmt.Sprintf("0x%04X", inst.Words[1])}
+        inst.Comment = d.DataName(inst.Words[1])
+    case avr.STS:
+        inst.Operands = []string{fmt.Sprintf("0x%04X", inst.Words[1]), rd}
+        inst.Comment = d.DataName(inst.Words[1])
+
+    case avr.LDS_SHORT, avr.STS_SHORT:
+        // ADDR[7:0] = ~w[8], w[8], w[10], w[9], w[3], w[2], w[1], w[0]
+        k := uint16(^w>>1)&0x80 | (w>>2)&0x40 | (w>>5)&0x30 | w&0x0F
+        if inst.Inst == avr.LDS_SHORT {
+            inst.Operands = []string{rdHigh, fmt.Sprintf("0x%02X", k)}
+        } else {
+            inst.Operands = []string{fmt.Sprintf("0x%02X", k), rdHigh}
+        }
+        inst.Comment = d.DataName(k)
+    }
+}
+
+// Sets the operand and target of an instruction with a relative target,
+// given as an offset in words from the next instruction.
+func (d *Disassembler) relative(inst *Inst, pc uint32, offset int32) {
+    inst.Operands = []string{fmt.Sprintf(".%+d", 2*offset)}
+    inst.Target = uint32(int32(2*(pc+1))+2*offset) & (uint32(d.Spec.ProgMemSize()) - 1)
+    inst.HasTarget = true
+    inst.Comment = d.targetComment(inst.Target)
+}
+
+// Sets the operand and target of an instruction with an absolute target.
+func (d *Disassembler) absolute(inst *Inst, target uint32) {
+    // avr-objdump prints a target of 0 without the 0x prefix
+    if target == 0 {
+        inst.Operands = []string{"0"}
+    } else {
+        inst.Operands = []string{fmt.Sprintf("0x%x", target)}
+    }
+    inst.Target = target
+    inst.HasTarget = true
+    inst.Comment = d.targetComment(target)
+}
+
+// Returns a comment giving a target address and, if known, its symbol.
+func (d *Disassembler) targetComment(addr uint32) string {
+    s := fmt.Sprintf("0x%x", addr)
+    if d.Symbolizer != nil {
+        if name, offset, ok := d.Symbolizer(addr); ok {
+            if offset != 0 {
+                return fmt.Sprintf("%s <%s+0x%x>", s, name, offset)
+            }
+            return fmt.Sprintf("%s <%s>", s, name)
+        }
+    }
+    return s
+}
+
+// Returns a comment for an I/O address: the name of the port, or the address
+// in decimal if it has no name.
+func (d *Disassembler) ioComment(a uint16) string {
+    if name := d.PortName(0, a); name != "" {
+        return name
+    }
+    return fmt.Sprint(a)
+}
+
+// Returns the name of general purpose register n.
+func reg(n uint16) string {
+    return fmt.Sprintf("r%d", n)
+}
+
+// Sign-extends a field of the given width in bits.
+func signExtend(x uint32, bits uint) int32 {
+    shift := 32 - bits
+    return int32(x<<shift) >> shift
+}
@@ -0,0 +1,210 @@
+package disasm
+
+import (
+    "bufio"
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/spec"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// A line of an avr-objdump listing.
+type listingLine struct {
+    addr    uint32
+    text    string // mnemonic and operands
+    comment string
+}
+
+// Reads the program bytes, symbols and instructions from an avr-objdump
+// listing.
+func readListing(t *testing.T, name string) (prog []uint16, syms map[uint32]string, lines []listingLine) {
+    f, err := os.Open(name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    var mem []byte
+    syms = make(map[uint32]string)
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if strings.HasSuffix(line, ">:") {
+            // symbol: "00000068 <port_to_mode_PGM>:"
+            fields := strings.SplitN(line, " ", 2)
+            addr, _ := strconv.ParseUint(fields[0], 16, 32)
+            syms[uint32(addr)] = strings.TrimSuffix(strings.TrimPrefix(fields[1], "<"), ">:")
+            continue
+        }
+
+        fields := strings.Split(line, "\t")
+        if len(fields) < 2 || !strings.HasSuffix(fields[0], ":") {
+            continue
+        }
+        addr, err := strconv.ParseUint(strings.TrimSpace(strings.TrimSuffix(fields[0], ":")), 16, 32)
+        if err != nil {
+            continue
+        }
+
+        // raw bytes, followed by an ASCII dump on data lines
+        for i, hex := range strings.Fields(fields[1]) {
+            b, err := strconv.ParseUint(hex, 16, 8)
+            if err != nil || len(hex) != 2 {
+                break
+            }
+            for uint64(len(mem)) <= addr+uint64(i) {
+                mem = append(mem, 0)
+            }
+            mem[addr+uint64(i)] = uint8(b)
+        }
+
+        if len(fields) >= 3 {
+            text := fields[2]
+            if len(fields) >= 4 {
+                text += "\t" + strings.TrimSpace(fields[3])
+            }
+            l := listingLine{addr: uint32(addr), text: text}
+            if len(fields) >= 5 {
+                l.comment = strings.TrimPrefix(fields[4], "; ")
+            }
+            lines = append(lines, l)
+        }
+    }
+
+    prog = make([]uint16, (len(mem)+1)/2)
+    for i := range mem {
+        prog[i/2] |= uint16(mem[i]) << (8 * uint(i%2))
+    }
+    return prog, syms, lines
+}
+
+// Returns a Symbolizer for a set of symbols.
+func symbolizer(syms map[uint32]string) Symbolizer {
+    var addrs []uint32
+    for addr := range syms {
+        addrs = append(addrs, addr)
+    }
+    sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+    return func(addr uint32) (name string, offset uint32, ok bool) {
+        i := sort.Search(len(addrs), func(i int) bool { return addrs[i] > addr })
+        if i == 0 {
+            return "", 0, false
+        }
+        return syms[addrs[i-1]], addr - addrs[i-1], true
+    }
+}
+
+func TestBlinkListing(t *testing.T) {
+    prog, syms, lines := readListing(t, "../programs/blink/blink-atmega168.txt")
+    if len(lines) < 300 {
+        t.Fatalf("only read %d instructions from listing", len(lines))
+    }
+
+    d := New(spec.ATmega168)
+    d.Symbolizer = symbolizer(syms)
+    for _, line := range lines {
+        inst := d.Decode(prog, line.addr/2)
+        if text := inst.Text(); text != line.text {
+            t.Errorf("0x%04x: expected %q, got %q", line.addr, line.text, inst.Text())
+            continue
+        }
+        // comments on branches and immediates match; I/O ports are named
+        if inst.HasTarget || strings.HasPrefix(line.comment, "0x") {
+            if inst.Comment != line.comment {
+                t.Errorf("0x%04x: expected comment %q, got %q", line.addr, line.comment, inst.Comment)
+            }
+        }
+    }
+}
+
+func TestPortNames(t *testing.T) {
+    d := New(spec.ATmega168)
+    prog := []uint16{
+        0xBE1F,         // out 0x3f, r1
+        0x9A2D,         // sbi 0x05, 5
+        0x9080, 0x00B2, // lds r8, 0x00B2
+        0xB01B, // in r1, 0x0b
+    }
+    expected := []string{
+        "out\t0x3f, r1\t; SREG",
+        "sbi\t0x05, 5\t; PORTB",
+        "lds\tr8, 0x00B2\t; TCNT2",
+        "in\tr1, 0x0b\t; PORTD",
+    }
+
+    insts := d.Disassemble(prog, 0, uint32(len(prog)))
+    if len(insts) != len(expected) {
+        t.Fatalf("expected %d instructions, got %d", len(expected), len(insts))
+    }
+    for i, inst := range insts {
+        if inst.String() != expected[i] {
+            t.Errorf("expected %q, got %q", expected[i], inst.String())
+        }
+    }
+}
+
+func TestInvalidAndReducedCore(t *testing.T) {
+    d := New(spec.ATmega168)
+    if s := d.Decode([]uint16{0xFFFF}, 0).String(); s != ".word\t0xffff\t; ????" {
+        t.Errorf("expected invalid word, got %q", s)
+    }
+    // a two-word instruction cut short
+    if inst := d.Decode([]uint16{0x940C}, 0); inst.Inst != -1 {
+        t.Errorf("expected truncated JMP to be invalid, got %s", inst)
+    }
+
+    // LDS is a one-word instruction on reduced-core devices
+    inst := New(spec.ATtiny10).Decode([]uint16{0xA105}, 0)
+    if inst.Inst != avr.LDS_SHORT || inst.String() != "lds\tr16, 0x45" {
+        t.Errorf("expected short lds, got %q", inst.String())
+    }
+}
+
+func TestFindCode(t *testing.T) {
+    prog, syms, _ := readListing(t, "../programs/blink/blink-atmega168.txt")
+
+    s := spec.ATmega168
+    var entries []uint32
+    for i := uint(0); i < s.NumInterrupts; i++ {
+        entries = append(entries, uint32(i*s.InterruptVectorSize))
+    }
+    code := New(s).FindCode(prog, entries)
+
+    for addr, name := range syms {
+        isData := strings.HasSuffix(name, "_PGM")
+        if code[addr/2] == isData {
+            t.Errorf("0x%04x <%s>: expected code=%t", addr, name, !isData)
+        }
+    }
+    // the words of the tables are not code
+    for addr := uint32(0x68); addr < 0xC2; addr += 2 {
+        if code[addr/2] {
+            t.Errorf("0x%04x: data marked as code", addr)
+        }
+    }
+}
+
+func TestVectorSymbolizer(t *testing.T) {
+    sym := VectorSymbolizer(spec.ATmega168)
+    tests := []struct {
+        addr   uint32
+        name   string
+        offset uint32
+        ok     bool
+    }{
+        {0x00, "RESET", 0, true},
+        {0x04, "INT0", 0, true},
+        {0x06, "INT0", 2, true},
+        {0x68, "", 0, false}, // past the last of 26 vectors
+    }
+    for _, tt := range tests {
+        name, offset, ok := sym(tt.addr)
+        if name != tt.name || offset != tt.offset || ok != tt.ok {
+            t.Errorf("0x%04x: expected %q+%d (%t), got %q+%d (%t)", tt.addr, tt.name, tt.offset, tt.ok, name, offset, ok)
+        }
+    }
+}
@@ -0,0 +1,78 @@
+package disasm
+
+import (
+    "github.com/kierdavis/avr"
+)
+
+// Returns true if execution can continue with the instruction following this
+// one: false for unconditional jumps, returns and invalid words.
+func (i Inst) FallsThrough() bool {
+    switch i.Inst {
+    case avr.JMP, avr.RJMP, avr.IJMP, avr.EIJMP, avr.RET, avr.RETI, -1:
+        return false
+    }
+    return true
+}
+
+// Returns true if the instruction conditionally skips the instruction that
+// follows it.
+func (i Inst) IsSkip() bool {
+    switch i.Inst {
+    case avr.CPSE, avr.SBRC, avr.SBRS, avr.SBIC, avr.SBIS:
+        return true
+    }
+    return false
+}
+
+// Returns true if the instruction is a subroutine call.
+func (i Inst) IsCall() bool {
+    switch i.Inst {
+    case avr.CALL, avr.RCALL, avr.ICALL, avr.EICALL:
+        return true
+    }
+    return false
+}
+
+// FindCode separates code from data by following the flow of control through
+// prog from the given entry points (word addresses), such as the reset and
+// interrupt vectors. It returns a slice parallel to prog in which the first
+// word of each reachable instruction is marked.
+//
+// Flow is followed through fall-through, skips, branches, jumps and calls.
+// The targets of indirect jumps and calls (IJMP, ICALL and so on) cannot be
+// determined statically, so code reached only through them (such as that of
+// functions called through pointers) is not found unless it is also given as
+// an entry point. Tracing stops at invalid words.
+func (d *Disassembler) FindCode(prog []uint16, entries []uint32) (code []bool) {
+    code = make([]bool, len(prog))
+    pending := append([]uint32(nil), entries...)
+
+    for len(pending) > 0 {
+        pc := pending[len(pending)-1]
+        pending = pending[:len(pending)-1]
+
+        // follow a straight line of instructions until it ends or joins code
+        // that has already been traced
+        for pc < uint32(len(prog)) && !code[pc] {
+            inst := d.Decode(prog, pc)
+            if inst.Inst < 0 {
+                break
+            }
+            code[pc] = true
+            next := pc + uint32(len(inst.Words))
+
+            if inst.HasTarget {
+                pending = append(pending, inst.Target/2)
+            }
+            if inst.IsSkip() && next < uint32(len(prog)) {
+                skipped := d.Decode(prog, next)
+                pending = append(pending, next+uint32(len(skipped.Words)))
+            }
+            if !inst.FallsThrough() {
+                break
+            }
+            pc = next
+        }
+    }
+    return code
+}
@@ -0,0 +1,235 @@
+package emulator
+
+import (
+    "github.com/kierdavis/avr"
+)
+
+// Returns the value of general-purpose register n (0 to 31).
+func (em *Emulator) Reg(n uint) uint8 {
+    return em.regs[n]
+}
+
+// Sets the value of general-purpose register n (0 to 31).
+func (em *Emulator) SetReg(n uint, val uint8) {
+    em.regs[n] = val
+    if em.sanitizer != nil {
+        em.sanitizer.regs[n] = 0xFF
+    }
+}
+
+// Returns the 16-bit value of the register pair n+1:n, such as 26 for X, 28 for
+// Y or 30 for Z.
+func (em *Emulator) RegPair(n uint) uint16 {
+    return uint16(em.regs[n+1])<<8 | uint16(em.regs[n])
+}
+
+// Sets the 16-bit value of the register pair n+1:n.
+func (em *Emulator) SetRegPair(n uint, val uint16) {
+    em.regs[n] = uint8(val)
+    em.regs[n+1] = uint8(val >> 8)
+    if em.sanitizer != nil {
+        em.sanitizer.regs[n], em.sanitizer.regs[n+1] = 0xFF, 0xFF
+    }
+}
+
+// Returns the value of the status register.
+func (em *Emulator) SREG() uint8 {
+    return SregPort{em}.Read()
+}
+
+// Sets the value of the status register.
+func (em *Emulator) SetSREG(val uint8) {
+    SregPort{em}.Write(val)
+    if em.sanitizer != nil {
+        em.sanitizer.defineFlags()
+    }
+}
+
+// Returns the state of a single status flag.
+func (em *Emulator) Flag(f avr.Flag) bool {
+    return em.flags[f] != 0
+}
+
+// Sets the state of a single status flag.
+func (em *Emulator) SetFlag(f avr.Flag, state bool) {
+    if state {
+        em.flags[f] = 1
+    } else {
+        em.flags[f] = 0
+    }
+    if em.sanitizer != nil {
+        em.sanitizer.flags[f] = true
+    }
+}
+
+// Returns the program counter. This is a word address: the address of the next
+// instruction to be executed.
+func (em *Emulator) PC() uint32 {
+    return em.pc
+}
+
+// Sets the program counter (a word address). Bits above the width of the
+// program memory are discarded, as they would be by a jump.
+func (em *Emulator) SetPC(pc uint32) {
+    em.pc = pc & em.pcmask
+}
+
+// Returns the value of the stack pointer.
+func (em *Emulator) SP() uint16 {
+    return em.sp
+}
+
+// Sets the value of the stack pointer.
+func (em *Emulator) SetSP(sp uint16) {
+    em.sp = sp
+}
+
+// Returns the value of the RAMPX register, which supplies the upper bits of
+// data addresses formed from X on MCUs with more than 64 KB of data space.
+func (em *Emulator) RAMPX() uint8 {
+    return em.rampx
+}
+
+// Sets the value of the RAMPX register.
+func (em *Emulator) SetRAMPX(val uint8) {
+    em.rampx = val
+}
+
+// Returns the value of the RAMPY register.
+func (em *Emulator) RAMPY() uint8 {
+    return em.rampy
+}
+
+// Sets the value of the RAMPY register.
+func (em *Emulator) SetRAMPY(val uint8) {
+    em.rampy = val
+}
+
+// Returns the value of the RAMPZ register, which also supplies the upper bits
+// of program memory addresses used by ELPM and SPM.
+func (em *Emulator) RAMPZ() uint8 {
+    return em.rampz
+}
+
+// Sets the value of the RAMPZ register.
+func (em *Emulator) SetRAMPZ(val uint8) {
+    em.rampz = val
+}
+
+// Returns the value of the RAMPD register, used by LDS and STS.
+func (em *Emulator) RAMPD() uint8 {
+    return em.rampd
+}
+
+// Sets the value of the RAMPD register.
+func (em *Emulator) SetRAMPD(val uint8) {
+    em.rampd = val
+}
+
+// Returns the value of the EIND register, which supplies the upper bits of the
+// target address of EIJMP and EICALL.
+func (em *Emulator) EIND() uint8 {
+    return em.eind
+}
+
+// Sets the value of the EIND register.
+func (em *Emulator) SetEIND(val uint8) {
+    em.eind = val
+}
+
+// Returns the program word at the given word address. The address wraps around
+// at the end of program memory, as the program counter does.
+func (em *Emulator) ProgWord(addr uint32) uint16 {
+    return em.prog[addr&em.pcmask]
+}
+
+// Sets the program word at the given word address.
+func (em *Emulator) SetProgWord(addr uint32, word uint16) {
+    em.prog[addr&em.pcmask] = word
+}
+
+// Returns the byte at the given address in program memory. The address is a
+// byte address, so the low byte of program word n is at address 2n.
+func (em *Emulator) ProgByte(addr uint32) uint8 {
+    word := em.prog[(addr>>1)&em.pcmask]
+    if addr&1 != 0 {
+        return uint8(word >> 8)
+    }
+    return uint8(word)
+}
+
+// Sets the byte at the given byte address in program memory.
+func (em *Emulator) SetProgByte(addr uint32, val uint8) {
+    p := &em.prog[(addr>>1)&em.pcmask]
+    if addr&1 != 0 {
+        *p = (*p & 0x00FF) | uint16(val)<<8
+    } else {
+        *p = (*p & 0xFF00) | uint16(val)
+    }
+}
+
+// Returns the byte at the given address in EEPROM. The method panics if the
+// address is out of range.
+func (em *Emulator) EEPROMByte(addr uint16) uint8 {
+    return em.eeprom[addr]
+}
+
+// Sets the byte at the given address in EEPROM. The method panics if the
+// address is out of range.
+func (em *Emulator) SetEEPROMByte(addr uint16, val uint8) {
+    em.eeprom[addr] = val
+}
+
+// Returns the byte at the given address in data memory without side effects
+// and without logging warnings. I/O ports are read through their Peek method;
+// unmapped addresses and ports that do not implement PeekPort read as zero.
+// This is intended for debuggers and similar tools that inspect the state of a
+// program.
+func (em *Emulator) PeekData(addr uint16) uint8 {
+    switch r := em.demap(addr).(type) {
+    case RegsRegion, RAMRegion:
+        return r.Load(addr)
+    case IORegion:
+        if port, ok := em.ports[r.regionSpec.BankNum()][addr-r.regionSpec.Start()].(PeekPort); ok {
+            return port.Peek()
+        }
+    }
+    return 0
+}
+
+// Sets the byte at the given address in data memory without side effects. I/O
+// ports are written through their Poke method. Unmapped addresses and ports
+// that do not implement PeekPort are not written; ok is false for these.
+func (em *Emulator) PokeData(addr uint16, val uint8) (ok bool) {
+    switch r := em.demap(addr).(type) {
+    case RegsRegion, RAMRegion:
+        r.Store(addr, val)
+        if em.sanitizer != nil {
+            em.sanitizer.define(addr)
+        }
+        return true
+    case IORegion:
+        if port, ok := em.ports[r.regionSpec.BankNum()][addr-r.regionSpec.Start()].(PeekPort); ok {
+            port.Poke(val)
+            if _, sreg := port.(SregPort); sreg && em.sanitizer != nil {
+                em.sanitizer.defineFlags()
+            }
+            return true
+        }
+    }
+    return false
+}
+
+// Returns the byte at the given address in data memory exactly as a load
+// instruction would: reads of I/O ports go through the registered Port, and
+// accesses to unmapped addresses or ports are logged as warnings.
+func (em *Emulator) LoadData(addr uint16) uint8 {
+    return em.loadDataByte(addr)
+}
+
+// Sets the byte at the given address in data memory exactly as a store
+// instruction would: writes to I/O ports go through the registered Port, and
+// accesses to unmapped addresses or ports are logged as warnings.
+func (em *Emulator) StoreData(addr uint16, val uint8) {
+    em.storeDataByte(addr, val)
+}
@@ -0,0 +1,100 @@
+package emulator
+
+import (
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+func TestStatusRegister(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.SetSREG(0x83)
+    if !em.Flag(avr.FlagI) || !em.Flag(avr.FlagZ) || !em.Flag(avr.FlagC) || em.Flag(avr.FlagN) {
+        t.Errorf("SetSREG(0x83): unexpected flags")
+    }
+
+    em.SetFlag(avr.FlagZ, false)
+    em.SetFlag(avr.FlagT, true)
+    if sreg := em.SREG(); sreg != 0xC1 {
+        t.Errorf("expected SREG 0xC1, got 0x%02X", sreg)
+    }
+    if sreg := em.LoadData(0x5F); sreg != 0xC1 {
+        t.Errorf("expected SREG port to read 0xC1, got 0x%02X", sreg)
+    }
+}
+
+func TestRegistersAndMemory(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+
+    em.SetRegPair(30, 0x1234)
+    if em.Reg(30) != 0x34 || em.Reg(31) != 0x12 || em.RegPair(30) != 0x1234 {
+        t.Errorf("SetRegPair(30, 0x1234): got r31:r30 = %02X:%02X", em.Reg(31), em.Reg(30))
+    }
+    // the register file is mapped into data memory
+    if em.PeekData(0x001E) != 0x34 {
+        t.Errorf("expected r30 at data address 0x001E")
+    }
+
+    em.SetPC(0x12345)
+    if em.PC() != 0x0345 {
+        t.Errorf("expected PC to wrap to 0x0345, got 0x%04X", em.PC())
+    }
+
+    em.SetProgWord(0x10, 0xABCD)
+    em.SetProgByte(0x21, 0x99)
+    if em.ProgWord(0x10) != 0x99CD || em.ProgByte(0x20) != 0xCD {
+        t.Errorf("unexpected program word 0x%04X", em.ProgWord(0x10))
+    }
+
+    if !em.PokeData(0x0100, 0x5A) || em.LoadData(0x0100) != 0x5A {
+        t.Errorf("PokeData to RAM failed")
+    }
+    if !em.PokeData(0x005F, 0x81) || em.SREG() != 0x81 || em.PeekData(0x005F) != 0x81 {
+        t.Errorf("PokeData to SREG failed")
+    }
+    em.StoreData(0x005D, 0xF0) // SPL
+    if em.SP() != 0x00F0 {
+        t.Errorf("expected SP 0x00F0, got 0x%04X", em.SP())
+    }
+}
+
+// A port that counts the calls to its Read and Write methods.
+type countingPort struct {
+    reads, writes int
+}
+
+func (p *countingPort) Read() uint8 {
+    p.reads++
+    return 0xFF
+}
+
+func (p *countingPort) Write(x uint8) {
+    p.writes++
+}
+
+func TestPeekPokeIO(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    p := &countingPort{}
+    em.RegisterPortByName("UDR0", p)
+    addr := uint16(0xC6)
+
+    // ports that do not implement PeekPort must not be read or written
+    if em.PeekData(addr) != 0 || em.PokeData(addr, 0x55) {
+        t.Errorf("expected PeekData to read 0 and PokeData to fail on a port without Peek")
+    }
+    if p.reads != 0 || p.writes != 0 {
+        t.Errorf("PeekData/PokeData called Read %d times and Write %d times", p.reads, p.writes)
+    }
+
+    // loads and stores still go through the port
+    em.LoadData(addr)
+    em.StoreData(addr, 0x55)
+    if p.reads != 1 || p.writes != 1 {
+        t.Errorf("expected one Read and one Write, got %d and %d", p.reads, p.writes)
+    }
+
+    // the stack pointer ports implement PeekPort
+    if !em.PokeData(0x005E, 0x04) || !em.PokeData(0x005D, 0xFF) || em.SP() != 0x04FF {
+        t.Errorf("expected SP 0x04FF, got 0x%04X", em.SP())
+    }
+}
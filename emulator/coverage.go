@@ -0,0 +1,162 @@
+package emulator
+
+import (
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/spec"
+)
+
+// A Coverage records which instructions of the program running in an Emulator
+// have been executed, and how many times, and for each conditional branch and
+// skip instruction, how many times it was taken and not taken.
+//
+// Coverage of source lines can be written in the lcov format with
+// debuginfo.Info.WriteLCOV; without debugging information, Summarize reports
+// the coverage of a range of program memory such as a function.
+type Coverage struct {
+    em       *Emulator
+    hits     []uint64 // indexed by word address
+    branches map[uint32]*BranchCoverage
+}
+
+// A BranchCoverage counts the outcomes of a conditional branch (BRBS or BRBC)
+// or skip (CPSE, SBRC, SBRS, SBIC or SBIS) instruction. A skip is taken if
+// the next instruction is skipped.
+type BranchCoverage struct {
+    PC       uint32 // word address
+    Inst     avr.Instruction
+    Taken    uint64
+    NotTaken uint64
+}
+
+// A FunctionCoverage summarises the coverage of a range of program memory.
+type FunctionCoverage struct {
+    Name string
+    PCRange
+    Instructions, Executed int
+    // The number of possible outcomes of the conditional instructions in the
+    // range (two for each instruction), and the number of those that occurred.
+    Branches, BranchesCovered int
+}
+
+// Creates a Coverage and attaches it to the emulator, replacing any Coverage
+// already attached.
+func NewCoverage(em *Emulator) (c *Coverage) {
+    c = &Coverage{
+        em:       em,
+        hits:     make([]uint64, len(em.prog)),
+        branches: make(map[uint32]*BranchCoverage),
+    }
+    em.coverage = c
+    em.updateHooks()
+    return c
+}
+
+// Detaches the Coverage from its emulator. The coverage recorded so far is
+// kept.
+func (c *Coverage) Stop() {
+    if c.em.coverage == c {
+        c.em.coverage = nil
+        c.em.updateHooks()
+    }
+}
+
+// Called after each instruction, with the word address it was fetched from.
+func (c *Coverage) instruction(pc uint32, inst avr.Instruction) {
+    c.hits[pc]++
+
+    if IsConditional(inst) {
+        b := c.branches[pc]
+        if b == nil {
+            b = &BranchCoverage{PC: pc, Inst: inst}
+            c.branches[pc] = b
+        }
+        if c.em.pc == (pc+1)&c.em.pcmask {
+            b.NotTaken++
+        } else {
+            b.Taken++
+        }
+    }
+}
+
+// Returns the number of times the instruction at the given word address has
+// been executed.
+func (c *Coverage) Hits(pc uint32) uint64 {
+    return c.hits[pc]
+}
+
+// Returns the outcomes of the conditional instruction at the given word
+// address. ok is false if no conditional instruction there has been executed.
+func (c *Coverage) Branch(pc uint32) (b BranchCoverage, ok bool) {
+    if p := c.branches[pc]; p != nil {
+        return *p, true
+    }
+    return BranchCoverage{}, false
+}
+
+// Returns the outcomes of every conditional instruction in the given range of
+// program memory, including those that have not been executed, in order of
+// address.
+func (c *Coverage) Conditionals(r PCRange) (bs []BranchCoverage) {
+    c.decodeRange(r, func(pc uint32, inst avr.Instruction) {
+        if IsConditional(inst) {
+            b, ok := c.Branch(pc)
+            if !ok {
+                b = BranchCoverage{PC: pc, Inst: inst}
+            }
+            bs = append(bs, b)
+        }
+    })
+    return bs
+}
+
+// Summarises the coverage of the instructions in the given range of program
+// memory.
+func (c *Coverage) Summarize(name string, r PCRange) (fc FunctionCoverage) {
+    fc.Name, fc.PCRange = name, r
+    c.decodeRange(r, func(pc uint32, inst avr.Instruction) {
+        fc.Instructions++
+        if c.hits[pc] != 0 {
+            fc.Executed++
+        }
+    })
+    for _, b := range c.Conditionals(r) {
+        fc.Branches += 2
+        if b.Taken != 0 {
+            fc.BranchesCovered++
+        }
+        if b.NotTaken != 0 {
+            fc.BranchesCovered++
+        }
+    }
+    return fc
+}
+
+// Calls f for each valid instruction in the given range of program memory,
+// found by decoding it from its start.
+func (c *Coverage) decodeRange(r PCRange, f func(pc uint32, inst avr.Instruction)) {
+    decode := DecodeNonRC
+    if c.em.Spec.Family == spec.ReducedCore {
+        decode = DecodeRC
+    }
+
+    for pc := r.Start; pc < r.End && pc < uint32(len(c.em.prog)); pc++ {
+        inst := decode(c.em.prog[pc])
+        if inst < 0 {
+            continue
+        }
+        f(pc, inst)
+        if inst.IsTwoWord() {
+            pc++
+        }
+    }
+}
+
+// Reports whether inst is a conditional branch or skip instruction, whose
+// outcomes are recorded by a Coverage.
+func IsConditional(inst avr.Instruction) bool {
+    switch inst {
+    case avr.BRBC, avr.BRBS, avr.CPSE, avr.SBRC, avr.SBRS, avr.SBIC, avr.SBIS:
+        return true
+    }
+    return false
+}
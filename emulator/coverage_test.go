@@ -0,0 +1,47 @@
+package emulator
+
+import (
+    "github.com/kierdavis/avr/asm"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+const coverageTestProgram = `
+        ldi     r16, 2
+loop:   subi    r16, 1
+        brne    loop
+        sbrs    r16, 0
+        rjmp    done
+        jmp     0
+done:   rjmp    done
+`
+
+func TestCoverage(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, coverageTestProgram))
+    c := NewCoverage(em)
+    em.Run(20)
+    c.Stop()
+
+    if c.Hits(1) != 2 || c.Hits(5) != 0 || c.Hits(7) == 0 {
+        t.Errorf("unexpected hits: %d %d %d", c.Hits(1), c.Hits(5), c.Hits(7))
+    }
+    if b, ok := c.Branch(2); !ok || b.Taken != 1 || b.NotTaken != 1 {
+        t.Errorf("unexpected outcomes of brne: %+v", b)
+    }
+    if b, ok := c.Branch(3); !ok || b.Taken != 0 || b.NotTaken != 1 {
+        t.Errorf("unexpected outcomes of sbrs: %+v", b)
+    }
+
+    expected := FunctionCoverage{
+        Name:            "all",
+        PCRange:         PCRange{0, 8},
+        Instructions:    7,
+        Executed:        6,
+        Branches:        4,
+        BranchesCovered: 3,
+    }
+    if fc := c.Summarize("all", PCRange{0, 8}); fc != expected {
+        t.Errorf("expected %+v, got %+v", expected, fc)
+    }
+}
@@ -0,0 +1,149 @@
+package emulator
+
+import (
+    "github.com/kierdavis/avr"
+    "sort"
+)
+
+// A WatchKind selects the accesses that trigger a watchpoint.
+type WatchKind int
+
+const (
+    WatchWrite  WatchKind = 1 << iota // stores to data memory and writes to ports
+    WatchRead                         // loads from data memory and reads from ports
+    WatchAccess = WatchWrite | WatchRead
+)
+
+// A Watchpoint stops Run after an instruction accesses a range of data
+// addresses. Addresses in the I/O region watch the port at that address; see
+// PortAddress. Addresses in the register file only see accesses made through
+// the data space, such as by LD, ST or PUSH: instructions that take registers
+// as operands, such as ADD or MOV, do not trigger watchpoints.
+type Watchpoint struct {
+    Addr uint16    // first data address watched
+    Size uint16    // number of addresses watched (0 is treated as 1)
+    Kind WatchKind // accesses that trigger the watchpoint
+    // If Conditional is true, the watchpoint only triggers when the value read
+    // or written is equal to Value.
+    Conditional bool
+    Value       uint8
+}
+
+// Returns true if the access triggers the watchpoint.
+func (w Watchpoint) matches(a Access) bool {
+    size := w.Size
+    if size == 0 {
+        size = 1
+    }
+    if a.Addr-w.Addr >= size {
+        return false
+    }
+    if w.Conditional && a.Value != w.Value {
+        return false
+    }
+    switch a.Kind {
+    case DataWrite, PortWrite:
+        return w.Kind&WatchWrite != 0
+    default:
+        return w.Kind&WatchRead != 0
+    }
+}
+
+// Sets a breakpoint at the given word address in program memory. Run stops
+// before executing the instruction at a breakpoint; when Run is next called,
+// that instruction is executed rather than stopping again.
+func (em *Emulator) SetBreakpoint(pc uint32) {
+    if em.breakpoints == nil {
+        em.breakpoints = make(map[uint32]bool)
+    }
+    em.breakpoints[pc&em.pcmask] = true
+    em.updateDebugging()
+}
+
+// Removes the breakpoint at the given word address, if there is one.
+func (em *Emulator) ClearBreakpoint(pc uint32) {
+    delete(em.breakpoints, pc&em.pcmask)
+    if len(em.breakpoints) == 0 {
+        em.breakpoints = nil
+    }
+    em.updateDebugging()
+}
+
+// Returns the addresses of the breakpoints, in ascending order.
+func (em *Emulator) Breakpoints() (pcs []uint32) {
+    for pc := range em.breakpoints {
+        pcs = append(pcs, pc)
+    }
+    sort.Slice(pcs, func(i, j int) bool { return pcs[i] < pcs[j] })
+    return pcs
+}
+
+// Adds a watchpoint.
+func (em *Emulator) AddWatchpoint(w Watchpoint) {
+    em.watchpoints = append(em.watchpoints, w)
+    em.updateDebugging()
+}
+
+// Removes a watchpoint equal to w. Returns false if there is none.
+func (em *Emulator) RemoveWatchpoint(w Watchpoint) (ok bool) {
+    for i, other := range em.watchpoints {
+        if other == w {
+            em.watchpoints = append(em.watchpoints[:i], em.watchpoints[i+1:]...)
+            if len(em.watchpoints) == 0 {
+                em.watchpoints = nil
+            }
+            em.updateDebugging()
+            return true
+        }
+    }
+    return false
+}
+
+// Returns the watchpoints, in the order they were added.
+func (em *Emulator) Watchpoints() []Watchpoint {
+    return append([]Watchpoint(nil), em.watchpoints...)
+}
+
+// Returns the data address of an I/O port, for use in a Watchpoint.
+func (em *Emulator) PortAddress(pref avr.PortRef) uint16 {
+    return em.ioStart[pref.BankNum] + pref.Index
+}
+
+// Returns the watchpoint that stopped the last call to Run, and the access
+// that triggered it. The result is only meaningful if Run returned
+// avr.StopWatchpoint.
+func (em *Emulator) StopAccess() (w Watchpoint, a Access) {
+    return em.watchHit, em.watchAccess
+}
+
+// Sets whether a debugger is attached. While one is, the BREAK instruction
+// stops Run with avr.StopBreak, as it halts the CPU for an on-chip debugger;
+// otherwise BREAK does nothing, as on hardware with on-chip debugging
+// disabled.
+func (em *Emulator) SetDebuggerAttached(attached bool) {
+    em.debugger = attached
+}
+
+// Returns true if a debugger is attached.
+func (em *Emulator) DebuggerAttached() bool {
+    return em.debugger
+}
+
+func (em *Emulator) updateDebugging() {
+    em.debugging = em.breakpoints != nil || em.watchpoints != nil
+    em.updateHooks()
+}
+
+// Called for each access while there are watchpoints.
+func (em *Emulator) checkWatchpoints(a Access) {
+    if em.pendingStop != avr.StopTicks {
+        return
+    }
+    for _, w := range em.watchpoints {
+        if w.matches(a) {
+            em.pendingStop = avr.StopWatchpoint
+            em.watchHit, em.watchAccess = w, a
+            return
+        }
+    }
+}
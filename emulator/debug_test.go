@@ -0,0 +1,100 @@
+package emulator
+
+import (
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+// A port that remembers the last value written to it.
+type latchPort struct {
+    value uint8
+}
+
+func (p *latchPort) Read() uint8 {
+    return p.value
+}
+
+func (p *latchPort) Write(x uint8) {
+    p.value = x
+}
+
+func TestBreakpointsAndWatchpoints(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, []uint16{
+        0xE005,         // ldi r16, 5
+        0x9300, 0x0100, // sts 0x0100, r16
+        0x5F0F, // subi r16, 0xFF
+        0xB905, // out PORTB, r16
+        0xCFFB, // rjmp .-10
+    })
+    portb := &latchPort{}
+    em.RegisterPortByName("PORTB", portb)
+
+    check := func(what string, reason avr.StopReason, executed uint, expectedReason avr.StopReason, expectedTicks uint, pc uint32) {
+        if reason != expectedReason || executed != expectedTicks || em.PC() != pc {
+            t.Errorf("%s: expected %s after %d ticks at 0x%04X, got %s after %d ticks at 0x%04X",
+                what, expectedReason, expectedTicks, pc, reason, executed, em.PC())
+        }
+    }
+
+    em.SetBreakpoint(3)
+    reason, executed := em.Run(100)
+    check("breakpoint", reason, executed, avr.StopBreakpoint, 3, 3)
+    // the instruction at the breakpoint is executed when resuming
+    reason, executed = em.Run(100)
+    check("resume from breakpoint", reason, executed, avr.StopBreakpoint, 6, 3)
+    em.ClearBreakpoint(3)
+
+    w := Watchpoint{Addr: 0x0100, Kind: WatchWrite, Conditional: true, Value: 8}
+    em.AddWatchpoint(w)
+    reason, executed = em.Run(100)
+    check("conditional watchpoint", reason, executed, avr.StopWatchpoint, 12, 3)
+    if hit, a := em.StopAccess(); hit != w || a.Kind != DataWrite || a.Old != 7 || a.Value != 8 {
+        t.Errorf("unexpected watchpoint %+v or access %+v", hit, a)
+    }
+    if !em.RemoveWatchpoint(w) || len(em.Watchpoints()) != 0 {
+        t.Errorf("watchpoint not removed")
+    }
+
+    pref := spec.ATmega168.Ports["PORTB"]
+    em.AddWatchpoint(Watchpoint{Addr: em.PortAddress(pref), Kind: WatchAccess})
+    reason, executed = em.Run(100)
+    check("port watchpoint", reason, executed, avr.StopWatchpoint, 2, 5)
+    if _, a := em.StopAccess(); a.Kind != PortWrite || a.Port != pref || portb.value != 9 {
+        t.Errorf("unexpected access %+v, PORTB = %d", a, portb.value)
+    }
+
+    em.RemoveWatchpoint(Watchpoint{Addr: em.PortAddress(pref), Kind: WatchAccess})
+
+    // an instruction that triggers a watchpoint and runs past the end of the
+    // budget has its excess ticks consumed by the next call
+    em.AddWatchpoint(Watchpoint{Addr: 0x0100, Size: 2, Kind: WatchWrite})
+    reason, executed = em.Run(3)
+    check("watchpoint at end of budget", reason, executed, avr.StopWatchpoint, 3, 3)
+    reason, executed = em.Run(1)
+    check("excess ticks", reason, executed, avr.StopTicks, 1, 3)
+}
+
+func TestBreakInstruction(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, []uint16{
+        0x9598, // break
+        0x5F0F, // subi r16, 0xFF
+        0xCFFD, // rjmp .-6
+    })
+
+    // without a debugger, BREAK is a no-operation
+    if reason, executed := em.Run(8); reason != avr.StopTicks || executed != 8 || em.Reg(16) != 2 {
+        t.Errorf("without debugger: %s after %d ticks, r16 = %d", reason, executed, em.Reg(16))
+    }
+
+    em.SetDebuggerAttached(true)
+    if reason, executed := em.Run(100); reason != avr.StopBreak || executed != 1 || em.PC() != 1 {
+        t.Errorf("with debugger: %s after %d ticks at 0x%04X", reason, executed, em.PC())
+    }
+    // resuming continues after the BREAK
+    if reason, executed := em.Run(100); reason != avr.StopBreak || executed != 4 || em.Reg(16) != 3 {
+        t.Errorf("resuming: %s after %d ticks, r16 = %d", reason, executed, em.Reg(16))
+    }
+}
@@ -3,40 +3,80 @@ package emulator
 import (
     "github.com/kierdavis/avr"
     "github.com/kierdavis/avr/spec"
-    "log"
+    "math/rand"
 )
 
 // An Emulator encapsulates the state of a processor.
 type Emulator struct {
-    Spec        *spec.MCUSpec
-    regions     []Region
-    ports       [][]Port
-    prog        []uint16
-    ram         []uint8
-    pc          uint32
-    pcmask      uint32
-    sp          uint16
-    rampx       uint8
-    rampy       uint8
-    rampz       uint8
-    rampd       uint8
-    eind        uint8
-    regs        [32]uint8
-    flags       [8]uint8
-    logging     bool
-    excessTicks uint
+    Spec         *spec.MCUSpec
+    regions      []Region
+    ports        [][]Port
+    prog         []uint16
+    ram          []uint8
+    eeprom       []uint8
+    fuses        []uint8
+    lockBits     uint8
+    pc           uint32
+    pcmask       uint32
+    sp           uint16
+    rampx        uint8
+    rampy        uint8
+    rampz        uint8
+    rampd        uint8
+    eind         uint8
+    regs         [32]uint8
+    flags        [8]uint8
+    logging      bool
+    warnings     warnings
+    excessTicks  uint
+    snapshotters []Snapshotter
+    recorder     *Recorder
+    accessHook   func(Access)
+    ioStart      []uint16 // data address of the start of each I/O bank
+    instructions uint64
+    cycles       uint64
+    tracer       *Tracer
+    profiler     *Profiler
+    coverage     *Coverage
+    stack        *StackMonitor
+    sanitizer    *Sanitizer
+    inService    []uint // interrupts whose handlers are executing, innermost last
+    instrumented bool   // true if any per-instruction hook is attached; see updateHooks
+    observing    bool   // true if accesses are passed to observe; see updateHooks
+
+    // debugging state; see debug.go
+    debugging   bool // true if there are breakpoints or watchpoints
+    breakpoints map[uint32]bool
+    watchpoints []Watchpoint
+    resumePC    uint32 // breakpoint at which the last Run stopped
+    resuming    bool
+    debugger    bool           // true if a debugger is attached
+    pendingStop avr.StopReason // set during an instruction that stops Run
+    watchHit    Watchpoint
+    watchAccess Access
 }
 
 // NewEmulator creates and returns an initialised Emulator for the given MCUSpec.
 func NewEmulator(mcuSpec *spec.MCUSpec) (em *Emulator) {
     em = &Emulator{
-        Spec:    mcuSpec,
-        regions: make([]Region, len(mcuSpec.Regions)),
-        ports:   make([][]Port, len(mcuSpec.IOBankSizes)),
-        prog:    make([]uint16, 1<<mcuSpec.LogProgMemSize),
-        ram:     make([]uint8, 1<<mcuSpec.LogRAMSize),
-        pc:      0,
-        pcmask:  (1 << mcuSpec.LogProgMemSize) - 1,
+        Spec:     mcuSpec,
+        regions:  make([]Region, len(mcuSpec.Regions)),
+        ports:    make([][]Port, len(mcuSpec.IOBankSizes)),
+        prog:     make([]uint16, 1<<mcuSpec.LogProgMemSize),
+        ram:      make([]uint8, 1<<mcuSpec.LogRAMSize),
+        eeprom:   make([]uint8, mcuSpec.EEPROMSize()),
+        fuses:    make([]uint8, mcuSpec.NumFuseBytes),
+        lockBits: 0xFF,
+        pc:       0,
+        pcmask:   (1 << mcuSpec.LogProgMemSize) - 1,
+    }
+
+    // erased EEPROM and unprogrammed fuses read as ones
+    for i := range em.eeprom {
+        em.eeprom[i] = 0xFF
+    }
+    for i := range em.fuses {
+        em.fuses[i] = 0xFF
     }
 
     for i := range em.ports {
@@ -55,6 +95,10 @@ func NewEmulator(mcuSpec *spec.MCUSpec) (em *Emulator) {
             em.regions[i] = RegsRegion{em, regionSpec}
         case spec.IORegionSpec:
             em.regions[i] = IORegion{em, regionSpec}
+            if em.ioStart == nil {
+                em.ioStart = make([]uint16, len(mcuSpec.IOBankSizes))
+            }
+            em.ioStart[regionSpec.BankNum()] = regionSpec.Start()
         case spec.RAMRegionSpec:
             em.regions[i] = RAMRegion{em, regionSpec}
         }
@@ -67,6 +111,63 @@ func (em *Emulator) SetLogging(enabled bool) {
     em.logging = enabled
 }
 
+// Sets a function to be called for every access to data memory or an I/O port
+// made by an instruction, after the access is made. This is intended for
+// debuggers implementing watchpoints. Pass nil to remove the hook.
+func (em *Emulator) SetAccessHook(hook func(a Access)) {
+    em.accessHook = hook
+    em.updateHooks()
+}
+
+// Returns the number of instructions executed (including invalid instruction
+// words skipped) since the emulator was created. A debugger can run the
+// emulator one tick at a time until this changes in order to step a single
+// instruction.
+func (em *Emulator) InstructionCount() uint64 {
+    return em.instructions
+}
+
+// Returns the number of clock cycles taken by the instructions executed since
+// the emulator was created.
+func (em *Emulator) Cycles() uint64 {
+    return em.cycles
+}
+
+// Resets the CPU, as a reset from the RESET pin or a watchdog timeout would:
+// execution restarts from the reset vector with interrupts disabled, and SP
+// points to the end of RAM. The general-purpose registers and the contents of
+// memory are unaffected, as on hardware. Only the CPU is reset: on hardware, a
+// reset also returns the I/O registers to their reset values, so peripherals
+// must be reset separately (see, for example, gpio.GPIO.Reset and
+// timer.Timer.Reset).
+func (em *Emulator) Reset() {
+    em.pc = 0
+    _, em.sp = ramBounds(em.Spec)
+    em.rampx, em.rampy, em.rampz, em.rampd, em.eind = 0, 0, 0, 0, 0
+    em.flags = [8]uint8{}
+    em.excessTicks = 0
+    em.inService = em.inService[:0]
+    if em.profiler != nil {
+        em.profiler.reset()
+    }
+    if em.stack != nil {
+        em.stack.reset()
+    }
+    if em.sanitizer != nil {
+        em.sanitizer.defineFlags()
+    }
+}
+
+// Returns the first and last addresses of RAM in data memory.
+func ramBounds(s *spec.MCUSpec) (start, end uint16) {
+    for _, r := range s.Regions {
+        if r, ok := r.(spec.RAMRegionSpec); ok {
+            return r.Start(), r.Start() + r.Size() - 1
+        }
+    }
+    return 0, 0
+}
+
 func (em *Emulator) RegisterPort(pref avr.PortRef, port Port) {
     em.ports[pref.BankNum][pref.Index] = port
 }
@@ -99,12 +200,30 @@ func (em *Emulator) InterruptsEnabled() bool {
 
 func (em *Emulator) Interrupt(num uint) {
     if em.InterruptsEnabled() {
+        interrupted := em.pc
+        if em.stack != nil {
+            em.stack.interrupt(num, em.sp)
+        }
         em.flags[avr.FlagI] = 0
         em.pushPC()
         em.pc = uint32(num * em.Spec.InterruptVectorSize)
+        em.inService = append(em.inService, num)
+        if em.profiler != nil {
+            em.profiler.push(interrupted)
+        }
     }
 }
 
+// Returns the number of the interrupt whose handler is executing, if any. An
+// interrupt is in service from when it is taken until the RETI that returns
+// from its handler; if handlers are nested, the innermost one is returned.
+func (em *Emulator) InterruptInService() (num uint, ok bool) {
+    if n := len(em.inService); n > 0 {
+        return em.inService[n-1], true
+    }
+    return 0, false
+}
+
 func (em *Emulator) InterruptByName(name string) (ok bool) {
     num, ok := em.Spec.Interrupts[name]
     if !ok {
@@ -114,7 +233,15 @@ func (em *Emulator) InterruptByName(name string) (ok bool) {
     return true
 }
 
-func (em *Emulator) Run(ticks uint) {
+// Runs the program for the given number of ticks, or until it reaches a
+// breakpoint, triggers a watchpoint, executes a BREAK instruction with a
+// debugger attached or causes a warning whose action is WarningStop. Returns
+// the reason for stopping (see StopAccess and StopWarning for the details of
+// a watchpoint or warning) and the number of ticks consumed, which is less
+// than ticks only if the emulator stopped early. An instruction that runs past
+// the end of the ticks given is completed, and its excess ticks are consumed by
+// the next call.
+func (em *Emulator) Run(ticks uint) (reason avr.StopReason, executed uint) {
     // subtract ticks that were executed on the last call to Run
     ticksExecuted := em.excessTicks
 
@@ -126,37 +253,211 @@ func (em *Emulator) Run(ticks uint) {
     }
 
     for ticksExecuted < ticks {
+        if em.debugging {
+            if em.pendingStop != avr.StopTicks {
+                // a watchpoint triggered by an interrupt taken since the last
+                // instruction
+                reason, em.pendingStop = em.pendingStop, avr.StopTicks
+                em.excessTicks = 0
+                return reason, ticksExecuted
+            }
+            if em.breakpoints[em.pc] && !(em.resuming && em.resumePC == em.pc) {
+                em.resumePC, em.resuming = em.pc, true
+                em.excessTicks = 0
+                return avr.StopBreakpoint, ticksExecuted
+            }
+            em.resuming = false
+        }
+
+        if em.instrumented {
+            em.beginInstruction()
+        }
+
+        em.instructions++
+        pc := em.pc
         word := em.fetchProgWord()
         inst := decodeFunc(word)
-        if inst < 0 {
+        var cycles uint
+        switch {
+        case inst < 0:
             em.warn(InvalidInstructionWarning{em.pc - 1, word})
-            ticksExecuted++
-            continue
+            cycles = 1
+        case !em.Spec.Available[inst]:
+            em.warn(UnavailableInstructionWarning{em.pc - 1, inst, em.Spec})
+            cycles = 1
+        default:
+            if em.instrumented && em.sanitizer != nil {
+                em.sanitizer.beginInstruction(pc, inst, word)
+            }
+            cycles = handlers[inst](em, word)
         }
+        ticksExecuted += cycles
+        em.cycles += uint64(cycles)
 
-        if !em.Spec.Available[inst] {
-            em.warn(UnavailableInstructionWarning{em.pc - 1, inst, em.Spec})
-            ticksExecuted++
-            continue
+        if em.instrumented {
+            em.endInstruction(pc, inst, cycles)
         }
 
-        handler := handlers[inst]
-        ticksExecuted += handler(em, word)
+        if em.pendingStop != avr.StopTicks {
+            reason, em.pendingStop = em.pendingStop, avr.StopTicks
+            em.resuming = false
+            if ticksExecuted > ticks {
+                em.excessTicks = ticksExecuted - ticks
+                return reason, ticks
+            }
+            em.excessTicks = 0
+            return reason, ticksExecuted
+        }
     }
 
     em.excessTicks = ticksExecuted - ticks
+    return avr.StopTicks, ticks
+}
+
+// Calls the hooks that run before each instruction.
+func (em *Emulator) beginInstruction() {
+    if em.recorder != nil {
+        em.recorder.beginInstruction()
+    }
+    if em.tracer != nil {
+        em.tracer.beginInstruction()
+    }
+}
+
+// Calls the hooks that run after each instruction.
+func (em *Emulator) endInstruction(pc uint32, inst avr.Instruction, cycles uint) {
+    if em.tracer != nil {
+        em.tracer.endInstruction(inst)
+    }
+    if em.profiler != nil {
+        em.profiler.instruction(pc, inst, cycles)
+    }
+    if em.coverage != nil {
+        em.coverage.instruction(pc, inst)
+    }
+    if em.stack != nil {
+        em.stack.instruction(pc)
+    }
+    if em.sanitizer != nil {
+        em.sanitizer.endInstruction()
+    }
+}
+
+// Recomputes instrumented and observing. Called whenever a hook is attached or
+// detached, and whenever breakpoints or watchpoints are set or removed, so that
+// Run checks a single flag per instruction when nothing is attached.
+func (em *Emulator) updateHooks() {
+    em.instrumented = em.recorder != nil || em.tracer != nil || em.profiler != nil ||
+        em.coverage != nil || em.stack != nil || em.sanitizer != nil
+    em.observing = em.recorder != nil || em.accessHook != nil || em.debugging ||
+        em.tracer != nil || em.sanitizer != nil
 }
 
 // Copy program words from buf into program memory starting at the given address.
 // The method panics if the address is out of range at any point (the size of the
 // program memory is equal to 1 << em.Spec.LogProgMemSize).
-func (em *Emulator) WriteProg(address uint16, buf []uint16) {
+func (em *Emulator) WriteProg(address uint32, buf []uint16) {
     for _, word := range buf {
         em.prog[address] = word
         address++
     }
 }
 
+// Copy bytes from buf into EEPROM starting at the given address. The method
+// panics if the address is out of range at any point (the size of the EEPROM is
+// given by em.Spec.EEPROMSize()).
+func (em *Emulator) WriteEEPROM(address uint16, buf []uint8) {
+    for _, b := range buf {
+        em.eeprom[address] = b
+        address++
+    }
+}
+
+// Copy bytes from buf into data memory starting at the given address. Bytes
+// that fall in the register file or RAM are written directly; bytes that fall
+// on I/O ports or unmapped addresses are skipped, as writing to a port may
+// have side effects.
+func (em *Emulator) WriteData(address uint16, buf []uint8) {
+    for _, b := range buf {
+        switch r := em.demap(address).(type) {
+        case RegsRegion, RAMRegion:
+            r.Store(address, b)
+            if em.sanitizer != nil {
+                em.sanitizer.define(address)
+            }
+        }
+        address++
+    }
+}
+
+// Fills the register file and RAM with random bytes from r. On hardware their
+// contents at power-up are unpredictable rather than zero, so running a program
+// from random initial memory (with a few different seeds) exposes code that
+// reads memory it never initialised.
+func (em *Emulator) RandomizeRAM(r *rand.Rand) {
+    for i := range em.regs {
+        em.regs[i] = uint8(r.Intn(256))
+    }
+    for i := range em.ram {
+        em.ram[i] = uint8(r.Intn(256))
+    }
+}
+
+// Copy program words starting at the given address into buf. The method panics
+// if the address is out of range at any point.
+func (em *Emulator) ReadProg(address uint32, buf []uint16) {
+    for i := range buf {
+        buf[i] = em.prog[address]
+        address++
+    }
+}
+
+// Copy bytes from EEPROM starting at the given address into buf. The method
+// panics if the address is out of range at any point.
+func (em *Emulator) ReadEEPROM(address uint16, buf []uint8) {
+    for i := range buf {
+        buf[i] = em.eeprom[address]
+        address++
+    }
+}
+
+// Copy bytes from data memory starting at the given address into buf. Bytes in
+// the register file or RAM are read directly; bytes on I/O ports or unmapped
+// addresses read as zero, as reading a port may have side effects.
+func (em *Emulator) ReadData(address uint16, buf []uint8) {
+    for i := range buf {
+        switch r := em.demap(address).(type) {
+        case RegsRegion, RAMRegion:
+            buf[i] = r.Load(address)
+        default:
+            buf[i] = 0
+        }
+        address++
+    }
+}
+
+// Returns the value of fuse byte n (0 is the low fuse byte, 1 the high fuse
+// byte and 2 the extended fuse byte). Unprogrammed fuse bits read as ones.
+func (em *Emulator) Fuse(n uint) uint8 {
+    return em.fuses[n]
+}
+
+// Sets the value of fuse byte n. The method panics if n is not less than
+// em.Spec.NumFuseBytes.
+func (em *Emulator) SetFuse(n uint, val uint8) {
+    em.fuses[n] = val
+}
+
+// Returns the value of the lock bits.
+func (em *Emulator) LockBits() uint8 {
+    return em.lockBits
+}
+
+// Sets the value of the lock bits.
+func (em *Emulator) SetLockBits(val uint8) {
+    em.lockBits = val
+}
+
 func (em *Emulator) fetchProgWord() (word uint16) {
     word = em.prog[em.pc]
     em.pc = (em.pc + 1) & em.pcmask
@@ -177,7 +478,14 @@ func (em *Emulator) demap(addr uint16) (r Region) {
 func (em *Emulator) loadDataByte(addr uint16) uint8 {
     r := em.demap(addr)
     if r != nil {
-        return r.Load(addr)
+        val := r.Load(addr)
+        if em.observing {
+            switch r.(type) {
+            case RegsRegion, RAMRegion:
+                em.observe(Access{Kind: DataRead, Addr: addr, Value: val})
+            }
+        }
+        return val
     } else {
         em.warn(UnmappedAddressWarning{em.pc - 1, addr})
         return 0
@@ -187,6 +495,15 @@ func (em *Emulator) loadDataByte(addr uint16) uint8 {
 func (em *Emulator) storeDataByte(addr uint16, val uint8) {
     r := em.demap(addr)
     if r != nil {
+        if em.observing {
+            switch r.(type) {
+            case RegsRegion, RAMRegion:
+                old := r.Load(addr)
+                r.Store(addr, val)
+                em.observe(Access{Kind: DataWrite, Addr: addr, Old: old, Value: val})
+                return
+            }
+        }
         r.Store(addr, val)
     } else {
         em.warn(UnmappedAddressWarning{em.pc - 1, addr})
@@ -203,22 +520,25 @@ func (em *Emulator) pop() uint8 {
     return em.loadDataByte(em.sp)
 }
 
+// The return address is pushed low byte first, so that it is stored big-endian
+// in memory, as on hardware (and as debuggers expect when unwinding the stack).
 func (em *Emulator) pushPC() {
+    em.push(uint8(em.pc))
+    em.push(uint8(em.pc >> 8))
+
     if em.Spec.LogProgMemSize > 16 { // pc is 3 bytes
         em.push(uint8(em.pc >> 16))
     }
-
-    em.push(uint8(em.pc >> 8))
-    em.push(uint8(em.pc))
 }
 
 func (em *Emulator) popPC() {
-    em.pc = uint32(em.pop())
-    em.pc |= uint32(em.pop()) << 8
-
+    em.pc = 0
     if em.Spec.LogProgMemSize > 16 { // pc is 3 bytes
-        em.pc |= uint32(em.pop()) << 16
+        em.pc = uint32(em.pop()) << 16
     }
+
+    em.pc |= uint32(em.pop()) << 8
+    em.pc |= uint32(em.pop())
 }
 
 func (em *Emulator) readPort(bankNum uint, index uint16) uint8 {
@@ -228,7 +548,11 @@ func (em *Emulator) readPort(bankNum uint, index uint16) uint8 {
         return 0
     }
 
-    return port.Read()
+    val := port.Read()
+    if em.observing {
+        em.observe(Access{Kind: PortRead, Addr: em.ioStart[bankNum] + index, Port: avr.PortRef{bankNum, index}, Value: val})
+    }
+    return val
 }
 
 func (em *Emulator) writePort(bankNum uint, index uint16, val uint8) {
@@ -239,6 +563,29 @@ func (em *Emulator) writePort(bankNum uint, index uint16, val uint8) {
     }
 
     port.Write(val)
+    if em.observing {
+        em.observe(Access{Kind: PortWrite, Addr: em.ioStart[bankNum] + index, Port: avr.PortRef{bankNum, index}, Value: val})
+    }
+}
+
+// Passes an access to the recorder, the tracer, the sanitizer, the watchpoints
+// and the access hook, if set.
+func (em *Emulator) observe(a Access) {
+    if em.recorder != nil && a.Kind != DataRead {
+        em.recorder.record(a)
+    }
+    if em.tracer != nil {
+        em.tracer.record(a)
+    }
+    if em.sanitizer != nil {
+        em.sanitizer.access(a)
+    }
+    if em.watchpoints != nil {
+        em.checkWatchpoints(a)
+    }
+    if em.accessHook != nil {
+        em.accessHook(a)
+    }
 }
 
 // Skip the next instruction. Returns 1 if one word was skipped or 2 if two
@@ -259,14 +606,3 @@ func (em *Emulator) skip() (cycles uint) {
     }
     return 1
 }
-
-// Log a warning, if warning logging is enabled. Warnings include events such as
-// * invalid instructions
-// * instructions not available on this particular MCU
-// * accesses to an unmapped data memory address
-// which are ignored by a real MCU but are often indicative of software errors.
-func (em *Emulator) warn(w Warning) {
-    if em.logging {
-        log.Printf("[avr/emulator:(*Emulator).warn] %s\n", w.String())
-    }
-}
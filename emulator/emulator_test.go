@@ -0,0 +1,57 @@
+package emulator
+
+import (
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+// Return addresses are pushed low byte first, so that the high byte is at the
+// lower address, as on hardware.
+func TestReturnAddressLayout(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0x0002, []uint16{0x9518})         // reti (INT0 vector)
+    em.WriteProg(0x0120, []uint16{0x940E, 0x0200}) // call 0x0400
+    em.WriteProg(0x0200, []uint16{0x9508})         // ret
+    em.SetPC(0x0120)
+    em.SetSP(0x04FF)
+
+    check := func(what string, sp uint16, stack []uint8, pc uint32) {
+        if em.SP() != sp || em.PC() != pc {
+            t.Errorf("%s: expected SP 0x%04X and PC 0x%04X, got 0x%04X and 0x%04X", what, sp, pc, em.SP(), em.PC())
+        }
+        for i, b := range stack {
+            if got := em.PeekData(sp + 1 + uint16(i)); got != b {
+                t.Errorf("%s: expected 0x%02X at 0x%04X, got 0x%02X", what, b, sp+1+uint16(i), got)
+            }
+        }
+    }
+
+    em.Run(4)
+    check("after CALL", 0x04FD, []uint8{0x01, 0x22}, 0x0200)
+
+    em.SetFlag(avr.FlagI, true)
+    em.Interrupt(1)
+    check("after interrupt", 0x04FB, []uint8{0x02, 0x00, 0x01, 0x22}, 0x0002)
+
+    em.Run(4)
+    check("after RETI", 0x04FD, []uint8{0x01, 0x22}, 0x0200)
+    em.Run(4)
+    check("after RET", 0x04FF, nil, 0x0122)
+}
+
+func TestReset(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.SetPC(0x0120)
+    em.SetSP(0x0300)
+    em.SetFlag(avr.FlagI, true)
+    em.SetReg(16, 0x42)
+
+    em.Reset()
+    if em.PC() != 0 || em.SP() != 0x04FF || em.Flag(avr.FlagI) {
+        t.Errorf("expected PC 0x0000, SP 0x04FF and interrupts disabled, got PC 0x%04X, SP 0x%04X and I = %t", em.PC(), em.SP(), em.Flag(avr.FlagI))
+    }
+    if em.Reg(16) != 0x42 {
+        t.Errorf("expected registers to be kept, got r16 = 0x%02X", em.Reg(16))
+    }
+}
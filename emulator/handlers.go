@@ -281,9 +281,11 @@ func doBRBS(em *Emulator, word uint16) (cycles uint) {
     return 1
 }
 
-// breakpoint
+// breakpoint; a no-operation unless a debugger is attached
 func doBREAK(em *Emulator, word uint16) (cycles uint) {
-    panic("doBREAK: unimplemented")
+    if em.debugger {
+        em.pendingStop = avr.StopBreak
+    }
     return 1
 }
 
@@ -1227,6 +1229,9 @@ func doRET(em *Emulator, word uint16) (cycles uint) {
 func doRETI(em *Emulator, word uint16) (cycles uint) {
     em.popPC()
     em.flags[avr.FlagI] = 1
+    if n := len(em.inService); n > 0 {
+        em.inService = em.inService[:n-1]
+    }
 
     if em.Spec.LogProgMemSize > 16 {
         return 5
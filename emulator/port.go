@@ -10,6 +10,20 @@ type Port interface {
     Write(uint8)
 }
 
+// A PeekPort is a Port whose contents can be inspected and modified without the
+// side effects of an instruction accessing it. Peek returns what Read would,
+// and Poke changes the port's contents as Write would, but neither acts on the
+// rest of the peripheral: poking a timer's control register does not force an
+// output compare, for example. Poking a port that drives output pins, such as
+// a GPIO port, still updates the pins. Debuggers use it through PeekData and
+// PokeData, and a Recorder pokes ports to redo the writes made to them; ports
+// that do not implement it cannot be inspected.
+type PeekPort interface {
+    Port
+    Peek() uint8
+    Poke(uint8)
+}
+
 // SregPort implements the SREG (status register) I/O port. It is automatically
 // registered upon creation of an Emulator.
 type SregPort struct {
@@ -38,6 +52,14 @@ func (p SregPort) Write(x uint8) {
     p.em.flags[avr.FlagC] = x & 1
 }
 
+func (p SregPort) Peek() uint8 {
+    return p.Read()
+}
+
+func (p SregPort) Poke(x uint8) {
+    p.Write(x)
+}
+
 // SphPort implements the SPH (stack pointer high byte) I/O port. It is
 // automatically registered upon creation of an Emulator.
 type SphPort struct {
@@ -52,6 +74,14 @@ func (p SphPort) Write(x uint8) {
     p.em.sp = (p.em.sp & 0x00FF) | (uint16(x) << 8)
 }
 
+func (p SphPort) Peek() uint8 {
+    return p.Read()
+}
+
+func (p SphPort) Poke(x uint8) {
+    p.Write(x)
+}
+
 // SplPort implements the SPL (stack pointer low byte) I/O port. It is
 // automatially registered upon creation of an Emulator.
 type SplPort struct {
@@ -65,3 +95,11 @@ func (p SplPort) Read() uint8 {
 func (p SplPort) Write(x uint8) {
     p.em.sp = (p.em.sp & 0xFF00) | uint16(x)
 }
+
+func (p SplPort) Peek() uint8 {
+    return p.Read()
+}
+
+func (p SplPort) Poke(x uint8) {
+    p.Write(x)
+}
@@ -0,0 +1,361 @@
+package emulator
+
+import (
+    "bufio"
+    "compress/gzip"
+    "fmt"
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/disasm"
+    "io"
+    "sort"
+)
+
+// A Profiler attributes the clock cycles spent by the program running in an
+// Emulator to the instructions that spent them and to the chain of calls that
+// led to them. Calls are tracked through CALL, RCALL, ICALL and EICALL
+// instructions and the taking of interrupts, and returns through RET and RETI.
+// A return pops every call whose return address has been popped from the
+// stack, so that the profile survives longjmp-style unwinding and computed
+// jumps made by pushing an address and returning.
+//
+// The profile can be summarised with Functions, or written in the pprof format
+// with WriteProfile and explored with "go tool pprof".
+type Profiler struct {
+    em *Emulator
+    // If not nil, used to name the functions containing the instructions.
+    // Instructions that it cannot name are attributed to the entry point of
+    // the call in which they were executed, such as an interrupt vector.
+    Symbolizer disasm.Symbolizer
+    root       *profileNode
+    stack      []profileFrame
+}
+
+// A node of the calling context tree: one for each distinct chain of calls.
+type profileNode struct {
+    parent   *profileNode
+    callSite uint32 // word address of the call in the parent, or of the interrupted instruction
+    entry    uint32 // word address of the function called
+    calls    uint64
+    children map[profileKey]*profileNode
+    costs    map[uint32]*profileCost // by word address
+}
+
+type profileKey struct {
+    callSite, entry uint32
+}
+
+type profileCost struct {
+    cycles, instructions uint64
+}
+
+type profileFrame struct {
+    node *profileNode
+    sp   uint16 // SP after the return address was pushed
+}
+
+// A FunctionProfile is the cost of one function in a profile. Flat costs are
+// those of the function's own instructions; cumulative costs include those of
+// the functions (and interrupt handlers) it called.
+type FunctionProfile struct {
+    Name                              string
+    Calls                             uint64
+    FlatCycles, CumCycles             uint64
+    FlatInstructions, CumInstructions uint64
+}
+
+// Creates a Profiler and attaches it to the emulator, replacing any Profiler
+// already attached. Cycles are counted from the next instruction executed, as
+// if the program were at the top level (such as in main).
+func NewProfiler(em *Emulator) (p *Profiler) {
+    p = &Profiler{
+        em:   em,
+        root: newProfileNode(nil, 0, 0),
+    }
+    em.profiler = p
+    em.updateHooks()
+    return p
+}
+
+func newProfileNode(parent *profileNode, callSite, entry uint32) *profileNode {
+    return &profileNode{
+        parent:   parent,
+        callSite: callSite,
+        entry:    entry,
+        children: make(map[profileKey]*profileNode),
+        costs:    make(map[uint32]*profileCost),
+    }
+}
+
+// Detaches the profiler from its emulator. The profile collected so far is
+// kept.
+func (p *Profiler) Stop() {
+    if p.em.profiler == p {
+        p.em.profiler = nil
+        p.em.updateHooks()
+    }
+}
+
+// Returns the node of the call currently executing.
+func (p *Profiler) current() *profileNode {
+    if n := len(p.stack); n > 0 {
+        return p.stack[n-1].node
+    }
+    return p.root
+}
+
+// Called after each instruction, with the word address it was fetched from.
+func (p *Profiler) instruction(pc uint32, inst avr.Instruction, cycles uint) {
+    node := p.current()
+    c := node.costs[pc]
+    if c == nil {
+        c = &profileCost{}
+        node.costs[pc] = c
+    }
+    c.cycles += uint64(cycles)
+    c.instructions++
+
+    switch inst {
+    case avr.CALL, avr.RCALL, avr.ICALL, avr.EICALL:
+        p.push(pc)
+    case avr.RET, avr.RETI:
+        p.pop()
+    }
+}
+
+// Enters a call (or interrupt) from the instruction at callSite to the current
+// PC.
+func (p *Profiler) push(callSite uint32) {
+    parent := p.current()
+    key := profileKey{callSite, p.em.pc}
+    node := parent.children[key]
+    if node == nil {
+        node = newProfileNode(parent, callSite, p.em.pc)
+        parent.children[key] = node
+    }
+    node.calls++
+    p.stack = append(p.stack, profileFrame{node, p.em.sp})
+}
+
+// Leaves the calls whose return addresses are no longer on the stack.
+func (p *Profiler) pop() {
+    for len(p.stack) > 0 && p.stack[len(p.stack)-1].sp < p.em.sp {
+        p.stack = p.stack[:len(p.stack)-1]
+    }
+}
+
+// Called when the CPU is reset.
+func (p *Profiler) reset() {
+    p.stack = p.stack[:0]
+}
+
+// Returns the name of the function containing the instruction at the given
+// word address, executed in the given call. Instructions that cannot be named
+// are named after the entry point of the call, or its address.
+func (p *Profiler) funcName(pc uint32, node *profileNode) string {
+    if p.Symbolizer != nil {
+        if name, _, ok := p.Symbolizer(pc * 2); ok {
+            return name
+        }
+        if name, offset, ok := p.Symbolizer(node.entry * 2); ok && offset == 0 {
+            return name
+        }
+    }
+    return fmt.Sprintf("0x%04x", node.entry*2)
+}
+
+// Calls f for every instruction address in the calling context tree that has
+// a cost, with the chain of calls that led to it (innermost first).
+func (p *Profiler) walk(node *profileNode, path []*profileNode, f func(pc uint32, c *profileCost, path []*profileNode)) {
+    path = append([]*profileNode{node}, path...)
+    for pc, c := range node.costs {
+        f(pc, c, path)
+    }
+    for _, child := range node.children {
+        p.walk(child, path, f)
+    }
+}
+
+// Returns the cost of each function, in decreasing order of cumulative cycles.
+func (p *Profiler) Functions() (fns []FunctionProfile) {
+    byName := make(map[string]*FunctionProfile)
+    get := func(name string) *FunctionProfile {
+        fp := byName[name]
+        if fp == nil {
+            fp = &FunctionProfile{Name: name}
+            byName[name] = fp
+        }
+        return fp
+    }
+
+    p.walk(p.root, nil, func(pc uint32, c *profileCost, path []*profileNode) {
+        leaf := get(p.funcName(pc, path[0]))
+        leaf.FlatCycles += c.cycles
+        leaf.FlatInstructions += c.instructions
+
+        // count each function on the stack once, however deeply it recurses
+        seen := map[*FunctionProfile]bool{leaf: true}
+        leaf.CumCycles += c.cycles
+        leaf.CumInstructions += c.instructions
+        for _, node := range path[:len(path)-1] {
+            fp := get(p.funcName(node.callSite, node.parent))
+            if !seen[fp] {
+                seen[fp] = true
+                fp.CumCycles += c.cycles
+                fp.CumInstructions += c.instructions
+            }
+        }
+    })
+
+    var count func(node *profileNode)
+    count = func(node *profileNode) {
+        for _, child := range node.children {
+            get(p.funcName(child.entry, child)).Calls += child.calls
+            count(child)
+        }
+    }
+    count(p.root)
+
+    for _, fp := range byName {
+        fns = append(fns, *fp)
+    }
+    sort.Slice(fns, func(i, j int) bool {
+        if fns[i].CumCycles != fns[j].CumCycles {
+            return fns[i].CumCycles > fns[j].CumCycles
+        }
+        return fns[i].Name < fns[j].Name
+    })
+    return fns
+}
+
+// Writes the profile to w as a gzipped pprof protocol buffer, with samples of
+// cycles and instructions. Each instruction address is a location; interrupt
+// handlers appear as if called by the instruction they interrupted.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+    var prof protoBuf
+    stringIndex := map[string]int{"": 0}
+    stringTable := []string{""}
+    str := func(s string) uint64 {
+        i, ok := stringIndex[s]
+        if !ok {
+            i = len(stringTable)
+            stringIndex[s] = i
+            stringTable = append(stringTable, s)
+        }
+        return uint64(i)
+    }
+
+    valueType := func(typ, unit string) *protoBuf {
+        var vt protoBuf
+        vt.uint(1, str(typ))
+        vt.uint(2, str(unit))
+        return &vt
+    }
+    prof.message(1, valueType("cycles", "count"))
+    prof.message(1, valueType("instructions", "count"))
+
+    type locKey struct {
+        pc   uint32
+        name string
+    }
+    locations := make(map[locKey]uint64)
+    functions := make(map[string]uint64)
+    var locs, funcs []*protoBuf
+    location := func(pc uint32, node *profileNode) uint64 {
+        name := p.funcName(pc, node)
+        key := locKey{pc, name}
+        id, ok := locations[key]
+        if ok {
+            return id
+        }
+        fnID, ok := functions[name]
+        if !ok {
+            fnID = uint64(len(funcs) + 1)
+            functions[name] = fnID
+            var fn protoBuf
+            fn.uint(1, fnID)
+            fn.uint(2, str(name))
+            fn.uint(3, str(name))
+            funcs = append(funcs, &fn)
+        }
+        id = uint64(len(locs) + 1)
+        locations[key] = id
+        var line, loc protoBuf
+        line.uint(1, fnID)
+        loc.uint(1, id)
+        loc.uint(3, uint64(pc*2))
+        loc.message(4, &line)
+        locs = append(locs, &loc)
+        return id
+    }
+
+    var samples []*protoBuf
+    p.walk(p.root, nil, func(pc uint32, c *profileCost, path []*profileNode) {
+        ids := []uint64{location(pc, path[0])}
+        for _, node := range path[:len(path)-1] {
+            ids = append(ids, location(node.callSite, node.parent))
+        }
+        var sample protoBuf
+        sample.packed(1, ids)
+        sample.packed(2, []uint64{c.cycles, c.instructions})
+        samples = append(samples, &sample)
+    })
+    for _, sample := range samples {
+        prof.message(2, sample)
+    }
+    for _, loc := range locs {
+        prof.message(4, loc)
+    }
+    for _, fn := range funcs {
+        prof.message(5, fn)
+    }
+    for _, s := range stringTable {
+        prof.bytes(6, []byte(s))
+    }
+    prof.message(11, valueType("cycles", "count"))
+    prof.uint(12, 1)
+    prof.uint(14, str("cycles")) // default sample type
+
+    bw := bufio.NewWriter(w)
+    zw := gzip.NewWriter(bw)
+    if _, err := zw.Write(prof); err != nil {
+        return err
+    }
+    if err := zw.Close(); err != nil {
+        return err
+    }
+    return bw.Flush()
+}
+
+// A protoBuf is an encoded protocol buffer message, built up field by field.
+type protoBuf []byte
+
+func (b *protoBuf) varint(x uint64) {
+    for x >= 0x80 {
+        *b = append(*b, byte(x)|0x80)
+        x >>= 7
+    }
+    *b = append(*b, byte(x))
+}
+
+func (b *protoBuf) uint(field int, x uint64) {
+    b.varint(uint64(field) << 3)
+    b.varint(x)
+}
+
+func (b *protoBuf) bytes(field int, data []byte) {
+    b.varint(uint64(field)<<3 | 2)
+    b.varint(uint64(len(data)))
+    *b = append(*b, data...)
+}
+
+func (b *protoBuf) message(field int, m *protoBuf) {
+    b.bytes(field, *m)
+}
+
+func (b *protoBuf) packed(field int, xs []uint64) {
+    var data protoBuf
+    for _, x := range xs {
+        data.varint(x)
+    }
+    b.bytes(field, data)
+}
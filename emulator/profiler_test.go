@@ -0,0 +1,272 @@
+package emulator
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/binary"
+    "fmt"
+    "github.com/kierdavis/avr/asm"
+    "github.com/kierdavis/avr/spec"
+    "io/ioutil"
+    "strings"
+    "testing"
+)
+
+const profilerTestProgram = `
+        ldi     r16, 0x04
+        out     SPH, r16
+        ldi     r16, 0xFF
+        out     SPL, r16
+main:   rcall   f
+        rcall   g
+        rjmp    main
+f:      nop
+        rcall   g
+        ret
+g:      nop
+        nop
+        ret
+`
+
+// Names the functions of profilerTestProgram.
+func profilerTestSymbolizer(addr uint32) (name string, offset uint32, ok bool) {
+    switch w := addr / 2; {
+    case w < 4:
+        return "init", addr, true
+    case w < 7:
+        return "main", addr - 8, true
+    case w < 10:
+        return "f", addr - 14, true
+    default:
+        return "g", addr - 20, true
+    }
+}
+
+func TestProfiler(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, profilerTestProgram))
+    p := NewProfiler(em)
+    p.Symbolizer = profilerTestSymbolizer
+    em.Run(4 + 2*28) // two iterations of main
+    p.Stop()
+
+    expected := []FunctionProfile{
+        {"init", 0, 4, 4, 4, 4},
+        {"main", 0, 16, 56, 6, 24},
+        {"f", 2, 16, 28, 6, 12},
+        {"g", 4, 24, 24, 12, 12},
+    }
+    fns := p.Functions()
+    // order by cumulative cycles puts main first
+    if len(fns) != len(expected) || fns[0] != expected[1] {
+        t.Fatalf("unexpected profile %+v", fns)
+    }
+    for _, e := range expected {
+        found := false
+        for _, fn := range fns {
+            if fn.Name == e.Name {
+                found = true
+                if fn != e {
+                    t.Errorf("expected %+v, got %+v", e, fn)
+                }
+            }
+        }
+        if !found {
+            t.Errorf("no profile for %s", e.Name)
+        }
+    }
+
+    var buf bytes.Buffer
+    if err := p.WriteProfile(&buf); err != nil {
+        t.Fatal(err)
+    }
+    zr, err := gzip.NewReader(&buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data, err := ioutil.ReadAll(zr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    prof, err := decodeTestProfile(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(prof.sampleTypes) != 2 || prof.sampleTypes[0] != "cycles" || prof.sampleTypes[1] != "instructions" {
+        t.Errorf("unexpected sample types %q", prof.sampleTypes)
+    }
+    // g costs 6 cycles and 3 instructions per call; it is called twice from f
+    // and twice from main
+    expectedStacks := map[string][2]uint64{
+        "g;f;main": {12, 6},
+        "g;main":   {12, 6},
+        "f;main":   {16, 6},
+        "init":     {4, 4},
+    }
+    for stack, e := range expectedStacks {
+        if got := prof.stacks[stack]; got != e {
+            t.Errorf("stack %s: expected %d cycles and %d instructions, got %d and %d", stack, e[0], e[1], got[0], got[1])
+        }
+    }
+    for addr, name := range prof.locations {
+        if sym, _, _ := profilerTestSymbolizer(uint32(addr)); sym != name {
+            t.Errorf("location at 0x%04x: expected function %s, got %s", addr, sym, name)
+        }
+    }
+}
+
+// The parts of a pprof profile checked by TestProfiler.
+type testProfile struct {
+    sampleTypes []string
+    stacks      map[string][2]uint64 // values of the samples with each stack of function names, leaf first, joined by ";"
+    locations   map[uint64]string    // function name at each location's address
+}
+
+// Decodes a pprof protocol buffer (see github.com/google/pprof, file
+// proto/profile.proto).
+func decodeTestProfile(data []byte) (prof testProfile, err error) {
+    type sample struct{ locs, values []uint64 }
+    var samples []sample
+    var sampleTypes []uint64            // string indexes of the types
+    locFuncs := make(map[uint64]uint64) // location ID to function ID
+    locAddrs := make(map[uint64]uint64) // location ID to address
+    funcNames := make(map[uint64]uint64)
+    var strs []string
+
+    err = decodeTestProto(data, func(field int, v uint64, b []byte) error {
+        switch field {
+        case 1: // sample_type
+            return decodeTestProto(b, func(field int, v uint64, b []byte) error {
+                if field == 1 {
+                    sampleTypes = append(sampleTypes, v)
+                }
+                return nil
+            })
+        case 2: // sample
+            var s sample
+            err := decodeTestProto(b, func(field int, v uint64, b []byte) error {
+                vals, err := decodeTestPacked(b)
+                if field == 1 {
+                    s.locs = vals
+                } else if field == 2 {
+                    s.values = vals
+                }
+                return err
+            })
+            samples = append(samples, s)
+            return err
+        case 4: // location
+            var id, addr, fn uint64
+            err := decodeTestProto(b, func(field int, v uint64, b []byte) error {
+                switch field {
+                case 1:
+                    id = v
+                case 3:
+                    addr = v
+                case 4: // line
+                    return decodeTestProto(b, func(field int, v uint64, b []byte) error {
+                        if field == 1 {
+                            fn = v
+                        }
+                        return nil
+                    })
+                }
+                return nil
+            })
+            locFuncs[id], locAddrs[id] = fn, addr
+            return err
+        case 5: // function
+            var id, name uint64
+            err := decodeTestProto(b, func(field int, v uint64, b []byte) error {
+                switch field {
+                case 1:
+                    id = v
+                case 2:
+                    name = v
+                }
+                return nil
+            })
+            funcNames[id] = name
+            return err
+        case 6: // string_table
+            strs = append(strs, string(b))
+        }
+        return nil
+    })
+    if err != nil {
+        return prof, err
+    }
+
+    str := func(i uint64) string {
+        if i < uint64(len(strs)) {
+            return strs[i]
+        }
+        return fmt.Sprintf("<string %d>", i)
+    }
+    for _, typ := range sampleTypes {
+        prof.sampleTypes = append(prof.sampleTypes, str(typ))
+    }
+    prof.stacks = make(map[string][2]uint64)
+    for _, s := range samples {
+        var names []string
+        for _, loc := range s.locs {
+            names = append(names, str(funcNames[locFuncs[loc]]))
+        }
+        if len(s.values) != 2 {
+            return prof, fmt.Errorf("sample has %d values", len(s.values))
+        }
+        key := strings.Join(names, ";")
+        v := prof.stacks[key]
+        prof.stacks[key] = [2]uint64{v[0] + s.values[0], v[1] + s.values[1]}
+    }
+    prof.locations = make(map[uint64]string)
+    for id, addr := range locAddrs {
+        prof.locations[addr] = str(funcNames[locFuncs[id]])
+    }
+    return prof, nil
+}
+
+// Calls fn for each field of a protocol buffer message, with the value of a
+// varint field or the contents of a length-delimited field.
+func decodeTestProto(data []byte, fn func(field int, v uint64, b []byte) error) error {
+    for len(data) > 0 {
+        key, n := binary.Uvarint(data)
+        if n <= 0 {
+            return fmt.Errorf("bad field key")
+        }
+        data = data[n:]
+        var v uint64
+        var b []byte
+        switch key & 7 {
+        case 0:
+            if v, n = binary.Uvarint(data); n <= 0 {
+                return fmt.Errorf("bad varint")
+            }
+            data = data[n:]
+        case 2:
+            l, n := binary.Uvarint(data)
+            if n <= 0 || uint64(len(data)-n) < l {
+                return fmt.Errorf("bad length")
+            }
+            b, data = data[n:n+int(l)], data[n+int(l):]
+        default:
+            return fmt.Errorf("unexpected wire type %d", key&7)
+        }
+        if err := fn(int(key>>3), v, b); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Decodes a packed repeated varint field.
+func decodeTestPacked(b []byte) (vals []uint64, err error) {
+    for len(b) > 0 {
+        v, n := binary.Uvarint(b)
+        if n <= 0 {
+            return nil, fmt.Errorf("bad packed varint")
+        }
+        vals, b = append(vals, v), b[n:]
+    }
+    return vals, nil
+}
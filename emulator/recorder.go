@@ -0,0 +1,299 @@
+package emulator
+
+import (
+    "fmt"
+    "github.com/kierdavis/avr"
+)
+
+// An AccessKind identifies the kind of an Access.
+type AccessKind int
+
+const (
+    // A write to the register file or RAM through the data space.
+    DataWrite AccessKind = iota
+    // A write to an I/O port.
+    PortWrite
+    // A read from an I/O port. These are the inputs from peripherals to the
+    // program.
+    PortRead
+    // A read from the register file or RAM through the data space. These are
+    // passed to access hooks but not recorded by a Recorder.
+    DataRead
+)
+
+// An Access is a memory access made by an instruction, as recorded by a
+// Recorder or passed to an access hook.
+type Access struct {
+    Kind  AccessKind
+    Addr  uint16      // data address (of the port, for port accesses)
+    Port  avr.PortRef // port accessed (PortWrite and PortRead only)
+    Old   uint8       // value overwritten (DataWrite only)
+    Value uint8       // value written or read
+}
+
+// State of the CPU registers at the start of an instruction.
+type cpuState struct {
+    pc           uint32
+    sp           uint16
+    sreg         uint8
+    rampx        uint8
+    rampy        uint8
+    rampz        uint8
+    rampd        uint8
+    eind         uint8
+    regs         [32]uint8
+    instructions uint64
+    cycles       uint64
+    inService    []uint // set only by a Recorder; shared between entries
+}
+
+// The history of one instruction: the CPU state before it executed, and the
+// accesses made by it (and by any interrupt taken before the next instruction).
+type historyEntry struct {
+    before   cpuState
+    accesses []Access
+}
+
+// A checkpoint is a full snapshot taken at the start of an instruction.
+type checkpoint struct {
+    pos  uint64
+    snap *Snapshot
+}
+
+// A Recorder records the execution of an Emulator so that it can be run
+// backwards. It keeps a full Snapshot every interval instructions and, for
+// every instruction, the CPU registers and a log of the writes it made to the
+// register file, RAM and I/O ports and of the values it read from I/O ports.
+//
+// Stepping back restores the latest snapshot at or before the target position
+// and then redoes the logged writes up to the target, poking ports through
+// PeekPort so that peripherals do not act on them again. Since instructions
+// are not re-executed, the CPU registers, memories and I/O registers are
+// restored exactly, but state that changes on its own, such as a timer's
+// count, is as it was at the snapshot or the last write to it. A smaller
+// interval makes such state more precise at the cost of memory. A write to a
+// port that does not implement PeekPort cannot be redone, so a snapshot is
+// also taken after each instruction that makes one.
+//
+// Positions count instructions executed since recording began. After stepping
+// back, history beyond the new position is discarded, and running the
+// emulator records a new history from there.
+type Recorder struct {
+    em             *Emulator
+    interval       uint64
+    maxCheckpoints int
+    checkpoints    []checkpoint
+    entries        []historyEntry // entries[i] is the entry for position base+i
+    base           uint64
+    pos            uint64
+    inService      []uint // copy of the emulator's in-service interrupts, shared by entries until they change
+    checkpointNext bool   // take a snapshot before the next instruction
+}
+
+// Start recording the execution of em. A snapshot is taken every interval
+// instructions; once maxCheckpoints snapshots are held, the oldest snapshot and
+// the history before the next one are discarded, limiting how far back the
+// emulator can be run.
+func NewRecorder(em *Emulator, interval uint, maxCheckpoints int) (r *Recorder) {
+    if interval == 0 {
+        interval = 1
+    }
+    if maxCheckpoints < 1 {
+        maxCheckpoints = 1
+    }
+    r = &Recorder{
+        em:             em,
+        interval:       uint64(interval),
+        maxCheckpoints: maxCheckpoints,
+    }
+    em.recorder = r
+    em.updateHooks()
+    return r
+}
+
+// Stop recording. The history already recorded can still be used.
+func (r *Recorder) Stop() {
+    if r.em.recorder == r {
+        r.em.recorder = nil
+        r.em.updateHooks()
+    }
+}
+
+// Returns the current position: the number of instructions executed since
+// recording began.
+func (r *Recorder) Position() uint64 {
+    return r.pos
+}
+
+// Returns the earliest position that can be returned to.
+func (r *Recorder) Oldest() uint64 {
+    if len(r.checkpoints) == 0 {
+        return r.pos
+    }
+    return r.checkpoints[0].pos
+}
+
+// Returns the accesses made by the instruction at the given position, or nil
+// if it is not in the recorded history.
+func (r *Recorder) Accesses(pos uint64) []Access {
+    if pos < r.base || pos >= r.pos {
+        return nil
+    }
+    return r.entries[pos-r.base].accesses
+}
+
+// Step back n instructions.
+func (r *Recorder) StepBack(n uint64) (err error) {
+    if n > r.pos {
+        return fmt.Errorf("emulator: cannot step back %d instructions from position %d", n, r.pos)
+    }
+    return r.Seek(r.pos - n)
+}
+
+// Return the emulator to the state it was in at the start of the instruction at
+// the given position, which must be between Oldest() and Position().
+func (r *Recorder) Seek(pos uint64) (err error) {
+    if pos > r.pos || pos < r.Oldest() {
+        return fmt.Errorf("emulator: position %d is outside the recorded history (%d to %d)", pos, r.Oldest(), r.pos)
+    }
+    if pos == r.pos {
+        return nil
+    }
+
+    // latest checkpoint at or before pos
+    i := len(r.checkpoints) - 1
+    for r.checkpoints[i].pos > pos {
+        i--
+    }
+    cp := r.checkpoints[i]
+
+    // don't record the writes made while restoring
+    r.em.recorder = nil
+    r.em.updateHooks()
+    defer func() {
+        r.em.recorder = r
+        r.em.updateHooks()
+    }()
+
+    if err = r.em.Restore(cp.snap); err != nil {
+        return err
+    }
+    for p := cp.pos; p < pos; p++ {
+        for _, a := range r.entries[p-r.base].accesses {
+            r.redo(a)
+        }
+    }
+    r.setCPUState(r.entries[pos-r.base].before)
+
+    r.checkpoints = r.checkpoints[:i+1]
+    r.entries = r.entries[:pos-r.base]
+    r.pos = pos
+    r.checkpointNext = false
+    return nil
+}
+
+// Run backwards to the most recent instruction that made an access for which
+// match returns true, leaving the emulator in the state before that instruction
+// executed. If no such instruction is in the recorded history, the emulator is
+// not changed and ok is false.
+func (r *Recorder) ReverseUntil(match func(a Access) bool) (pos uint64, ok bool, err error) {
+    for pos = r.pos; pos > r.Oldest(); {
+        pos--
+        for _, a := range r.entries[pos-r.base].accesses {
+            if match(a) {
+                return pos, true, r.Seek(pos)
+            }
+        }
+    }
+    return r.pos, false, nil
+}
+
+// Run backwards to the most recent instruction that wrote to the given address
+// in the register file or RAM.
+func (r *Recorder) ReverseToWrite(addr uint16) (pos uint64, ok bool, err error) {
+    return r.ReverseUntil(func(a Access) bool {
+        return a.Kind == DataWrite && a.Addr == addr
+    })
+}
+
+// Called before each instruction is executed.
+func (r *Recorder) beginInstruction() {
+    if r.pos%r.interval == 0 || r.checkpointNext {
+        r.addCheckpoint()
+        r.checkpointNext = false
+    }
+    s := r.em.cpuState()
+    if !equalUints(r.inService, r.em.inService) {
+        r.inService = append([]uint(nil), r.em.inService...)
+    }
+    s.inService = r.inService
+    r.entries = append(r.entries, historyEntry{before: s})
+    r.pos++
+}
+
+func (r *Recorder) addCheckpoint() {
+    n := len(r.checkpoints)
+    if n > 0 && r.checkpoints[n-1].pos == r.pos {
+        // already taken, before stepping back to this position
+        return
+    }
+
+    r.checkpoints = append(r.checkpoints, checkpoint{r.pos, r.em.Snapshot()})
+    if len(r.checkpoints) > r.maxCheckpoints {
+        r.checkpoints = r.checkpoints[1:]
+        oldest := r.checkpoints[0].pos
+        r.entries = append([]historyEntry(nil), r.entries[oldest-r.base:]...)
+        r.base = oldest
+    }
+}
+
+// Records an access made by the current instruction.
+func (r *Recorder) record(a Access) {
+    if n := len(r.entries); n > 0 {
+        r.entries[n-1].accesses = append(r.entries[n-1].accesses, a)
+    }
+    if a.Kind == PortWrite {
+        if _, ok := r.em.ports[a.Port.BankNum][a.Port.Index].(PeekPort); !ok {
+            r.checkpointNext = true
+        }
+    }
+}
+
+// Redoes a recorded write.
+func (r *Recorder) redo(a Access) {
+    switch a.Kind {
+    case DataWrite:
+        r.em.PokeData(a.Addr, a.Value)
+    case PortWrite:
+        if port, ok := r.em.ports[a.Port.BankNum][a.Port.Index].(PeekPort); ok {
+            port.Poke(a.Value)
+        }
+    }
+}
+
+func (em *Emulator) cpuState() cpuState {
+    return cpuState{em.pc, em.sp, em.SREG(), em.rampx, em.rampy, em.rampz, em.rampd, em.eind, em.regs,
+        em.instructions, em.cycles, nil}
+}
+
+func (r *Recorder) setCPUState(s cpuState) {
+    em := r.em
+    em.pc, em.sp = s.pc, s.sp
+    em.SetSREG(s.sreg)
+    em.rampx, em.rampy, em.rampz, em.rampd, em.eind = s.rampx, s.rampy, s.rampz, s.rampd, s.eind
+    em.regs = s.regs
+    em.instructions, em.cycles = s.instructions, s.cycles
+    em.inService = append(em.inService[:0], s.inService...)
+}
+
+func equalUints(a, b []uint) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
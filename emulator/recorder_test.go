@@ -0,0 +1,171 @@
+package emulator
+
+import (
+    "github.com/kierdavis/avr/asm"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+func TestRecorder(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, []uint16{
+        0x5F0F,         // subi r16, 0xFF
+        0x9300, 0x0100, // sts 0x0100, r16
+        0xCFFC, // rjmp .-6
+    })
+    r := NewRecorder(em, 4, 100)
+
+    // each iteration of the loop is 3 instructions and 5 cycles
+    em.Run(50)
+    if r.Position() != 30 || em.Reg(16) != 10 || em.PeekData(0x0100) != 10 {
+        t.Fatalf("unexpected state after running: position %d, r16 = %d", r.Position(), em.Reg(16))
+    }
+
+    if err := r.StepBack(4); err != nil {
+        t.Fatal(err)
+    }
+    // back to the rjmp of the ninth iteration
+    if r.Position() != 26 || em.PC() != 3 || em.Reg(16) != 9 || em.PeekData(0x0100) != 9 {
+        t.Errorf("after StepBack(4): position %d, PC 0x%04X, r16 = %d, [0x0100] = %d",
+            r.Position(), em.PC(), em.Reg(16), em.PeekData(0x0100))
+    }
+
+    pos, ok, err := r.ReverseToWrite(0x0100)
+    if err != nil || !ok {
+        t.Fatalf("ReverseToWrite: %t, %v", ok, err)
+    }
+    // back to the sts of the ninth iteration
+    if pos != 25 || em.PC() != 1 || em.Reg(16) != 9 || em.PeekData(0x0100) != 8 {
+        t.Errorf("after ReverseToWrite: position %d, PC 0x%04X, r16 = %d, [0x0100] = %d",
+            pos, em.PC(), em.Reg(16), em.PeekData(0x0100))
+    }
+
+    // running again records a new history from here
+    em.Run(5)
+    if r.Position() != 28 || em.PeekData(0x0100) != 9 {
+        t.Errorf("after running again: position %d, [0x0100] = %d", r.Position(), em.PeekData(0x0100))
+    }
+    if err := r.Seek(0); err != nil || em.Reg(16) != 0 || em.PeekData(0x0100) != 0 {
+        t.Errorf("Seek(0): %v, r16 = %d", err, em.Reg(16))
+    }
+}
+
+func TestRecorderLimit(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, []uint16{0x5F0F, 0xCFFE}) // subi r16, 0xFF; rjmp .-4
+    r := NewRecorder(em, 10, 2)
+
+    em.Run(300) // 100 iterations
+    if r.Oldest() != 180 {
+        t.Errorf("expected oldest position 180, got %d", r.Oldest())
+    }
+    if err := r.Seek(170); err == nil {
+        t.Errorf("expected an error seeking before the oldest checkpoint")
+    }
+    if err := r.Seek(185); err != nil || em.Reg(16) != 93 {
+        t.Errorf("Seek(185): %v, r16 = %d", err, em.Reg(16))
+    }
+}
+
+func TestRecorderPortAccesses(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, []uint16{
+        0x5F0F, // subi r16, 0xFF
+        0xB905, // out PORTB, r16
+        0xB113, // in r17, PINB
+        0xCFFC, // rjmp .-8
+    })
+    portb := &countingPort{}
+    em.RegisterPortByName("PORTB", portb)
+    em.RegisterPortByName("PINB", &countingPort{})
+    r := NewRecorder(em, 100, 10)
+
+    em.Run(25) // 5 iterations
+    reads := 0
+    for pos := r.Oldest(); pos < r.Position(); pos++ {
+        for _, a := range r.Accesses(pos) {
+            if a.Kind == PortRead && a.Value == 0xFF {
+                reads++
+            }
+        }
+    }
+    if reads != 5 {
+        t.Errorf("expected 5 port reads to be recorded, got %d", reads)
+    }
+
+    // PORTB does not implement PeekPort, so its writes cannot be redone: a
+    // snapshot is taken after each one instead, and stepping back leaves the
+    // port alone
+    if len(r.checkpoints) != 6 {
+        t.Errorf("expected 6 snapshots, got %d", len(r.checkpoints))
+    }
+    writes := portb.writes
+    if err := r.Seek(11); err != nil || em.Reg(16) != 3 {
+        t.Errorf("Seek(11): %v, r16 = %d", err, em.Reg(16))
+    }
+    if portb.writes != writes {
+        t.Errorf("expected PORTB not to be written while stepping back")
+    }
+
+    pos, ok, err := r.ReverseUntil(func(a Access) bool { return a.Kind == PortWrite })
+    if err != nil || !ok || pos != 9 || em.Reg(16) != 3 {
+        t.Errorf("ReverseUntil(PortWrite): position %d, %t, %v, r16 = %d", pos, ok, err, em.Reg(16))
+    }
+}
+
+const recorderISRProgram = `
+        rjmp    start
+        nop
+        rjmp    isr             ; INT0
+        nop
+start:  ldi     r16, 0x04
+        out     SPH, r16
+        ldi     r16, 0xFF
+        out     SPL, r16
+        sei
+loop:   subi    r17, 0xFF
+        rjmp    loop
+isr:    subi    r18, 0xFF
+        subi    r18, 0xFF
+        reti
+`
+
+func TestRecorderSeekAcrossInterrupt(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, recorderISRProgram))
+    r := NewRecorder(em, 4, 100)
+
+    // the state at the start of each position, as seen running forwards
+    type state struct {
+        instructions, cycles uint64
+        inService            bool
+        pc                   uint32
+    }
+    var states []state
+    for r.Position() < 24 {
+        if int(r.Position()) == len(states) {
+            if len(states) == 10 {
+                em.Interrupt(1)
+            }
+            _, ok := em.InterruptInService()
+            states = append(states, state{em.InstructionCount(), em.Cycles(), ok, em.PC()})
+        }
+        em.Run(1)
+    }
+    if !states[11].inService || states[20].inService {
+        t.Fatalf("expected the handler to run from position 10 to 13, got %+v", states)
+    }
+
+    // seek backwards into and out of the handler, landing both on and between
+    // checkpoints
+    for _, pos := range []uint64{21, 13, 12, 11, 10, 9, 3} {
+        if err := r.Seek(pos); err != nil {
+            t.Fatal(err)
+        }
+        _, ok := em.InterruptInService()
+        got := state{em.InstructionCount(), em.Cycles(), ok, em.PC()}
+        if got != states[pos] {
+            t.Errorf("Seek(%d): expected %+v, got %+v", pos, states[pos], got)
+        }
+    }
+}
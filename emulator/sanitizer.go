@@ -0,0 +1,457 @@
+package emulator
+
+import (
+    "fmt"
+    "github.com/kierdavis/avr"
+)
+
+// A Sanitizer keeps "shadow memory" for the registers, status flags and RAM of
+// an Emulator, recording which of their bits are defined: derived from
+// constants, program memory, I/O registers, or values written by a loader or
+// debugger, rather than from whatever the memory held at power-up. It warns
+// with an UndefinedValueWarning when an undefined value decides a conditional
+// branch or skip, is used as an address or jump target, or is written to an I/O
+// register, as the program's behaviour then depends on the state of memory at
+// power-up.
+//
+// Undefined values may be copied, pushed, stored and computed with freely;
+// only their uses are reported. Definedness is tracked bit by bit through
+// moves, logical operations, shifts and bit manipulation. The result of an
+// addition or subtraction is undefined from its lowest undefined operand bit
+// upwards, and a multiplication or any flag computed from an undefined operand
+// bit is wholly undefined. Each instruction is reported at most once.
+//
+// Everything but the status flags is undefined when a Sanitizer is attached,
+// so it should be attached before the program and any initial data memory are
+// loaded. Definedness is not included in snapshots.
+type Sanitizer struct {
+    em        *Emulator
+    regs      [32]uint8 // defined bits of each register
+    ram       []uint8   // defined bits of each byte of RAM
+    flags     [8]bool
+    sreg      avr.PortRef
+    portNames map[avr.PortRef]string
+    reported  map[uint32]bool
+    errors    int
+
+    // the instruction executing, if executing is true
+    executing bool
+    pc        uint32
+    load      int    // register to which a load from memory is made, or -1
+    store     uint8  // defined bits of a value stored to memory
+    combine   bool   // the stored value is combined with the value loaded
+    loaded    uint8  // defined bits of the last value loaded
+    check     string // if not "", loads are uses of this kind
+}
+
+// Creates a Sanitizer and attaches it to the emulator, replacing any Sanitizer
+// already attached.
+func NewSanitizer(em *Emulator) (s *Sanitizer) {
+    s = &Sanitizer{
+        em:        em,
+        ram:       make([]uint8, len(em.ram)),
+        flags:     [8]bool{true, true, true, true, true, true, true, true},
+        portNames: make(map[avr.PortRef]string),
+        reported:  make(map[uint32]bool),
+    }
+    for name, pref := range em.Spec.Ports {
+        s.portNames[pref] = name
+    }
+    s.sreg = em.Spec.Ports["SREG"]
+    em.sanitizer = s
+    em.updateHooks()
+    return s
+}
+
+// Detaches the Sanitizer from its emulator.
+func (s *Sanitizer) Stop() {
+    if s.em.sanitizer == s {
+        s.em.sanitizer = nil
+        s.em.updateHooks()
+    }
+}
+
+// Returns the number of uses of undefined values reported.
+func (s *Sanitizer) Errors() int {
+    return s.errors
+}
+
+// Returns the defined bits of the byte at the given address in data memory.
+// I/O registers and unmapped addresses are always defined.
+func (s *Sanitizer) Defined(addr uint16) uint8 {
+    if p := s.shadow(addr); p != nil {
+        return *p
+    }
+    return 0xFF
+}
+
+// Returns the defined bits of general-purpose register n (0 to 31).
+func (s *Sanitizer) RegDefined(n uint) uint8 {
+    return s.regs[n]
+}
+
+// Returns the shadow of the given address in data memory, or nil if it is not
+// in the register file or RAM.
+func (s *Sanitizer) shadow(addr uint16) *uint8 {
+    switch r := s.em.demap(addr).(type) {
+    case RegsRegion:
+        return &s.regs[addr-r.regionSpec.Start()]
+    case RAMRegion:
+        return &s.ram[addr-r.regionSpec.Start()]
+    }
+    return nil
+}
+
+// Marks the byte at the given address in data memory as defined.
+func (s *Sanitizer) define(addr uint16) {
+    if p := s.shadow(addr); p != nil {
+        *p = 0xFF
+    }
+}
+
+// Marks the status flags as defined, as when the CPU is reset.
+func (s *Sanitizer) defineFlags() {
+    for i := range s.flags {
+        s.flags[i] = true
+    }
+}
+
+func (s *Sanitizer) report(use string) {
+    if s.reported[s.pc] {
+        return
+    }
+    s.reported[s.pc] = true
+    s.errors++
+    s.em.warn(UndefinedValueWarning{s.pc, use})
+}
+
+// Called before each valid instruction is executed, with the word address it
+// was fetched from. Instructions that access memory are completed by access.
+func (s *Sanitizer) beginInstruction(pc uint32, inst avr.Instruction, word uint16) {
+    s.executing, s.pc = true, pc
+    s.load, s.store, s.combine, s.check = -1, 0xFF, false, ""
+
+    // the common instruction fields
+    d := (word & 0x01F0) >> 4
+    r := ((word & 0x0200) >> 5) | (word & 0x000F)
+    dh := 16 + ((word & 0x00F0) >> 4)
+    k := uint8(((word & 0x0F00) >> 4) | (word & 0x000F))
+    b := word & 0x0007
+    md, mr := s.regs[d], s.regs[r]
+    a, c := s.em.regs[d], s.em.regs[r]
+    f := &s.flags
+
+    switch inst {
+    case avr.ADD, avr.ADC, avr.SUB, avr.SBC, avr.CP, avr.CPC:
+        m := md & mr
+        withCarry := inst == avr.ADC || inst == avr.SBC || inst == avr.CPC
+        if withCarry && !f[avr.FlagC] {
+            m &^= 1
+        }
+        if d == r && inst != avr.ADD && inst != avr.ADC {
+            // the result is 0, or -C with carry
+            m = 0xFF
+            if withCarry && !f[avr.FlagC] {
+                m = 0
+            }
+        }
+        x := s.arith(left(m), withCarry)
+        if inst != avr.CP && inst != avr.CPC {
+            s.regs[d] = x
+        }
+
+    case avr.SUBI, avr.SBCI, avr.CPI:
+        m := s.regs[dh]
+        if inst == avr.SBCI && !f[avr.FlagC] {
+            m &^= 1
+        }
+        x := s.arith(left(m), inst == avr.SBCI)
+        if inst != avr.CPI {
+            s.regs[dh] = x
+        }
+
+    case avr.AND:
+        s.regs[d] = s.logic(a&c, md&mr|md&^a|mr&^c)
+    case avr.OR:
+        s.regs[d] = s.logic(a|c, md&mr|md&a|mr&c)
+    case avr.EOR:
+        m := md & mr
+        if d == r {
+            m = 0xFF
+        }
+        s.regs[d] = s.logic(a^c, m)
+    case avr.ANDI:
+        s.regs[dh] = s.logic(s.em.regs[dh]&k, s.regs[dh]|^k)
+    case avr.ORI:
+        s.regs[dh] = s.logic(s.em.regs[dh]|k, s.regs[dh]|k)
+    case avr.COM:
+        s.regs[d] = s.logic(^a, md)
+        f[avr.FlagC] = true
+
+    case avr.NEG:
+        s.regs[d] = s.arith(left(md), false)
+    case avr.INC, avr.DEC:
+        s.regs[d] = left(md)
+        full := s.regs[d] == 0xFF
+        f[avr.FlagV], f[avr.FlagN], f[avr.FlagZ], f[avr.FlagS] = full, full, full, full
+
+    case avr.ADIW, avr.SBIW:
+        p := 24 + ((word & 0x0030) >> 3)
+        m := left16(uint16(s.regs[p+1])<<8 | uint16(s.regs[p]))
+        s.regs[p+1], s.regs[p] = uint8(m>>8), uint8(m)
+        full := m == 0xFFFF
+        f[avr.FlagV], f[avr.FlagN], f[avr.FlagZ], f[avr.FlagC], f[avr.FlagS] = full, full, full, full, full
+
+    case avr.LSR, avr.ROR, avr.ASR:
+        m := md >> 1
+        switch {
+        case inst == avr.LSR || inst == avr.ROR && f[avr.FlagC]:
+            m |= 0x80
+        case inst == avr.ASR:
+            m |= md & 0x80
+        }
+        s.regs[d] = m
+        f[avr.FlagC] = md&1 != 0
+        f[avr.FlagN] = m&0x80 != 0
+        f[avr.FlagZ] = m == 0xFF
+        f[avr.FlagV] = f[avr.FlagN] && f[avr.FlagC]
+        f[avr.FlagS] = f[avr.FlagN] && f[avr.FlagV]
+
+    case avr.SWAP:
+        s.regs[d] = md>>4 | md<<4
+    case avr.MOV:
+        s.regs[d] = mr
+    case avr.MOVW:
+        dw, rw := 2*((word&0x00F0)>>4), 2*(word&0x000F)
+        s.regs[dw], s.regs[dw+1] = s.regs[rw], s.regs[rw+1]
+    case avr.LDI:
+        s.regs[dh] = 0xFF
+
+    case avr.MUL, avr.MULS, avr.MULSU, avr.FMUL, avr.FMULS, avr.FMULSU:
+        var m uint8
+        switch inst {
+        case avr.MUL:
+            m = md & mr
+        case avr.MULS:
+            m = s.regs[dh] & s.regs[16+(word&0x000F)]
+        default:
+            m = s.regs[16+((word&0x0070)>>4)] & s.regs[16+(word&0x0007)]
+        }
+        full := m == 0xFF
+        if !full {
+            m = 0
+        }
+        s.regs[0], s.regs[1] = m, m
+        f[avr.FlagZ], f[avr.FlagC] = full, full
+
+    case avr.BCLR, avr.BSET:
+        f[(word&0x0070)>>4] = true
+    case avr.BST:
+        f[avr.FlagT] = md&(1<<b) != 0
+    case avr.BLD:
+        if f[avr.FlagT] {
+            s.regs[d] |= 1 << b
+        } else {
+            s.regs[d] &^= 1 << b
+        }
+
+    case avr.BRBC, avr.BRBS:
+        if !f[b] {
+            s.report("branch condition")
+        }
+    case avr.CPSE:
+        if d != r && md&mr != 0xFF {
+            s.report("branch condition")
+        }
+    case avr.SBRC, avr.SBRS:
+        if md&(1<<b) == 0 {
+            s.report("branch condition")
+        }
+
+    case avr.IJMP, avr.ICALL, avr.EIJMP, avr.EICALL:
+        s.checkPair(30, "jump target")
+    case avr.RET, avr.RETI:
+        s.check = "return address"
+        if inst == avr.RETI {
+            f[avr.FlagI] = true
+        }
+
+    case avr.IN, avr.POP:
+        s.load = int(d)
+    case avr.OUT, avr.PUSH:
+        s.store = md
+    case avr.LDS:
+        s.load = int(d)
+    case avr.LDS_SHORT:
+        s.load = int(dh)
+    case avr.STS:
+        s.store = md
+    case avr.STS_SHORT:
+        s.store = s.regs[dh]
+
+    case avr.LD_X, avr.LD_X_INC, avr.LD_X_DEC:
+        s.checkPointer(26)
+        s.load = int(d)
+    case avr.LD_Y, avr.LD_Y_INC, avr.LD_Y_DEC, avr.LDD_Y:
+        s.checkPointer(28)
+        s.load = int(d)
+    case avr.LD_Z, avr.LD_Z_INC, avr.LD_Z_DEC, avr.LDD_Z:
+        s.checkPointer(30)
+        s.load = int(d)
+    case avr.ST_X, avr.ST_X_INC, avr.ST_X_DEC:
+        s.checkPointer(26)
+        s.store = md
+    case avr.ST_Y, avr.ST_Y_INC, avr.ST_Y_DEC, avr.STD_Y:
+        s.checkPointer(28)
+        s.store = md
+    case avr.ST_Z, avr.ST_Z_INC, avr.ST_Z_DEC, avr.STD_Z:
+        s.checkPointer(30)
+        s.store = md
+
+    case avr.XCH, avr.LAS, avr.LAC, avr.LAT:
+        s.checkPointer(30)
+        s.load = int(d)
+        s.store = md
+        s.combine = inst != avr.XCH
+
+    case avr.LPM_R0, avr.ELPM_R0:
+        s.checkPair(30, "address")
+        s.regs[0] = 0xFF
+    case avr.LPM, avr.LPM_INC, avr.ELPM, avr.ELPM_INC:
+        s.checkPair(30, "address")
+        s.regs[d] = 0xFF
+    }
+
+    // unmapped addresses and ports read as zero without an access
+    if s.load >= 0 {
+        s.regs[s.load] = 0xFF
+    }
+}
+
+// Called after each valid instruction is executed.
+func (s *Sanitizer) endInstruction() {
+    s.executing = false
+}
+
+// Sets the flags of an arithmetic instruction with the given defined result
+// bits. If withZ is true, Z depends on its previous value.
+func (s *Sanitizer) arith(m uint8, withZ bool) uint8 {
+    f := &s.flags
+    full := m == 0xFF
+    f[avr.FlagH], f[avr.FlagV], f[avr.FlagN], f[avr.FlagC], f[avr.FlagS] = full, full, full, full, full
+    f[avr.FlagZ] = full && (f[avr.FlagZ] || !withZ)
+    return m
+}
+
+// Sets the flags of a logical instruction with the given result and defined
+// result bits.
+func (s *Sanitizer) logic(x, m uint8) uint8 {
+    f := &s.flags
+    f[avr.FlagV] = true
+    f[avr.FlagN] = m&0x80 != 0
+    f[avr.FlagS] = f[avr.FlagN]
+    // the result is known to be non-zero if a defined bit is set
+    f[avr.FlagZ] = m == 0xFF || x&m != 0
+    return m
+}
+
+// Reports a use of the register pair starting at register lo if it is not
+// wholly defined.
+func (s *Sanitizer) checkPair(lo uint, use string) {
+    if s.regs[lo]&s.regs[lo+1] != 0xFF {
+        s.report(use)
+    }
+}
+
+// Reports a use of the pointer register X, Y or Z (whose low register is lo)
+// as an address in data memory if it is not wholly defined.
+func (s *Sanitizer) checkPointer(lo uint) {
+    if s.em.Spec.LogDataSpaceSize > 8 {
+        s.checkPair(lo, "address")
+    } else if s.regs[lo] != 0xFF {
+        s.report("address")
+    }
+}
+
+// Called for each access to data memory or an I/O port.
+func (s *Sanitizer) access(a Access) {
+    switch a.Kind {
+    case DataRead:
+        if s.executing {
+            s.loadValue(s.Defined(a.Addr))
+        }
+    case PortRead:
+        if s.executing {
+            m := uint8(0xFF)
+            if a.Port == s.sreg {
+                m = s.sregDefined()
+            }
+            s.loadValue(m)
+        }
+    case DataWrite:
+        if p := s.shadow(a.Addr); p != nil {
+            if !s.executing {
+                // such as a return address pushed by an interrupt
+                *p = 0xFF
+            } else if s.combine {
+                *p = s.store & s.loaded
+            } else {
+                *p = s.store
+            }
+        }
+    case PortWrite:
+        if !s.executing {
+            return
+        }
+        if a.Port == s.sreg {
+            for i := range s.flags {
+                s.flags[i] = s.store&(1<<uint(i)) != 0
+            }
+        } else if s.store != 0xFF {
+            name, ok := s.portNames[a.Port]
+            if !ok {
+                name = fmt.Sprintf("$%04X", a.Addr)
+            }
+            s.report("write to I/O register " + name)
+        }
+    }
+}
+
+func (s *Sanitizer) loadValue(m uint8) {
+    s.loaded = m
+    if s.check != "" && m != 0xFF {
+        s.report(s.check)
+    }
+    if s.load >= 0 {
+        s.regs[s.load] = m
+    }
+}
+
+// Returns the defined bits of SREG.
+func (s *Sanitizer) sregDefined() (m uint8) {
+    for i, def := range s.flags {
+        if def {
+            m |= 1 << uint(i)
+        }
+    }
+    return m
+}
+
+// Returns the defined bits of the result of an addition or subtraction of
+// operands with the given defined bits: carries propagate undefinedness
+// upwards from the lowest undefined bit.
+func left(m uint8) uint8 {
+    u := ^m
+    if u == 0 {
+        return 0xFF
+    }
+    return u&-u - 1
+}
+
+func left16(m uint16) uint16 {
+    u := ^m
+    if u == 0 {
+        return 0xFFFF
+    }
+    return u&-u - 1
+}
@@ -0,0 +1,101 @@
+package emulator
+
+import (
+    "fmt"
+    "github.com/kierdavis/avr/asm"
+    "github.com/kierdavis/avr/spec"
+    "sort"
+    "testing"
+)
+
+const sanitizerTestProgram = `
+        lds     r24, 0x0100     ; undefined
+        cpi     r24, 1
+        breq    l1              ; 3: undefined branch condition
+l1:     ldi     r16, 5
+        sts     0x0102, r16
+        lds     r17, 0x0102
+        cpi     r17, 5
+        brne    l2              ; defined
+l2:     lds     r18, 0x0103
+        andi    r18, 0x0F
+        ori     r18, 0x01
+        breq    l3              ; defined: r18 is not zero
+l3:     sbrc    r18, 0          ; defined
+        nop
+        sbrs    r18, 1          ; 18: undefined bit
+        nop
+        lds     r30, 0x0104
+        ldi     r31, 0x01
+        ld      r20, Z          ; 23: undefined address
+        push    r24
+        pop     r25
+        out     PORTB, r25      ; 26: undefined I/O write
+        eor     r26, r26
+        out     PORTB, r26
+l4:     rjmp    l4
+`
+
+func TestSanitizer(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    s := NewSanitizer(em)
+    em.RegisterPortByName("PORTB", &latchPort{})
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, sanitizerTestProgram))
+    em.SetSP(0x04FF)
+    em.Run(60)
+
+    var pcs []int
+    for pc := range s.reported {
+        pcs = append(pcs, int(pc))
+    }
+    sort.Ints(pcs)
+    if got := fmt.Sprint(pcs); got != "[3 18 23 26]" {
+        t.Errorf("expected uses of undefined values at [3 18 23 26], got %s", got)
+    }
+    if s.Errors() != 4 {
+        t.Errorf("expected 4 errors, got %d", s.Errors())
+    }
+
+    for _, c := range []struct {
+        reg  uint
+        mask uint8
+    }{{16, 0xFF}, {17, 0xFF}, {18, 0xF1}, {24, 0x00}, {25, 0x00}, {26, 0xFF}} {
+        if m := s.RegDefined(c.reg); m != c.mask {
+            t.Errorf("expected r%d to have defined bits 0x%02x, got 0x%02x", c.reg, c.mask, m)
+        }
+    }
+    if m := s.Defined(0x0102); m != 0xFF {
+        t.Errorf("expected 0x0102 to be defined, got 0x%02x", m)
+    }
+    if m := s.Defined(0x04FF); m != 0x00 {
+        t.Errorf("expected pushed undefined value at 0x04ff to be undefined, got 0x%02x", m)
+    }
+}
+
+func TestSanitizerArithmetic(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    s := NewSanitizer(em)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, `
+        ldi     r16, 0x10
+        lds     r17, 0x0100
+        andi    r17, 0xF0
+        add     r16, r17        ; low nibble defined
+        lsr     r17             ; top bit and the 3 lowest bits defined
+        lds     r18, 0x0101
+        sub     r18, r18        ; defined zero
+        sbc     r19, r19        ; -C, defined
+    `))
+    em.Run(20)
+
+    for _, c := range []struct {
+        reg  uint
+        mask uint8
+    }{{16, 0x0F}, {17, 0x87}, {18, 0xFF}, {19, 0xFF}} {
+        if m := s.RegDefined(c.reg); m != c.mask {
+            t.Errorf("expected r%d to have defined bits 0x%02x, got 0x%02x", c.reg, c.mask, m)
+        }
+    }
+    if s.Errors() != 0 {
+        t.Errorf("expected no errors, got %d", s.Errors())
+    }
+}
@@ -0,0 +1,342 @@
+package emulator
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+)
+
+// A Snapshotter is a peripheral (or other component of a simulation) whose
+// state can be saved in a Snapshot. Peripherals register themselves with
+// AddSnapshotter when they are added to an Emulator.
+type Snapshotter interface {
+    // SnapshotName returns a name identifying the component, unique among
+    // those registered with an Emulator, such as "timer:0".
+    SnapshotName() string
+    // SnapshotState returns an encoding of the component's current state.
+    SnapshotState() []byte
+    // RestoreState restores state previously returned by SnapshotState.
+    RestoreState(data []byte) error
+}
+
+// The saved state of a Snapshotter.
+type PeripheralState struct {
+    Name string
+    Data []byte
+}
+
+// A Snapshot is a copy of the complete state of an Emulator: the CPU
+// registers, all memories, and the state of every registered Snapshotter. A
+// snapshot can be restored any number of times, and can be saved to a file with
+// WriteTo and read back with ReadSnapshot.
+type Snapshot struct {
+    MCU         string // label of the MCU spec
+    PC          uint32
+    SP          uint16
+    RAMPX       uint8
+    RAMPY       uint8
+    RAMPZ       uint8
+    RAMPD       uint8
+    EIND        uint8
+    SREG        uint8
+    Regs        [32]uint8
+    LockBits    uint8
+    ExcessTicks uint64 // ticks executed beyond the end of the last call to Run
+    // Counts returned by InstructionCount and Cycles
+    Instructions uint64
+    Cycles       uint64
+    InService    []uint // interrupts whose handlers are executing, innermost last
+    Prog         []uint16
+    RAM          []uint8
+    EEPROM       []uint8
+    Fuses        []uint8
+    Peripherals  []PeripheralState
+}
+
+// Registers a component whose state is to be included in snapshots.
+func (em *Emulator) AddSnapshotter(s Snapshotter) {
+    em.snapshotters = append(em.snapshotters, s)
+}
+
+// Take a snapshot of the current state of the emulator.
+func (em *Emulator) Snapshot() (snap *Snapshot) {
+    snap = &Snapshot{
+        MCU:          em.Spec.Label,
+        PC:           em.pc,
+        SP:           em.sp,
+        RAMPX:        em.rampx,
+        RAMPY:        em.rampy,
+        RAMPZ:        em.rampz,
+        RAMPD:        em.rampd,
+        EIND:         em.eind,
+        SREG:         em.SREG(),
+        Regs:         em.regs,
+        LockBits:     em.lockBits,
+        ExcessTicks:  uint64(em.excessTicks),
+        Instructions: em.instructions,
+        Cycles:       em.cycles,
+        InService:    append([]uint(nil), em.inService...),
+        Prog:         append([]uint16(nil), em.prog...),
+        RAM:          append([]uint8(nil), em.ram...),
+        EEPROM:       append([]uint8(nil), em.eeprom...),
+        Fuses:        append([]uint8(nil), em.fuses...),
+    }
+
+    for _, s := range em.snapshotters {
+        snap.Peripherals = append(snap.Peripherals, PeripheralState{s.SnapshotName(), s.SnapshotState()})
+    }
+    return snap
+}
+
+// Restore the emulator to the state saved in a snapshot. The snapshot must
+// have been taken from an emulator for the same MCU with the same set of
+// registered Snapshotters. If an error is returned, the emulator may be left
+// partially restored.
+func (em *Emulator) Restore(snap *Snapshot) (err error) {
+    if snap.MCU != em.Spec.Label {
+        return fmt.Errorf("emulator: snapshot is of a %s, not a %s", snap.MCU, em.Spec.Label)
+    }
+    if len(snap.Prog) != len(em.prog) || len(snap.RAM) != len(em.ram) ||
+        len(snap.EEPROM) != len(em.eeprom) || len(snap.Fuses) != len(em.fuses) {
+        return errors.New("emulator: snapshot memory sizes do not match MCU spec")
+    }
+    if len(snap.Peripherals) != len(em.snapshotters) {
+        return fmt.Errorf("emulator: snapshot has %d peripherals, but %d are registered",
+            len(snap.Peripherals), len(em.snapshotters))
+    }
+
+    em.pc = snap.PC & em.pcmask
+    em.sp = snap.SP
+    em.rampx = snap.RAMPX
+    em.rampy = snap.RAMPY
+    em.rampz = snap.RAMPZ
+    em.rampd = snap.RAMPD
+    em.eind = snap.EIND
+    em.SetSREG(snap.SREG)
+    em.regs = snap.Regs
+    em.lockBits = snap.LockBits
+    em.excessTicks = uint(snap.ExcessTicks)
+    em.instructions = snap.Instructions
+    em.cycles = snap.Cycles
+    em.inService = append(em.inService[:0], snap.InService...)
+    copy(em.prog, snap.Prog)
+    copy(em.ram, snap.RAM)
+    copy(em.eeprom, snap.EEPROM)
+    copy(em.fuses, snap.Fuses)
+
+    for _, s := range em.snapshotters {
+        state, ok := snap.peripheral(s.SnapshotName())
+        if !ok {
+            return fmt.Errorf("emulator: snapshot has no state for %s", s.SnapshotName())
+        }
+        if err = s.RestoreState(state); err != nil {
+            return fmt.Errorf("emulator: restoring %s: %s", s.SnapshotName(), err)
+        }
+    }
+    return nil
+}
+
+// Returns the saved state of the named peripheral.
+func (snap *Snapshot) peripheral(name string) (data []byte, ok bool) {
+    for _, p := range snap.Peripherals {
+        if p.Name == name {
+            return p.Data, true
+        }
+    }
+    return nil, false
+}
+
+// Snapshot file format: the magic string and a version number, followed by the
+// fields of the Snapshot in order. Integers are little-endian; strings and
+// slices are prefixed with their length as a uint32.
+const (
+    snapshotMagic   = "AVRSNAP\x00"
+    SnapshotVersion = 1
+)
+
+// Fixed-size part of a snapshot file.
+type snapshotHeader struct {
+    Magic        [8]byte
+    Version      uint32
+    PC           uint32
+    SP           uint16
+    RAMPX        uint8
+    RAMPY        uint8
+    RAMPZ        uint8
+    RAMPD        uint8
+    EIND         uint8
+    SREG         uint8
+    Regs         [32]uint8
+    LockBits     uint8
+    ExcessTicks  uint64
+    Instructions uint64
+    Cycles       uint64
+}
+
+// Writes the snapshot to w in a versioned binary format.
+func (snap *Snapshot) WriteTo(w io.Writer) (n int64, err error) {
+    cw := &countingWriter{w: bufio.NewWriter(w)}
+    hdr := snapshotHeader{
+        Version:      SnapshotVersion,
+        PC:           snap.PC,
+        SP:           snap.SP,
+        RAMPX:        snap.RAMPX,
+        RAMPY:        snap.RAMPY,
+        RAMPZ:        snap.RAMPZ,
+        RAMPD:        snap.RAMPD,
+        EIND:         snap.EIND,
+        SREG:         snap.SREG,
+        Regs:         snap.Regs,
+        LockBits:     snap.LockBits,
+        ExcessTicks:  snap.ExcessTicks,
+        Instructions: snap.Instructions,
+        Cycles:       snap.Cycles,
+    }
+    copy(hdr.Magic[:], snapshotMagic)
+
+    binary.Write(cw, binary.LittleEndian, &hdr)
+    writeBytes(cw, []byte(snap.MCU))
+    binary.Write(cw, binary.LittleEndian, uint32(len(snap.InService)))
+    for _, num := range snap.InService {
+        binary.Write(cw, binary.LittleEndian, uint32(num))
+    }
+    binary.Write(cw, binary.LittleEndian, uint32(len(snap.Prog)))
+    binary.Write(cw, binary.LittleEndian, snap.Prog)
+    writeBytes(cw, snap.RAM)
+    writeBytes(cw, snap.EEPROM)
+    writeBytes(cw, snap.Fuses)
+    binary.Write(cw, binary.LittleEndian, uint32(len(snap.Peripherals)))
+    for _, p := range snap.Peripherals {
+        writeBytes(cw, []byte(p.Name))
+        writeBytes(cw, p.Data)
+    }
+
+    if cw.err == nil {
+        cw.err = cw.w.Flush()
+    }
+    return cw.n, cw.err
+}
+
+// Reads a snapshot written by WriteTo.
+func ReadSnapshot(r io.Reader) (snap *Snapshot, err error) {
+    br := bufio.NewReader(r)
+    var hdr snapshotHeader
+    if err = binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+        return nil, err
+    }
+    if string(hdr.Magic[:]) != snapshotMagic {
+        return nil, errors.New("emulator: not a snapshot file")
+    }
+    if hdr.Version != SnapshotVersion {
+        return nil, fmt.Errorf("emulator: unsupported snapshot version %d", hdr.Version)
+    }
+
+    snap = &Snapshot{
+        PC:           hdr.PC,
+        SP:           hdr.SP,
+        RAMPX:        hdr.RAMPX,
+        RAMPY:        hdr.RAMPY,
+        RAMPZ:        hdr.RAMPZ,
+        RAMPD:        hdr.RAMPD,
+        EIND:         hdr.EIND,
+        SREG:         hdr.SREG,
+        Regs:         hdr.Regs,
+        LockBits:     hdr.LockBits,
+        ExcessTicks:  hdr.ExcessTicks,
+        Instructions: hdr.Instructions,
+        Cycles:       hdr.Cycles,
+    }
+
+    sr := &snapshotReader{r: br}
+    snap.MCU = string(sr.bytes())
+    if n := sr.length(4); sr.err == nil {
+        inService := make([]uint32, n)
+        if sr.err = binary.Read(br, binary.LittleEndian, inService); sr.err == nil {
+            for _, num := range inService {
+                snap.InService = append(snap.InService, uint(num))
+            }
+        }
+    }
+    if n := sr.length(2); sr.err == nil {
+        snap.Prog = make([]uint16, n)
+        sr.err = binary.Read(br, binary.LittleEndian, snap.Prog)
+    }
+    snap.RAM = sr.bytes()
+    snap.EEPROM = sr.bytes()
+    snap.Fuses = sr.bytes()
+    numPeripherals := sr.length(1)
+    for i := uint32(0); i < numPeripherals && sr.err == nil; i++ {
+        name := string(sr.bytes())
+        data := sr.bytes()
+        snap.Peripherals = append(snap.Peripherals, PeripheralState{name, data})
+    }
+
+    if sr.err != nil {
+        if sr.err == io.EOF {
+            sr.err = io.ErrUnexpectedEOF
+        }
+        return nil, sr.err
+    }
+    return snap, nil
+}
+
+// Writes a length-prefixed byte string.
+func writeBytes(w io.Writer, data []byte) {
+    binary.Write(w, binary.LittleEndian, uint32(len(data)))
+    w.Write(data)
+}
+
+// An io.Writer that counts bytes written and remembers the first error, so
+// that a sequence of writes can be checked once at the end.
+type countingWriter struct {
+    w   *bufio.Writer
+    n   int64
+    err error
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+    if cw.err != nil {
+        return 0, cw.err
+    }
+    n, cw.err = cw.w.Write(p)
+    cw.n += int64(n)
+    return n, cw.err
+}
+
+// Reads length-prefixed fields, remembering the first error.
+type snapshotReader struct {
+    r   *bufio.Reader
+    err error
+}
+
+// The largest length accepted when reading a snapshot, to avoid huge
+// allocations when reading a corrupt file.
+const maxSnapshotLength = 1 << 24
+
+// Reads a length prefix for elements of the given size.
+func (sr *snapshotReader) length(elemSize uint32) (n uint32) {
+    if sr.err != nil {
+        return 0
+    }
+    if sr.err = binary.Read(sr.r, binary.LittleEndian, &n); sr.err != nil {
+        return 0
+    }
+    if n*elemSize > maxSnapshotLength || n > maxSnapshotLength {
+        sr.err = fmt.Errorf("emulator: snapshot field length %d is too large", n)
+        return 0
+    }
+    return n
+}
+
+// Reads a length-prefixed byte string.
+func (sr *snapshotReader) bytes() (data []byte) {
+    n := sr.length(1)
+    if sr.err != nil {
+        return nil
+    }
+    data = make([]byte, n)
+    _, sr.err = io.ReadFull(sr.r, data)
+    return data
+}
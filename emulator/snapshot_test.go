@@ -0,0 +1,98 @@
+package emulator
+
+import (
+    "bytes"
+    "errors"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+// A Snapshotter holding a single byte.
+type testPeripheral struct {
+    val uint8
+}
+
+func (p *testPeripheral) SnapshotName() string  { return "test" }
+func (p *testPeripheral) SnapshotState() []byte { return []byte{p.val} }
+
+func (p *testPeripheral) RestoreState(data []byte) error {
+    if len(data) != 1 {
+        return errors.New("bad state")
+    }
+    p.val = data[0]
+    return nil
+}
+
+func TestSnapshotRestore(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    p := &testPeripheral{val: 1}
+    em.AddSnapshotter(p)
+
+    em.SetPC(0x0123)
+    em.SetSP(0x04FF)
+    em.SetSREG(0x82)
+    em.SetReg(16, 0xAA)
+    em.PokeData(0x0200, 0x55)
+    em.SetEEPROMByte(3, 0x33)
+    em.SetProgWord(0x40, 0x9508)
+    em.instructions, em.cycles = 100, 150
+    em.inService = []uint{1, 3}
+    snap := em.Snapshot()
+
+    // round trip through the file format
+    var buf bytes.Buffer
+    if _, err := snap.WriteTo(&buf); err != nil {
+        t.Fatal(err)
+    }
+    snap, err := ReadSnapshot(&buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    em.SetPC(0)
+    em.SetSP(0)
+    em.SetSREG(0)
+    em.SetReg(16, 0)
+    em.PokeData(0x0200, 0)
+    em.SetEEPROMByte(3, 0xFF)
+    em.SetProgWord(0x40, 0)
+    em.instructions, em.cycles = 0, 0
+    em.inService = em.inService[:0]
+    p.val = 2
+
+    if err := em.Restore(snap); err != nil {
+        t.Fatal(err)
+    }
+    if em.PC() != 0x0123 || em.SP() != 0x04FF || em.SREG() != 0x82 || em.Reg(16) != 0xAA {
+        t.Errorf("CPU state not restored: PC=0x%04X SP=0x%04X SREG=0x%02X r16=0x%02X", em.PC(), em.SP(), em.SREG(), em.Reg(16))
+    }
+    if em.PeekData(0x0200) != 0x55 || em.EEPROMByte(3) != 0x33 || em.ProgWord(0x40) != 0x9508 {
+        t.Errorf("memories not restored")
+    }
+    if num, ok := em.InterruptInService(); em.InstructionCount() != 100 || em.Cycles() != 150 || !ok || num != 3 || len(em.inService) != 2 {
+        t.Errorf("counters and interrupts in service not restored: %d instructions, %d cycles, in service %v",
+            em.InstructionCount(), em.Cycles(), em.inService)
+    }
+    if p.val != 1 {
+        t.Errorf("peripheral state not restored")
+    }
+
+    if err := NewEmulator(spec.ATtiny10).Restore(snap); err == nil {
+        t.Errorf("expected an error restoring a snapshot of a different MCU")
+    }
+}
+
+func TestReadSnapshotErrors(t *testing.T) {
+    var buf bytes.Buffer
+    NewEmulator(spec.ATmega168).Snapshot().WriteTo(&buf)
+    data := buf.Bytes()
+
+    if _, err := ReadSnapshot(bytes.NewReader(data[:len(data)-1])); err == nil {
+        t.Errorf("expected an error reading a truncated snapshot")
+    }
+    bad := append([]byte(nil), data...)
+    bad[8] = 99 // version
+    if _, err := ReadSnapshot(bytes.NewReader(bad)); err == nil {
+        t.Errorf("expected an error reading an unsupported version")
+    }
+}
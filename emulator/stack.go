@@ -0,0 +1,165 @@
+package emulator
+
+import (
+    "sort"
+)
+
+// A StackMonitor watches the stack pointer of an Emulator. It records the
+// high-water mark of the stack and the most stack used by each interrupt
+// handler, and warns when the stack grows past a limit or into the register
+// file or I/O registers below RAM.
+//
+// The stack pointer is checked after each instruction. Checking starts when it
+// first equals Top, as the program's startup code sets it.
+type StackMonitor struct {
+    em *Emulator
+    // The address of the top of the stack, from which its depth is measured.
+    // It defaults to the last address in RAM, where avr-gcc programs start
+    // their stacks unless linked with a different __stack.
+    Top uint16
+    // If not 0, the lowest address that the stack may grow down to, such as
+    // the address of the _end symbol (the end of .bss) or __heap_end. A
+    // StackOverflowWarning is logged when the stack grows below it.
+    Limit uint16
+
+    ramStart   uint16
+    started    bool
+    maxDepth   uint16
+    maxPC      uint32
+    vectors    map[uint]*VectorStack
+    entries    []stackEntry // interrupts in service, innermost last
+    overflowed bool         // true while the stack extends below Limit
+    collided   bool         // true while the stack extends below RAM
+    overflows  int
+    collisions int
+}
+
+// The state of the stack when an interrupt was taken.
+type stackEntry struct {
+    num uint
+    sp  uint16 // SP before the return address was pushed
+}
+
+// A VectorStack is the most stack used by an interrupt handler, including
+// the return address pushed when the interrupt was taken and any handlers
+// that interrupted it.
+type VectorStack struct {
+    Num      uint // interrupt vector number
+    Calls    uint64
+    MaxUsage uint16
+}
+
+// Creates a StackMonitor and attaches it to the emulator, replacing any
+// StackMonitor already attached.
+func NewStackMonitor(em *Emulator) (m *StackMonitor) {
+    m = &StackMonitor{
+        em:      em,
+        vectors: make(map[uint]*VectorStack),
+    }
+    m.ramStart, m.Top = ramBounds(em.Spec)
+    em.stack = m
+    em.updateHooks()
+    return m
+}
+
+// Detaches the StackMonitor from its emulator. The statistics recorded so far
+// are kept.
+func (m *StackMonitor) Stop() {
+    if m.em.stack == m {
+        m.em.stack = nil
+        m.em.updateHooks()
+    }
+}
+
+// Returns the greatest depth of the stack in bytes, below Top, and the word
+// address of the instruction that reached it.
+func (m *StackMonitor) MaxDepth() (depth uint16, pc uint32) {
+    return m.maxDepth, m.maxPC
+}
+
+// Returns the stack usage of each interrupt handler that has been executed,
+// in order of vector number.
+func (m *StackMonitor) Vectors() (vs []VectorStack) {
+    for _, v := range m.vectors {
+        vs = append(vs, *v)
+    }
+    sort.Slice(vs, func(i, j int) bool {
+        return vs[i].Num < vs[j].Num
+    })
+    return vs
+}
+
+// Returns the number of times the stack has grown past Limit and into the
+// registers below RAM.
+func (m *StackMonitor) Errors() (overflows, collisions int) {
+    return m.overflows, m.collisions
+}
+
+// Returns true once checking has started, when the stack pointer first equals
+// Top.
+func (m *StackMonitor) Started() bool {
+    return m.started
+}
+
+// Called when the CPU is reset. Checking restarts when the program next sets
+// up its stack.
+func (m *StackMonitor) reset() {
+    m.started = false
+    m.entries = m.entries[:0]
+    m.overflowed, m.collided = false, false
+}
+
+// Called when an interrupt is taken, with SP before the return address is
+// pushed.
+func (m *StackMonitor) interrupt(num uint, sp uint16) {
+    m.entries = append(m.entries, stackEntry{num, sp})
+    v := m.vectors[num]
+    if v == nil {
+        v = &VectorStack{Num: num}
+        m.vectors[num] = v
+    }
+    v.Calls++
+}
+
+// Called after each instruction, with the word address it was fetched from.
+func (m *StackMonitor) instruction(pc uint32) {
+    sp := m.em.sp
+    if !m.started {
+        if sp != m.Top {
+            return
+        }
+        m.started = true
+    }
+
+    // leave the handlers that have returned
+    if n := len(m.em.inService); len(m.entries) > n {
+        m.entries = m.entries[:n]
+    }
+
+    if sp < m.Top && m.Top-sp > m.maxDepth {
+        m.maxDepth, m.maxPC = m.Top-sp, pc
+    }
+    for _, e := range m.entries {
+        if sp < e.sp {
+            if v := m.vectors[e.num]; e.sp-sp > v.MaxUsage {
+                v.MaxUsage = e.sp - sp
+            }
+        }
+    }
+
+    // SP points to the byte below the top of the stack
+    if over := m.Limit != 0 && sp+1 < m.Limit; over != m.overflowed {
+        m.overflowed = over
+        if over {
+            m.overflows++
+            m.em.warn(StackOverflowWarning{pc, sp, m.Limit})
+        }
+    }
+    if below := sp+1 < m.ramStart; below != m.collided {
+        m.collided = below
+        if below {
+            m.collisions++
+            m.em.warn(StackCollisionWarning{pc, sp})
+        }
+    }
+}
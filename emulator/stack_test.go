@@ -0,0 +1,82 @@
+package emulator
+
+import (
+    "fmt"
+    "github.com/kierdavis/avr/asm"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+const stackTestProgram = `
+        rjmp    start
+        nop
+        rjmp    isr             ; INT0
+        nop
+start:  ldi     r16, 0x04
+        out     SPH, r16
+        ldi     r16, 0xFF
+        out     SPL, r16
+        sei
+        push    r0
+        push    r0
+        rcall   f
+        pop     r0
+        pop     r0
+loop:   rjmp    loop
+f:      push    r0
+        pop     r0
+        ret
+isr:    push    r0
+        push    r1
+        pop     r1
+        pop     r0
+        reti
+`
+
+func TestStackMonitor(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, stackTestProgram))
+    m := NewStackMonitor(em)
+    m.Limit = 0x04FD
+    em.Run(40)
+    em.InterruptByName("INT0")
+    em.Run(40)
+
+    if depth, pc := m.MaxDepth(); depth != 5 || pc != 15 {
+        t.Errorf("expected max depth 5 at 0x000f, got %d at 0x%04x", depth, pc)
+    }
+    if vs := fmt.Sprint(m.Vectors()); vs != "[{1 1 4}]" {
+        t.Errorf("unexpected vector stack usage %s", vs)
+    }
+    if overflows, collisions := m.Errors(); overflows != 2 || collisions != 0 {
+        t.Errorf("expected 2 overflows and no collisions, got %d and %d", overflows, collisions)
+    }
+}
+
+func TestStackCollision(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, `
+        ldi     r16, 0x02
+        out     SPL, r16
+        ldi     r16, 0x01
+        out     SPH, r16
+        push    r0
+        push    r0
+        push    r0
+        push    r0
+`))
+    m := NewStackMonitor(em)
+    m.Top = 0x0102
+    em.Run(2)
+    if m.Started() {
+        t.Errorf("started before SP was set to Top")
+    }
+    em.Run(8) // up to the last byte of RAM
+    if _, collisions := m.Errors(); collisions != 0 {
+        t.Errorf("collision detected while the stack is in RAM")
+    }
+    em.Run(2)
+    if _, collisions := m.Errors(); collisions != 1 {
+        t.Errorf("expected a collision, got %d", collisions)
+    }
+}
@@ -0,0 +1,523 @@
+package emulator
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/disasm"
+    "github.com/kierdavis/avr/spec"
+    "io"
+    "strings"
+)
+
+// A TraceFormat is an output format of a Tracer.
+type TraceFormat int
+
+const (
+    // One line of text per instruction.
+    TraceText TraceFormat = iota
+    // One JSON object per line per instruction.
+    TraceJSON
+    // A compact binary encoding, read by TraceReader.
+    TraceBinary
+)
+
+var traceFormatNames = []string{"text", "json", "binary"}
+
+func (f TraceFormat) String() string {
+    if f < 0 || int(f) >= len(traceFormatNames) {
+        return fmt.Sprintf("TraceFormat(%d)", int(f))
+    }
+    return traceFormatNames[f]
+}
+
+// Returns the format with the given name (as returned by String).
+func ParseTraceFormat(name string) (f TraceFormat, ok bool) {
+    for i, n := range traceFormatNames {
+        if n == name {
+            return TraceFormat(i), true
+        }
+    }
+    return 0, false
+}
+
+// A RegChange is a change to a general-purpose register made by an
+// instruction.
+type RegChange struct {
+    Reg      uint8
+    Old, New uint8
+}
+
+// A TraceEntry describes the execution of one instruction.
+type TraceEntry struct {
+    Cycle    uint64          // clock cycle at which the instruction started (see Emulator.Cycles)
+    PC       uint32          // word address of the instruction
+    Words    []uint16        // the instruction's words
+    Inst     avr.Instruction // -1 if the words are not a valid instruction
+    Text     string          // disassembled instruction, such as "ldi r24, 0x20"
+    Regs     []RegChange     // registers changed, in order of register number
+    OldSREG  uint8
+    SREG     uint8
+    OldSP    uint16
+    SP       uint16
+    Accesses []Access // accesses to data memory and I/O ports, in order
+}
+
+// A TraceFilter selects the instructions written by a Tracer. An instruction is
+// written if it lies in one of the ranges (or there are none) and is of one of
+// the classes (or there are none).
+type TraceFilter struct {
+    Ranges  []PCRange
+    Classes []avr.InstClass
+}
+
+// A PCRange is a range of word addresses in program memory, from Start up to
+// but not including End.
+type PCRange struct {
+    Start, End uint32
+}
+
+// A Tracer writes a trace of the instructions executed by an Emulator: for each
+// instruction, the clock cycle, the PC, the instruction, the registers, flags
+// and stack pointer it changed and the memory and I/O accesses it made.
+//
+// Program addresses in the text and JSON formats are byte addresses, as
+// printed by avr-objdump.
+type Tracer struct {
+    em     *Emulator
+    w      *bufio.Writer
+    format TraceFormat
+    // Used to disassemble instructions. Set its Symbolizer to annotate branch
+    // targets with symbols.
+    Disassembler *disasm.Disassembler
+    filter       TraceFilter
+    classes      [avr.NumInstructions]bool // instructions passing the class filter
+    err          error
+
+    active    bool // true while tracing an instruction
+    before    cpuState
+    cycle     uint64
+    accesses  []Access
+    lastCycle uint64 // of the last entry written in binary format
+}
+
+// The header of the binary format.
+const traceMagic = "AVRTRACE\x01"
+
+// Creates a Tracer writing to w in the given format, and attaches it to the
+// emulator, replacing any tracer already attached.
+func NewTracer(em *Emulator, w io.Writer, format TraceFormat) (t *Tracer) {
+    t = &Tracer{
+        em:           em,
+        w:            bufio.NewWriter(w),
+        format:       format,
+        Disassembler: disasm.New(em.Spec),
+    }
+    t.SetFilter(TraceFilter{})
+    if format == TraceBinary {
+        t.w.WriteString(traceMagic)
+    }
+    em.tracer = t
+    em.updateHooks()
+    return t
+}
+
+// Sets the filter selecting the instructions to be traced.
+func (t *Tracer) SetFilter(f TraceFilter) {
+    t.filter = f
+    for i := range t.classes {
+        t.classes[i] = len(f.Classes) == 0
+        for _, c := range f.Classes {
+            if avr.Instruction(i).Class() == c {
+                t.classes[i] = true
+            }
+        }
+    }
+}
+
+// Detaches the tracer from the emulator and flushes its output. Returns the
+// first error encountered writing the trace.
+func (t *Tracer) Stop() (err error) {
+    if t.em.tracer == t {
+        t.em.tracer = nil
+        t.em.updateHooks()
+    }
+    return t.Flush()
+}
+
+// Flushes the output. Returns the first error encountered writing the trace.
+func (t *Tracer) Flush() (err error) {
+    if err = t.w.Flush(); t.err == nil {
+        t.err = err
+    }
+    return t.err
+}
+
+// Called before each instruction is executed.
+func (t *Tracer) beginInstruction() {
+    pc := t.em.pc
+    t.active = len(t.filter.Ranges) == 0
+    for _, r := range t.filter.Ranges {
+        if r.Start <= pc && pc < r.End {
+            t.active = true
+            break
+        }
+    }
+    if t.active {
+        t.before = t.em.cpuState()
+        t.cycle = t.em.cycles
+        t.accesses = t.accesses[:0]
+    }
+}
+
+// Records an access made by the current instruction.
+func (t *Tracer) record(a Access) {
+    if t.active {
+        t.accesses = append(t.accesses, a)
+    }
+}
+
+// Called after each instruction is executed, with the instruction decoded by
+// Run.
+func (t *Tracer) endInstruction(inst avr.Instruction) {
+    if !t.active {
+        return
+    }
+    t.active = false
+
+    if inst < 0 && len(t.filter.Classes) > 0 || inst >= 0 && !t.classes[inst] {
+        return
+    }
+
+    pc := t.before.pc
+    words := []uint16{t.em.prog[pc]}
+    if inst >= 0 && inst.IsTwoWord() {
+        words = append(words, t.em.prog[(pc+1)&t.em.pcmask])
+    }
+    e := TraceEntry{
+        Cycle:    t.cycle,
+        PC:       pc,
+        Words:    words,
+        Inst:     inst,
+        OldSREG:  t.before.sreg,
+        SREG:     t.em.SREG(),
+        OldSP:    t.before.sp,
+        SP:       t.em.sp,
+        Accesses: t.accesses,
+    }
+    for i, old := range t.before.regs {
+        if t.em.regs[i] != old {
+            e.Regs = append(e.Regs, RegChange{uint8(i), old, t.em.regs[i]})
+        }
+    }
+    // the binary format does not include the text, and disassembling is slow
+    if t.format != TraceBinary {
+        e.Text = strings.Replace(t.Disassembler.Decode(t.em.prog, pc).Text(), "\t", " ", -1)
+    }
+    t.write(&e)
+}
+
+// Writes an entry in the tracer's format.
+func (t *Tracer) write(e *TraceEntry) {
+    if t.err != nil {
+        return
+    }
+    var err error
+    switch t.format {
+    case TraceText:
+        _, err = fmt.Fprintln(t.w, t.formatText(e))
+    case TraceJSON:
+        var buf []byte
+        if buf, err = json.Marshal(t.jsonEntry(e)); err == nil {
+            buf = append(buf, '\n')
+            _, err = t.w.Write(buf)
+        }
+    case TraceBinary:
+        _, err = t.w.Write(appendBinaryEntry(nil, e, t.lastCycle))
+        t.lastCycle = e.Cycle
+    }
+    t.err = err
+}
+
+// Returns the name of the port accessed, or its data address if it has none.
+func (t *Tracer) accessName(a Access) string {
+    if a.Kind == PortRead || a.Kind == PortWrite {
+        if name := t.Disassembler.PortName(a.Port.BankNum, a.Port.Index); name != "" {
+            return name
+        }
+    }
+    return fmt.Sprintf("[%04x]", a.Addr)
+}
+
+// Formats an entry as a line of text, such as
+//
+//	1234 00d4: st X+, r24       r26 00->01 [0100]<-20 (was 00)
+func (t *Tracer) formatText(e *TraceEntry) string {
+    var changes []string
+    for _, c := range e.Regs {
+        changes = append(changes, fmt.Sprintf("r%d %02x->%02x", c.Reg, c.Old, c.New))
+    }
+    if e.SREG != e.OldSREG {
+        changes = append(changes, fmt.Sprintf("SREG %s->%s", formatSREG(e.OldSREG), formatSREG(e.SREG)))
+    }
+    if e.SP != e.OldSP {
+        changes = append(changes, fmt.Sprintf("SP %04x->%04x", e.OldSP, e.SP))
+    }
+    for _, a := range e.Accesses {
+        switch a.Kind {
+        case DataWrite:
+            changes = append(changes, fmt.Sprintf("%s<-%02x (was %02x)", t.accessName(a), a.Value, a.Old))
+        case PortWrite:
+            changes = append(changes, fmt.Sprintf("%s<-%02x", t.accessName(a), a.Value))
+        default:
+            changes = append(changes, fmt.Sprintf("%s->%02x", t.accessName(a), a.Value))
+        }
+    }
+    line := fmt.Sprintf("%10d %04x: %-24s %s", e.Cycle, 2*e.PC, e.Text, strings.Join(changes, " "))
+    return strings.TrimRight(line, " ")
+}
+
+// Formats SREG as its flag letters, upper case if set.
+func formatSREG(sreg uint8) string {
+    flags := []byte("ITHSVNZC")
+    for i := range flags {
+        if sreg&(0x80>>uint(i)) == 0 {
+            flags[i] += 'a' - 'A'
+        }
+    }
+    return string(flags)
+}
+
+// The JSON encoding of a TraceEntry.
+type jsonTraceEntry struct {
+    Cycle    uint64       `json:"cycle"`
+    PC       uint32       `json:"pc"`
+    Words    []uint16     `json:"words"`
+    Inst     string       `json:"inst"`
+    Regs     []jsonChange `json:"regs,omitempty"`
+    SREG     []uint8      `json:"sreg,omitempty"`
+    SP       []uint16     `json:"sp,omitempty"`
+    Accesses []jsonAccess `json:"accesses,omitempty"`
+}
+
+type jsonChange struct {
+    Reg uint8 `json:"reg"`
+    Old uint8 `json:"old"`
+    New uint8 `json:"new"`
+}
+
+type jsonAccess struct {
+    Kind  string `json:"kind"`
+    Addr  uint16 `json:"addr"`
+    Port  string `json:"port,omitempty"`
+    Value uint8  `json:"value"`
+    Old   *uint8 `json:"old,omitempty"`
+}
+
+var accessKindNames = []string{"write", "port_write", "port_read", "read"}
+
+func (t *Tracer) jsonEntry(e *TraceEntry) (j jsonTraceEntry) {
+    j = jsonTraceEntry{
+        Cycle: e.Cycle,
+        PC:    2 * e.PC,
+        Words: e.Words,
+        Inst:  e.Text,
+    }
+    for _, c := range e.Regs {
+        j.Regs = append(j.Regs, jsonChange{c.Reg, c.Old, c.New})
+    }
+    if e.SREG != e.OldSREG {
+        j.SREG = []uint8{e.OldSREG, e.SREG}
+    }
+    if e.SP != e.OldSP {
+        j.SP = []uint16{e.OldSP, e.SP}
+    }
+    for _, a := range e.Accesses {
+        ja := jsonAccess{Kind: accessKindNames[a.Kind], Addr: a.Addr, Value: a.Value}
+        switch a.Kind {
+        case DataWrite:
+            old := a.Old
+            ja.Old = &old
+        case PortRead, PortWrite:
+            ja.Port = t.Disassembler.PortName(a.Port.BankNum, a.Port.Index)
+        }
+        j.Accesses = append(j.Accesses, ja)
+    }
+    return j
+}
+
+// The binary format begins with traceMagic, followed by one record per entry:
+//
+//	uvarint   cycles since the previous record's Cycle (or since 0)
+//	uvarint   PC
+//	byte      number of words (1 or 2), then the words (little-endian)
+//	byte      flags: bit 0 if SREG changed, bit 1 if SP changed
+//	[2]byte   old and new SREG, if changed
+//	[4]byte   old and new SP (little-endian), if changed
+//	byte      number of register changes, then (reg, old, new) for each
+//	uvarint   number of accesses, then for each: kind, data address
+//	          (little-endian), value and old value; port accesses are followed
+//	          by the port's bank number and index (little-endian)
+func appendBinaryEntry(buf []byte, e *TraceEntry, lastCycle uint64) []byte {
+    var tmp [binary.MaxVarintLen64]byte
+    putUvarint := func(x uint64) {
+        n := binary.PutUvarint(tmp[:], x)
+        buf = append(buf, tmp[:n]...)
+    }
+    putUint16 := func(x uint16) {
+        buf = append(buf, uint8(x), uint8(x>>8))
+    }
+
+    putUvarint(e.Cycle - lastCycle)
+    putUvarint(uint64(e.PC))
+    buf = append(buf, uint8(len(e.Words)))
+    for _, w := range e.Words {
+        putUint16(w)
+    }
+
+    flags := uint8(0)
+    if e.SREG != e.OldSREG {
+        flags |= 1
+    }
+    if e.SP != e.OldSP {
+        flags |= 2
+    }
+    buf = append(buf, flags)
+    if flags&1 != 0 {
+        buf = append(buf, e.OldSREG, e.SREG)
+    }
+    if flags&2 != 0 {
+        putUint16(e.OldSP)
+        putUint16(e.SP)
+    }
+
+    buf = append(buf, uint8(len(e.Regs)))
+    for _, c := range e.Regs {
+        buf = append(buf, c.Reg, c.Old, c.New)
+    }
+
+    putUvarint(uint64(len(e.Accesses)))
+    for _, a := range e.Accesses {
+        buf = append(buf, uint8(a.Kind))
+        putUint16(a.Addr)
+        buf = append(buf, a.Value, a.Old)
+        if a.Kind == PortRead || a.Kind == PortWrite {
+            buf = append(buf, uint8(a.Port.BankNum))
+            putUint16(a.Port.Index)
+        }
+    }
+    return buf
+}
+
+// A TraceReader reads a trace written by a Tracer in the binary format.
+type TraceReader struct {
+    r         *bufio.Reader
+    dis       *disasm.Disassembler
+    lastCycle uint64
+}
+
+// Creates a TraceReader reading from r. The MCU spec is used to decode and
+// disassemble the instructions; if it is nil, the entries' Inst and Text
+// fields are not filled in.
+func NewTraceReader(r io.Reader, mcuSpec *spec.MCUSpec) (tr *TraceReader, err error) {
+    tr = &TraceReader{r: bufio.NewReader(r)}
+    if mcuSpec != nil {
+        tr.dis = disasm.New(mcuSpec)
+    }
+    magic := make([]byte, len(traceMagic))
+    if _, err = io.ReadFull(tr.r, magic); err != nil || string(magic) != traceMagic {
+        return nil, fmt.Errorf("emulator: not a binary trace")
+    }
+    return tr, nil
+}
+
+// Reads the next entry. Returns io.EOF at the end of the trace. SREG and OldSREG
+// are zero in entries for instructions that did not change SREG, as are SP and
+// OldSP.
+func (tr *TraceReader) Next() (e TraceEntry, err error) {
+    delta, err := binary.ReadUvarint(tr.r)
+    if err == io.EOF {
+        return e, io.EOF
+    }
+    failed := func() (TraceEntry, error) {
+        return TraceEntry{}, fmt.Errorf("emulator: truncated or corrupt trace")
+    }
+    if err != nil {
+        return failed()
+    }
+    var errs []error
+    readByte := func() uint8 {
+        b, err := tr.r.ReadByte()
+        if err != nil {
+            errs = append(errs, err)
+        }
+        return b
+    }
+    readUint16 := func() uint16 {
+        lo := readByte()
+        return uint16(lo) | uint16(readByte())<<8
+    }
+    readUvarint := func() uint64 {
+        x, err := binary.ReadUvarint(tr.r)
+        if err != nil {
+            errs = append(errs, err)
+        }
+        return x
+    }
+
+    e.Cycle = tr.lastCycle + delta
+    tr.lastCycle = e.Cycle
+    pc := readUvarint()
+    if tr.dis != nil && pc >= uint64(tr.dis.Spec.ProgMemSize()/2) {
+        return failed()
+    }
+    e.PC = uint32(pc)
+    nwords := readByte()
+    if nwords < 1 || nwords > 2 {
+        return failed()
+    }
+    for i := uint8(0); i < nwords; i++ {
+        e.Words = append(e.Words, readUint16())
+    }
+
+    flags := readByte()
+    if flags&1 != 0 {
+        e.OldSREG = readByte()
+        e.SREG = readByte()
+    }
+    if flags&2 != 0 {
+        e.OldSP = readUint16()
+        e.SP = readUint16()
+    }
+
+    nregs := readByte()
+    for i := uint8(0); i < nregs && len(errs) == 0; i++ {
+        e.Regs = append(e.Regs, RegChange{readByte(), readByte(), readByte()})
+    }
+
+    naccesses := readUvarint()
+    for i := uint64(0); i < naccesses && len(errs) == 0; i++ {
+        a := Access{Kind: AccessKind(readByte())}
+        a.Addr = readUint16()
+        a.Value = readByte()
+        a.Old = readByte()
+        if a.Kind == PortRead || a.Kind == PortWrite {
+            a.Port.BankNum = uint(readByte())
+            a.Port.Index = readUint16()
+        }
+        e.Accesses = append(e.Accesses, a)
+    }
+    if len(errs) > 0 {
+        return failed()
+    }
+
+    e.Inst = -1
+    if tr.dis != nil {
+        inst := tr.dis.DecodeWords(e.Words, e.PC)
+        e.Inst = inst.Inst
+        e.Text = strings.Replace(inst.Text(), "\t", " ", -1)
+    }
+    return e, nil
+}
@@ -0,0 +1,154 @@
+package emulator
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/spec"
+    "io"
+    "io/ioutil"
+    "strings"
+    "testing"
+)
+
+var tracerTestProgram = []uint16{
+    0xE005,         // ldi r16, 5
+    0x9300, 0x0100, // sts 0x0100, r16
+    0x5F0F, // subi r16, 0xFF
+    0xB905, // out PORTB, r16
+    0xCFFB, // rjmp .-10
+}
+
+func newTracerTestEmulator() (em *Emulator) {
+    em = NewEmulator(spec.ATmega168)
+    em.WriteProg(0, tracerTestProgram)
+    em.RegisterPortByName("PORTB", &latchPort{})
+    return em
+}
+
+func TestTracerText(t *testing.T) {
+    em := newTracerTestEmulator()
+    var buf bytes.Buffer
+    tr := NewTracer(em, &buf, TraceText)
+    em.Run(7)
+    if err := tr.Stop(); err != nil {
+        t.Fatal(err)
+    }
+
+    expected := []string{
+        "         0 0000: ldi r16, 0x05            r16 00->05",
+        "         1 0002: sts 0x0100, r16          [0100]<-05 (was 00)",
+        "         3 0006: subi r16, 0xFF           r16 05->06 SREG ithsvnzc->itHsvnzC",
+        "         4 0008: out 0x05, r16            PORTB<-06",
+        "         5 000a: rjmp .-10",
+    }
+    got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+    if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+        t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), buf.String())
+    }
+}
+
+func TestTracerFilter(t *testing.T) {
+    em := newTracerTestEmulator()
+    var buf bytes.Buffer
+    tr := NewTracer(em, &buf, TraceJSON)
+    tr.SetFilter(TraceFilter{
+        Ranges:  []PCRange{{1, 5}},
+        Classes: []avr.InstClass{avr.TransferClass},
+    })
+    em.Run(13) // two iterations
+    tr.Stop()
+
+    var pcs []uint32
+    for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+        var e struct {
+            PC       uint32
+            Accesses []struct {
+                Kind string
+                Port string
+            }
+        }
+        if err := json.Unmarshal([]byte(line), &e); err != nil {
+            t.Fatalf("%s: %s", line, err)
+        }
+        pcs = append(pcs, e.PC)
+        if e.PC == 8 && (len(e.Accesses) != 1 || e.Accesses[0].Kind != "port_write" || e.Accesses[0].Port != "PORTB") {
+            t.Errorf("unexpected accesses in %s", line)
+        }
+    }
+    // the sts and out of each iteration
+    if fmt.Sprint(pcs) != "[2 8 2 8]" {
+        t.Errorf("expected PCs [2 8 2 8], got %v", pcs)
+    }
+}
+
+func TestTracerBinary(t *testing.T) {
+    em := newTracerTestEmulator()
+    var text, bin bytes.Buffer
+    tr := NewTracer(em, &bin, TraceBinary)
+    em.Run(20)
+    tr.Stop()
+
+    // the binary trace should decode to the same entries as the text trace
+    textTracer := NewTracer(newTracerTestEmulator(), &text, TraceText)
+    textTracer.em.Run(20)
+    textTracer.Stop()
+
+    r, err := NewTraceReader(&bin, spec.ATmega168)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var decoded bytes.Buffer
+    for {
+        e, err := r.Next()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            t.Fatal(err)
+        }
+        fmt.Fprintln(&decoded, textTracer.formatText(&e))
+    }
+    if decoded.String() != text.String() {
+        t.Errorf("decoded binary trace:\n%s\ndiffers from text trace:\n%s", decoded.String(), text.String())
+    }
+
+    if _, err := NewTraceReader(strings.NewReader("not a trace"), nil); err == nil {
+        t.Errorf("expected an error reading a non-trace")
+    }
+
+    // an entry whose PC lies beyond program memory
+    r, err = NewTraceReader(strings.NewReader(traceMagic+"\x00\xFF\xFF\xFF\xFF\x0F\x01\x00\x00"), spec.ATmega168)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := r.Next(); err == nil || err == io.EOF {
+        t.Errorf("expected an error reading an entry with PC $FFFFFFFF, got %v", err)
+    }
+}
+
+func TestHookFlags(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    if em.instrumented || em.observing {
+        t.Fatalf("expected no hooks on a new emulator")
+    }
+
+    tr := NewTracer(em, ioutil.Discard, TraceBinary)
+    p := NewProfiler(em)
+    if !em.instrumented || !em.observing {
+        t.Errorf("expected hooks with a tracer and a profiler attached")
+    }
+    tr.Stop()
+    if !em.instrumented || em.observing {
+        t.Errorf("expected only per-instruction hooks with a profiler attached")
+    }
+    p.Stop()
+    if em.instrumented {
+        t.Errorf("expected no per-instruction hooks after detaching the profiler")
+    }
+
+    em.AddWatchpoint(Watchpoint{Addr: 0x0100, Kind: WatchWrite})
+    if em.instrumented || !em.observing {
+        t.Errorf("expected accesses to be observed with a watchpoint set")
+    }
+}
@@ -41,8 +41,15 @@ func andFlagIfEqual(dest *uint8, x, y uint8) {
 // * instructions not available on this particular MCU
 // * accesses to an unmapped data memory address
 // which are ignored by a real MCU but are often indicative of software errors.
+//
+// An Emulator's handling of warnings can be changed with SetWarningHandler and
+// SetWarningAction.
 type Warning interface {
     String() string
+    // Returns the kind of warning.
+    Kind() WarningKind
+    // Returns the word address of the instruction that caused the warning.
+    Where() uint32
 }
 
 // An attempt to load from/store to an address in data memory outside of the
@@ -56,6 +63,14 @@ func (w UnmappedAddressWarning) String() string {
     return fmt.Sprintf("access of unmapped data memory address $%04X (at PC $%06X)", w.Address, w.PC)
 }
 
+func (w UnmappedAddressWarning) Kind() WarningKind {
+    return UnmappedAddress
+}
+
+func (w UnmappedAddressWarning) Where() uint32 {
+    return w.PC
+}
+
 // An attempt to load from/store to an I/O port address that is not mapped by
 // the MCUSpec.
 type UnmappedPortWarning struct {
@@ -68,6 +83,14 @@ func (w UnmappedPortWarning) String() string {
     return fmt.Sprintf("access of unmapped I/O port at address $%04X in I/O bank %d (at PC $%06X)", w.PortAddr, w.BankNum, w.PC)
 }
 
+func (w UnmappedPortWarning) Kind() WarningKind {
+    return UnmappedPort
+}
+
+func (w UnmappedPortWarning) Where() uint32 {
+    return w.PC
+}
+
 // An invalid instruction word.
 type InvalidInstructionWarning struct {
     PC   uint32
@@ -78,6 +101,14 @@ func (w InvalidInstructionWarning) String() string {
     return fmt.Sprintf("invalid instruction word $%04X (at PC $%06X)", w.Word, w.PC)
 }
 
+func (w InvalidInstructionWarning) Kind() WarningKind {
+    return InvalidInstruction
+}
+
+func (w InvalidInstructionWarning) Where() uint32 {
+    return w.PC
+}
+
 // An instruction that is unsupported by this MCU.
 type UnavailableInstructionWarning struct {
     PC          uint32
@@ -88,3 +119,66 @@ type UnavailableInstructionWarning struct {
 func (w UnavailableInstructionWarning) String() string {
     return fmt.Sprintf("instruction %s is not available on %s (at PC $%06X)", w.Instruction, w.MCUSpec.Label, w.PC)
 }
+
+func (w UnavailableInstructionWarning) Kind() WarningKind {
+    return UnavailableInstruction
+}
+
+func (w UnavailableInstructionWarning) Where() uint32 {
+    return w.PC
+}
+
+// The stack growing below the limit set on a StackMonitor.
+type StackOverflowWarning struct {
+    PC    uint32
+    SP    uint16
+    Limit uint16
+}
+
+func (w StackOverflowWarning) String() string {
+    return fmt.Sprintf("stack overflow: SP $%04X has grown below the limit $%04X (at PC $%06X)", w.SP, w.Limit, w.PC)
+}
+
+func (w StackOverflowWarning) Kind() WarningKind {
+    return StackOverflow
+}
+
+func (w StackOverflowWarning) Where() uint32 {
+    return w.PC
+}
+
+// The stack growing out of RAM into the I/O registers or register file.
+type StackCollisionWarning struct {
+    PC uint32
+    SP uint16
+}
+
+func (w StackCollisionWarning) String() string {
+    return fmt.Sprintf("stack collision: SP $%04X has grown out of RAM into the registers (at PC $%06X)", w.SP, w.PC)
+}
+
+func (w StackCollisionWarning) Kind() WarningKind {
+    return StackCollision
+}
+
+func (w StackCollisionWarning) Where() uint32 {
+    return w.PC
+}
+
+// The use of an undefined value, found by a Sanitizer.
+type UndefinedValueWarning struct {
+    PC  uint32
+    Use string // such as "branch condition" or "address"
+}
+
+func (w UndefinedValueWarning) String() string {
+    return fmt.Sprintf("use of undefined value in %s (at PC $%06X)", w.Use, w.PC)
+}
+
+func (w UndefinedValueWarning) Kind() WarningKind {
+    return UndefinedValue
+}
+
+func (w UndefinedValueWarning) Where() uint32 {
+    return w.PC
+}
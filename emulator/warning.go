@@ -0,0 +1,146 @@
+package emulator
+
+import (
+    "fmt"
+    "github.com/kierdavis/avr"
+    "log"
+)
+
+// A WarningKind identifies a type of Warning.
+type WarningKind int
+
+const (
+    UnmappedAddress WarningKind = iota
+    UnmappedPort
+    InvalidInstruction
+    UnavailableInstruction
+    StackOverflow
+    StackCollision
+    UndefinedValue
+    NumWarningKinds = iota
+)
+
+var warningKindNames = [NumWarningKinds]string{
+    "unmapped-address",
+    "unmapped-port",
+    "invalid-instruction",
+    "unavailable-instruction",
+    "stack-overflow",
+    "stack-collision",
+    "undefined-value",
+}
+
+// Returns the name of the kind of warning, such as "invalid-instruction".
+func (k WarningKind) String() string {
+    if k < 0 || k >= NumWarningKinds {
+        return fmt.Sprintf("WarningKind(%d)", int(k))
+    }
+    return warningKindNames[k]
+}
+
+// Returns the kind of warning with the given name.
+func WarningKindByName(name string) (k WarningKind, ok bool) {
+    for k := WarningKind(0); k < NumWarningKinds; k++ {
+        if warningKindNames[k] == name {
+            return k, true
+        }
+    }
+    return 0, false
+}
+
+// A WarningAction is what an Emulator does with warnings of a particular kind.
+type WarningAction int
+
+const (
+    // Report the warning: pass it to the warning handler if one is set, or
+    // else log it if logging is enabled. This is the default.
+    WarningReport WarningAction = iota
+    // Report only the first warning of the kind issued by each instruction
+    // address.
+    WarningReportOnce
+    // Report the warning and stop Run with avr.StopWarning once the instruction
+    // that caused it has completed, treating it as a crash.
+    WarningStop
+    // Discard the warning.
+    WarningIgnore
+)
+
+// The per-emulator state of warning handling.
+type warnings struct {
+    handler func(Warning)
+    actions [NumWarningKinds]WarningAction
+    counts  [NumWarningKinds]uint64
+    seen    map[warningSite]bool // reported warnings, for WarningReportOnce
+    stop    Warning              // the warning that stopped Run
+}
+
+type warningSite struct {
+    kind WarningKind
+    pc   uint32
+}
+
+// Sets a function to be called with each warning that is reported, in place
+// of logging it, so that warnings can be collected or counted. Pass nil to
+// log warnings again.
+func (em *Emulator) SetWarningHandler(handler func(w Warning)) {
+    em.warnings.handler = handler
+}
+
+// Sets the action taken on warnings of the given kind.
+func (em *Emulator) SetWarningAction(kind WarningKind, action WarningAction) {
+    em.warnings.actions[kind] = action
+}
+
+// Returns the action taken on warnings of the given kind.
+func (em *Emulator) WarningAction(kind WarningKind) WarningAction {
+    return em.warnings.actions[kind]
+}
+
+// Returns the number of warnings of the given kind issued since the emulator
+// was created, including those ignored or not reported again.
+func (em *Emulator) WarningCount(kind WarningKind) uint64 {
+    return em.warnings.counts[kind]
+}
+
+// Returns the warning that stopped the last call to Run. The result is only
+// meaningful if Run returned avr.StopWarning.
+func (em *Emulator) StopWarning() Warning {
+    return em.warnings.stop
+}
+
+// Issue a warning, taking the action set for its kind. Warnings include events
+// such as
+// * invalid instructions
+// * instructions not available on this particular MCU
+// * accesses to an unmapped data memory address
+// which are ignored by a real MCU but are often indicative of software errors.
+func (em *Emulator) warn(w Warning) {
+    ws := &em.warnings
+    kind := w.Kind()
+    ws.counts[kind]++
+
+    switch ws.actions[kind] {
+    case WarningIgnore:
+        return
+    case WarningReportOnce:
+        site := warningSite{kind, w.Where()}
+        if ws.seen[site] {
+            return
+        }
+        if ws.seen == nil {
+            ws.seen = make(map[warningSite]bool)
+        }
+        ws.seen[site] = true
+    case WarningStop:
+        if em.pendingStop == avr.StopTicks {
+            em.pendingStop = avr.StopWarning
+            ws.stop = w
+        }
+    }
+
+    if ws.handler != nil {
+        ws.handler(w)
+    } else if em.logging {
+        log.Printf("[avr/emulator:(*Emulator).warn] %s\n", w.String())
+    }
+}
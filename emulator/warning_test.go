@@ -0,0 +1,60 @@
+package emulator
+
+import (
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+func TestWarningActions(t *testing.T) {
+    em := NewEmulator(spec.ATmega168)
+    em.WriteProg(0, []uint16{
+        0xB105, // in r16, PORTB (unmapped)
+        0xFFFF, // invalid
+        0xCFFD, // rjmp .-6
+    })
+
+    var warnings []Warning
+    em.SetWarningHandler(func(w Warning) {
+        warnings = append(warnings, w)
+    })
+    em.SetWarningAction(UnmappedPort, WarningReportOnce)
+    em.SetWarningAction(InvalidInstruction, WarningIgnore)
+
+    if reason, executed := em.Run(12); reason != avr.StopTicks || executed != 12 {
+        t.Errorf("expected to run for 12 ticks, stopped by %s after %d", reason, executed)
+    }
+    if len(warnings) != 1 || warnings[0].Kind() != UnmappedPort || warnings[0].Where() != 0 {
+        t.Errorf("expected one unmapped-port warning at 0x0000, got %v", warnings)
+    }
+    if n := em.WarningCount(UnmappedPort); n != 3 {
+        t.Errorf("expected 3 unmapped-port warnings to be counted, got %d", n)
+    }
+    if n := em.WarningCount(InvalidInstruction); n != 3 {
+        t.Errorf("expected 3 invalid-instruction warnings to be counted, got %d", n)
+    }
+
+    em.SetWarningAction(InvalidInstruction, WarningStop)
+    if reason, _ := em.Run(12); reason != avr.StopWarning {
+        t.Errorf("expected to stop with a warning, stopped by %s", reason)
+    } else if w := em.StopWarning(); w.Kind() != InvalidInstruction || w.Where() != 1 || em.PC() != 2 {
+        t.Errorf("expected to stop at 0x0002 after an invalid instruction at 0x0001, got %v at 0x%04X", w, em.PC())
+    }
+    if len(warnings) != 2 || warnings[1].Kind() != InvalidInstruction {
+        t.Errorf("expected the stopping warning to be reported, got %v", warnings)
+    }
+}
+
+func TestWarningKindByName(t *testing.T) {
+    for k := WarningKind(0); k < NumWarningKinds; k++ {
+        if k2, ok := WarningKindByName(k.String()); !ok || k2 != k {
+            t.Errorf("%s: expected to look up %d, got %d, %v", k, k, k2, ok)
+        }
+    }
+    if _, ok := WarningKindByName("nonsense"); ok {
+        t.Errorf("expected unknown name not to be found")
+    }
+    if s := WarningKind(NumWarningKinds).String(); s != "WarningKind(7)" {
+        t.Errorf("expected WarningKind(7), got %q", s)
+    }
+}
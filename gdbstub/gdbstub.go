@@ -0,0 +1,529 @@
+// Package gdbstub implements the GDB remote serial protocol, allowing a program
+// running in an Emulator to be debugged with avr-gdb in the same way as with
+// simavr:
+//
+//	(gdb) target remote :1234
+//
+// Registers r0-r31, SREG, SP and PC can be read and written. Memory addresses
+// follow avr-gdb's convention: program memory is at 0, data memory at 0x800000
+// and EEPROM at 0x810000. Software and hardware breakpoints (which are the
+// same to the emulator), write, read and access watchpoints, single-stepping,
+// continuing, interrupting with Ctrl-C and "monitor reset" are supported. BREAK
+// instructions in the program stop it with SIGTRAP, as breakpoints do.
+package gdbstub
+
+import (
+    "bufio"
+    "encoding/hex"
+    "fmt"
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/emulator"
+    "io"
+    "log"
+    "net"
+    "strings"
+)
+
+// avr-gdb's offsets of the memory spaces within its address space.
+const (
+    dataOffset   = 0x800000
+    eepromOffset = 0x810000
+    spaceLimit   = 0x820000
+)
+
+// The number of ticks run between checks for an interrupt from the debugger.
+const pollInterval = 4096
+
+// A Server debugs a program running in an Emulator on behalf of GDB.
+// Breakpoints and watchpoints set by GDB are set in the emulator, and removed
+// when the connection ends.
+type Server struct {
+    em *emulator.Emulator
+    // Run advances the emulation by the given number of ticks, or until the
+    // emulator stops. It defaults to the emulator's Run method; set it to the
+    // Run method of a clock.Clock so that peripherals keep time with the CPU.
+    Run func(ticks uint) (reason avr.StopReason, executed uint)
+    // If not nil, called by "monitor reset" after the CPU is reset, to reset
+    // peripherals.
+    Reset   func()
+    logging bool
+
+    breakpoints map[uint32]bool // word addresses of breakpoints set by GDB
+    watchpoints []emulator.Watchpoint
+}
+
+// Kinds of watchpoint, as numbered in Z packets.
+var watchKinds = map[int]emulator.WatchKind{
+    2: emulator.WatchWrite,
+    3: emulator.WatchRead,
+    4: emulator.WatchAccess,
+}
+
+// Names of the kinds of watchpoint in stop replies.
+var watchNames = map[emulator.WatchKind]string{
+    emulator.WatchWrite:  "watch",
+    emulator.WatchRead:   "rwatch",
+    emulator.WatchAccess: "awatch",
+}
+
+// Creates a Server for the given emulator.
+func New(em *emulator.Emulator) (s *Server) {
+    return &Server{
+        em:          em,
+        Run:         em.Run,
+        breakpoints: make(map[uint32]bool),
+    }
+}
+
+func (s *Server) SetLogging(enabled bool) {
+    s.logging = enabled
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+    if s.logging {
+        log.Printf("[avr/gdbstub] "+format, args...)
+    }
+}
+
+// ListenAndServe listens on the given TCP address (such as ":1234"), waits for
+// GDB to connect and serves the connection until GDB detaches, kills the
+// program or disconnects.
+func (s *Server) ListenAndServe(addr string) (err error) {
+    l, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    s.logf("waiting for gdb on %s", l.Addr())
+    conn, err := l.Accept()
+    l.Close()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    s.logf("gdb connected from %s", conn.RemoteAddr())
+    return s.Serve(conn)
+}
+
+// An event received from GDB.
+type event struct {
+    packet    string
+    badSum    bool
+    interrupt bool // Ctrl-C
+    err       error
+}
+
+// State of a connection.
+type session struct {
+    *Server
+    w        *bufio.Writer
+    events   chan event
+    noAck    bool
+    lastStop string
+}
+
+// Serve serves a single connection from GDB until GDB detaches, kills the
+// program or disconnects.
+func (s *Server) Serve(conn io.ReadWriter) (err error) {
+    ss := &session{
+        Server:   s,
+        w:        bufio.NewWriter(conn),
+        events:   make(chan event, 16),
+        lastStop: "S05",
+    }
+    done := make(chan struct{})
+    defer close(done)
+    go readEvents(conn, ss.events, done)
+
+    defer s.clearPoints()
+    s.em.SetDebuggerAttached(true)
+    defer s.em.SetDebuggerAttached(false)
+
+    for {
+        ev := <-ss.events
+        switch {
+        case ev.err == io.EOF:
+            s.logf("gdb disconnected")
+            return nil
+        case ev.err != nil:
+            return ev.err
+        case ev.interrupt:
+            // already stopped
+            continue
+        case ev.badSum:
+            if !ss.noAck {
+                ss.w.WriteString("-")
+                ss.w.Flush()
+            }
+            continue
+        }
+
+        if !ss.noAck {
+            // acknowledge before handling, as continuing may take a long time
+            ss.w.WriteString("+")
+            if err = ss.w.Flush(); err != nil {
+                return err
+            }
+        }
+        reply, stop, err := ss.handle(ev.packet)
+        if err != nil {
+            return err
+        }
+        if reply != "" || !stop {
+            ss.send(reply)
+        }
+        if stop {
+            return ss.w.Flush()
+        }
+        if err = ss.w.Flush(); err != nil {
+            return err
+        }
+    }
+}
+
+// Reads packets and interrupts from r until it fails or done is closed.
+func readEvents(r io.Reader, events chan<- event, done <-chan struct{}) {
+    br := bufio.NewReader(r)
+    send := func(ev event) bool {
+        select {
+        case events <- ev:
+            return true
+        case <-done:
+            return false
+        }
+    }
+
+    for {
+        c, err := br.ReadByte()
+        if err != nil {
+            send(event{err: err})
+            return
+        }
+        switch c {
+        case 0x03:
+            if !send(event{interrupt: true}) {
+                return
+            }
+        case '$':
+            data, err := br.ReadString('#')
+            if err != nil {
+                send(event{err: err})
+                return
+            }
+            data = data[:len(data)-1]
+            sum := make([]byte, 2)
+            if _, err = io.ReadFull(br, sum); err != nil {
+                send(event{err: err})
+                return
+            }
+            ok := fmt.Sprintf("%02x", checksum(data)) == strings.ToLower(string(sum))
+            if !send(event{packet: data, badSum: !ok}) {
+                return
+            }
+        }
+        // acknowledgements ('+' and '-') and anything else are ignored
+    }
+}
+
+// Returns the checksum of a packet's data.
+func checksum(data string) (sum uint8) {
+    for i := 0; i < len(data); i++ {
+        sum += data[i]
+    }
+    return sum
+}
+
+// Writes a packet.
+func (ss *session) send(data string) {
+    fmt.Fprintf(ss.w, "$%s#%02x", data, checksum(data))
+}
+
+// Runs the program until it reaches a breakpoint, triggers a watchpoint, or is
+// interrupted; or, if step is true, for a single instruction. Returns the stop
+// reply.
+func (ss *session) resume(step bool) (reply string, err error) {
+    s := ss.Server
+    start := s.em.InstructionCount()
+
+    for {
+        var reason avr.StopReason
+        if step {
+            // one tick at a time, so that only one instruction is executed
+            reason, _ = s.Run(1)
+        } else {
+            reason, _ = s.Run(pollInterval)
+        }
+
+        switch reason {
+        case avr.StopBreakpoint, avr.StopBreak:
+            return "S05", nil
+        case avr.StopWarning:
+            s.logf("stopped by warning: %s", s.em.StopWarning())
+            return "S05", nil
+        case avr.StopWatchpoint:
+            w, a := s.em.StopAccess()
+            return fmt.Sprintf("T05%s:%x;", watchNames[w.Kind], dataOffset+uint32(a.Addr)), nil
+        }
+        if step {
+            if s.em.InstructionCount() != start {
+                return "S05", nil
+            }
+            continue
+        }
+
+        select {
+        case ev := <-ss.events:
+            if ev.err != nil {
+                return "", ev.err
+            }
+            if ev.interrupt {
+                return "S02", nil
+            }
+        default:
+        }
+    }
+}
+
+// Handles a packet, returning the reply and whether the session should end.
+func (ss *session) handle(packet string) (reply string, stop bool, err error) {
+    s := ss.Server
+    if packet == "" {
+        return "", false, nil
+    }
+    args := packet[1:]
+
+    switch packet[0] {
+    case '?':
+        return ss.lastStop, false, nil
+
+    case 'g':
+        return hex.EncodeToString(s.registers()), false, nil
+    case 'G':
+        buf, err := hex.DecodeString(args)
+        if err != nil || len(buf) != numRegBytes {
+            return "E01", false, nil
+        }
+        s.setRegisters(buf)
+        return "OK", false, nil
+
+    case 'p':
+        var n int
+        if _, err := fmt.Sscanf(args, "%x", &n); err != nil || n < 0 || n >= len(regSizes) {
+            return "E01", false, nil
+        }
+        buf := s.registers()
+        offset := regOffset(n)
+        return hex.EncodeToString(buf[offset : offset+regSizes[n]]), false, nil
+    case 'P':
+        var n int
+        var value string
+        parts := strings.SplitN(args, "=", 2)
+        if len(parts) == 2 {
+            _, err = fmt.Sscanf(parts[0], "%x", &n)
+            value = parts[1]
+        }
+        val, herr := hex.DecodeString(value)
+        if len(parts) != 2 || err != nil || herr != nil || n < 0 || n >= len(regSizes) || len(val) != regSizes[n] {
+            return "E01", false, nil
+        }
+        buf := s.registers()
+        copy(buf[regOffset(n):], val)
+        s.setRegisters(buf)
+        return "OK", false, nil
+
+    case 'm':
+        var addr, length uint32
+        if _, err := fmt.Sscanf(args, "%x,%x", &addr, &length); err != nil {
+            return "E01", false, nil
+        }
+        buf, ok := s.readMemory(addr, length)
+        if !ok {
+            return "E01", false, nil
+        }
+        return hex.EncodeToString(buf), false, nil
+    case 'M', 'X':
+        var addr, length uint32
+        colon := strings.IndexByte(args, ':')
+        if colon < 0 {
+            return "E01", false, nil
+        }
+        if _, err := fmt.Sscanf(args[:colon], "%x,%x", &addr, &length); err != nil {
+            return "E01", false, nil
+        }
+        var buf []byte
+        if packet[0] == 'M' {
+            buf, err = hex.DecodeString(args[colon+1:])
+        } else {
+            buf = unescape(args[colon+1:])
+        }
+        if err != nil || uint32(len(buf)) != length || !s.writeMemory(addr, buf) {
+            return "E01", false, nil
+        }
+        return "OK", false, nil
+
+    case 'c', 's':
+        if args != "" {
+            var addr uint32
+            if _, err := fmt.Sscanf(args, "%x", &addr); err != nil {
+                return "E01", false, nil
+            }
+            s.em.SetPC(addr / 2)
+        }
+        if ss.lastStop, err = ss.resume(packet[0] == 's'); err != nil {
+            return "", true, err
+        }
+        return ss.lastStop, false, nil
+
+    case 'Z', 'z':
+        var kind int
+        var addr, length uint32
+        if _, err := fmt.Sscanf(args, "%d,%x,%x", &kind, &addr, &length); err != nil {
+            return "E01", false, nil
+        }
+        if !s.setPoint(packet[0] == 'Z', kind, addr, length) {
+            return "E01", false, nil
+        }
+        return "OK", false, nil
+
+    case 'H':
+        return "OK", false, nil
+
+    case 'k':
+        s.logf("gdb killed the program")
+        return "", true, nil
+    case 'D':
+        s.logf("gdb detached")
+        return "OK", true, nil
+
+    case 'q', 'Q', 'v':
+        return ss.query(packet)
+    }
+
+    // unsupported
+    return "", false, nil
+}
+
+// Handles a general query or a v packet.
+func (ss *session) query(packet string) (reply string, stop bool, err error) {
+    name := packet
+    if i := strings.IndexAny(packet, ":,;"); i >= 0 {
+        name = packet[:i]
+    }
+
+    switch name {
+    case "qSupported":
+        return "PacketSize=4000;QStartNoAckMode+", false, nil
+    case "QStartNoAckMode":
+        // this packet has been acknowledged; later ones are not
+        ss.noAck = true
+        return "OK", false, nil
+    case "qAttached":
+        return "1", false, nil
+    case "qSymbol":
+        return "OK", false, nil
+    case "qRcmd":
+        cmd, err := hex.DecodeString(packet[len("qRcmd,"):])
+        if err != nil {
+            return "E01", false, nil
+        }
+        ss.output(ss.monitor(strings.TrimSpace(string(cmd))))
+        return "OK", false, nil
+    case "vKill":
+        s := ss.Server
+        s.logf("gdb killed the program")
+        return "OK", true, nil
+    }
+
+    // unsupported
+    return "", false, nil
+}
+
+// Sends text to be printed on GDB's console.
+func (ss *session) output(text string) {
+    if text != "" {
+        ss.send("O" + hex.EncodeToString([]byte(text)))
+    }
+}
+
+// Executes a "monitor" command, returning its output.
+func (ss *session) monitor(cmd string) string {
+    s := ss.Server
+    switch cmd {
+    case "reset":
+        s.em.Reset()
+        if s.Reset != nil {
+            s.Reset()
+        }
+        s.logf("reset by gdb")
+        return "MCU reset\n"
+    case "help":
+        return "monitor reset - reset the MCU\n"
+    }
+    return fmt.Sprintf("unknown monitor command %q (try \"monitor help\")\n", cmd)
+}
+
+// Decodes the binary data of an X packet, in which '#', '$', '}' and '*' are
+// escaped by '}' followed by the byte XOR 0x20.
+func unescape(data string) (buf []byte) {
+    for i := 0; i < len(data); i++ {
+        c := data[i]
+        if c == '}' && i+1 < len(data) {
+            i++
+            c = data[i] ^ 0x20
+        }
+        buf = append(buf, c)
+    }
+    return buf
+}
+
+// Sets or clears a breakpoint or watchpoint. Returns false if the request is
+// invalid.
+func (s *Server) setPoint(set bool, kind int, addr, length uint32) (ok bool) {
+    switch kind {
+    case 0, 1:
+        if addr >= uint32(s.em.Spec.ProgMemSize()) {
+            return false
+        }
+        pc := addr / 2
+        if set && !s.breakpoints[pc] {
+            s.breakpoints[pc] = true
+            s.em.SetBreakpoint(pc)
+        } else if !set && s.breakpoints[pc] {
+            delete(s.breakpoints, pc)
+            s.em.ClearBreakpoint(pc)
+        }
+        return true
+
+    case 2, 3, 4:
+        if addr < dataOffset || addr+length > eepromOffset || length == 0 {
+            return false
+        }
+        w := emulator.Watchpoint{Addr: uint16(addr - dataOffset), Size: uint16(length), Kind: watchKinds[kind]}
+        for i, other := range s.watchpoints {
+            if other == w {
+                if !set {
+                    s.watchpoints = append(s.watchpoints[:i], s.watchpoints[i+1:]...)
+                    s.em.RemoveWatchpoint(w)
+                }
+                return true
+            }
+        }
+        if set {
+            s.watchpoints = append(s.watchpoints, w)
+            s.em.AddWatchpoint(w)
+        }
+        return true
+    }
+    return false
+}
+
+// Removes the breakpoints and watchpoints set by GDB from the emulator.
+func (s *Server) clearPoints() {
+    for pc := range s.breakpoints {
+        s.em.ClearBreakpoint(pc)
+    }
+    for _, w := range s.watchpoints {
+        s.em.RemoveWatchpoint(w)
+    }
+    s.breakpoints = make(map[uint32]bool)
+    s.watchpoints = nil
+}
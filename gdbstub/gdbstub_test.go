@@ -0,0 +1,125 @@
+package gdbstub
+
+import (
+    "bufio"
+    "encoding/hex"
+    "fmt"
+    "github.com/kierdavis/avr/asm"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/spec"
+    "net"
+    "strings"
+    "testing"
+)
+
+const testProgram = `
+        ldi     r16, 0x12
+        sts     0x0100, r16
+loop:   nop
+        rjmp    loop
+`
+
+// A GDB client talking to a Server over a pipe.
+type client struct {
+    t    *testing.T
+    conn net.Conn
+    r    *bufio.Reader
+}
+
+// Sends a packet and waits for its acknowledgement.
+func (c *client) send(data string) {
+    fmt.Fprintf(c.conn, "$%s#%02x", data, checksum(data))
+    if b, err := c.r.ReadByte(); err != nil || b != '+' {
+        c.t.Fatalf("%s: expected acknowledgement, got %q (%v)", data, b, err)
+    }
+}
+
+// Reads a reply packet and acknowledges it.
+func (c *client) reply() string {
+    if _, err := c.r.ReadString('$'); err != nil {
+        c.t.Fatal(err)
+    }
+    data, err := c.r.ReadString('#')
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    c.r.Discard(2)
+    c.conn.Write([]byte("+"))
+    return strings.TrimSuffix(data, "#")
+}
+
+// Sends a packet and checks the reply.
+func (c *client) expect(data, reply string) {
+    c.send(data)
+    if got := c.reply(); got != reply {
+        c.t.Errorf("%s: expected reply %q, got %q", data, reply, got)
+    }
+}
+
+func startServer(t *testing.T) (em *emulator.Emulator, c *client, done chan error) {
+    em = emulator.NewEmulator(spec.ATmega168)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, testProgram))
+
+    serverConn, clientConn := net.Pipe()
+    done = make(chan error, 1)
+    go func() {
+        done <- New(em).Serve(serverConn)
+        serverConn.Close()
+    }()
+    return em, &client{t, clientConn, bufio.NewReader(clientConn)}, done
+}
+
+func TestSession(t *testing.T) {
+    em, c, done := startServer(t)
+
+    c.expect("?", "S05")
+    c.expect("m0,4", "02e10093")
+    c.expect("p22", "00000000")
+
+    // write watchpoint on 0x0100, hit by the sts
+    c.expect("Z2,800100,1", "OK")
+    c.expect("c", "T05watch:800100;")
+    c.expect("p22", "06000000")
+    c.expect("m800100,1", "12")
+    c.expect("z2,800100,1", "OK")
+
+    // breakpoint at loop, then step past it
+    c.expect("Z0,6,2", "OK")
+    c.expect("c", "S05")
+    c.expect("p22", "06000000")
+    c.expect("s", "S05")
+    c.expect("p22", "08000000")
+    c.expect("c", "S05")
+    c.expect("p22", "06000000")
+    c.expect("z0,6,2", "OK")
+
+    // registers and memory
+    c.expect("P10=34", "OK")
+    c.expect("M800101,2:abcd", "OK")
+    if em.Reg(16) != 0x34 || em.PeekData(0x0101) != 0xAB || em.PeekData(0x0102) != 0xCD {
+        t.Errorf("register or memory writes not applied")
+    }
+    c.send("g")
+    regs := c.reply()
+    if len(regs) != 2*numRegBytes || regs[32:34] != "34" || regs[70:78] != "06000000" {
+        t.Errorf("unexpected register file %s", regs)
+    }
+
+    // Ctrl-C while running
+    c.send("c")
+    c.conn.Write([]byte{0x03})
+    if reply := c.reply(); reply != "S02" {
+        t.Errorf("expected S02 after interrupt, got %q", reply)
+    }
+
+    c.expect("qRcmd,"+hex.EncodeToString([]byte("reset")), "O"+hex.EncodeToString([]byte("MCU reset\n")))
+    if reply := c.reply(); reply != "OK" {
+        t.Errorf("expected OK after monitor output, got %q", reply)
+    }
+    c.expect("p22", "00000000")
+
+    c.expect("D", "OK")
+    if err := <-done; err != nil {
+        t.Errorf("Serve returned %v", err)
+    }
+}
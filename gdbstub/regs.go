@@ -0,0 +1,117 @@
+package gdbstub
+
+// Sizes in bytes of the registers in avr-gdb's register file: r0-r31, SREG, SP
+// and PC (as a byte address).
+var regSizes = []int{
+    1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+    1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+    1, 2, 4,
+}
+
+// Register numbers of SREG, SP and PC.
+const (
+    regSREG = 32
+    regSP   = 33
+    regPC   = 34
+)
+
+// The size of the register file.
+const numRegBytes = 39
+
+// Returns the offset of register n in the register file.
+func regOffset(n int) (offset int) {
+    for _, size := range regSizes[:n] {
+        offset += size
+    }
+    return offset
+}
+
+// Returns the register file, in the target's (little-endian) byte order.
+func (s *Server) registers() (buf []byte) {
+    em := s.em
+    buf = make([]byte, numRegBytes)
+    for i := 0; i < 32; i++ {
+        buf[i] = em.Reg(uint(i))
+    }
+    buf[regOffset(regSREG)] = em.SREG()
+    sp := em.SP()
+    buf[regOffset(regSP)] = uint8(sp)
+    buf[regOffset(regSP)+1] = uint8(sp >> 8)
+    pc := 2 * em.PC()
+    for i := 0; i < 4; i++ {
+        buf[regOffset(regPC)+i] = uint8(pc >> (8 * uint(i)))
+    }
+    return buf
+}
+
+// Sets the registers from a register file.
+func (s *Server) setRegisters(buf []byte) {
+    em := s.em
+    for i := 0; i < 32; i++ {
+        em.SetReg(uint(i), buf[i])
+    }
+    em.SetSREG(buf[regOffset(regSREG)])
+    em.SetSP(uint16(buf[regOffset(regSP)]) | uint16(buf[regOffset(regSP)+1])<<8)
+    var pc uint32
+    for i := 0; i < 4; i++ {
+        pc |= uint32(buf[regOffset(regPC)+i]) << (8 * uint(i))
+    }
+    em.SetPC(pc / 2)
+}
+
+// Reads length bytes of memory at a GDB address. Returns false if any of the
+// range lies outside the memories of the MCU.
+func (s *Server) readMemory(addr, length uint32) (buf []byte, ok bool) {
+    em := s.em
+    buf = make([]byte, length)
+    for i := range buf {
+        a := addr + uint32(i)
+        switch {
+        case a < dataOffset:
+            if a >= uint32(em.Spec.ProgMemSize()) {
+                return nil, false
+            }
+            buf[i] = em.ProgByte(a)
+        case a < eepromOffset:
+            if a-dataOffset >= 1<<em.Spec.LogDataSpaceSize {
+                return nil, false
+            }
+            buf[i] = em.PeekData(uint16(a - dataOffset))
+        case a < spaceLimit:
+            if a-eepromOffset >= uint32(em.Spec.EEPROMSize()) {
+                return nil, false
+            }
+            buf[i] = em.EEPROMByte(uint16(a - eepromOffset))
+        default:
+            return nil, false
+        }
+    }
+    return buf, true
+}
+
+// Writes bytes to memory at a GDB address. Writes to I/O registers are poked
+// without side effects where the peripheral allows it, and otherwise go
+// through the peripheral as a store instruction would. Returns false if any of
+// the range lies outside the memories of the MCU; in that case, none of it is
+// written.
+func (s *Server) writeMemory(addr uint32, buf []byte) (ok bool) {
+    if _, ok = s.readMemory(addr, uint32(len(buf))); !ok && len(buf) > 0 {
+        return false
+    }
+
+    em := s.em
+    for i, b := range buf {
+        a := addr + uint32(i)
+        switch {
+        case a < dataOffset:
+            em.SetProgByte(a, b)
+        case a < eepromOffset:
+            if !em.PokeData(uint16(a-dataOffset), b) {
+                em.StoreData(uint16(a-dataOffset), b)
+            }
+        default:
+            em.SetEEPROMByte(uint16(a-eepromOffset), b)
+        }
+    }
+    return true
+}
@@ -27,6 +27,7 @@ type GPIO struct {
     inputAdapters  [8]InputPinAdapter
     outputAdapters [8]OutputPinAdapter
     overriden      [8]bool
+    overrideStates uint8 // states of overridden output pins
 }
 
 func New(portLetter byte, width uint) (g *GPIO) {
@@ -49,6 +50,11 @@ func (g *GPIO) SetOutputAdapter(pinNumber uint, adapter OutputPinAdapter) {
 func (g *GPIO) OverrideOutput(pinNumber uint) (callback func(bool)) {
     g.overriden[pinNumber] = true
     return func(newState bool) {
+        if newState {
+            g.overrideStates |= 1 << pinNumber
+        } else {
+            g.overrideStates &^= 1 << pinNumber
+        }
         adapter := g.outputAdapters[pinNumber]
         if adapter != nil {
             adapter.SetState(newState)
@@ -56,10 +62,50 @@ func (g *GPIO) OverrideOutput(pinNumber uint) (callback func(bool)) {
     }
 }
 
+// Returns the level of a pin: the state it is driven to if it is an output, or
+// the state read from its input adapter if it is an input.
+func (g *GPIO) Pin(pinNumber uint) bool {
+    if (g.dirs>>pinNumber)&1 == Input {
+        return g.getInput(pinNumber)
+    } else if g.overriden[pinNumber] {
+        return (g.overrideStates>>pinNumber)&1 != 0
+    } else {
+        return (g.outputs>>pinNumber)&1 != 0
+    }
+}
+
 func (g *GPIO) AddTo(em *emulator.Emulator) {
     em.RegisterPortByName(fmt.Sprintf("PORT%c", g.letter), port{g})
     em.RegisterPortByName(fmt.Sprintf("DDR%c", g.letter), ddr{g})
     em.RegisterPortByName(fmt.Sprintf("PIN%c", g.letter), pin{g})
+    em.AddSnapshotter(g)
+}
+
+// Returns the registers to their reset values, as a reset of the MCU would: all
+// pins become inputs with their pull-ups disabled.
+func (g *GPIO) Reset() {
+    g.dirs, g.outputs, g.pullups = 0, 0, 0
+    g.updateOutputs(0xFF)
+}
+
+// GPIO implements emulator.Snapshotter.
+func (g *GPIO) SnapshotName() string {
+    return fmt.Sprintf("gpio:%c", g.letter)
+}
+
+func (g *GPIO) SnapshotState() []byte {
+    return []byte{g.dirs, g.outputs, g.pullups}
+}
+
+// Restores the state of the registers and pushes the restored pin states to
+// the adapters.
+func (g *GPIO) RestoreState(data []byte) error {
+    if len(data) != 3 {
+        return fmt.Errorf("GPIO state is %d bytes, expected 3", len(data))
+    }
+    g.dirs, g.outputs, g.pullups = data[0], data[1], data[2]
+    g.updateOutputs(0xFF)
+    return nil
 }
 
 // called when a PIN port is read
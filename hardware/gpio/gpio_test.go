@@ -0,0 +1,59 @@
+package gpio
+
+import (
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+// An output adapter that remembers the last state it was set to.
+type latchAdapter struct {
+    state bool
+}
+
+func (a *latchAdapter) SetState(state bool) {
+    a.state = state
+}
+
+func TestRecorderRedoesPortWrites(t *testing.T) {
+    em := emulator.NewEmulator(spec.ATmega168)
+    em.WriteProg(0, []uint16{
+        0xE00F, // ldi r16, 0x0F
+        0xB904, // out DDRB, r16
+        0xE005, // ldi r16, 0x05
+        0xB905, // out PORTB, r16
+        0xE00A, // ldi r16, 0x0A
+        0xB905, // out PORTB, r16
+        0xCFFF, // rjmp .-2
+    })
+    g := New('B', 8)
+    g.AddTo(em)
+    pin0, pin1 := &latchAdapter{}, &latchAdapter{}
+    g.SetOutputAdapter(0, pin0)
+    g.SetOutputAdapter(1, pin1)
+    r := emulator.NewRecorder(em, 100, 10)
+
+    em.Run(6)
+    if em.PeekData(0x0025) != 0x0A || pin0.state {
+        t.Fatalf("unexpected state after running: PORTB = 0x%02X, pin 0 %t", em.PeekData(0x0025), pin0.state)
+    }
+
+    // back across the second write to PORTB; the snapshot was taken before the
+    // first write to DDRB
+    if err := r.Seek(5); err != nil {
+        t.Fatal(err)
+    }
+    if em.PeekData(0x0024) != 0x0F || em.PeekData(0x0025) != 0x05 {
+        t.Errorf("after Seek(5): DDRB = 0x%02X, PORTB = 0x%02X", em.PeekData(0x0024), em.PeekData(0x0025))
+    }
+    if !pin0.state || pin1.state {
+        t.Errorf("after Seek(5): expected pin 0 high and pin 1 low, got %t and %t", pin0.state, pin1.state)
+    }
+
+    if err := r.Seek(1); err != nil {
+        t.Fatal(err)
+    }
+    if em.PeekData(0x0024) != 0x00 || em.PeekData(0x0025) != 0x00 {
+        t.Errorf("after Seek(1): DDRB = 0x%02X, PORTB = 0x%02X", em.PeekData(0x0024), em.PeekData(0x0025))
+    }
+}
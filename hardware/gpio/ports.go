@@ -15,6 +15,16 @@ func (p port) Write(x uint8) {
     p.g.updateOutputs(diff)
 }
 
+func (p port) Peek() uint8 {
+    return p.Read()
+}
+
+// Poke is the same as Write: it updates the pins, so the output adapters of any
+// pins that change are told of it.
+func (p port) Poke(x uint8) {
+    p.Write(x)
+}
+
 // Implementation of DDRx I/O port
 type ddr struct {
     g *GPIO
@@ -30,6 +40,16 @@ func (p ddr) Write(x uint8) {
     p.g.updateOutputs(diff)
 }
 
+func (p ddr) Peek() uint8 {
+    return p.Read()
+}
+
+// Poke is the same as Write: it updates the pins, so the output adapters of any
+// pins that change are told of it.
+func (p ddr) Poke(x uint8) {
+    p.Write(x)
+}
+
 // Implementation of PINx I/O port
 type pin struct {
     g *GPIO
@@ -45,6 +65,16 @@ func (p pin) Write(x uint8) {
     p.g.updateOutputs(diff)
 }
 
+func (p pin) Peek() uint8 {
+    return p.Read()
+}
+
+// Poke is the same as Write: it sets the pull-ups, which updates the pins, so
+// the output adapters of any pins that change are told of it.
+func (p pin) Poke(x uint8) {
+    p.Write(x)
+}
+
 // TODO: PINx does not have read-modify-write capabilities.
 // Possible solution: add more methods on Port to enable changing individual bits
 // Alternatively, add one method to return the value that Write would modify
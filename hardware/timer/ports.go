@@ -13,6 +13,14 @@ func (p tccra) Write(x uint8) {
     p.t.controlA = x
 }
 
+func (p tccra) Peek() uint8 {
+    return p.t.controlA
+}
+
+func (p tccra) Poke(x uint8) {
+    p.t.controlA = x
+}
+
 // Implementation of TCCRxB port
 type tccrb struct {
     t *Timer
@@ -33,6 +41,15 @@ func (p tccrb) Write(x uint8) {
     p.t.controlB = x & 0x3F
 }
 
+func (p tccrb) Peek() uint8 {
+    return p.t.controlB
+}
+
+// Unlike Write, Poke does not force an output compare.
+func (p tccrb) Poke(x uint8) {
+    p.t.controlB = x & 0x3F
+}
+
 // Implementation of TCNTx port
 type tcnt struct {
     t *Timer
@@ -49,6 +66,15 @@ func (p tcnt) Write(x uint8) {
     p.t.inhibitCompareMatch = true
 }
 
+func (p tcnt) Peek() uint8 {
+    return p.t.count
+}
+
+// Unlike Write, Poke does not inhibit the next compare match.
+func (p tcnt) Poke(x uint8) {
+    p.t.count = x
+}
+
 // Implementation of OCRxA port
 type ocra struct {
     t *Timer
@@ -62,6 +88,14 @@ func (p ocra) Write(x uint8) {
     p.t.compareValBufferA = x
 }
 
+func (p ocra) Peek() uint8 {
+    return p.t.compareValBufferA
+}
+
+func (p ocra) Poke(x uint8) {
+    p.t.compareValBufferA = x
+}
+
 // Implementation of OCRxb port
 type ocrb struct {
     t *Timer
@@ -75,6 +109,14 @@ func (p ocrb) Write(x uint8) {
     p.t.compareValBufferB = x
 }
 
+func (p ocrb) Peek() uint8 {
+    return p.t.compareValBufferB
+}
+
+func (p ocrb) Poke(x uint8) {
+    p.t.compareValBufferB = x
+}
+
 // Implementation of TIMSKx port
 type timsk struct {
     t *Timer
@@ -88,6 +130,14 @@ func (p timsk) Write(x uint8) {
     p.t.interruptMask = x
 }
 
+func (p timsk) Peek() uint8 {
+    return p.t.interruptMask
+}
+
+func (p timsk) Poke(x uint8) {
+    p.t.interruptMask = x
+}
+
 // Implementation of TIFRx port
 type tifr struct {
     t *Timer
@@ -101,3 +151,12 @@ func (p tifr) Write(x uint8) {
     // Bits in TIFRx are cleared by writing a one to them.
     p.t.interruptFlags &= ^x
 }
+
+func (p tifr) Peek() uint8 {
+    return p.t.interruptFlags
+}
+
+// Poke is the same as Write: the flags written with a one are cleared.
+func (p tifr) Poke(x uint8) {
+    p.Write(x)
+}
@@ -7,6 +7,8 @@
 package timer
 
 import (
+    "bytes"
+    "encoding/binary"
     "fmt"
     "github.com/kierdavis/avr/emulator"
     "github.com/kierdavis/avr/hardware/gpio"
@@ -53,6 +55,78 @@ func (t *Timer) AddTo(em *emulator.Emulator) {
     em.RegisterPortByName(fmt.Sprintf("OCR%dB", t.digit), ocrb{t})
     em.RegisterPortByName(fmt.Sprintf("TIMSK%d", t.digit), timsk{t})
     em.RegisterPortByName(fmt.Sprintf("TIFR%d", t.digit), tifr{t})
+    em.AddSnapshotter(t)
+}
+
+// Saved state of a timer, in the form encoded by SnapshotState.
+type timerState struct {
+    ControlA            uint8
+    ControlB            uint8
+    Count               uint8
+    CompareValA         uint8
+    CompareValBufferA   uint8
+    CompareValB         uint8
+    CompareValBufferB   uint8
+    InterruptMask       uint8
+    InterruptFlags      uint8
+    Downwards           bool
+    OCPinStates         [2]bool
+    InhibitCompareMatch bool
+    ExcessTicks         uint64
+}
+
+// Timer implements emulator.Snapshotter.
+func (t *Timer) SnapshotName() string {
+    return fmt.Sprintf("timer:%d", t.digit)
+}
+
+func (t *Timer) SnapshotState() []byte {
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.LittleEndian, &timerState{
+        t.controlA, t.controlB, t.count,
+        t.compareValA, t.compareValBufferA, t.compareValB, t.compareValBufferB,
+        t.interruptMask, t.interruptFlags, t.downwards, t.ocPinStates,
+        t.inhibitCompareMatch, uint64(t.excessTicks),
+    })
+    return buf.Bytes()
+}
+
+// Restores the state of the timer and pushes the restored output-compare pin
+// states to the GPIO layer.
+func (t *Timer) RestoreState(data []byte) error {
+    var s timerState
+    if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &s); err != nil {
+        return fmt.Errorf("invalid timer state: %s", err)
+    }
+
+    t.controlA, t.controlB, t.count = s.ControlA, s.ControlB, s.Count
+    t.compareValA, t.compareValBufferA = s.CompareValA, s.CompareValBufferA
+    t.compareValB, t.compareValBufferB = s.CompareValB, s.CompareValBufferB
+    t.interruptMask, t.interruptFlags = s.InterruptMask, s.InterruptFlags
+    t.downwards = s.Downwards
+    t.ocPinStates = s.OCPinStates
+    t.inhibitCompareMatch = s.InhibitCompareMatch
+    t.excessTicks = uint(s.ExcessTicks)
+
+    t.updateOCPin(0)
+    t.updateOCPin(1)
+    return nil
+}
+
+// Returns the registers to their reset values, as a reset of the MCU would,
+// stopping the timer.
+func (t *Timer) Reset() {
+    t.controlA, t.controlB, t.count = 0, 0, 0
+    t.compareValA, t.compareValBufferA = 0, 0
+    t.compareValB, t.compareValBufferB = 0, 0
+    t.interruptMask, t.interruptFlags = 0, 0
+    t.downwards = false
+    t.ocPinStates = [2]bool{}
+    t.inhibitCompareMatch = false
+    t.excessTicks = 0
+
+    t.updateOCPin(0)
+    t.updateOCPin(1)
 }
 
 // Connect an output-compare pin to a GPIO port by calling the GPIO's
@@ -61,6 +135,11 @@ func (t *Timer) OverrideOCPin(ocPinNum uint, gpioPinNum uint, g *gpio.GPIO) {
     t.ocPinCallbacks[ocPinNum] = g.OverrideOutput(gpioPinNum)
 }
 
+// Returns the state of an output-compare pin (0 for OCxA, 1 for OCxB).
+func (t *Timer) OCPin(ocPinNum uint) bool {
+    return t.ocPinStates[ocPinNum]
+}
+
 // Note: in PWM modes, OCRA/OCRB do not exhibit a newly written value until the count overflows
 
 func (t *Timer) Run(ticks uint) {
@@ -0,0 +1,36 @@
+package timer
+
+import (
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+func TestRecorderRedoesFlagClears(t *testing.T) {
+    em := emulator.NewEmulator(spec.ATmega168)
+    em.WriteProg(0, []uint16{
+        0xE001, // ldi r16, 0x01
+        0xBB05, // out TIFR0, r16
+        0xE002, // ldi r16, 0x02
+        0xBB05, // out TIFR0, r16
+        0xCFFF, // rjmp .-2
+    })
+    tm := New(0)
+    tm.AddTo(em)
+    tm.interruptFlags = 0x07
+    r := emulator.NewRecorder(em, 100, 10)
+
+    em.Run(4)
+    if em.PeekData(0x0035) != 0x04 {
+        t.Fatalf("unexpected TIFR0 after running: 0x%02X", em.PeekData(0x0035))
+    }
+
+    // back across the second write, which cleared OCF0A; the first, which
+    // cleared TOV0, is redone
+    if err := r.Seek(3); err != nil {
+        t.Fatal(err)
+    }
+    if em.PeekData(0x0035) != 0x06 {
+        t.Errorf("after Seek(3): expected TIFR0 0x06, got 0x%02X", em.PeekData(0x0035))
+    }
+}
@@ -0,0 +1,152 @@
+package avr
+
+// Whether an instruction encoding applies to reduced-core (AVR1) devices only,
+// to all other devices only, or to both. A few encodings mean different things
+// on reduced-core devices (for example, LDD is replaced by LD with only
+// displacement 0).
+type RCMode uint8
+
+const (
+    RC RCMode = iota
+    NotRC
+    Either
+)
+
+// An InstDef defines the binary encoding of an instruction: a word w encodes
+// the instruction if w & Mask == Match. Operand fields are the bits not in
+// Mask.
+type InstDef struct {
+    Inst   Instruction
+    Mask   uint16
+    Match  uint16
+    RCMode RCMode
+}
+
+// The encodings of all instructions. Where encodings overlap, the first
+// matching definition takes precedence.
+var InstDefs = []InstDef{
+    InstDef{ADC, 0xFC00, 0x1C00, Either},
+    InstDef{ADD, 0xFC00, 0x0C00, Either},
+    InstDef{ADIW, 0xFF00, 0x9600, Either},
+    InstDef{AND, 0xFC00, 0x2000, Either},
+    InstDef{ANDI, 0xF000, 0x7000, Either},
+    InstDef{ASR, 0xFE0F, 0x9405, Either},
+    InstDef{BCLR, 0xFF8F, 0x9488, Either},
+    InstDef{BLD, 0xFE08, 0xF800, Either},
+    InstDef{BRBC, 0xFC00, 0xF400, Either},
+    InstDef{BRBS, 0xFC00, 0xF000, Either},
+    InstDef{BREAK, 0xFFFF, 0x9598, Either},
+    InstDef{BSET, 0xFF8F, 0x9408, Either},
+    InstDef{BST, 0xFE08, 0xFA00, Either},
+    InstDef{CALL, 0xFE0E, 0x940E, Either},
+    InstDef{CBI, 0xFF00, 0x9800, Either},
+    InstDef{COM, 0xFE0F, 0x9400, Either},
+    InstDef{CP, 0xFC00, 0x1400, Either},
+    InstDef{CPC, 0xFC00, 0x0400, Either},
+    InstDef{CPI, 0xF000, 0x3000, Either},
+    InstDef{CPSE, 0xFC00, 0x1000, Either},
+    InstDef{DEC, 0xFE0F, 0x940A, Either},
+    InstDef{DES, 0xFF0F, 0x940B, Either},
+    InstDef{EICALL, 0xFFFF, 0x9519, Either},
+    InstDef{EIJMP, 0xFFFF, 0x9419, Either},
+    InstDef{ELPM, 0xFE0F, 0x9006, Either},
+    InstDef{ELPM_INC, 0xFE0F, 0x9007, Either},
+    InstDef{ELPM_R0, 0xFFFF, 0x95D8, Either},
+    InstDef{EOR, 0xFC00, 0x2400, Either},
+    InstDef{FMUL, 0xFF88, 0x0308, Either},
+    InstDef{FMULS, 0xFF88, 0x0380, Either},
+    InstDef{FMULSU, 0xFF88, 0x0388, Either},
+    InstDef{ICALL, 0xFFFF, 0x9509, Either},
+    InstDef{IJMP, 0xFFFF, 0x9409, Either},
+    InstDef{IN, 0xF800, 0xB000, Either},
+    InstDef{INC, 0xFE0F, 0x9403, Either},
+    InstDef{JMP, 0xFE0E, 0x940C, Either},
+    InstDef{LAC, 0xFE0F, 0x9206, Either},
+    InstDef{LAS, 0xFE0F, 0x9205, Either},
+    InstDef{LAT, 0xFE0F, 0x9207, Either},
+    InstDef{LD_X, 0xFE0F, 0x900C, Either},
+    InstDef{LD_X_DEC, 0xFE0F, 0x900E, Either},
+    InstDef{LD_X_INC, 0xFE0F, 0x900D, Either},
+    InstDef{LD_Y, 0xFE0F, 0x8008, RC},
+    InstDef{LD_Y_DEC, 0xFE0F, 0x900A, Either},
+    InstDef{LD_Y_INC, 0xFE0F, 0x9009, Either},
+    InstDef{LD_Z, 0xFE0F, 0x8000, RC},
+    InstDef{LD_Z_DEC, 0xFE0F, 0x9002, Either},
+    InstDef{LD_Z_INC, 0xFE0F, 0x9001, Either},
+    InstDef{LDD_Y, 0xD208, 0x8008, NotRC},
+    InstDef{LDD_Z, 0xD208, 0x8000, NotRC},
+    InstDef{LDI, 0xF000, 0xE000, Either},
+    InstDef{LDS, 0xFE0F, 0x9000, NotRC},
+    InstDef{LDS_SHORT, 0xF800, 0xA000, RC},
+    InstDef{LPM, 0xFE0F, 0x9004, Either},
+    InstDef{LPM_INC, 0xFE0F, 0x9005, Either},
+    InstDef{LPM_R0, 0xFFFF, 0x95C8, Either},
+    InstDef{LSR, 0xFE0F, 0x9406, Either},
+    InstDef{MOV, 0xFC00, 0x2C00, Either},
+    InstDef{MOVW, 0xFF00, 0x0100, Either},
+    InstDef{MUL, 0xFC00, 0x9C00, Either},
+    InstDef{MULS, 0xFF00, 0x0200, Either},
+    InstDef{MULSU, 0xFF88, 0x0300, Either},
+    InstDef{NEG, 0xFE0F, 0x9401, Either},
+    InstDef{NOP, 0xFFFF, 0x0000, Either},
+    InstDef{OR, 0xFC00, 0x2800, Either},
+    InstDef{ORI, 0xF000, 0x6000, Either},
+    InstDef{OUT, 0xF800, 0xB800, Either},
+    InstDef{POP, 0xFE0F, 0x900F, Either},
+    InstDef{PUSH, 0xFE0F, 0x920F, Either},
+    InstDef{RCALL, 0xF000, 0xD000, Either},
+    InstDef{RET, 0xFFFF, 0x9508, Either},
+    InstDef{RETI, 0xFFFF, 0x9518, Either},
+    InstDef{RJMP, 0xF000, 0xC000, Either},
+    InstDef{ROR, 0xFE0F, 0x9407, Either},
+    InstDef{SBC, 0xFC00, 0x0800, Either},
+    InstDef{SBCI, 0xF000, 0x4000, Either},
+    InstDef{SBI, 0xFF00, 0x9A00, Either},
+    InstDef{SBIC, 0xFF00, 0x9900, Either},
+    InstDef{SBIS, 0xFF00, 0x9B00, Either},
+    InstDef{SBIW, 0xFF00, 0x9700, Either},
+    InstDef{SBRC, 0xFE08, 0xFC00, Either},
+    InstDef{SBRS, 0xFE08, 0xFE00, Either},
+    InstDef{SLEEP, 0xFFFF, 0x9588, Either},
+    InstDef{SPM, 0xFFFF, 0x95E8, Either},
+    InstDef{SPM_2, 0xFFFF, 0x95F8, Either},
+    InstDef{ST_X, 0xFE0F, 0x920C, Either},
+    InstDef{ST_X_DEC, 0xFE0F, 0x920E, Either},
+    InstDef{ST_X_INC, 0xFE0F, 0x920D, Either},
+    InstDef{ST_Y, 0xFE0F, 0x8208, RC},
+    InstDef{ST_Y_DEC, 0xFE0F, 0x920A, Either},
+    InstDef{ST_Y_INC, 0xFE0F, 0x9209, Either},
+    InstDef{ST_Z, 0xFE0F, 0x8200, RC},
+    InstDef{ST_Z_DEC, 0xFE0F, 0x9202, Either},
+    InstDef{ST_Z_INC, 0xFE0F, 0x9201, Either},
+    InstDef{STD_Y, 0xD208, 0x8208, NotRC},
+    InstDef{STD_Z, 0xD208, 0x8200, NotRC},
+    InstDef{STS, 0xFE0F, 0x9200, NotRC},
+    InstDef{STS_SHORT, 0xF800, 0xA800, RC},
+    InstDef{SUB, 0xFC00, 0x1800, Either},
+    InstDef{SUBI, 0xF000, 0x5000, Either},
+    InstDef{SWAP, 0xFE0F, 0x9402, Either},
+    InstDef{WDR, 0xFFFF, 0x95A8, Either},
+    InstDef{XCH, 0xFE0F, 0x9204, Either},
+}
+
+// Decode returns the instruction encoded by the first word of an instruction,
+// or -1 if the word does not encode a valid instruction. This performs a linear
+// search of InstDefs; the emulator uses faster decoders generated from the
+// same table by avrmakedec.
+func Decode(word uint16, reducedCore bool) (inst Instruction) {
+    var r RCMode
+    if reducedCore {
+        r = RC
+    } else {
+        r = NotRC
+    }
+
+    for _, instDef := range InstDefs {
+        if word&instDef.Mask == instDef.Match && (instDef.RCMode == r || instDef.RCMode == Either) {
+            return instDef.Inst
+        }
+    }
+
+    return -1
+}
@@ -0,0 +1,60 @@
+// Package binloader encapsulates loading of raw binary images into an
+// Emulator. A raw image has no header or addressing information: byte 0 of the
+// file is placed at the target offset. Since any file is a valid raw image,
+// loader.Load only uses this format if no other format recognises a file.
+package binloader
+
+import (
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader"
+    "io"
+    "io/ioutil"
+)
+
+func init() {
+    loader.RegisterFormat(Format{})
+}
+
+// Format implements loader.Format for raw binary images.
+type Format struct{}
+
+func (Format) Name() string {
+    return loader.RawFormat
+}
+
+// Detect always returns false; raw images are loaded as a fallback.
+func (Format) Detect(head []byte) bool {
+    return false
+}
+
+func (Format) Load(em *emulator.Emulator, r io.Reader, t loader.Target) (ranges []loader.Range, err error) {
+    return Load(em, r, t)
+}
+
+func (Format) Save(w io.Writer, em *emulator.Emulator, m loader.Memory) (err error) {
+    return Save(w, em, m)
+}
+
+// Save writes the entire contents of a memory of em to w as a raw image.
+func Save(w io.Writer, em *emulator.Emulator, m loader.Memory) (err error) {
+    _, err = w.Write(loader.Read(em, m))
+    return err
+}
+
+// Load reads a raw image from r and copies it into the target memory of em. It
+// returns the range of memory that was written, or an error if the image does
+// not fit.
+func Load(em *emulator.Emulator, r io.Reader, t loader.Target) (ranges []loader.Range, err error) {
+    data, err := ioutil.ReadAll(r)
+    if err != nil {
+        return nil, err
+    }
+    if len(data) == 0 {
+        return nil, nil
+    }
+
+    if err = loader.Write(em, t, 0, data); err != nil {
+        return nil, err
+    }
+    return []loader.Range{{t.Offset, t.Offset + uint32(len(data))}}, nil
+}
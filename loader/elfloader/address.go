@@ -0,0 +1,77 @@
+package elfloader
+
+import (
+    "fmt"
+)
+
+// A Space identifies one of the memory spaces of an AVR. avr-gcc places all of
+// them into a single 32-bit ELF address space by adding a fixed offset to the
+// addresses of each.
+type Space int
+
+const (
+    Flash Space = iota
+    Data
+    EEPROM
+    Fuse
+    Lock
+    Signature
+)
+
+// Offsets of each memory space within the ELF address space, as used by the
+// avr-gcc linker scripts.
+var spaceOffsets = [...]uint32{
+    Flash:     0x000000,
+    Data:      0x800000,
+    EEPROM:    0x810000,
+    Fuse:      0x820000,
+    Lock:      0x830000,
+    Signature: 0x840000,
+}
+
+// Addresses at or above this are not part of any memory space.
+const spaceLimit = 0x850000
+
+func (s Space) String() string {
+    switch s {
+    case Flash:
+        return "flash"
+    case Data:
+        return "data"
+    case EEPROM:
+        return "eeprom"
+    case Fuse:
+        return "fuse"
+    case Lock:
+        return "lock"
+    case Signature:
+        return "signature"
+    }
+    return fmt.Sprintf("Space(%d)", int(s))
+}
+
+// Offset returns the offset of the memory space within the ELF address space.
+func (s Space) Offset() uint32 {
+    return spaceOffsets[s]
+}
+
+// SplitAddress splits an ELF address into a memory space and a byte offset
+// within that space. For example, 0x800100 (the start of RAM on an ATmega168)
+// splits into Data and 0x0100. ok is false if the address does not lie within
+// any memory space.
+func SplitAddress(addr uint32) (space Space, offset uint32, ok bool) {
+    if addr >= spaceLimit {
+        return 0, 0, false
+    }
+    for space = Signature; space > Flash; space-- {
+        if addr >= spaceOffsets[space] {
+            break
+        }
+    }
+    return space, addr - spaceOffsets[space], true
+}
+
+// JoinAddress is the inverse of SplitAddress.
+func JoinAddress(space Space, offset uint32) (addr uint32) {
+    return spaceOffsets[space] + offset
+}
@@ -0,0 +1,395 @@
+// Package elfloader encapsulates loading of ELF files produced by avr-gcc into
+// an Emulator. Unlike an IHEX file, an ELF file retains the program's symbol
+// table, the contents of EEPROM, fuse and lock bytes, and (optionally) the name
+// of the MCU the program was built for.
+package elfloader
+
+import (
+    "debug/elf"
+    "fmt"
+    "github.com/kierdavis/avr/disasm"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader"
+    "github.com/kierdavis/avr/spec"
+    "io"
+    "log"
+    "os"
+    "sort"
+)
+
+// A File is an ELF file produced by avr-gcc.
+type File struct {
+    // Name of the MCU the program was built for (as given to avr-gcc's -mmcu
+    // option), if recorded in the file; otherwise "".
+    MCU string
+    // Clock frequency in Hz that the program was built for, if recorded in the
+    // file; otherwise 0.
+    Frequency uint32
+    // Byte address in flash of the program's entry point.
+    Entry uint32
+    // Symbols defined by the program, sorted by space and address.
+    Symbols []Symbol
+
+    elf      *elf.File
+    segments []segment
+    closer   io.Closer
+}
+
+// A block of bytes to be loaded into a memory space.
+type segment struct {
+    space   Space
+    address uint32
+    data    []byte
+}
+
+// Open opens the named file and prepares it for loading.
+func Open(name string) (f *File, err error) {
+    ef, err := elf.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    f, err = newFile(ef)
+    if err != nil {
+        ef.Close()
+        return nil, err
+    }
+    f.closer = ef
+    return f, nil
+}
+
+// OpenIfELF is like Open, but returns a nil File and no error if the named file
+// exists but is not an ELF file, so that the caller can load it in another
+// format instead.
+func OpenIfELF(name string) (f *File, err error) {
+    file, err := os.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    magic := make([]byte, len(elf.ELFMAG))
+    _, err = io.ReadFull(file, magic)
+    file.Close()
+    if err != nil || string(magic) != elf.ELFMAG {
+        return nil, nil
+    }
+    return Open(name)
+}
+
+// NewFile reads an ELF file from r and prepares it for loading.
+func NewFile(r io.ReaderAt) (f *File, err error) {
+    ef, err := elf.NewFile(r)
+    if err != nil {
+        return nil, err
+    }
+    return newFile(ef)
+}
+
+func newFile(ef *elf.File) (f *File, err error) {
+    if ef.Machine != elf.EM_AVR {
+        return nil, fmt.Errorf("elfloader: file is for machine %s, not AVR", ef.Machine)
+    }
+
+    f = &File{
+        Entry: uint32(ef.Entry),
+        elf:   ef,
+    }
+
+    if err = f.readNotes(); err != nil {
+        return nil, err
+    }
+    if err = f.readSegments(); err != nil {
+        return nil, err
+    }
+    if f.Symbols, err = readSymbols(ef); err != nil {
+        return nil, err
+    }
+    return f, nil
+}
+
+// Close closes the underlying file if the File was created by Open.
+func (f *File) Close() (err error) {
+    if f.closer != nil {
+        return f.closer.Close()
+    }
+    return nil
+}
+
+// ELF returns the underlying ELF file, for use by packages that need access to
+// other sections (such as debugging information).
+func (f *File) ELF() *elf.File {
+    return f.elf
+}
+
+// Reads the MCU name and frequency from the .mmcu and device info sections.
+// The .mmcu section takes priority as it is written by the programmer rather
+// than the toolchain.
+func (f *File) readNotes() (err error) {
+    if sec := f.elf.Section(".note.gnu.avr.deviceinfo"); sec != nil {
+        buf, err := sec.Data()
+        if err != nil {
+            return err
+        }
+        info, err := parseDeviceInfo(buf)
+        if err != nil {
+            return err
+        }
+        f.MCU = info.name
+    }
+
+    if sec := f.elf.Section(".mmcu"); sec != nil {
+        buf, err := sec.Data()
+        if err != nil {
+            return err
+        }
+        info, err := parseMMCU(buf)
+        if err != nil {
+            return err
+        }
+        if info.name != "" {
+            f.MCU = info.name
+        }
+        f.Frequency = info.frequency
+    }
+
+    return nil
+}
+
+// Collects the loadable contents of the file. Segments are placed according to
+// their physical (load) address, so initialised data (.data), which is linked
+// to run from RAM, is loaded into flash after .text from where the startup
+// code copies it.
+func (f *File) readSegments() (err error) {
+    for _, prog := range f.elf.Progs {
+        if prog.Type != elf.PT_LOAD || prog.Filesz == 0 {
+            continue
+        }
+
+        space, addr, ok := SplitAddress(uint32(prog.Paddr))
+        if !ok {
+            return fmt.Errorf("elfloader: segment at address 0x%06X does not lie in any memory space", prog.Paddr)
+        }
+
+        data := make([]byte, prog.Filesz)
+        if _, err = prog.ReadAt(data, 0); err != nil {
+            return err
+        }
+        f.segments = append(f.segments, segment{space, addr, data})
+    }
+    return nil
+}
+
+// Returns the concatenated contents of all segments in the given space,
+// starting at address 0.
+func (f *File) spaceContents(space Space) (buf []byte) {
+    for _, seg := range f.segments {
+        if seg.space != space {
+            continue
+        }
+        end := seg.address + uint32(len(seg.data))
+        for uint32(len(buf)) < end {
+            buf = append(buf, 0xFF)
+        }
+        copy(buf[seg.address:], seg.data)
+    }
+    return buf
+}
+
+// Ranges returns the byte address ranges of the given space that the file
+// has contents for, in ascending order.
+func (f *File) Ranges(space Space) (ranges []loader.Range) {
+    for _, seg := range f.segments {
+        if seg.space == space && len(seg.data) > 0 {
+            ranges = append(ranges, loader.Range{seg.address, seg.address + uint32(len(seg.data))})
+        }
+    }
+    sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+    // merge adjacent and overlapping ranges
+    merged := ranges[:0]
+    for _, r := range ranges {
+        if n := len(merged); n > 0 && r.Start <= merged[n-1].End {
+            if r.End > merged[n-1].End {
+                merged[n-1].End = r.End
+            }
+            continue
+        }
+        merged = append(merged, r)
+    }
+    return merged
+}
+
+// DeviceSignature returns the device signature stored in the .signature
+// section, if present.
+func (f *File) DeviceSignature() (sig [3]uint8, ok bool) {
+    buf := f.spaceContents(Signature)
+    if len(buf) < 3 {
+        return sig, false
+    }
+    // avr-libc's <avr/signature.h> stores the bytes in reverse order
+    return [3]uint8{buf[2], buf[1], buf[0]}, true
+}
+
+// Spec returns the MCUSpec for the MCU the program was built for, identified by
+// name (from the .mmcu section or the device info note) or else by the device
+// signature in the .signature section.
+func (f *File) Spec() (s *spec.MCUSpec, err error) {
+    if f.MCU != "" {
+        s, ok := spec.Lookup(f.MCU)
+        if !ok {
+            return nil, fmt.Errorf("elfloader: program was built for %s, which is not supported", f.MCU)
+        }
+        return s, nil
+    }
+
+    if sig, ok := f.DeviceSignature(); ok {
+        s, ok := spec.LookupSignature(sig)
+        if !ok {
+            return nil, fmt.Errorf("elfloader: no supported MCU has signature %02X %02X %02X", sig[0], sig[1], sig[2])
+        }
+        return s, nil
+    }
+
+    return nil, fmt.Errorf("elfloader: file does not identify the MCU it was built for")
+}
+
+// SelectSpec returns the MCUSpec for the MCU the program was built for, as Spec
+// does, or if the file does not identify a supported MCU, the MCUSpec
+// registered under the name fallback (see spec.Lookup). In the latter case the
+// reason is logged. SelectSpec may be called on a nil File, such as OpenIfELF
+// returns for other formats, in which case it always uses the fallback.
+func (f *File) SelectSpec(fallback string) (s *spec.MCUSpec, err error) {
+    if f != nil {
+        s, err = f.Spec()
+        if err == nil {
+            return s, nil
+        }
+        log.Printf("[avr/loader/elfloader] %s; falling back to %s", err, fallback)
+    }
+
+    s, ok := spec.Lookup(fallback)
+    if !ok {
+        return nil, fmt.Errorf("elfloader: unknown MCU %q", fallback)
+    }
+    return s, nil
+}
+
+// Symbolizer returns a disasm.Symbolizer that names program addresses using
+// the file's symbol table. If the file has no symbols, or f is nil, the
+// addresses in the interrupt vector table of s are named after their vectors
+// instead.
+func (f *File) Symbolizer(s *spec.MCUSpec) disasm.Symbolizer {
+    if f == nil || len(f.Symbols) == 0 {
+        return disasm.VectorSymbolizer(s)
+    }
+    return func(addr uint32) (name string, offset uint32, ok bool) {
+        sym, ok := f.SymbolAt(Flash, addr)
+        return sym.Name, addr - sym.Address, ok
+    }
+}
+
+// Load loads the program into em: flash contents (.text and .data) into
+// program memory, .eeprom into EEPROM, and .fuse and .lock into the fuse and
+// lock bytes. If the file contains a .signature section, it must match the
+// signature of em.Spec.
+func (f *File) Load(em *emulator.Emulator) (err error) {
+    s := em.Spec
+
+    if sig, ok := f.DeviceSignature(); ok && sig != s.Signature {
+        return fmt.Errorf("elfloader: program was built for an MCU with signature %02X %02X %02X, but %s has signature %02X %02X %02X",
+            sig[0], sig[1], sig[2], s.Label, s.Signature[0], s.Signature[1], s.Signature[2])
+    }
+
+    // segments need not be word-aligned (.data may have an odd length), so
+    // flash is assembled into a single image first
+    flash := f.spaceContents(Flash)
+    if len(flash)%2 != 0 {
+        flash = append(flash, 0xFF)
+    }
+
+    for _, seg := range f.segments {
+        end := seg.address + uint32(len(seg.data))
+
+        switch seg.space {
+        case Flash:
+            if end > uint32(s.ProgMemSize()) {
+                return fmt.Errorf("elfloader: flash segment at 0x%04X-0x%04X does not fit in %s's %d bytes of program memory",
+                    seg.address, end-1, s.Label, s.ProgMemSize())
+            }
+            start, end := seg.address/2, (end+1)/2
+            words := make([]uint16, end-start)
+            for i := range words {
+                j := 2 * (start + uint32(i))
+                words[i] = uint16(flash[j]) | uint16(flash[j+1])<<8
+            }
+            em.WriteProg(start, words)
+
+        case EEPROM:
+            if end > uint32(s.EEPROMSize()) {
+                return fmt.Errorf("elfloader: EEPROM segment at 0x%04X-0x%04X does not fit in %s's %d bytes of EEPROM",
+                    seg.address, end-1, s.Label, s.EEPROMSize())
+            }
+            em.WriteEEPROM(uint16(seg.address), seg.data)
+
+        case Fuse:
+            if end > uint32(s.NumFuseBytes) {
+                return fmt.Errorf("elfloader: program sets %d fuse bytes, but %s has %d", end, s.Label, s.NumFuseBytes)
+            }
+            for i, b := range seg.data {
+                em.SetFuse(uint(seg.address)+uint(i), b)
+            }
+
+        case Lock:
+            if end > 1 {
+                return fmt.Errorf("elfloader: lock section is %d bytes long, expected 1", end)
+            }
+            em.SetLockBits(seg.data[0])
+
+        case Data, Signature:
+            // data memory is not programmable (initialised data is loaded from
+            // flash by the startup code) and the signature was checked above
+        }
+    }
+
+    return nil
+}
+
+// Lookup returns the symbol with the given name.
+func (f *File) Lookup(name string) (sym Symbol, ok bool) {
+    for _, sym = range f.Symbols {
+        if sym.Name == name {
+            return sym, true
+        }
+    }
+    return Symbol{}, false
+}
+
+// SymbolAt returns the symbol containing the given address in the given space.
+// If several symbols contain the address, the one starting closest to it is
+// returned.
+func (f *File) SymbolAt(space Space, addr uint32) (sym Symbol, ok bool) {
+    // index of the first symbol after addr
+    i := sort.Search(len(f.Symbols), func(i int) bool {
+        s := f.Symbols[i]
+        return s.Space > space || (s.Space == space && s.Address > addr)
+    })
+    for i--; i >= 0 && f.Symbols[i].Space == space; i-- {
+        if f.Symbols[i].Contains(space, addr) {
+            // symbols sharing an address are sorted in order of preference
+            for i > 0 && f.Symbols[i-1].Space == space && f.Symbols[i-1].Address == f.Symbols[i].Address &&
+                f.Symbols[i-1].Contains(space, addr) {
+                i--
+            }
+            return f.Symbols[i], true
+        }
+    }
+    return Symbol{}, false
+}
+
+// Load reads an ELF file from r and loads it into em. It is a shorthand for
+// NewFile followed by (*File).Load.
+func Load(em *emulator.Emulator, r io.ReaderAt) (err error) {
+    f, err := NewFile(r)
+    if err != nil {
+        return err
+    }
+    return f.Load(em)
+}
@@ -0,0 +1,283 @@
+package elfloader
+
+import (
+    "bytes"
+    "debug/elf"
+    "encoding/binary"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader"
+    "github.com/kierdavis/avr/spec"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+var splitAddressTests = []struct {
+    addr   uint32
+    space  Space
+    offset uint32
+    ok     bool
+}{
+    {0x000000, Flash, 0x0000, true},
+    {0x003FFE, Flash, 0x3FFE, true},
+    {0x800100, Data, 0x0100, true},
+    {0x8004FF, Data, 0x04FF, true},
+    {0x810010, EEPROM, 0x0010, true},
+    {0x820002, Fuse, 0x0002, true},
+    {0x830000, Lock, 0x0000, true},
+    {0x840001, Signature, 0x0001, true},
+    {0x850000, 0, 0, false},
+}
+
+func TestSplitAddress(t *testing.T) {
+    for _, test := range splitAddressTests {
+        space, offset, ok := SplitAddress(test.addr)
+        if space != test.space || offset != test.offset || ok != test.ok {
+            t.Errorf("SplitAddress(0x%06X): expected (%s, 0x%04X, %t), got (%s, 0x%04X, %t)",
+                test.addr, test.space, test.offset, test.ok, space, offset, ok)
+        }
+        if ok && JoinAddress(space, offset) != test.addr {
+            t.Errorf("JoinAddress(%s, 0x%04X): expected 0x%06X, got 0x%06X", space, offset, test.addr, JoinAddress(space, offset))
+        }
+    }
+}
+
+// The .mmcu section produced by AVR_MCU(16000000, "atmega168").
+var testMMCU = []byte{
+    mmcuTagFrequency, 4, 0x00, 0x24, 0xF4, 0x00,
+    mmcuTagName, 10, 'a', 't', 'm', 'e', 'g', 'a', '1', '6', '8', 0,
+    mmcuTagEnd, 0,
+}
+
+func TestParseMMCU(t *testing.T) {
+    info, err := parseMMCU(testMMCU)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.name != "atmega168" || info.frequency != 16000000 {
+        t.Errorf("expected atmega168 at 16000000 Hz, got %s at %d Hz", info.name, info.frequency)
+    }
+
+    if _, err = parseMMCU(testMMCU[:10]); err == nil {
+        t.Errorf("expected an error for a truncated .mmcu section")
+    }
+}
+
+func TestParseDeviceInfo(t *testing.T) {
+    var buf bytes.Buffer
+    le := binary.LittleEndian
+    strtab := []byte("\x00atmega88\x00\x00\x00")
+    desc := []uint32{0, 8192, 0x100, 1024, 0, 512, 8, 1, 0}
+    binary.Write(&buf, le, []uint32{4, uint32(4*len(desc) + len(strtab)), deviceInfoNoteType})
+    buf.WriteString("AVR\x00")
+    binary.Write(&buf, le, desc)
+    buf.Write(strtab)
+
+    info, err := parseDeviceInfo(buf.Bytes())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.name != "atmega88" || info.flashSize != 8192 || info.sramStart != 0x100 || info.eepromSize != 512 {
+        t.Errorf("unexpected device info: %+v", info)
+    }
+}
+
+// Builds a minimal avr-gcc style executable for an ATmega168.
+func buildTestELF() []byte {
+    le := binary.LittleEndian
+
+    type seg struct {
+        vaddr, paddr uint32
+        data         []byte
+    }
+    segs := []seg{
+        {0x000000, 0x000000, []byte{0x0C, 0x94, 0x02, 0x00, 0xFF, 0xCF}}, // .text: jmp main; main: rjmp .-2
+        {0x800100, 0x000006, []byte{0x34, 0x12}},                         // .data
+        {0x810000, 0x810000, []byte{0x01, 0x02, 0x03}},                   // .eeprom
+        {0x820000, 0x820000, []byte{0x62, 0xDF, 0xF9}},                   // .fuse
+        {0x830000, 0x830000, []byte{0xFC}},                               // .lock
+        {0x840000, 0x840000, []byte{0x06, 0x94, 0x1E}},                   // .signature
+    }
+
+    strtab := []byte("\x00main\x00counter\x00__vectors\x00__stack\x00__SREG__\x00")
+    shstrtab := []byte("\x00.text\x00.mmcu\x00.symtab\x00.strtab\x00.shstrtab\x00")
+    var symtab bytes.Buffer
+    binary.Write(&symtab, le, []elf.Sym32{
+        {},
+        {Name: 1, Value: 0x000004, Size: 2, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Shndx: 1},
+        {Name: 6, Value: 0x800100, Size: 2, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Shndx: 1},
+        {Name: 14, Value: 0x000000, Size: 0, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE), Shndx: 1},
+        {Name: 24, Value: 0x8004FF, Size: 0, Info: elf.ST_INFO(elf.STB_WEAK, elf.STT_NOTYPE), Shndx: uint16(elf.SHN_ABS)},
+        {Name: 32, Value: 0x00003F, Size: 0, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE), Shndx: uint16(elf.SHN_ABS)},
+    })
+
+    // lay out file: header, program headers, segment data, section data,
+    // section headers
+    const ehsize, phentsize, shentsize = 52, 32, 40
+    var body bytes.Buffer
+    offset := func() uint32 { return uint32(ehsize + phentsize*len(segs) + body.Len()) }
+
+    var progs []elf.Prog32
+    for _, s := range segs {
+        progs = append(progs, elf.Prog32{
+            Type: uint32(elf.PT_LOAD), Off: offset(), Vaddr: s.vaddr, Paddr: s.paddr,
+            Filesz: uint32(len(s.data)), Memsz: uint32(len(s.data)), Flags: uint32(elf.PF_R), Align: 1,
+        })
+        body.Write(s.data)
+    }
+
+    sections := []elf.Section32{{}}
+    addSection := func(name uint32, typ elf.SectionType, data []byte, link, entsize uint32) {
+        sections = append(sections, elf.Section32{
+            Name: name, Type: uint32(typ), Off: offset(), Size: uint32(len(data)), Link: link, Addralign: 1, Entsize: entsize,
+        })
+        body.Write(data)
+    }
+    addSection(1, elf.SHT_PROGBITS, segs[0].data, 0, 0)
+    addSection(7, elf.SHT_PROGBITS, testMMCU, 0, 0)
+    addSection(13, elf.SHT_SYMTAB, symtab.Bytes(), 4, 16)
+    addSection(21, elf.SHT_STRTAB, strtab, 0, 0)
+    addSection(29, elf.SHT_STRTAB, shstrtab, 0, 0)
+    shoff := offset()
+
+    var out bytes.Buffer
+    hdr := elf.Header32{
+        Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_AVR), Version: uint32(elf.EV_CURRENT),
+        Entry: 0, Phoff: ehsize, Shoff: shoff, Ehsize: ehsize,
+        Phentsize: phentsize, Phnum: uint16(len(progs)),
+        Shentsize: shentsize, Shnum: uint16(len(sections)), Shstrndx: uint16(len(sections) - 1),
+    }
+    copy(hdr.Ident[:], elf.ELFMAG)
+    hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+    hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+    hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+    binary.Write(&out, le, hdr)
+    binary.Write(&out, le, progs)
+    out.Write(body.Bytes())
+    binary.Write(&out, le, sections)
+    return out.Bytes()
+}
+
+func TestLoad(t *testing.T) {
+    f, err := NewFile(bytes.NewReader(buildTestELF()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if f.MCU != "atmega168" || f.Frequency != 16000000 {
+        t.Errorf("expected atmega168 at 16000000 Hz, got %q at %d Hz", f.MCU, f.Frequency)
+    }
+
+    s, err := f.Spec()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if s != spec.ATmega168 {
+        t.Errorf("expected spec ATmega168, got %s", s.Label)
+    }
+
+    flash := f.spaceContents(Flash)
+    if !bytes.Equal(flash, []byte{0x0C, 0x94, 0x02, 0x00, 0xFF, 0xCF, 0x34, 0x12}) {
+        t.Errorf("unexpected flash contents % X", flash)
+    }
+    // .text and the initial contents of .data are adjacent
+    if r := f.Ranges(Flash); len(r) != 1 || r[0] != (loader.Range{0, 8}) {
+        t.Errorf("unexpected flash ranges %v", r)
+    }
+
+    em := emulator.NewEmulator(s)
+    if err = f.Load(em); err != nil {
+        t.Fatal(err)
+    }
+    if em.Fuse(0) != 0x62 || em.Fuse(1) != 0xDF || em.Fuse(2) != 0xF9 || em.LockBits() != 0xFC {
+        t.Errorf("unexpected fuses %02X %02X %02X and lock bits %02X", em.Fuse(0), em.Fuse(1), em.Fuse(2), em.LockBits())
+    }
+    // the .data image is stored in flash after .text, starting at byte 6
+    for i, b := range []uint8{0x0C, 0x94, 0x02, 0x00, 0xFF, 0xCF, 0x34, 0x12} {
+        if got := em.ProgByte(uint32(i)); got != b {
+            t.Errorf("flash byte %d: expected %02X, got %02X", i, b, got)
+        }
+    }
+    for i, b := range []uint8{1, 2, 3} {
+        if got := em.EEPROMByte(uint16(i)); got != b {
+            t.Errorf("EEPROM byte %d: expected %02X, got %02X", i, b, got)
+        }
+    }
+
+    // the signature does not match an ATmega48
+    if err = f.Load(emulator.NewEmulator(spec.ATmega48)); err == nil {
+        t.Errorf("expected a signature mismatch error when loading into an ATmega48")
+    }
+
+    sym, ok := f.SymbolAt(Flash, 5)
+    if !ok || sym.Name != "main" || sym.Kind != Func {
+        t.Errorf("SymbolAt(flash, 5): expected func main, got %+v", sym)
+    }
+    sym, ok = f.SymbolAt(Data, 0x0101)
+    if !ok || sym.Name != "counter" || sym.Kind != Object {
+        t.Errorf("SymbolAt(data, 0x0101): expected object counter, got %+v", sym)
+    }
+    if _, ok = f.SymbolAt(Flash, 2); ok {
+        t.Errorf("SymbolAt(flash, 2): expected no symbol")
+    }
+    if sym, ok = f.Lookup("__vectors"); !ok || sym.Space != Flash || sym.Address != 0 {
+        t.Errorf("Lookup(__vectors): got %+v, %t", sym, ok)
+    }
+    // absolute symbols are kept only outside program memory
+    if sym, ok = f.Lookup("__stack"); !ok || sym.Space != Data || sym.Address != 0x04FF {
+        t.Errorf("Lookup(__stack): got %+v, %t", sym, ok)
+    }
+    if sym, ok = f.Lookup("__SREG__"); ok {
+        t.Errorf("Lookup(__SREG__): expected no symbol, got %+v", sym)
+    }
+
+    if name, offset, ok := f.Symbolizer(s)(5); !ok || name != "main" || offset != 1 {
+        t.Errorf("Symbolizer(5): expected main+1, got %s+%d (%t)", name, offset, ok)
+    }
+    // without a symbol table, the vectors are named
+    if name, offset, ok := (*File)(nil).Symbolizer(s)(6); !ok || name != "INT0" || offset != 2 {
+        t.Errorf("nil Symbolizer(6): expected INT0+2, got %s+%d (%t)", name, offset, ok)
+    }
+}
+
+func TestOpenIfELFAndSelectSpec(t *testing.T) {
+    dir, err := ioutil.TempDir("", "elfloader")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    elfPath := filepath.Join(dir, "prog.elf")
+    hexPath := filepath.Join(dir, "prog.hex")
+    if err = ioutil.WriteFile(elfPath, buildTestELF(), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err = ioutil.WriteFile(hexPath, []byte(":00000001FF\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    f, err := OpenIfELF(elfPath)
+    if err != nil || f == nil {
+        t.Fatalf("OpenIfELF(prog.elf): %v, %v", f, err)
+    }
+    defer f.Close()
+    if s, err := f.SelectSpec("attiny10"); err != nil || s != spec.ATmega168 {
+        t.Errorf("expected the spec recorded in the file to be selected, got %v, %v", s, err)
+    }
+
+    f, err = OpenIfELF(hexPath)
+    if err != nil || f != nil {
+        t.Fatalf("OpenIfELF(prog.hex): expected no file and no error, got %v, %v", f, err)
+    }
+    // a nil File always uses the fallback
+    if s, err := f.SelectSpec("attiny10"); err != nil || s != spec.ATtiny10 {
+        t.Errorf("expected the fallback spec to be selected, got %v, %v", s, err)
+    }
+    if _, err := f.SelectSpec("atmega328p"); err == nil {
+        t.Errorf("expected an error for an unknown fallback")
+    }
+
+    if _, err = OpenIfELF(filepath.Join(dir, "missing")); err == nil {
+        t.Errorf("expected an error opening a missing file")
+    }
+}
@@ -0,0 +1,116 @@
+package elfloader
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+)
+
+// Tags used in the .mmcu section. This section is produced by the AVR_MCU
+// macro from simavr's avr_mcu_section.h and consists of a sequence of
+// (tag, length, value) records terminated by a record with tag 0.
+const (
+    mmcuTagEnd       = 0
+    mmcuTagName      = 1
+    mmcuTagFrequency = 2
+)
+
+// Information contained in the .mmcu section.
+type mmcuInfo struct {
+    name      string
+    frequency uint32
+}
+
+// Parses the contents of a .mmcu section.
+func parseMMCU(buf []byte) (info mmcuInfo, err error) {
+    for len(buf) > 0 {
+        tag := buf[0]
+        if tag == mmcuTagEnd {
+            break
+        }
+        if len(buf) < 2 || len(buf) < 2+int(buf[1]) {
+            return info, fmt.Errorf("elfloader: truncated record (tag %d) in .mmcu section", tag)
+        }
+        val := buf[2 : 2+int(buf[1])]
+        buf = buf[2+len(val):]
+
+        switch tag {
+        case mmcuTagName:
+            info.name = cString(val)
+        case mmcuTagFrequency:
+            if len(val) < 4 {
+                return info, fmt.Errorf("elfloader: frequency record in .mmcu section is too short")
+            }
+            info.frequency = binary.LittleEndian.Uint32(val)
+        }
+        // other tags (voltages, VCD traces etc.) are not used by this emulator
+    }
+    return info, nil
+}
+
+// The type of the note in the .note.gnu.avr.deviceinfo section.
+const deviceInfoNoteType = 1
+
+// Information contained in the .note.gnu.avr.deviceinfo section, which is
+// emitted by the avr-libc startup code.
+type deviceInfo struct {
+    name                    string
+    flashStart, flashSize   uint32
+    sramStart, sramSize     uint32
+    eepromStart, eepromSize uint32
+}
+
+// Parses the contents of a .note.gnu.avr.deviceinfo section. The note is laid
+// out as follows (all integers are 32-bit little-endian):
+//
+//     namesz, descsz, type, name ("AVR\0"),
+//     flash start, flash size, SRAM start, SRAM size, EEPROM start, EEPROM size,
+//     offset table length (in bytes), offset table, string table
+//
+// The first entry in the offset table is the offset of the device name within
+// the string table.
+func parseDeviceInfo(buf []byte) (info deviceInfo, err error) {
+    le := binary.LittleEndian
+    if len(buf) < 12 {
+        return info, fmt.Errorf("elfloader: device info note is too short")
+    }
+    namesz, descsz, typ := le.Uint32(buf[0:]), le.Uint32(buf[4:]), le.Uint32(buf[8:])
+    buf = buf[12:]
+
+    // name is padded to a multiple of 4 bytes
+    namePadded := (namesz + 3) &^ 3
+    if uint32(len(buf)) < namePadded+descsz {
+        return info, fmt.Errorf("elfloader: device info note is truncated")
+    }
+    if cString(buf[:namesz]) != "AVR" || typ != deviceInfoNoteType {
+        return info, fmt.Errorf("elfloader: device info note has unexpected name %q or type %d", cString(buf[:namesz]), typ)
+    }
+    desc := buf[namePadded : namePadded+descsz]
+
+    if len(desc) < 28 {
+        return info, fmt.Errorf("elfloader: device info note is too short")
+    }
+    info.flashStart, info.flashSize = le.Uint32(desc[0:]), le.Uint32(desc[4:])
+    info.sramStart, info.sramSize = le.Uint32(desc[8:]), le.Uint32(desc[12:])
+    info.eepromStart, info.eepromSize = le.Uint32(desc[16:]), le.Uint32(desc[20:])
+
+    tableLen := le.Uint32(desc[24:])
+    if tableLen < 4 || uint32(len(desc)-28) < tableLen {
+        return info, fmt.Errorf("elfloader: device info note has a malformed offset table")
+    }
+    strtab := desc[28+tableLen:]
+    nameOffset := le.Uint32(desc[28:])
+    if nameOffset >= uint32(len(strtab)) {
+        return info, fmt.Errorf("elfloader: device name offset %d is outside the string table", nameOffset)
+    }
+    info.name = cString(strtab[nameOffset:])
+    return info, nil
+}
+
+// Returns the contents of buf up to the first NUL byte.
+func cString(buf []byte) string {
+    if i := bytes.IndexByte(buf, 0); i >= 0 {
+        buf = buf[:i]
+    }
+    return string(buf)
+}
@@ -0,0 +1,118 @@
+package elfloader
+
+import (
+    "debug/elf"
+    "sort"
+)
+
+// A SymbolKind classifies a symbol.
+type SymbolKind int
+
+const (
+    // A symbol with no type information, such as an assembler label.
+    Label SymbolKind = iota
+    // A function.
+    Func
+    // A data object (a variable or constant).
+    Object
+)
+
+func (k SymbolKind) String() string {
+    switch k {
+    case Func:
+        return "func"
+    case Object:
+        return "object"
+    }
+    return "label"
+}
+
+// A Symbol is an entry from the symbol table of an ELF file.
+type Symbol struct {
+    Name    string
+    Space   Space
+    Address uint32 // byte address within Space
+    Size    uint32 // size in bytes, or 0 if unknown
+    Kind    SymbolKind
+    Global  bool
+}
+
+// Contains returns true if the given address in the given space lies within
+// the symbol. A symbol of size 0 contains only its own address.
+func (s Symbol) Contains(space Space, addr uint32) bool {
+    if space != s.Space || addr < s.Address {
+        return false
+    }
+    return addr == s.Address || addr-s.Address < s.Size
+}
+
+// Reads and converts the symbol table of an ELF file. Undefined and common
+// symbols are omitted, as are section and file symbols and absolute symbols in
+// program memory (avr-gcc defines absolute symbols such as __SREG__ whose
+// values are I/O or register numbers, not addresses); the rest are sorted by
+// space and then address. Absolute symbols in other spaces, such as __stack,
+// are kept.
+func readSymbols(ef *elf.File) (syms []Symbol, err error) {
+    elfSyms, err := ef.Symbols()
+    if err == elf.ErrNoSymbols {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+
+    for _, es := range elfSyms {
+        if es.Name == "" || es.Section == elf.SHN_UNDEF || es.Section == elf.SHN_COMMON {
+            continue
+        }
+
+        var kind SymbolKind
+        switch elf.ST_TYPE(es.Info) {
+        case elf.STT_NOTYPE:
+            kind = Label
+        case elf.STT_FUNC:
+            kind = Func
+        case elf.STT_OBJECT:
+            kind = Object
+        default:
+            continue
+        }
+
+        space, addr, ok := SplitAddress(uint32(es.Value))
+        if !ok || (es.Section == elf.SHN_ABS && space == Flash) {
+            continue
+        }
+
+        syms = append(syms, Symbol{
+            Name:    es.Name,
+            Space:   space,
+            Address: addr,
+            Size:    uint32(es.Size),
+            Kind:    kind,
+            Global:  elf.ST_BIND(es.Info) != elf.STB_LOCAL,
+        })
+    }
+
+    sort.Sort(bySpaceAndAddress(syms))
+    return syms, nil
+}
+
+type bySpaceAndAddress []Symbol
+
+func (a bySpaceAndAddress) Len() int      { return len(a) }
+func (a bySpaceAndAddress) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySpaceAndAddress) Less(i, j int) bool {
+    if a[i].Space != a[j].Space {
+        return a[i].Space < a[j].Space
+    }
+    if a[i].Address != a[j].Address {
+        return a[i].Address < a[j].Address
+    }
+    // prefer typed, global symbols when several share an address
+    if a[i].Kind != a[j].Kind {
+        return a[i].Kind > a[j].Kind
+    }
+    if a[i].Global != a[j].Global {
+        return a[i].Global
+    }
+    return a[i].Name < a[j].Name
+}
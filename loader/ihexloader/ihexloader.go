@@ -2,30 +2,148 @@
 package ihexloader
 
 import (
+    "fmt"
     "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader"
     "github.com/kierdavis/ihex-go"
     "io"
 )
 
+func init() {
+    loader.RegisterFormat(Format{})
+}
+
+// Format implements loader.Format for Intel HEX files.
+type Format struct{}
+
+func (Format) Name() string {
+    return "ihex"
+}
+
+// Detect returns true if the file begins with a record: a colon followed by
+// hexadecimal digits.
+func (Format) Detect(head []byte) bool {
+    for len(head) > 0 && (head[0] == ' ' || head[0] == '\t' || head[0] == '\r' || head[0] == '\n') {
+        head = head[1:]
+    }
+    return len(head) >= 3 && head[0] == ':' && isHexDigit(head[1]) && isHexDigit(head[2])
+}
+
+func (Format) Load(em *emulator.Emulator, r io.Reader, t loader.Target) (ranges []loader.Range, err error) {
+    result, err := LoadTarget(em, r, t)
+    return result.Ranges, err
+}
+
+func isHexDigit(c byte) bool {
+    return ('0' <= c && c <= '9') || ('A' <= c && c <= 'F') || ('a' <= c && c <= 'f')
+}
+
+// Record types other than Data and EOF. Types 02 and 04 set the upper bits of
+// the addresses of subsequent data records, allowing images larger than 64 KB;
+// types 03 and 05 give the start address of the program.
+const (
+    extendedSegmentAddress ihex.RecordType = 0x02
+    startSegmentAddress    ihex.RecordType = 0x03
+    extendedLinearAddress  ihex.RecordType = 0x04
+    startLinearAddress     ihex.RecordType = 0x05
+)
+
+// A Result describes what was loaded from an IHEX file.
+type Result struct {
+    // Byte address ranges of the target memory that were written, in the
+    // order they appear in the file. Adjacent records are merged into one
+    // range.
+    Ranges []loader.Range
+    // Start address given by a type 03 or 05 record, as a byte address. Such
+    // records are emitted by some toolchains but have no meaning to an AVR,
+    // which always starts executing from the reset vector.
+    Start    uint32
+    HasStart bool
+}
+
+// State of a load in progress.
+type ihexLoader struct {
+    em     *emulator.Emulator
+    target loader.Target
+    base   uint32 // address set by an extended address record
+    result Result
+}
+
 // Load parses an IHEX file from r and loads the program data contained in
-// it into em.
-func Load(em *emulator.Emulator, r io.Reader) (err error) {
+// it into em. Data records must be word-aligned and fit within program
+// memory; if one does not, an error is returned and loading stops.
+func Load(em *emulator.Emulator, r io.Reader) (result Result, err error) {
+    return LoadTarget(em, r, loader.Target{Memory: loader.Flash})
+}
+
+// LoadTarget parses an IHEX file from r and loads the data contained in it into
+// the target memory of em. When the target is program memory, data records
+// must be word-aligned.
+func LoadTarget(em *emulator.Emulator, r io.Reader, t loader.Target) (result Result, err error) {
     dec := ihex.NewDecoder(r)
-    buf := make([]uint16, 0, 8)
+    l := &ihexLoader{em: em, target: t}
 
     for dec.Scan() {
-        rec := dec.Record()
-        if rec.Type == ihex.Data {
-            buf = buf[:0]
-            for i := 0; i+1 < len(rec.Data); i += 2 {
-                lo := uint16(rec.Data[i])
-                hi := uint16(rec.Data[i+1])
-                buf = append(buf, (hi<<8)|lo)
-            }
-
-            em.WriteProg(rec.Address>>1, buf)
+        if err = l.record(dec.Record()); err != nil {
+            return l.result, err
         }
     }
 
-    return dec.Err()
+    return l.result, dec.Err()
+}
+
+// Processes a single record.
+func (l *ihexLoader) record(rec ihex.Record) (err error) {
+    switch rec.Type {
+    case ihex.Data:
+        return l.data(l.base+uint32(rec.Address), rec.Data)
+
+    case extendedSegmentAddress:
+        if len(rec.Data) != 2 {
+            return fmt.Errorf("ihexloader: extended segment address record has %d data bytes, expected 2", len(rec.Data))
+        }
+        l.base = (uint32(rec.Data[0])<<8 | uint32(rec.Data[1])) << 4
+
+    case extendedLinearAddress:
+        if len(rec.Data) != 2 {
+            return fmt.Errorf("ihexloader: extended linear address record has %d data bytes, expected 2", len(rec.Data))
+        }
+        l.base = (uint32(rec.Data[0])<<8 | uint32(rec.Data[1])) << 16
+
+    case startSegmentAddress, startLinearAddress:
+        if len(rec.Data) != 4 {
+            return fmt.Errorf("ihexloader: start address record has %d data bytes, expected 4", len(rec.Data))
+        }
+        hi := uint32(rec.Data[0])<<8 | uint32(rec.Data[1])
+        lo := uint32(rec.Data[2])<<8 | uint32(rec.Data[3])
+        if rec.Type == startSegmentAddress {
+            l.result.Start = hi<<4 + lo // CS:IP
+        } else {
+            l.result.Start = hi<<16 | lo // EIP
+        }
+        l.result.HasStart = true
+    }
+
+    return nil
+}
+
+// Writes the contents of a data record to the target memory.
+func (l *ihexLoader) data(address uint32, data []byte) (err error) {
+    if len(data) == 0 {
+        return nil
+    }
+    if l.target.Memory == loader.Flash && (address%2 != 0 || len(data)%2 != 0) {
+        return fmt.Errorf("ihexloader: data record at 0x%05X with %d bytes is not word-aligned", address, len(data))
+    }
+    end := address + uint32(len(data))
+    if size := l.target.Memory.Size(l.em); l.target.Offset+end > size {
+        return fmt.Errorf("ihexloader: data record at 0x%05X-0x%05X is outside %s (%d bytes on %s)",
+            address, end-1, l.target.Memory, size, l.em.Spec.Label)
+    }
+
+    if err = loader.Write(l.em, l.target, address, data); err != nil {
+        return err
+    }
+    l.result.Ranges = loader.AddRange(l.result.Ranges, l.target.Offset+address, l.target.Offset+end)
+    return nil
 }
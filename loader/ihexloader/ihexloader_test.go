@@ -0,0 +1,97 @@
+package ihexloader
+
+import (
+    "bytes"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader"
+    "github.com/kierdavis/avr/spec"
+    "github.com/kierdavis/ihex-go"
+    "strings"
+    "testing"
+)
+
+func TestExtendedAddressRecords(t *testing.T) {
+    em := emulator.NewEmulator(spec.ATmega168)
+    l := &ihexLoader{em: em}
+
+    records := []ihex.Record{
+        {Type: ihex.Data, Address: 0x0000, Data: []byte{0x0C, 0x94, 0x34, 0x00}},
+        {Type: ihex.Data, Address: 0x0004, Data: []byte{0x0C, 0x94, 0x3E, 0x00}},
+        {Type: extendedSegmentAddress, Address: 0, Data: []byte{0x02, 0x00}}, // 0x2000
+        {Type: ihex.Data, Address: 0x0010, Data: []byte{0xAA, 0xBB}},
+        {Type: extendedLinearAddress, Address: 0, Data: []byte{0x00, 0x00}},
+        {Type: ihex.Data, Address: 0x3FFE, Data: []byte{0xCC, 0xDD}},
+        {Type: startLinearAddress, Address: 0, Data: []byte{0x00, 0x00, 0x01, 0x00}},
+    }
+    for _, rec := range records {
+        if err := l.record(rec); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    expected := []loader.Range{{0x0000, 0x0008}, {0x2010, 0x2012}, {0x3FFE, 0x4000}}
+    if len(l.result.Ranges) != len(expected) {
+        t.Fatalf("expected ranges %v, got %v", expected, l.result.Ranges)
+    }
+    for i, r := range expected {
+        if l.result.Ranges[i] != r {
+            t.Errorf("expected ranges %v, got %v", expected, l.result.Ranges)
+        }
+    }
+    if !l.result.HasStart || l.result.Start != 0x0100 {
+        t.Errorf("expected start address 0x0100, got 0x%X (%t)", l.result.Start, l.result.HasStart)
+    }
+
+    for addr, want := range map[uint32]uint8{0x0006: 0x3E, 0x2010: 0xAA, 0x2011: 0xBB, 0x3FFF: 0xDD} {
+        if got := em.ProgByte(addr); got != want {
+            t.Errorf("program byte 0x%04X: expected 0x%02X, got 0x%02X", addr, want, got)
+        }
+    }
+}
+
+func TestInvalidDataRecords(t *testing.T) {
+    invalidTests := []struct {
+        records []ihex.Record
+        want    string
+    }{
+        {[]ihex.Record{{Type: ihex.Data, Address: 0x0001, Data: []byte{0x00, 0x00}}}, "not word-aligned"},
+        {[]ihex.Record{{Type: ihex.Data, Address: 0x0000, Data: []byte{0x00, 0x00, 0x00}}}, "not word-aligned"},
+        {[]ihex.Record{
+            {Type: extendedLinearAddress, Address: 0, Data: []byte{0x00, 0x01}},
+            {Type: ihex.Data, Address: 0x0000, Data: []byte{0x00, 0x00}},
+        }, "data record at 0x10000-0x10001 is outside flash (16384 bytes on ATmega168)"},
+        {[]ihex.Record{{Type: extendedSegmentAddress, Address: 0, Data: []byte{0x00}}}, "expected 2"},
+    }
+
+    for _, test := range invalidTests {
+        l := &ihexLoader{em: emulator.NewEmulator(spec.ATmega168)}
+        var err error
+        for _, rec := range test.records {
+            if err = l.record(rec); err != nil {
+                break
+            }
+        }
+        if err == nil || !strings.Contains(err.Error(), test.want) {
+            t.Errorf("expected an error containing %q, got %v", test.want, err)
+        }
+    }
+}
+
+func TestEncode(t *testing.T) {
+    data := make([]byte, 20)
+    for i := range data {
+        data[i] = uint8(i)
+    }
+
+    var buf bytes.Buffer
+    if err := Encode(&buf, 0xFFF8, data); err != nil {
+        t.Fatal(err)
+    }
+    expected := ":08FFF8000001020304050607E5\n" +
+        ":020000040001F9\n" +
+        ":0C00000008090A0B0C0D0E0F1011121352\n" +
+        ":00000001FF\n"
+    if buf.String() != expected {
+        t.Errorf("expected:\n%sgot:\n%s", expected, buf.String())
+    }
+}
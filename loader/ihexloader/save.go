@@ -0,0 +1,65 @@
+package ihexloader
+
+import (
+    "bufio"
+    "fmt"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader"
+    "github.com/kierdavis/ihex-go"
+    "io"
+)
+
+// The number of data bytes in each data record written by Encode, as used by
+// avr-objcopy.
+const recordSize = 16
+
+func (Format) Save(w io.Writer, em *emulator.Emulator, m loader.Memory) (err error) {
+    return Save(w, em, m)
+}
+
+// Save writes the entire contents of a memory of em to w as an IHEX file.
+func Save(w io.Writer, em *emulator.Emulator, m loader.Memory) (err error) {
+    return Encode(w, 0, loader.Read(em, m))
+}
+
+// Encode writes data to w as an IHEX file, with the first byte at the given
+// address. Extended linear address records are emitted where data crosses a 64
+// KB boundary. The file is terminated with an EOF record.
+func Encode(w io.Writer, address uint32, data []byte) (err error) {
+    bw := bufio.NewWriter(w)
+    base := uint32(0)
+
+    for len(data) > 0 {
+        if address&^0xFFFF != base {
+            base = address &^ 0xFFFF
+            writeRecord(bw, extendedLinearAddress, 0, []byte{uint8(base >> 24), uint8(base >> 16)})
+        }
+
+        // don't let a record cross a 64 KB boundary
+        n := recordSize
+        if n > len(data) {
+            n = len(data)
+        }
+        if limit := int(base + 0x10000 - address); n > limit {
+            n = limit
+        }
+
+        writeRecord(bw, ihex.Data, uint16(address), data[:n])
+        address += uint32(n)
+        data = data[n:]
+    }
+
+    writeRecord(bw, ihex.EOF, 0, nil)
+    return bw.Flush()
+}
+
+// Writes a single record.
+func writeRecord(w *bufio.Writer, typ ihex.RecordType, address uint16, data []byte) {
+    sum := uint8(len(data)) + uint8(address>>8) + uint8(address) + uint8(typ)
+    fmt.Fprintf(w, ":%02X%04X%02X", len(data), address, uint8(typ))
+    for _, b := range data {
+        fmt.Fprintf(w, "%02X", b)
+        sum += b
+    }
+    fmt.Fprintf(w, "%02X\n", -sum)
+}
@@ -0,0 +1,270 @@
+// Package loader provides a common interface to the file formats that programs
+// and memory images can be loaded from. It is modelled on the standard
+// library's image package: each format is implemented in a subpackage that
+// registers itself when imported, and Load detects the format of a file from
+// its contents. A program using the loader should import the formats it needs
+// for their side effects:
+//
+//	import _ "github.com/kierdavis/avr/loader/ihexloader"
+//
+// Files can be loaded into program memory, EEPROM or data memory, at any
+// offset. This allows EEPROM and RAM images to be preloaded alongside a
+// program.
+package loader
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "github.com/kierdavis/avr/emulator"
+    "io"
+    "os"
+)
+
+// A Memory identifies one of the memories of an MCU.
+type Memory int
+
+const (
+    Flash Memory = iota
+    EEPROM
+    Data
+)
+
+func (m Memory) String() string {
+    switch m {
+    case Flash:
+        return "flash"
+    case EEPROM:
+        return "eeprom"
+    case Data:
+        return "data"
+    }
+    return fmt.Sprintf("Memory(%d)", int(m))
+}
+
+// ParseMemory returns the Memory with the given name ("flash", "eeprom" or
+// "data").
+func ParseMemory(name string) (m Memory, ok bool) {
+    for m = Flash; m <= Data; m++ {
+        if m.String() == name {
+            return m, true
+        }
+    }
+    return 0, false
+}
+
+// Size returns the size of the memory in bytes on the emulated MCU.
+func (m Memory) Size(em *emulator.Emulator) uint32 {
+    switch m {
+    case Flash:
+        return uint32(em.Spec.ProgMemSize())
+    case EEPROM:
+        return uint32(em.Spec.EEPROMSize())
+    case Data:
+        return 1 << em.Spec.LogDataSpaceSize
+    }
+    return 0
+}
+
+// A Target specifies where the contents of a file are loaded.
+type Target struct {
+    Memory Memory
+    Offset uint32 // byte address at which address 0 of the file is placed
+}
+
+func (t Target) String() string {
+    return fmt.Sprintf("%s@0x%04X", t.Memory, t.Offset)
+}
+
+// A Range is a range of byte addresses within a memory.
+type Range struct {
+    Start uint32
+    End   uint32 // exclusive
+}
+
+func (r Range) String() string {
+    return fmt.Sprintf("0x%05X-0x%05X", r.Start, r.End-1)
+}
+
+// AddRange appends the range [start, end) to ranges, merging it with the last
+// range if they are adjacent.
+func AddRange(ranges []Range, start, end uint32) []Range {
+    if n := len(ranges); n > 0 && ranges[n-1].End == start {
+        ranges[n-1].End = end
+        return ranges
+    }
+    return append(ranges, Range{start, end})
+}
+
+// A Format is a file format that can be loaded into an emulator.
+type Format interface {
+    // Name returns a short name for the format, such as "ihex".
+    Name() string
+    // Detect returns true if head, the first bytes of a file (at most
+    // DetectSize), appears to be in this format.
+    Detect(head []byte) bool
+    // Load reads a file from r and loads it into the target memory of em. It
+    // returns the ranges of the target memory that were written.
+    Load(em *emulator.Emulator, r io.Reader, t Target) (ranges []Range, err error)
+}
+
+// A Saver is a Format that can also write memory images.
+type Saver interface {
+    Format
+    // Save writes the entire contents of a memory of em to w.
+    Save(w io.Writer, em *emulator.Emulator, m Memory) (err error)
+}
+
+// The number of bytes passed to Format.Detect.
+const DetectSize = 512
+
+// The name of the raw binary format, which is assumed if no other format
+// recognises a file.
+const RawFormat = "bin"
+
+// ErrFormat is returned by Load if the format of a file was not recognised.
+var ErrFormat = errors.New("loader: unknown file format")
+
+var formats []Format
+
+// RegisterFormat registers a file format for use by Load. It is typically
+// called from the init function of the package implementing the format.
+func RegisterFormat(f Format) {
+    formats = append(formats, f)
+}
+
+// Formats returns all registered formats, in order of registration.
+func Formats() []Format {
+    return append([]Format(nil), formats...)
+}
+
+// Lookup returns the registered format with the given name.
+func Lookup(name string) (f Format, ok bool) {
+    for _, f = range formats {
+        if f.Name() == name {
+            return f, true
+        }
+    }
+    return nil, false
+}
+
+// Detect returns the registered format that recognises head, the first bytes
+// of a file. If no format recognises it, the raw binary format is returned (if
+// registered).
+func Detect(head []byte) (f Format, ok bool) {
+    for _, f = range formats {
+        if f.Name() != RawFormat && f.Detect(head) {
+            return f, true
+        }
+    }
+    return Lookup(RawFormat)
+}
+
+// Load reads a file from r, detects its format and loads it into the target
+// memory of em. It returns the name of the format and the ranges of memory
+// that were written.
+func Load(em *emulator.Emulator, r io.Reader, t Target) (format string, ranges []Range, err error) {
+    br := bufio.NewReaderSize(r, DetectSize)
+    head, err := br.Peek(DetectSize)
+    if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+        return "", nil, err
+    }
+
+    f, ok := Detect(head)
+    if !ok {
+        return "", nil, ErrFormat
+    }
+    ranges, err = f.Load(em, br, t)
+    return f.Name(), ranges, err
+}
+
+// LoadFile opens the named file and loads it as Load does.
+func LoadFile(em *emulator.Emulator, name string, t Target) (format string, ranges []Range, err error) {
+    file, err := os.Open(name)
+    if err != nil {
+        return "", nil, err
+    }
+    defer file.Close()
+    return Load(em, file, t)
+}
+
+// SaveFile writes the entire contents of a memory of em to the named file, in
+// the named format.
+func SaveFile(em *emulator.Emulator, name string, m Memory, format string) (err error) {
+    f, ok := Lookup(format)
+    if !ok {
+        return fmt.Errorf("loader: unknown file format %q", format)
+    }
+    saver, ok := f.(Saver)
+    if !ok {
+        return fmt.Errorf("loader: %s files cannot be written", format)
+    }
+
+    file, err := os.Create(name)
+    if err != nil {
+        return err
+    }
+    if err = saver.Save(file, em, m); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// Read returns the entire contents of a memory of em. I/O ports in data memory
+// read as zero.
+func Read(em *emulator.Emulator, m Memory) (data []byte) {
+    data = make([]byte, m.Size(em))
+    switch m {
+    case Flash:
+        words := make([]uint16, len(data)/2)
+        em.ReadProg(0, words)
+        for i, word := range words {
+            data[2*i] = uint8(word)
+            data[2*i+1] = uint8(word >> 8)
+        }
+    case EEPROM:
+        em.ReadEEPROM(0, data)
+    case Data:
+        em.ReadData(0, data)
+    }
+    return data
+}
+
+// Write copies data into the target memory of em at the given address
+// (relative to the target's offset). It returns an error if the data does not
+// fit in the memory. Program memory may be written at any byte address.
+func Write(em *emulator.Emulator, t Target, address uint32, data []byte) (err error) {
+    start := t.Offset + address
+    end := start + uint32(len(data))
+    if size := t.Memory.Size(em); end > size || end < start {
+        return fmt.Errorf("loader: %d bytes at %s address 0x%05X do not fit in %s's %d bytes of %s",
+            len(data), t.Memory, start, em.Spec.Label, size, t.Memory)
+    }
+    if len(data) == 0 {
+        return nil
+    }
+
+    switch t.Memory {
+    case Flash:
+        // merge partial words at either end with the existing contents
+        wstart, wend := start&^1, (end+1)&^1
+        buf := make([]byte, wend-wstart)
+        buf[0] = em.ProgByte(wstart)
+        buf[len(buf)-1] = em.ProgByte(wend - 1)
+        copy(buf[start-wstart:], data)
+
+        words := make([]uint16, len(buf)/2)
+        for i := range words {
+            words[i] = uint16(buf[2*i]) | uint16(buf[2*i+1])<<8
+        }
+        em.WriteProg(wstart/2, words)
+    case EEPROM:
+        em.WriteEEPROM(uint16(start), data)
+    case Data:
+        em.WriteData(uint16(start), data)
+    default:
+        return fmt.Errorf("loader: invalid memory %s", t.Memory)
+    }
+    return nil
+}
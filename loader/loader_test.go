@@ -0,0 +1,57 @@
+package loader
+
+import (
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/spec"
+    "testing"
+)
+
+func TestWriteFlash(t *testing.T) {
+    em := emulator.NewEmulator(spec.ATmega168)
+    em.WriteProg(0, []uint16{0x1111, 0x2222, 0x3333})
+
+    // an unaligned write must preserve the other halves of the words it touches
+    if err := Write(em, Target{Flash, 1}, 0, []byte{0xAA, 0xBB, 0xCC}); err != nil {
+        t.Fatal(err)
+    }
+    expected := []uint8{0x11, 0xAA, 0xBB, 0xCC, 0x33, 0x33}
+    for addr, want := range expected {
+        if got := em.ProgByte(uint32(addr)); got != want {
+            t.Errorf("flash byte %d: expected 0x%02X, got 0x%02X", addr, want, got)
+        }
+    }
+
+    if err := Write(em, Target{Flash, 0x3FFF}, 0, []byte{1, 2}); err == nil {
+        t.Errorf("expected an error writing past the end of flash")
+    }
+}
+
+func TestWriteEEPROMAndData(t *testing.T) {
+    em := emulator.NewEmulator(spec.ATmega168)
+    if err := Write(em, Target{EEPROM, 0x1FE}, 0, []byte{1, 2}); err != nil {
+        t.Fatal(err)
+    }
+    if em.EEPROMByte(0x1FF) != 2 {
+        t.Errorf("expected EEPROM byte 0x1FF to be 2, got %d", em.EEPROMByte(0x1FF))
+    }
+    if err := Write(em, Target{EEPROM, 0x1FF}, 0, []byte{1, 2}); err == nil {
+        t.Errorf("expected an error writing past the end of EEPROM")
+    }
+
+    if err := Write(em, Target{Data, 0x0100}, 0, []byte{0x5A}); err != nil {
+        t.Fatal(err)
+    }
+    if em.PeekData(0x0100) != 0x5A {
+        t.Errorf("expected data byte 0x0100 to be 0x5A, got 0x%02X", em.PeekData(0x0100))
+    }
+}
+
+func TestAddRange(t *testing.T) {
+    var ranges []Range
+    ranges = AddRange(ranges, 0, 4)
+    ranges = AddRange(ranges, 4, 8)
+    ranges = AddRange(ranges, 16, 20)
+    if len(ranges) != 2 || ranges[0] != (Range{0, 8}) || ranges[1] != (Range{16, 20}) {
+        t.Errorf("unexpected ranges %v", ranges)
+    }
+}
@@ -0,0 +1,168 @@
+// Package srecloader encapsulates loading of Motorola S-record files into an
+// Emulator.
+//
+// Each line of an S-record file is a record of the form
+//
+//     S<type><count><address><data><checksum>
+//
+// where count is the number of bytes in the address, data and checksum fields,
+// and the checksum is the ones' complement of the low byte of the sum of the
+// count, address and data bytes. Data records have 2-byte (S1), 3-byte (S2) or
+// 4-byte (S3) addresses.
+package srecloader
+
+import (
+    "bufio"
+    "encoding/hex"
+    "fmt"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader"
+    "io"
+    "strings"
+)
+
+func init() {
+    loader.RegisterFormat(Format{})
+}
+
+// Format implements loader.Format for S-record files.
+type Format struct{}
+
+func (Format) Name() string {
+    return "srec"
+}
+
+// Detect returns true if the file begins with a record: an 'S' followed by a
+// record type digit and a hexadecimal byte count.
+func (Format) Detect(head []byte) bool {
+    for len(head) > 0 && (head[0] == ' ' || head[0] == '\t' || head[0] == '\r' || head[0] == '\n') {
+        head = head[1:]
+    }
+    return len(head) >= 4 && head[0] == 'S' && '0' <= head[1] && head[1] <= '9' &&
+        isHexDigit(head[2]) && isHexDigit(head[3])
+}
+
+func (Format) Load(em *emulator.Emulator, r io.Reader, t loader.Target) (ranges []loader.Range, err error) {
+    result, err := Load(em, r, t)
+    return result.Ranges, err
+}
+
+func isHexDigit(c byte) bool {
+    return ('0' <= c && c <= '9') || ('A' <= c && c <= 'F') || ('a' <= c && c <= 'f')
+}
+
+// A Record is a single parsed S-record.
+type Record struct {
+    Type    uint8 // 0 to 9
+    Address uint32
+    Data    []byte
+}
+
+// The number of address bytes in each type of record. Type 4 is reserved.
+var addressSizes = [10]int{2, 2, 3, 4, 0, 2, 3, 4, 3, 2}
+
+// ParseRecord parses a single record from a line of text (without the line
+// terminator).
+func ParseRecord(line string) (rec Record, err error) {
+    if len(line) < 4 || line[0] != 'S' || line[1] < '0' || line[1] > '9' || line[1] == '4' {
+        return Record{}, fmt.Errorf("srecloader: invalid record %q", line)
+    }
+    rec.Type = line[1] - '0'
+
+    buf, err := hex.DecodeString(line[2:])
+    if err != nil {
+        return Record{}, fmt.Errorf("srecloader: invalid record %q: %s", line, err)
+    }
+    if int(buf[0]) != len(buf)-1 {
+        return Record{}, fmt.Errorf("srecloader: record %q has byte count %d, expected %d", line, buf[0], len(buf)-1)
+    }
+
+    var sum uint8
+    for _, b := range buf[:len(buf)-1] {
+        sum += b
+    }
+    if ^sum != buf[len(buf)-1] {
+        return Record{}, fmt.Errorf("srecloader: record %q has checksum 0x%02X, expected 0x%02X", line, buf[len(buf)-1], ^sum)
+    }
+
+    addrSize := addressSizes[rec.Type]
+    if len(buf) < 2+addrSize {
+        return Record{}, fmt.Errorf("srecloader: record %q is too short", line)
+    }
+    for _, b := range buf[1 : 1+addrSize] {
+        rec.Address = rec.Address<<8 | uint32(b)
+    }
+    rec.Data = buf[1+addrSize : len(buf)-1]
+    return rec, nil
+}
+
+// A Result describes what was loaded from an S-record file.
+type Result struct {
+    // Byte address ranges of the target memory that were written, in the
+    // order they appear in the file. Adjacent records are merged into one
+    // range.
+    Ranges []loader.Range
+    // Contents of the S0 header record, conventionally a module name.
+    Header string
+    // Start address given by an S7, S8 or S9 record. As with IHEX start
+    // addresses, this has no meaning to an AVR.
+    Start    uint32
+    HasStart bool
+}
+
+// Load parses an S-record file from r and loads the data contained in it into
+// the target memory of em. When the target is program memory, data records
+// must be word-aligned. If a record count (S5 or S6) record is present, it is
+// checked against the number of data records read.
+func Load(em *emulator.Emulator, r io.Reader, t loader.Target) (result Result, err error) {
+    scanner := bufio.NewScanner(r)
+    numData := uint32(0)
+    size := t.Memory.Size(em)
+
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+
+        rec, err := ParseRecord(line)
+        if err != nil {
+            return result, err
+        }
+
+        switch rec.Type {
+        case 0:
+            result.Header = strings.TrimRight(string(rec.Data), "\x00")
+
+        case 1, 2, 3:
+            numData++
+            if len(rec.Data) == 0 {
+                continue
+            }
+            if t.Memory == loader.Flash && (rec.Address%2 != 0 || len(rec.Data)%2 != 0) {
+                return result, fmt.Errorf("srecloader: data record at 0x%05X with %d bytes is not word-aligned", rec.Address, len(rec.Data))
+            }
+            end := rec.Address + uint32(len(rec.Data))
+            if t.Offset+end > size {
+                return result, fmt.Errorf("srecloader: data record at 0x%05X-0x%05X is outside %s (%d bytes on %s)",
+                    rec.Address, end-1, t.Memory, size, em.Spec.Label)
+            }
+            if err = loader.Write(em, t, rec.Address, rec.Data); err != nil {
+                return result, err
+            }
+            result.Ranges = loader.AddRange(result.Ranges, t.Offset+rec.Address, t.Offset+end)
+
+        case 5, 6:
+            if rec.Address != numData {
+                return result, fmt.Errorf("srecloader: record count is %d, but %d data records were read", rec.Address, numData)
+            }
+
+        case 7, 8, 9:
+            result.Start = rec.Address
+            result.HasStart = true
+            return result, nil
+        }
+    }
+
+    return result, scanner.Err()
+}
@@ -0,0 +1,74 @@
+package srecloader
+
+import (
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/loader"
+    "github.com/kierdavis/avr/spec"
+    "strings"
+    "testing"
+)
+
+func TestParseRecord(t *testing.T) {
+    rec, err := ParseRecord("S1130000285F245F2212226A000424290008237C2A")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rec.Type != 1 || rec.Address != 0x0000 || len(rec.Data) != 16 || rec.Data[0] != 0x28 {
+        t.Errorf("unexpected record %+v", rec)
+    }
+
+    rec, err = ParseRecord("S2080100000C94000056")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rec.Type != 2 || rec.Address != 0x010000 || len(rec.Data) != 4 {
+        t.Errorf("unexpected record %+v", rec)
+    }
+
+    badRecords := []string{
+        "S1130000285F245F2212226A000424290008237C2B", // checksum
+        "S1120000285F245F2212226A000424290008237C2A", // byte count
+        "S4030000FC", // reserved type
+        "S10300",     // too short
+        ":10000000",  // not an S-record
+    }
+    for _, line := range badRecords {
+        if _, err := ParseRecord(line); err == nil {
+            t.Errorf("ParseRecord(%q): expected an error", line)
+        }
+    }
+}
+
+func TestLoad(t *testing.T) {
+    file := strings.Join([]string{
+        "S00600004844521B",
+        "S1070000AABBCCDDEA",
+        "S1050004EEFF09",
+        "S5030002FA",
+        "S9030000FC",
+    }, "\n")
+
+    em := emulator.NewEmulator(spec.ATmega168)
+    result, err := Load(em, strings.NewReader(file), loader.Target{Memory: loader.EEPROM, Offset: 0x10})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Header != "HDR" || !result.HasStart || result.Start != 0 {
+        t.Errorf("unexpected result %+v", result)
+    }
+    if len(result.Ranges) != 1 || result.Ranges[0] != (loader.Range{0x10, 0x16}) {
+        t.Errorf("expected ranges [0x00010-0x00015], got %v", result.Ranges)
+    }
+    for i, want := range []uint8{0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF} {
+        if got := em.EEPROMByte(uint16(0x10 + i)); got != want {
+            t.Errorf("EEPROM byte 0x%02X: expected 0x%02X, got 0x%02X", 0x10+i, want, got)
+        }
+    }
+
+    if (Format{}).Detect([]byte("S00600004844521B\n")) != true {
+        t.Errorf("Detect: expected true")
+    }
+    if (Format{}).Detect([]byte(":100000000C94")) != false {
+        t.Errorf("Detect: expected false")
+    }
+}
@@ -124,26 +124,126 @@ func mega48_88_168(v int) *MCUSpec {
         "SPM_READY":    25,
     }
 
-    // GTCCR port only present on ATmega88/168
+    registers := map[string]RegisterSpec{
+        "PINB":   bitsReg("PINB%d", 0, 8),
+        "DDRB":   bitsReg("DDB%d", 0, 8),
+        "PORTB":  bitsReg("PORTB%d", 0, 8),
+        "PINC":   bitsReg("PINC%d", 0, 7),
+        "DDRC":   bitsReg("DDC%d", 0, 7),
+        "PORTC":  bitsReg("PORTC%d", 0, 7),
+        "PIND":   bitsReg("PIND%d", 0, 8),
+        "DDRD":   bitsReg("DDD%d", 0, 8),
+        "PORTD":  bitsReg("PORTD%d", 0, 8),
+        "TIFR0":  reg(w1c("OCF0B", 0x04), w1c("OCF0A", 0x02), w1c("TOV0", 0x01)),
+        "TIFR1":  reg(w1c("ICF1", 0x20), w1c("OCF1B", 0x04), w1c("OCF1A", 0x02), w1c("TOV1", 0x01)),
+        "TIFR2":  reg(w1c("OCF2B", 0x04), w1c("OCF2A", 0x02), w1c("TOV2", 0x01)),
+        "PCIFR":  reg(w1c("PCIF2", 0x04), w1c("PCIF1", 0x02), w1c("PCIF0", 0x01)),
+        "EIFR":   reg(w1c("INTF1", 0x02), w1c("INTF0", 0x01)),
+        "EIMSK":  reg(rw("INT1", 0x02), rw("INT0", 0x01)),
+        "GPIOR0": byteReg("GPIOR0"),
+        "EECR":   reg(rw("EEPM", 0x30), rw("EERIE", 0x08), rw("EEMPE", 0x04), rw("EEPE", 0x02), rw("EERE", 0x01)),
+        "EEDR":   byteReg("EEDR"),
+        "EEARL":  byteReg("EEAR"),
+        "TCCR0A": reg(rw("COM0A", 0xC0), rw("COM0B", 0x30), rw("WGM0", 0x03)),
+        "TCCR0B": reg(wo("FOC0A", 0x80), wo("FOC0B", 0x40), rw("WGM02", 0x08), rw("CS0", 0x07)),
+        "TCNT0":  byteReg("TCNT0"),
+        "OCR0A":  byteReg("OCR0A"),
+        "OCR0B":  byteReg("OCR0B"),
+        "GPIOR1": byteReg("GPIOR1"),
+        "GPIOR2": byteReg("GPIOR2"),
+        "SPCR":   reg(rw("SPIE", 0x80), rw("SPE", 0x40), rw("DORD", 0x20), rw("MSTR", 0x10), rw("CPOL", 0x08), rw("CPHA", 0x04), rw("SPR", 0x03)),
+        "SPSR":   reg(ro("SPIF", 0x80), ro("WCOL", 0x40), rw("SPI2X", 0x01)),
+        "SPDR":   byteReg("SPDR"),
+        "ACSR":   reg(rw("ACD", 0x80), rw("ACBG", 0x40), ro("ACO", 0x20), w1c("ACI", 0x10), rw("ACIE", 0x08), rw("ACIC", 0x04), rw("ACIS", 0x03)),
+        "SMCR":   reg(rw("SM", 0x0E), rw("SE", 0x01)),
+        "MCUSR":  reg(rw("WDRF", 0x08), rw("BORF", 0x04), rw("EXTRF", 0x02), withReset(rw("PORF", 0x01), 0x01)),
+        "SPMCSR": reg(rw("SPMIE", 0x80), ro("RWWSB", 0x40), rw("SIGRD", 0x20), rw("RWWSRE", 0x10), rw("BLBSET", 0x08), rw("PGWRT", 0x04), rw("PGERS", 0x02), rw("SELFPRGEN", 0x01)),
+        "SREG":   sregReg(),
+        "WDTCSR": reg(w1c("WDIF", 0x80), rw("WDIE", 0x40), rw("WDP3", 0x20), rw("WDCE", 0x10), rw("WDE", 0x08), rw("WDP", 0x07)),
+        "CLKPR":  reg(rw("CLKPCE", 0x80), withReset(rw("CLKPS", 0x0F), 0x03)), // reset value assumes CKDIV8 is programmed
+        "PRR":    reg(rw("PRTWI", 0x80), rw("PRTIM2", 0x40), rw("PRTIM0", 0x20), rw("PRTIM1", 0x08), rw("PRSPI", 0x04), rw("PRUSART0", 0x02), rw("PRADC", 0x01)),
+        "OSCCAL": byteReg("CAL"),
+        "PCICR":  reg(rw("PCIE2", 0x04), rw("PCIE1", 0x02), rw("PCIE0", 0x01)),
+        "EICRA":  reg(rw("ISC1", 0x0C), rw("ISC0", 0x03)),
+        "PCMSK0": bitsReg("PCINT%d", 0, 8),
+        "PCMSK1": bitsReg("PCINT%d", 8, 7),
+        "PCMSK2": bitsReg("PCINT%d", 16, 8),
+        "TIMSK0": reg(rw("OCIE0B", 0x04), rw("OCIE0A", 0x02), rw("TOIE0", 0x01)),
+        "TIMSK1": reg(rw("ICIE1", 0x20), rw("OCIE1B", 0x04), rw("OCIE1A", 0x02), rw("TOIE1", 0x01)),
+        "TIMSK2": reg(rw("OCIE2B", 0x04), rw("OCIE2A", 0x02), rw("TOIE2", 0x01)),
+        "ADCL":   reg(ro("ADCL", 0xFF)),
+        "ADCH":   reg(ro("ADCH", 0xFF)),
+        "ADCSRA": reg(rw("ADEN", 0x80), rw("ADSC", 0x40), rw("ADATE", 0x20), w1c("ADIF", 0x10), rw("ADIE", 0x08), rw("ADPS", 0x07)),
+        "ADCSRB": reg(rw("ACME", 0x40), rw("ADTS", 0x07)),
+        "ADMUX":  reg(rw("REFS", 0xC0), rw("ADLAR", 0x20), rw("MUX", 0x0F)),
+        "DIDR0":  bitsReg("ADC%dD", 0, 6),
+        "DIDR1":  reg(rw("AIN1D", 0x02), rw("AIN0D", 0x01)),
+        "TCCR1A": reg(rw("COM1A", 0xC0), rw("COM1B", 0x30), rw("WGM1", 0x03)),
+        "TCCR1B": reg(rw("ICNC1", 0x80), rw("ICES1", 0x40), rw("WGM13", 0x10), rw("WGM12", 0x08), rw("CS1", 0x07)),
+        "TCCR1C": reg(wo("FOC1A", 0x80), wo("FOC1B", 0x40)),
+        "TCNT1L": byteReg("TCNT1L"),
+        "TCNT1H": byteReg("TCNT1H"),
+        "ICR1L":  byteReg("ICR1L"),
+        "ICR1H":  byteReg("ICR1H"),
+        "OCR1AL": byteReg("OCR1AL"),
+        "OCR1AH": byteReg("OCR1AH"),
+        "OCR1BL": byteReg("OCR1BL"),
+        "OCR1BH": byteReg("OCR1BH"),
+        "TCCR2A": reg(rw("COM2A", 0xC0), rw("COM2B", 0x30), rw("WGM2", 0x03)),
+        "TCCR2B": reg(wo("FOC2A", 0x80), wo("FOC2B", 0x40), rw("WGM22", 0x08), rw("CS2", 0x07)),
+        "TCNT2":  byteReg("TCNT2"),
+        "OCR2A":  byteReg("OCR2A"),
+        "OCR2B":  byteReg("OCR2B"),
+        "ASSR":   reg(rw("EXCLK", 0x40), rw("AS2", 0x20), ro("TCN2UB", 0x10), ro("OCR2AUB", 0x08), ro("OCR2BUB", 0x04), ro("TCR2AUB", 0x02), ro("TCR2BUB", 0x01)),
+        "TWBR":   byteReg("TWBR"),
+        "TWSR":   reg(withReset(ro("TWS", 0xF8), 0xF8), rw("TWPS", 0x03)),
+        "TWAR":   reg(withReset(rw("TWA", 0xFE), 0xFE), rw("TWGCE", 0x01)),
+        "TWDR":   reg(withReset(rw("TWD", 0xFF), 0xFF)),
+        "TWCR":   reg(w1c("TWINT", 0x80), rw("TWEA", 0x40), rw("TWSTA", 0x20), rw("TWSTO", 0x10), ro("TWWC", 0x08), rw("TWEN", 0x04), rw("TWIE", 0x01)),
+        "TWAMR":  reg(rw("TWAM", 0xFE)),
+        "UCSR0A": reg(ro("RXC0", 0x80), w1c("TXC0", 0x40), withReset(ro("UDRE0", 0x20), 0x20), ro("FE0", 0x10), ro("DOR0", 0x08), ro("UPE0", 0x04), rw("U2X0", 0x02), rw("MPCM0", 0x01)),
+        "UCSR0B": reg(rw("RXCIE0", 0x80), rw("TXCIE0", 0x40), rw("UDRIE0", 0x20), rw("RXEN0", 0x10), rw("TXEN0", 0x08), rw("UCSZ02", 0x04), ro("RXB80", 0x02), rw("TXB80", 0x01)),
+        "UCSR0C": reg(rw("UMSEL0", 0xC0), rw("UPM0", 0x30), rw("USBS0", 0x08), withReset(rw("UCSZ0", 0x06), 0x06), rw("UCPOL0", 0x01)),
+        "UBRR0L": byteReg("UBRR0L"),
+        "UBRR0H": reg(rw("UBRR0H", 0x0F)),
+        "UDR0":   byteReg("UDR0"),
+    }
+
+    // The GTCCR port, the interrupt vector select bits and the high byte of the
+    // EEPROM address are only present on ATmega88/168
     if v != 48 {
         ports["GTCCR"] = avr.PortRef{0, 0x23}
+        registers["GTCCR"] = reg(rw("TSM", 0x80), rw("PSRASY", 0x02), rw("PSRSYNC", 0x01))
+        registers["MCUCR"] = reg(rw("PUD", 0x10), rw("IVSEL", 0x02), rw("IVCE", 0x01))
+        registers["EEARH"] = reg(rw("EEAR8", 0x01))
+    } else {
+        registers["MCUCR"] = reg(rw("PUD", 0x10))
+        registers["EEARH"] = reg()
     }
 
     var logProgMemSize, logDataSpaceSize, logRAMSize, logEEPROMSize, interruptVectorSize uint
+    var signature [3]uint8
+    var family MCUFamily
     switch v {
     case 48:
+        signature = [3]uint8{0x1E, 0x92, 0x05}
+        family = EnhancedCore8K
         logProgMemSize = 11 // 2 kW (4 kB)
         logDataSpaceSize = 10
         logRAMSize = 9    // 512 B
         logEEPROMSize = 8 // 256 B
         interruptVectorSize = 1
     case 88:
+        signature = [3]uint8{0x1E, 0x93, 0x0A}
+        family = EnhancedCore8K
         logProgMemSize = 12 // 4 kW (8 kB)
         logDataSpaceSize = 11
         logRAMSize = 10   // 1 kB
         logEEPROMSize = 9 // 512 B
         interruptVectorSize = 1
     case 168:
+        signature = [3]uint8{0x1E, 0x94, 0x06}
+        family = EnhancedCore128K
         logProgMemSize = 13 // 8 kW (16 kB)
         logDataSpaceSize = 11
         logRAMSize = 10   // 1 kB
@@ -151,15 +251,23 @@ func mega48_88_168(v int) *MCUSpec {
         interruptVectorSize = 2
     }
 
+    // stack pointer is initialised to RAMEND
+    ramEnd := uint16(0x0100 + (1 << logRAMSize) - 1)
+    registers["SPL"] = reg(withReset(rw("SP", 0xFF), uint8(ramEnd)))
+    registers["SPH"] = reg(withReset(rw("SP", (1<<(logDataSpaceSize-8))-1), uint8(ramEnd>>8)))
+
     return linkRegions(&MCUSpec{
         Label:               fmt.Sprintf("ATmega%d", v),
-        Family:              EnhancedCore128K,
+        Signature:           signature,
+        Family:              family,
         NumRegs:             32,
         LogProgMemSize:      logProgMemSize,
         LogDataSpaceSize:    logDataSpaceSize, // data memory address width
         LogRAMSize:          logRAMSize,
         LogEEPROMSize:       logEEPROMSize,
+        NumFuseBytes:        3,
         InterruptVectorSize: interruptVectorSize,
+        NumInterrupts:       26,
         IOBankSizes:         []uint{64, 160},
         Regions: []RegionSpec{
             RegsRegionSpec{start: 0x0000},
@@ -168,6 +276,7 @@ func mega48_88_168(v int) *MCUSpec {
             RAMRegionSpec{start: 0x0100},
         },
         Ports:      ports,
+        Registers:  registers,
         Interrupts: interrupts,
         Available: [avr.NumInstructions]bool{
             /* ADC */ true,
@@ -254,7 +363,7 @@ func mega48_88_168(v int) *MCUSpec {
             /* SBRS */ true,
             /* SLEEP */ true,
             /* SPM */ true,
-            /* SPM_2 */ true,
+            /* SPM_2 */ false,
             /* ST_X */ true,
             /* ST_X_INC */ true,
             /* ST_X_DEC */ true,
@@ -280,3 +389,9 @@ func mega48_88_168(v int) *MCUSpec {
 var ATmega48 = mega48_88_168(48)
 var ATmega88 = mega48_88_168(88)
 var ATmega168 = mega48_88_168(168)
+
+func init() {
+    Register(ATmega48, "atmega48", "mega48")
+    Register(ATmega88, "atmega88", "mega88")
+    Register(ATmega168, "atmega168", "mega168")
+}
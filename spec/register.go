@@ -0,0 +1,237 @@
+package spec
+
+import (
+    "fmt"
+    "github.com/kierdavis/avr"
+    "strings"
+)
+
+// An Access describes how software may access the bits of a bit field.
+type Access int
+
+const (
+    // The field may be read and written.
+    ReadWrite Access = iota
+    // The field may only be read; writes are ignored.
+    ReadOnly
+    // The field may only be written; reads return zero.
+    WriteOnly
+    // The field may be read, and is cleared by writing a one to it. Writing a
+    // zero has no effect. This is typical of interrupt flags.
+    WriteOneToClear
+)
+
+func (a Access) String() string {
+    switch a {
+    case ReadWrite:
+        return "R/W"
+    case ReadOnly:
+        return "R"
+    case WriteOnly:
+        return "W"
+    case WriteOneToClear:
+        return "R/W1C"
+    }
+    return fmt.Sprintf("Access(%d)", int(a))
+}
+
+// A BitField is a named group of bits within an I/O register. Mask and Reset
+// are given in register bit positions, so a field occupying bits 3..0 has a
+// Mask of 0x0F.
+type BitField struct {
+    Name   string
+    Mask   uint8
+    Access Access
+    Reset  uint8 // value of the field's bits after a reset
+}
+
+// Shift returns the bit position of the least significant bit of the field.
+func (f BitField) Shift() uint {
+    var shift uint
+    for shift = 0; shift < 8; shift++ {
+        if f.Mask&(1<<shift) != 0 {
+            break
+        }
+    }
+    return shift
+}
+
+// Width returns the number of bits in the field.
+func (f BitField) Width() uint {
+    var n uint
+    for m := f.Mask; m != 0; m &= m - 1 {
+        n++
+    }
+    return n
+}
+
+// Extract returns the value of the field within the register value x, shifted
+// down so that the least significant bit of the field is bit 0.
+func (f BitField) Extract(x uint8) uint8 {
+    return (x & f.Mask) >> f.Shift()
+}
+
+// Insert returns the register value x with the field set to val. Bits of val
+// that do not fit in the field are discarded.
+func (f BitField) Insert(x uint8, val uint8) uint8 {
+    return (x & ^f.Mask) | ((val << f.Shift()) & f.Mask)
+}
+
+// A RegisterSpec describes the layout of an I/O register as a list of bit
+// fields, ordered from the most significant bit downwards. Bits not covered by
+// any field are reserved.
+type RegisterSpec struct {
+    Fields []BitField
+}
+
+// Field returns the bit field with the given name.
+func (r RegisterSpec) Field(name string) (f BitField, ok bool) {
+    for _, f = range r.Fields {
+        if f.Name == name {
+            return f, true
+        }
+    }
+    return BitField{}, false
+}
+
+// FieldAt returns the bit field containing the given bit number.
+func (r RegisterSpec) FieldAt(bit uint) (f BitField, ok bool) {
+    for _, f = range r.Fields {
+        if f.Mask&(1<<bit) != 0 {
+            return f, true
+        }
+    }
+    return BitField{}, false
+}
+
+// ResetValue returns the value of the register after a reset.
+func (r RegisterSpec) ResetValue() (x uint8) {
+    for _, f := range r.Fields {
+        x |= f.Reset & f.Mask
+    }
+    return x
+}
+
+// ReservedMask returns a mask of the bits not covered by any field.
+func (r RegisterSpec) ReservedMask() uint8 {
+    var used uint8
+    for _, f := range r.Fields {
+        used |= f.Mask
+    }
+    return ^used
+}
+
+// Decode returns a symbolic representation of the register value x. Single-bit
+// fields are listed by name if they are set, and multi-bit fields are listed as
+// NAME=value. For example, a TCCR0B value of 0x83 decodes to "FOC0A|CS0=3".
+func (r RegisterSpec) Decode(x uint8) string {
+    var parts []string
+    for _, f := range r.Fields {
+        val := f.Extract(x)
+        if f.Width() == 1 {
+            if val != 0 {
+                parts = append(parts, f.Name)
+            }
+        } else if val != 0 {
+            parts = append(parts, fmt.Sprintf("%s=%d", f.Name, val))
+        }
+    }
+    if rsvd := x & r.ReservedMask(); rsvd != 0 {
+        parts = append(parts, fmt.Sprintf("0x%02X", rsvd))
+    }
+    if len(parts) == 0 {
+        return "0"
+    }
+    return strings.Join(parts, "|")
+}
+
+// Register returns the bit field layout of the named I/O register.
+func (s *MCUSpec) Register(name string) (r RegisterSpec, ok bool) {
+    r, ok = s.Registers[name]
+    return r, ok
+}
+
+// PortName returns the name of the I/O port at the given reference.
+func (s *MCUSpec) PortName(pref avr.PortRef) (name string, ok bool) {
+    for name, p := range s.Ports {
+        if p == pref {
+            return name, true
+        }
+    }
+    return "", false
+}
+
+// RegisterAt returns the name and bit field layout of the I/O register at the
+// given port reference. ok is false if no port is defined there; if a port is
+// defined but has no bit field layout, r has no fields.
+func (s *MCUSpec) RegisterAt(pref avr.PortRef) (name string, r RegisterSpec, ok bool) {
+    name, ok = s.PortName(pref)
+    if !ok {
+        return "", RegisterSpec{}, false
+    }
+    return name, s.Registers[name], true
+}
+
+// Helpers used in definitions of register layouts.
+
+// Constructs a RegisterSpec from a list of fields.
+func reg(fields ...BitField) RegisterSpec {
+    return RegisterSpec{Fields: fields}
+}
+
+// A read/write field.
+func rw(name string, mask uint8) BitField {
+    return BitField{Name: name, Mask: mask, Access: ReadWrite}
+}
+
+// A read-only field.
+func ro(name string, mask uint8) BitField {
+    return BitField{Name: name, Mask: mask, Access: ReadOnly}
+}
+
+// A write-only field.
+func wo(name string, mask uint8) BitField {
+    return BitField{Name: name, Mask: mask, Access: WriteOnly}
+}
+
+// A write-one-to-clear field.
+func w1c(name string, mask uint8) BitField {
+    return BitField{Name: name, Mask: mask, Access: WriteOneToClear}
+}
+
+// Returns f with the given reset value.
+func withReset(f BitField, reset uint8) BitField {
+    f.Reset = reset & f.Mask
+    return f
+}
+
+// Constructs a register of n single-bit read/write fields, with bit i named
+// fmt.Sprintf(format, first+i). This is used for GPIO and other bit-per-pin
+// registers.
+func bitsReg(format string, first uint, n uint) RegisterSpec {
+    fields := make([]BitField, n)
+    for i := range fields {
+        bit := n - 1 - uint(i)
+        fields[i] = rw(fmt.Sprintf(format, first+bit), 1<<bit)
+    }
+    return RegisterSpec{Fields: fields}
+}
+
+// Constructs a register holding a single 8-bit read/write field.
+func byteReg(name string) RegisterSpec {
+    return reg(rw(name, 0xFF))
+}
+
+// The SREG layout is common to all AVRs.
+func sregReg() RegisterSpec {
+    return reg(
+        rw("I", 0x80),
+        rw("T", 0x40),
+        rw("H", 0x20),
+        rw("S", 0x10),
+        rw("V", 0x08),
+        rw("N", 0x04),
+        rw("Z", 0x02),
+        rw("C", 0x01),
+    )
+}
@@ -0,0 +1,105 @@
+package spec
+
+import (
+    "github.com/kierdavis/avr"
+    "testing"
+)
+
+func TestBitFields(t *testing.T) {
+    tests := []struct {
+        reg, field   string
+        access       Access
+        x            uint8 // register value
+        extracted    uint8
+        insert       uint8 // field value inserted into x
+        inserted     uint8
+        shift, width uint
+    }{
+        {"TCCR0B", "FOC0A", WriteOnly, 0x83, 1, 0, 0x03, 7, 1},
+        {"TCCR0B", "CS0", ReadWrite, 0x83, 3, 5, 0x85, 0, 3},
+        {"ADMUX", "MUX", ReadWrite, 0x4E, 0x0E, 0x13, 0x43, 0, 4},
+        {"ADMUX", "REFS", ReadWrite, 0x4E, 1, 3, 0xCE, 6, 2},
+        {"TIFR0", "TOV0", WriteOneToClear, 0x05, 1, 0, 0x04, 0, 1},
+    }
+    for _, tt := range tests {
+        r, ok := ATmega168.Register(tt.reg)
+        if !ok {
+            t.Errorf("%s: no register layout", tt.reg)
+            continue
+        }
+        f, ok := r.Field(tt.field)
+        if !ok {
+            t.Errorf("%s: no field %s", tt.reg, tt.field)
+            continue
+        }
+        if f.Access != tt.access {
+            t.Errorf("%s.%s: expected access %s, got %s", tt.reg, tt.field, tt.access, f.Access)
+        }
+        if f.Shift() != tt.shift || f.Width() != tt.width {
+            t.Errorf("%s.%s: expected shift %d and width %d, got %d and %d", tt.reg, tt.field, tt.shift, tt.width, f.Shift(), f.Width())
+        }
+        if got := f.Extract(tt.x); got != tt.extracted {
+            t.Errorf("%s.%s: expected to extract %d from 0x%02X, got %d", tt.reg, tt.field, tt.extracted, tt.x, got)
+        }
+        if got := f.Insert(tt.x, tt.insert); got != tt.inserted {
+            t.Errorf("%s.%s: expected inserting %d into 0x%02X to give 0x%02X, got 0x%02X", tt.reg, tt.field, tt.insert, tt.x, tt.inserted, got)
+        }
+        if at, ok := r.FieldAt(tt.shift); !ok || at.Name != tt.field {
+            t.Errorf("%s: expected bit %d to be in field %s, got %s (%t)", tt.reg, tt.shift, tt.field, at.Name, ok)
+        }
+    }
+}
+
+func TestRegisterSpec(t *testing.T) {
+    tests := []struct {
+        reg     string
+        x       uint8
+        decoded string
+        reset   uint8
+    }{
+        {"TCCR0B", 0x83, "FOC0A|CS0=3", 0x00},
+        {"TCCR0B", 0x00, "0", 0x00},
+        {"TCCR0B", 0x30, "0x30", 0x00}, // reserved bits
+        {"ADMUX", 0x65, "REFS=1|ADLAR|MUX=5", 0x00},
+        {"TIFR0", 0x06, "OCF0B|OCF0A", 0x00},
+        {"UCSR0A", 0x20, "UDRE0", 0x20},
+        {"UCSR0C", 0x06, "UCSZ0=3", 0x06},
+    }
+    for _, tt := range tests {
+        r, ok := ATmega168.Register(tt.reg)
+        if !ok {
+            t.Errorf("%s: no register layout", tt.reg)
+            continue
+        }
+        if got := r.Decode(tt.x); got != tt.decoded {
+            t.Errorf("%s: expected 0x%02X to decode to %q, got %q", tt.reg, tt.x, tt.decoded, got)
+        }
+        if got := r.ResetValue(); got != tt.reset {
+            t.Errorf("%s: expected reset value 0x%02X, got 0x%02X", tt.reg, tt.reset, got)
+        }
+    }
+
+    if r, _ := ATmega168.Register("TCCR0B"); r.ReservedMask() != 0x30 {
+        t.Errorf("TCCR0B: expected reserved mask 0x30, got 0x%02X", r.ReservedMask())
+    }
+    if _, ok := ATmega168.Register("NOSUCHREG"); ok {
+        t.Errorf("expected no layout for an unknown register")
+    }
+    if _, ok := (RegisterSpec{}).FieldAt(0); ok {
+        t.Errorf("expected no field in an empty layout")
+    }
+}
+
+func TestRegisterAt(t *testing.T) {
+    name, r, ok := ATmega168.RegisterAt(ATmega168.Ports["TCCR0B"])
+    if !ok || name != "TCCR0B" {
+        t.Fatalf("expected TCCR0B, got %q (%t)", name, ok)
+    }
+    if f, ok := r.FieldAt(7); !ok || f.Name != "FOC0A" {
+        t.Errorf("expected bit 7 of TCCR0B to be FOC0A, got %q (%t)", f.Name, ok)
+    }
+
+    if _, _, ok := ATmega168.RegisterAt(avr.PortRef{1, 0x9F}); ok {
+        t.Errorf("expected no register at an undefined port")
+    }
+}
@@ -0,0 +1,121 @@
+package spec
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// An Entry is a registered MCUSpec together with the names it can be looked up
+// by.
+type Entry struct {
+    Name    string   // name used by avr-gcc's -mmcu option, e.g. "atmega168"
+    Aliases []string // alternative names, e.g. "mega168"
+    Spec    *MCUSpec
+}
+
+var registry []Entry
+
+// Register adds an MCUSpec to the registry under the given avr-gcc name and
+// aliases. All of the MCUSpecs defined in this package are registered
+// automatically. Register panics if any of the names is already in use.
+func Register(s *MCUSpec, name string, aliases ...string) {
+    for _, n := range append([]string{name}, aliases...) {
+        if _, ok := Lookup(n); ok {
+            panic(fmt.Sprintf("spec.Register: name %q already registered", n))
+        }
+    }
+
+    registry = append(registry, Entry{
+        Name:    name,
+        Aliases: aliases,
+        Spec:    s,
+    })
+}
+
+// Lookup returns the MCUSpec registered under the given name, which may be
+// either an avr-gcc name (such as "atmega168") or an alias (such as "mega168").
+// Names are matched case-insensitively, so the spec's label ("ATmega168") is
+// accepted too.
+func Lookup(name string) (s *MCUSpec, ok bool) {
+    for _, e := range registry {
+        if strings.EqualFold(e.Name, name) {
+            return e.Spec, true
+        }
+        for _, alias := range e.Aliases {
+            if strings.EqualFold(alias, name) {
+                return e.Spec, true
+            }
+        }
+    }
+    return nil, false
+}
+
+// LookupSignature returns the MCUSpec with the given device signature.
+func LookupSignature(sig [3]uint8) (s *MCUSpec, ok bool) {
+    for _, e := range registry {
+        if e.Spec.Signature == sig {
+            return e.Spec, true
+        }
+    }
+    return nil, false
+}
+
+// NameOf returns the avr-gcc name that s is registered under.
+func NameOf(s *MCUSpec) (name string, ok bool) {
+    for _, e := range registry {
+        if e.Spec == s {
+            return e.Name, true
+        }
+    }
+    return "", false
+}
+
+// Entries returns all registered MCUSpecs, sorted by name. Numbers embedded in
+// names are compared numerically, so "atmega48" sorts before "atmega168".
+func Entries() []Entry {
+    entries := make([]Entry, len(registry))
+    copy(entries, registry)
+    sort.Sort(byName(entries))
+    return entries
+}
+
+type byName []Entry
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return naturalLess(a[i].Name, a[j].Name) }
+
+// Compares two strings, treating runs of digits as numbers.
+func naturalLess(a, b string) bool {
+    for a != "" && b != "" {
+        if isDigit(a[0]) && isDigit(b[0]) {
+            na, restA := splitNumber(a)
+            nb, restB := splitNumber(b)
+            if na != nb {
+                return na < nb
+            }
+            a, b = restA, restB
+            continue
+        }
+        if a[0] != b[0] {
+            return a[0] < b[0]
+        }
+        a, b = a[1:], b[1:]
+    }
+    return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+    return '0' <= c && c <= '9'
+}
+
+// Splits a leading run of digits off s and returns its value.
+func splitNumber(s string) (n uint64, rest string) {
+    i := 0
+    for i < len(s) && isDigit(s[i]) {
+        n = n*10 + uint64(s[i]-'0')
+        i++
+    }
+    return n, s[i:]
+}
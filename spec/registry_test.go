@@ -0,0 +1,64 @@
+package spec
+
+import (
+    "testing"
+)
+
+func TestLookup(t *testing.T) {
+    tests := []struct {
+        name string
+        s    *MCUSpec
+    }{
+        {"atmega168", ATmega168},
+        {"mega168", ATmega168},
+        {"ATmega168", ATmega168},
+        {"atmega48", ATmega48},
+        {"tiny10", ATtiny10},
+        {"attiny4", ATtiny4},
+    }
+    for _, tt := range tests {
+        s, ok := Lookup(tt.name)
+        if !ok || s != tt.s {
+            t.Errorf("Lookup(%q): expected %s, got %v (%t)", tt.name, tt.s.Label, s, ok)
+        }
+    }
+
+    if _, ok := Lookup("atmega328p"); ok {
+        t.Errorf("Lookup(\"atmega328p\"): expected no match")
+    }
+}
+
+func TestLookupSignature(t *testing.T) {
+    s, ok := LookupSignature([3]uint8{0x1E, 0x93, 0x0A})
+    if !ok || s != ATmega88 {
+        t.Errorf("expected signature 1E930A to be ATmega88, got %v (%t)", s, ok)
+    }
+    if _, ok := LookupSignature([3]uint8{0x00, 0x00, 0x00}); ok {
+        t.Errorf("expected no match for signature 000000")
+    }
+}
+
+func TestEntriesNaturalSort(t *testing.T) {
+    expected := []string{"atmega48", "atmega88", "atmega168", "attiny4", "attiny5", "attiny9", "attiny10"}
+    entries := Entries()
+    if len(entries) != len(expected) {
+        t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+    }
+    for i, e := range entries {
+        if e.Name != expected[i] {
+            t.Errorf("entry %d: expected %s, got %s", i, expected[i], e.Name)
+        }
+    }
+}
+
+func TestRegisterDuplicatePanics(t *testing.T) {
+    defer func() {
+        if recover() == nil {
+            t.Errorf("expected Register to panic on a duplicate alias")
+        }
+        if _, ok := Lookup("atmega168-dup"); ok {
+            t.Errorf("expected a rejected entry not to be registered")
+        }
+    }()
+    Register(ATmega168, "atmega168-dup", "mega168")
+}
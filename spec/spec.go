@@ -4,6 +4,8 @@ import (
     "github.com/kierdavis/avr"
 )
 
+//go:generate stringer -type=MCUFamily
+
 // An MCUFamily identifies the capabilities of an 8-bit MCU, with respect to
 // which instructions are supported.
 // See http://en.wikipedia.org/wiki/Atmel_AVR_instruction_set#Instruction_set_inheritance
@@ -23,20 +25,43 @@ const (
 // An MCUSpec is a specification of a particular AVR variant.
 type MCUSpec struct {
     Label               string
+    Signature           [3]uint8 // device signature bytes, as read by a programmer
     Family              MCUFamily
     NumRegs             uint
     LogProgMemSize      uint
     LogDataSpaceSize    uint
     LogRAMSize          uint
     LogEEPROMSize       uint
+    NumFuseBytes        uint // number of fuse bytes (low, high, extended, ...)
     InterruptVectorSize uint // size of a single interrupt vector, in words
+    NumInterrupts       uint // number of vectors in the interrupt vector table, including RESET
     IOBankSizes         []uint
     Regions             []RegionSpec
     Ports               map[string]avr.PortRef
+    Registers           map[string]RegisterSpec // bit field layouts, keyed by port name
     Interrupts          map[string]uint
     Available           [avr.NumInstructions]bool
 }
 
+// ProgMemSize returns the size of the program memory in bytes.
+func (s *MCUSpec) ProgMemSize() uint {
+    return 2 << s.LogProgMemSize
+}
+
+// RAMSize returns the size of the RAM in bytes.
+func (s *MCUSpec) RAMSize() uint {
+    return 1 << s.LogRAMSize
+}
+
+// EEPROMSize returns the size of the EEPROM in bytes, or zero if the MCU has no
+// EEPROM.
+func (s *MCUSpec) EEPROMSize() uint {
+    if s.LogEEPROMSize == 0 {
+        return 0
+    }
+    return 1 << s.LogEEPROMSize
+}
+
 // A RegionSpec is a specification of a region of data memory pertaining to a
 // particular AVR variant.
 type RegionSpec interface {
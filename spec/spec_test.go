@@ -0,0 +1,128 @@
+package spec
+
+import (
+    "github.com/kierdavis/avr"
+    "strings"
+    "testing"
+)
+
+func TestValidateShippedSpecs(t *testing.T) {
+    entries := Entries()
+    if len(entries) == 0 {
+        t.Fatal("no specs are registered")
+    }
+    for _, e := range entries {
+        if err := Validate(e.Spec); err != nil {
+            t.Errorf("%s: %s", e.Name, err)
+        }
+    }
+}
+
+// Returns a copy of s that can be modified without affecting s.
+func copySpec(s *MCUSpec) *MCUSpec {
+    c := *s
+    c.IOBankSizes = append([]uint(nil), s.IOBankSizes...)
+    c.Regions = append([]RegionSpec(nil), s.Regions...)
+    c.Ports = make(map[string]avr.PortRef)
+    for name, pref := range s.Ports {
+        c.Ports[name] = pref
+    }
+    c.Registers = make(map[string]RegisterSpec)
+    for name, r := range s.Registers {
+        c.Registers[name] = RegisterSpec{Fields: append([]BitField(nil), r.Fields...)}
+    }
+    c.Interrupts = make(map[string]uint)
+    for name, num := range s.Interrupts {
+        c.Interrupts[name] = num
+    }
+    return linkRegions(&c)
+}
+
+var validateTests = []struct {
+    name   string
+    base   *MCUSpec
+    mutate func(s *MCUSpec)
+    want   string
+}{
+    {"overlapping regions", ATmega168, func(s *MCUSpec) {
+        s.Regions = append(s.Regions, RAMRegionSpec{start: 0x0080})
+        linkRegions(s)
+    }, "region 4 (RAM) at $0080-$047F overlaps region 2 (I/O bank 1) at $0060-$00FF"},
+    {"region beyond data space", ATtiny10, func(s *MCUSpec) {
+        s.Regions[1] = RAMRegionSpec{start: 0x0070}
+        linkRegions(s)
+    }, "region 1 (RAM) at $0070-$008F extends beyond the end of the data space ($007F)"},
+    {"unlinked region", ATmega48, func(s *MCUSpec) {
+        s.Regions = append(s.Regions, RAMRegionSpec{start: 0x0800})
+    }, "region 4 (RAM) is not linked to this spec"},
+    {"port outside bank", ATmega88, func(s *MCUSpec) {
+        s.Ports["BOGUS"] = avr.PortRef{0, 0x40}
+    }, "port BOGUS: index $40 is outside I/O bank 0 (size 64)"},
+    {"port in nonexistent bank", ATtiny4, func(s *MCUSpec) {
+        s.Ports["BOGUS"] = avr.PortRef{1, 0x00}
+    }, "port BOGUS refers to nonexistent I/O bank 1 (there are 1 banks)"},
+    {"duplicate port", ATmega168, func(s *MCUSpec) {
+        s.Ports["ALSO_SREG"] = s.Ports["SREG"]
+    }, "ports ALSO_SREG and SREG both refer to index $3F of I/O bank 0"},
+    {"missing SREG", ATtiny9, func(s *MCUSpec) {
+        delete(s.Ports, "SREG")
+        delete(s.Registers, "SREG")
+    }, "required port SREG is not defined"},
+    {"interrupt beyond vector table", ATmega168, func(s *MCUSpec) {
+        s.Interrupts["BOGUS"] = 26
+    }, "interrupt BOGUS: vector 26 is beyond the end of the vector table (26 vectors)"},
+    {"duplicate interrupt", ATtiny5, func(s *MCUSpec) {
+        s.Interrupts["BOGUS"] = 1
+    }, "interrupts BOGUS and INT0 both use vector 1"},
+    {"RESET not at vector 0", ATtiny10, func(s *MCUSpec) {
+        s.Interrupts["RESET"] = 11
+        s.NumInterrupts = 12
+    }, "interrupt RESET is vector 11, but it must be vector 0"},
+    {"forbidden instruction", ATtiny4, func(s *MCUSpec) {
+        s.Available[avr.MUL] = true
+    }, "instruction MUL is marked available, but family ReducedCore does not support it"},
+    {"missing required instruction", ATmega168, func(s *MCUSpec) {
+        s.Available[avr.JMP] = false
+    }, "instruction JMP is marked unavailable, but family EnhancedCore128K requires it"},
+    {"wrong family", ATmega168, func(s *MCUSpec) {
+        s.Family = EnhancedCore8K
+    }, "LogProgMemSize is 13 (16384 bytes), but family EnhancedCore8K supports at most 8192 bytes"},
+    {"register without port", ATmega48, func(s *MCUSpec) {
+        s.Registers["BOGUS"] = byteReg("BOGUS")
+    }, "register BOGUS has a bit field layout but is not defined in Ports"},
+    {"overlapping fields", ATmega48, func(s *MCUSpec) {
+        s.Registers["GPIOR0"] = reg(rw("A", 0xF0), rw("B", 0x18))
+    }, "register GPIOR0: field B (mask 18) overlaps another field"},
+    {"reset outside mask", ATtiny4, func(s *MCUSpec) {
+        s.Registers["SREG"] = reg(BitField{Name: "X", Mask: 0x0F, Reset: 0x10})
+    }, "register SREG: field X has reset value 10 outside its mask 0F"},
+    {"bad signature", ATtiny9, func(s *MCUSpec) {
+        s.Signature[0] = 0x00
+    }, "Signature 00 90 08 does not begin with the Atmel manufacturer code 1E"},
+}
+
+func TestValidateReportsProblems(t *testing.T) {
+    for _, test := range validateTests {
+        s := copySpec(test.base)
+        if err := Validate(s); err != nil {
+            t.Fatalf("%s: unmodified spec is invalid: %s", test.name, err)
+        }
+        test.mutate(s)
+
+        err := Validate(s)
+        verr, ok := err.(*ValidationError)
+        if !ok {
+            t.Errorf("%s: expected a *ValidationError, got %v", test.name, err)
+            continue
+        }
+        found := false
+        for _, p := range verr.Problems {
+            if strings.Contains(p, test.want) {
+                found = true
+            }
+        }
+        if !found {
+            t.Errorf("%s: expected a problem containing %q, got:\n%s", test.name, test.want, err)
+        }
+    }
+}
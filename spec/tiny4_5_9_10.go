@@ -63,6 +63,49 @@ func tiny4_5_9_10(v int) *MCUSpec {
         // ADC: 10
     }
 
+    registers := map[string]RegisterSpec{
+        "PINB":   bitsReg("PINB%d", 0, 4),
+        "DDRB":   bitsReg("DDB%d", 0, 4),
+        "PORTB":  bitsReg("PORTB%d", 0, 4),
+        "PUEB":   bitsReg("PUEB%d", 0, 4),
+        "PORTCR": reg(rw("BBMB", 0x02)),
+        "PCMSK":  bitsReg("PCINT%d", 0, 4),
+        "PCIFR":  reg(w1c("PCIF0", 0x01)),
+        "PCICR":  reg(rw("PCIE0", 0x01)),
+        "EIMSK":  reg(rw("INT0", 0x01)),
+        "EIFR":   reg(w1c("INTF0", 0x01)),
+        "EICRA":  reg(rw("ISC0", 0x03)),
+        "ACSR":   reg(rw("ACD", 0x80), ro("ACO", 0x20), w1c("ACI", 0x10), rw("ACIE", 0x08), rw("ACIC", 0x04), rw("ACIS", 0x03)),
+        "ICR0L":  byteReg("ICR0L"),
+        "ICR0H":  byteReg("ICR0H"),
+        "OCR0BL": byteReg("OCR0BL"),
+        "OCR0BH": byteReg("OCR0BH"),
+        "OCR0AL": byteReg("OCR0AL"),
+        "OCR0AH": byteReg("OCR0AH"),
+        "TCNT0L": byteReg("TCNT0L"),
+        "TCNT0H": byteReg("TCNT0H"),
+        "TIFR0":  reg(w1c("ICF0", 0x20), w1c("OCF0B", 0x04), w1c("OCF0A", 0x02), w1c("TOV0", 0x01)),
+        "TIMSK0": reg(rw("ICIE0", 0x20), rw("OCIE0B", 0x04), rw("OCIE0A", 0x02), rw("TOIE0", 0x01)),
+        "TCCR0C": reg(wo("FOC0A", 0x80), wo("FOC0B", 0x40)),
+        "TCCR0B": reg(rw("ICNC0", 0x80), rw("ICES0", 0x40), rw("WGM03", 0x10), rw("WGM02", 0x08), rw("CS0", 0x07)),
+        "TCCR0A": reg(rw("COM0A", 0xC0), rw("COM0B", 0x30), rw("WGM0", 0x03)),
+        "GTCCR":  reg(rw("TSM", 0x80), rw("PSR", 0x01)),
+        "WDTCSR": reg(w1c("WDIF", 0x80), rw("WDIE", 0x40), rw("WDP3", 0x20), rw("WDE", 0x08), rw("WDP", 0x07)),
+        "NVMCSR": reg(ro("NVMBSY", 0x80)),
+        "NVMCMD": reg(rw("NVMCMD", 0x3F)),
+        "VLMCSR": reg(ro("VLMF", 0x80), rw("VLMIE", 0x40), rw("VLM", 0x07)),
+        "PRR":    reg(rw("PRADC", 0x02), rw("PRTIM0", 0x01)),
+        "CLKPSR": reg(withReset(rw("CLKPS", 0x0F), 0x03)),
+        "CLKMSR": reg(rw("CLKMS", 0x03)),
+        "OSCCAL": byteReg("CAL"),
+        "SMCR":   reg(rw("SM", 0x0E), rw("SE", 0x01)),
+        "RSTFLR": reg(rw("WDRF", 0x08), rw("EXTRF", 0x02), withReset(rw("PORF", 0x01), 0x01)),
+        "CCP":    reg(wo("CCP", 0xFF)),
+        "SPL":    reg(withReset(rw("SP", 0xFF), 0x5F)), // RAMEND
+        "SPH":    byteReg("SP"),
+        "SREG":   sregReg(),
+    }
+
     // ADC
     if v == 5 || v == 10 {
         ports["DIDR0"] = avr.PortRef{0, 0x17}
@@ -71,6 +114,11 @@ func tiny4_5_9_10(v int) *MCUSpec {
         ports["ADCSRA"] = avr.PortRef{0, 0x1C}
         ports["ADCSRB"] = avr.PortRef{0, 0x1D}
         interrupts["ADC"] = 10
+        registers["DIDR0"] = bitsReg("ADC%dD", 0, 4)
+        registers["ADCL"] = reg(ro("ADCL", 0xFF))
+        registers["ADMUX"] = reg(rw("MUX", 0x03))
+        registers["ADCSRA"] = reg(rw("ADEN", 0x80), rw("ADSC", 0x40), rw("ADATE", 0x20), w1c("ADIF", 0x10), rw("ADIE", 0x08), rw("ADPS", 0x07))
+        registers["ADCSRB"] = reg(rw("ADTS", 0x07))
     }
 
     var logProgMemSize uint
@@ -81,21 +129,37 @@ func tiny4_5_9_10(v int) *MCUSpec {
         logProgMemSize = 9 // 512 W (1024 B)
     }
 
+    var signature [3]uint8
+    switch v {
+    case 4:
+        signature = [3]uint8{0x1E, 0x8F, 0x0A}
+    case 5:
+        signature = [3]uint8{0x1E, 0x8F, 0x09}
+    case 9:
+        signature = [3]uint8{0x1E, 0x90, 0x08}
+    case 10:
+        signature = [3]uint8{0x1E, 0x90, 0x03}
+    }
+
     return linkRegions(&MCUSpec{
         Label:               fmt.Sprintf("ATtiny%d", v),
+        Signature:           signature,
         Family:              ReducedCore,
         NumRegs:             32, // technically only 16, but the 16 that are implemented are r16-r31
         LogProgMemSize:      logProgMemSize,
         LogDataSpaceSize:    7, // data memory address width
         LogRAMSize:          5, // 32 B
         LogEEPROMSize:       0, // none
+        NumFuseBytes:        1, // configuration byte
         InterruptVectorSize: 1,
+        NumInterrupts:       11,
         IOBankSizes:         []uint{64},
         Regions: []RegionSpec{
             IORegionSpec{start: 0x0000, bankNum: 0},
             RAMRegionSpec{start: 0x0040},
         },
         Ports:      ports,
+        Registers:  registers,
         Interrupts: interrupts,
         Available: [avr.NumInstructions]bool{
             /* ADC */ true,
@@ -209,3 +273,10 @@ var ATtiny4 = tiny4_5_9_10(4)
 var ATtiny5 = tiny4_5_9_10(5)
 var ATtiny9 = tiny4_5_9_10(9)
 var ATtiny10 = tiny4_5_9_10(10)
+
+func init() {
+    Register(ATtiny4, "attiny4", "tiny4")
+    Register(ATtiny5, "attiny5", "tiny5")
+    Register(ATtiny9, "attiny9", "tiny9")
+    Register(ATtiny10, "attiny10", "tiny10")
+}
@@ -0,0 +1,343 @@
+package spec
+
+import (
+    "fmt"
+    "github.com/kierdavis/avr"
+    "sort"
+    "strings"
+)
+
+// A ValidationError lists the problems found in an MCUSpec by Validate.
+type ValidationError struct {
+    Label    string
+    Problems []string
+}
+
+func (e *ValidationError) Error() string {
+    return fmt.Sprintf("spec %s: %d problem(s):\n  %s", e.Label, len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// Validate checks an MCUSpec for internal consistency. It returns nil if no
+// problems were found, or else a *ValidationError listing every problem.
+func Validate(s *MCUSpec) error {
+    v := validator{s: s}
+    v.checkSizes()
+    v.checkRegions()
+    v.checkPorts()
+    v.checkRegisters()
+    v.checkInterrupts()
+    v.checkAvailable()
+
+    if len(v.problems) == 0 {
+        return nil
+    }
+    return &ValidationError{Label: s.Label, Problems: v.problems}
+}
+
+type validator struct {
+    s        *MCUSpec
+    problems []string
+}
+
+func (v *validator) errorf(format string, args ...interface{}) {
+    v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) checkSizes() {
+    s := v.s
+    if s.NumRegs > 32 {
+        v.errorf("NumRegs is %d, but an AVR has at most 32 registers", s.NumRegs)
+    }
+    if s.LogDataSpaceSize > 24 {
+        v.errorf("LogDataSpaceSize is %d, but data addresses are at most 24 bits wide", s.LogDataSpaceSize)
+    }
+    if s.LogRAMSize > s.LogDataSpaceSize {
+        v.errorf("LogRAMSize (%d) exceeds LogDataSpaceSize (%d)", s.LogRAMSize, s.LogDataSpaceSize)
+    }
+    if s.Signature[0] != 0x1E {
+        v.errorf("Signature %02X %02X %02X does not begin with the Atmel manufacturer code 1E", s.Signature[0], s.Signature[1], s.Signature[2])
+    }
+
+    var maxLogProgMemSize uint
+    switch s.Family {
+    case ReducedCore, MinimalCore, ClassicCore8K, EnhancedCore8K:
+        maxLogProgMemSize = 12 // 4 kW (8 kB)
+    case ClassicCore128K, EnhancedCore128K:
+        maxLogProgMemSize = 16 // 64 kW (128 kB)
+    case EnhancedCore4M, XMEGA:
+        maxLogProgMemSize = 21 // 2 MW (4 MB)
+    default:
+        v.errorf("Family %s is not a known MCU family", s.Family)
+        return
+    }
+    if s.LogProgMemSize > maxLogProgMemSize {
+        v.errorf("LogProgMemSize is %d (%d bytes), but family %s supports at most %d bytes",
+            s.LogProgMemSize, s.ProgMemSize(), s.Family, uint(2)<<maxLogProgMemSize)
+    }
+}
+
+// Returns a description of a region, for use in error messages.
+func describeRegion(i int, r RegionSpec) string {
+    var kind string
+    switch r_ := r.(type) {
+    case RegsRegionSpec:
+        kind = "register file"
+    case IORegionSpec:
+        kind = fmt.Sprintf("I/O bank %d", r_.bankNum)
+    case RAMRegionSpec:
+        kind = "RAM"
+    default:
+        kind = fmt.Sprintf("%T", r)
+    }
+    return fmt.Sprintf("region %d (%s)", i, kind)
+}
+
+// Returns the MCUSpec a region was linked to by linkRegions.
+func regionOwner(r RegionSpec) *MCUSpec {
+    switch r_ := r.(type) {
+    case RegsRegionSpec:
+        return r_.mcuSpec
+    case IORegionSpec:
+        return r_.mcuSpec
+    case RAMRegionSpec:
+        return r_.mcuSpec
+    }
+    return nil
+}
+
+func (v *validator) checkRegions() {
+    s := v.s
+    dataSpaceSize := uint32(1) << s.LogDataSpaceSize
+
+    type span struct {
+        desc       string
+        start, end uint32 // end is exclusive
+    }
+    var spans []span
+
+    for i, r := range s.Regions {
+        desc := describeRegion(i, r)
+
+        if regionOwner(r) != s {
+            v.errorf("%s is not linked to this spec (was linkRegions called?)", desc)
+            continue
+        }
+        if io, ok := r.(IORegionSpec); ok && io.bankNum >= uint(len(s.IOBankSizes)) {
+            v.errorf("%s refers to a nonexistent I/O bank (there are %d banks)", desc, len(s.IOBankSizes))
+            continue
+        }
+
+        start := uint32(r.Start())
+        end := start + uint32(r.Size())
+        if end > dataSpaceSize {
+            v.errorf("%s at $%04X-$%04X extends beyond the end of the data space ($%04X)", desc, start, end-1, dataSpaceSize-1)
+        }
+        for _, other := range spans {
+            if start < other.end && other.start < end {
+                v.errorf("%s at $%04X-$%04X overlaps %s at $%04X-$%04X", desc, start, end-1, other.desc, other.start, other.end-1)
+            }
+        }
+        spans = append(spans, span{desc, start, end})
+    }
+}
+
+// Returns the keys of a map of ports in sorted order.
+func sortedPortNames(m map[string]avr.PortRef) []string {
+    names := make([]string, 0, len(m))
+    for name := range m {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func (v *validator) checkPorts() {
+    s := v.s
+    seen := make(map[avr.PortRef]string)
+
+    for _, name := range sortedPortNames(s.Ports) {
+        pref := s.Ports[name]
+        if pref.BankNum >= uint(len(s.IOBankSizes)) {
+            v.errorf("port %s refers to nonexistent I/O bank %d (there are %d banks)", name, pref.BankNum, len(s.IOBankSizes))
+            continue
+        }
+        if uint(pref.Index) >= s.IOBankSizes[pref.BankNum] {
+            v.errorf("port %s: index $%02X is outside I/O bank %d (size %d)", name, pref.Index, pref.BankNum, s.IOBankSizes[pref.BankNum])
+            continue
+        }
+        if other, ok := seen[pref]; ok {
+            v.errorf("ports %s and %s both refer to index $%02X of I/O bank %d", other, name, pref.Index, pref.BankNum)
+            continue
+        }
+        seen[pref] = name
+    }
+
+    // the emulator relies on these ports being present
+    for _, name := range []string{"SREG", "SPL"} {
+        if _, ok := s.Ports[name]; !ok {
+            v.errorf("required port %s is not defined", name)
+        }
+    }
+}
+
+func (v *validator) checkRegisters() {
+    s := v.s
+    names := make([]string, 0, len(s.Registers))
+    for name := range s.Registers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    for _, name := range names {
+        r := s.Registers[name]
+        if _, ok := s.Ports[name]; !ok {
+            v.errorf("register %s has a bit field layout but is not defined in Ports", name)
+        }
+
+        var used uint8
+        fieldNames := make(map[string]bool)
+        for _, f := range r.Fields {
+            if f.Mask == 0 {
+                v.errorf("register %s: field %s has an empty mask", name, f.Name)
+            }
+            if f.Mask&used != 0 {
+                v.errorf("register %s: field %s (mask %02X) overlaps another field", name, f.Name, f.Mask)
+            }
+            if f.Reset & ^f.Mask != 0 {
+                v.errorf("register %s: field %s has reset value %02X outside its mask %02X", name, f.Name, f.Reset, f.Mask)
+            }
+            if fieldNames[f.Name] {
+                v.errorf("register %s: field name %s is used more than once", name, f.Name)
+            }
+            used |= f.Mask
+            fieldNames[f.Name] = true
+        }
+    }
+}
+
+func (v *validator) checkInterrupts() {
+    s := v.s
+    names := make([]string, 0, len(s.Interrupts))
+    for name := range s.Interrupts {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    if s.InterruptVectorSize == 0 {
+        v.errorf("InterruptVectorSize is zero")
+    }
+    tableSize := s.NumInterrupts * s.InterruptVectorSize
+    if progWords := uint(1) << s.LogProgMemSize; tableSize > progWords {
+        v.errorf("interrupt vector table (%d vectors of %d words) is larger than program memory (%d words)",
+            s.NumInterrupts, s.InterruptVectorSize, progWords)
+    }
+
+    seen := make(map[uint]string)
+    for _, name := range names {
+        num := s.Interrupts[name]
+        if num >= s.NumInterrupts {
+            v.errorf("interrupt %s: vector %d is beyond the end of the vector table (%d vectors)", name, num, s.NumInterrupts)
+        }
+        if other, ok := seen[num]; ok {
+            v.errorf("interrupts %s and %s both use vector %d", other, name, num)
+        }
+        seen[num] = name
+    }
+
+    if num, ok := s.Interrupts["RESET"]; !ok {
+        v.errorf("interrupt RESET is not defined")
+    } else if num != 0 {
+        v.errorf("interrupt RESET is vector %d, but it must be vector 0", num)
+    }
+}
+
+// The availability of an instruction implied by an MCU family.
+type availability int
+
+const (
+    optional availability = iota
+    required
+    forbidden
+)
+
+// Returns the availability of an instruction on a family of MCUs.
+// See http://en.wikipedia.org/wiki/Atmel_AVR_instruction_set#Instruction_set_inheritance
+func familyAvailability(f MCUFamily, inst avr.Instruction) availability {
+    enhanced := f == EnhancedCore8K || f == EnhancedCore128K || f == EnhancedCore4M || f == XMEGA
+    longJumps := f == ClassicCore128K || f == EnhancedCore128K || f == EnhancedCore4M || f == XMEGA
+
+    // the reduced core has its own encodings for some instructions and lacks
+    // many others
+    switch inst {
+    case avr.LD_Y, avr.LD_Z, avr.ST_Y, avr.ST_Z, avr.LDS_SHORT, avr.STS_SHORT:
+        if f == ReducedCore {
+            return required
+        }
+        return forbidden
+    case avr.ADIW, avr.SBIW, avr.LDD_Y, avr.LDD_Z, avr.STD_Y, avr.STD_Z, avr.LDS, avr.STS, avr.LPM_R0:
+        switch f {
+        case ReducedCore:
+            return forbidden
+        case MinimalCore:
+            return optional
+        }
+        return required
+    }
+
+    switch inst {
+    case avr.MUL, avr.MULS, avr.MULSU, avr.FMUL, avr.FMULS, avr.FMULSU:
+        if enhanced {
+            return required
+        }
+        return forbidden
+    case avr.MOVW, avr.LPM, avr.LPM_INC:
+        if enhanced {
+            return required
+        }
+        if f == ReducedCore || f == MinimalCore {
+            return forbidden
+        }
+    case avr.CALL, avr.JMP:
+        if longJumps {
+            return required
+        }
+        return forbidden
+    case avr.ELPM_R0, avr.ELPM, avr.ELPM_INC:
+        if !longJumps {
+            return forbidden
+        }
+    case avr.EICALL, avr.EIJMP:
+        if f == EnhancedCore4M {
+            return required
+        }
+        if f != XMEGA {
+            return forbidden
+        }
+    case avr.SPM:
+        if f == ReducedCore || f == MinimalCore {
+            return forbidden
+        }
+    case avr.SPM_2, avr.DES, avr.XCH, avr.LAC, avr.LAS, avr.LAT:
+        if f != XMEGA {
+            return forbidden
+        }
+    }
+    return optional
+}
+
+func (v *validator) checkAvailable() {
+    s := v.s
+    for i := 0; i < avr.NumInstructions; i++ {
+        inst := avr.Instruction(i)
+        switch familyAvailability(s.Family, inst) {
+        case required:
+            if !s.Available[inst] {
+                v.errorf("instruction %s is marked unavailable, but family %s requires it", inst, s.Family)
+            }
+        case forbidden:
+            if s.Available[inst] {
+                v.errorf("instruction %s is marked available, but family %s does not support it", inst, s.Family)
+            }
+        }
+    }
+}
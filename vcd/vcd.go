@@ -0,0 +1,212 @@
+// Package vcd records signals of an emulated system, such as GPIO pins, timer
+// output-compare pins, I/O registers and the interrupt being serviced, to a
+// Value Change Dump file that can be viewed in a waveform viewer such as
+// GTKWave.
+//
+// A Writer is a clock.Process that samples its signals each time it is run and
+// records those that have changed. Add it to the clock after the peripherals,
+// so that it sees their state at the end of each step, and set a small clock
+// step so that changes are recorded at the tick they happen:
+//
+//	v := vcd.New(f, clk, 16e6)
+//	v.AddPin("PORTB5", gpioB, 5)
+//	v.AddRegister(em, "TCNT0")
+//	clk.SetStep(1)
+//	v.Start()
+package vcd
+
+import (
+    "bufio"
+    "fmt"
+    "github.com/kierdavis/avr/clock"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/hardware/gpio"
+    "github.com/kierdavis/avr/hardware/timer"
+    "io"
+    "strconv"
+    "strings"
+)
+
+// A Writer writes a Value Change Dump of a set of signals.
+type Writer struct {
+    w         *bufio.Writer
+    clk       *clock.Clock
+    psPerTick uint64
+    signals   []*signal
+    started   bool
+    lastTime  uint64
+}
+
+type signal struct {
+    name  string
+    id    string
+    width uint
+    value func() uint64
+    last  uint64
+}
+
+// Creates a Writer that writes to w, timing changes by the ticks of clk at the
+// given clock frequency in Hz. The Writer is added to the clock as a process.
+func New(w io.Writer, clk *clock.Clock, freq float64) (v *Writer) {
+    v = &Writer{
+        w:         bufio.NewWriter(w),
+        clk:       clk,
+        psPerTick: uint64(1e12/freq + 0.5),
+    }
+    clk.Add(v)
+    return v
+}
+
+// Adds a signal of the given width in bits, whose value is returned by the
+// given function. Signals must be added before Start is called.
+func (v *Writer) AddSignal(name string, width uint, value func() uint64) {
+    v.signals = append(v.signals, &signal{
+        name:  name,
+        id:    identifier(len(v.signals)),
+        width: width,
+        value: value,
+    })
+}
+
+// Adds the level of a GPIO pin.
+func (v *Writer) AddPin(name string, g *gpio.GPIO, pinNumber uint) {
+    v.AddSignal(name, 1, func() uint64 {
+        return bit(g.Pin(pinNumber))
+    })
+}
+
+// Adds an output-compare pin of a timer (0 for OCxA, 1 for OCxB). The pin's
+// state is recorded even if it is not connected to a GPIO pin.
+func (v *Writer) AddOCPin(name string, t *timer.Timer, ocPinNum uint) {
+    v.AddSignal(name, 1, func() uint64 {
+        return bit(t.OCPin(ocPinNum))
+    })
+}
+
+// Adds the I/O register with the given name, if the emulator's MCU has one.
+// The register's value is sampled with Emulator.PeekData, so it reads as zero
+// if its Port does not implement emulator.PeekPort.
+func (v *Writer) AddRegister(em *emulator.Emulator, name string) (ok bool) {
+    pref, ok := em.Spec.Ports[name]
+    if !ok {
+        return false
+    }
+    addr := em.PortAddress(pref)
+    v.AddSignal(name, 8, func() uint64 {
+        return uint64(em.PeekData(addr))
+    })
+    return true
+}
+
+// Adds a signal that is high while the named interrupt is in service (that
+// is, while its handler is the innermost one executing), if the emulator's MCU
+// has such an interrupt.
+func (v *Writer) AddInterrupt(em *emulator.Emulator, name string) (ok bool) {
+    num, ok := em.Spec.Interrupts[name]
+    if !ok {
+        return false
+    }
+    v.AddSignal(name, 1, func() uint64 {
+        n, ok := em.InterruptInService()
+        return bit(ok && n == num)
+    })
+    return true
+}
+
+// Adds a signal holding the vector number of the interrupt in service, or 0
+// if none is.
+func (v *Writer) AddInterruptInService(em *emulator.Emulator, name string) {
+    v.AddSignal(name, 8, func() uint64 {
+        n, _ := em.InterruptInService()
+        return uint64(n)
+    })
+}
+
+// Writes the header and the initial values of the signals, at the clock's
+// current time. It is called by the first Run if it has not been already.
+func (v *Writer) Start() {
+    if v.started {
+        return
+    }
+    v.started = true
+
+    fmt.Fprintf(v.w, "$version github.com/kierdavis/avr/vcd $end\n")
+    fmt.Fprintf(v.w, "$timescale 1 ps $end\n")
+    fmt.Fprintf(v.w, "$scope module avr $end\n")
+    for _, s := range v.signals {
+        kind := "wire"
+        if s.width > 1 {
+            kind = "reg"
+        }
+        fmt.Fprintf(v.w, "$var %s %d %s %s $end\n", kind, s.width, s.id, s.name)
+    }
+    fmt.Fprintf(v.w, "$upscope $end\n")
+    fmt.Fprintf(v.w, "$enddefinitions $end\n")
+
+    v.lastTime = v.clk.Ticks()
+    fmt.Fprintf(v.w, "#%d\n$dumpvars\n", v.lastTime*v.psPerTick)
+    for _, s := range v.signals {
+        s.last = s.value()
+        v.writeValue(s)
+    }
+    fmt.Fprintf(v.w, "$end\n")
+}
+
+// Writer implements clock.Process. It records the signals that have changed,
+// at the time at the end of the step.
+func (v *Writer) Run(ticks uint) {
+    v.Start()
+    timeWritten := false
+    for _, s := range v.signals {
+        val := s.value()
+        if val == s.last {
+            continue
+        }
+        if !timeWritten {
+            v.lastTime = v.clk.Ticks() + uint64(ticks)
+            fmt.Fprintf(v.w, "#%d\n", v.lastTime*v.psPerTick)
+            timeWritten = true
+        }
+        s.last = val
+        v.writeValue(s)
+    }
+}
+
+// Records the current time, so that the dump extends to it, and flushes the
+// output. The underlying writer is not closed.
+func (v *Writer) Close() error {
+    v.Start()
+    if now := v.clk.Ticks(); now > v.lastTime {
+        fmt.Fprintf(v.w, "#%d\n", now*v.psPerTick)
+    }
+    return v.w.Flush()
+}
+
+func (v *Writer) writeValue(s *signal) {
+    if s.width == 1 {
+        fmt.Fprintf(v.w, "%d%s\n", s.last, s.id)
+    } else {
+        fmt.Fprintf(v.w, "b%s %s\n", strconv.FormatUint(s.last, 2), s.id)
+    }
+}
+
+// Returns the identifier code of the nth signal, made of the printable ASCII
+// characters.
+func identifier(n int) string {
+    var b strings.Builder
+    for {
+        b.WriteByte(byte('!' + n%94))
+        n /= 94
+        if n == 0 {
+            return b.String()
+        }
+        n--
+    }
+}
+
+func bit(b bool) uint64 {
+    if b {
+        return 1
+    }
+    return 0
+}
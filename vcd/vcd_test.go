@@ -0,0 +1,94 @@
+package vcd
+
+import (
+    "bytes"
+    "github.com/kierdavis/avr"
+    "github.com/kierdavis/avr/asm"
+    "github.com/kierdavis/avr/clock"
+    "github.com/kierdavis/avr/emulator"
+    "github.com/kierdavis/avr/hardware/gpio"
+    "github.com/kierdavis/avr/spec"
+    "strings"
+    "testing"
+)
+
+const testProgram = `
+        rjmp    start
+        nop
+        reti                    ; INT0
+start:  sbi     DDRB, 5
+loop:   sbi     PORTB, 5
+        nop
+        cbi     PORTB, 5
+        rjmp    loop
+`
+
+func newTestSystem() (em *emulator.Emulator, clk *clock.Clock, g *gpio.GPIO) {
+    em = emulator.NewEmulator(spec.ATmega168)
+    em.WriteProg(0, asm.MustAssemble(spec.ATmega168, testProgram))
+    em.SetPC(3)
+    g = gpio.New('B', 8)
+    g.AddTo(em)
+    clk = clock.New()
+    clk.SetCPU(em)
+    clk.SetStep(1)
+    return em, clk, g
+}
+
+func TestWriter(t *testing.T) {
+    em, clk, g := newTestSystem()
+    var buf bytes.Buffer
+    v := New(&buf, clk, 1e6)
+    v.AddPin("PORTB5", g, 5)
+    v.AddRegister(em, "DDRB")
+    v.Start()
+    clk.Run(12)
+    if err := v.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    expected := `$version github.com/kierdavis/avr/vcd $end
+$timescale 1 ps $end
+$scope module avr $end
+$var wire 1 ! PORTB5 $end
+$var reg 8 " DDRB $end
+$upscope $end
+$enddefinitions $end
+#0
+$dumpvars
+0!
+b0 "
+$end
+#1000000
+b100000 "
+#3000000
+1!
+#6000000
+0!
+#10000000
+1!
+#12000000
+`
+    if buf.String() != expected {
+        t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+    }
+}
+
+func TestWriterInterrupt(t *testing.T) {
+    em, clk, _ := newTestSystem()
+    var buf bytes.Buffer
+    v := New(&buf, clk, 1e6)
+    v.AddInterrupt(em, "INT0")
+    v.AddInterruptInService(em, "ISR")
+    v.Start()
+    clk.Run(10)
+    em.SetFlag(avr.FlagI, true)
+    em.InterruptByName("INT0")
+    clk.Run(10)
+    v.Close()
+
+    expected := "#11000000\n1!\nb1 \"\n#12000000\n0!\nb0 \"\n#20000000\n"
+    if got := buf.String(); !strings.HasSuffix(got, expected) {
+        t.Errorf("expected dump to end with:\n%s\ngot:\n%s", expected, got)
+    }
+}